@@ -168,3 +168,20 @@ func ConvertWhatsGPSAlarmDataToRequest(data WhatsGPSAlarm) Alarm {
 	adapter := WhatsGPSAlarmDataAdapterImpl{}
 	return adapter.WhatsGPSToAlarmRequest(data)
 }
+
+// ConvertWhatsGPSPosition converts the last position of a car. The time of
+// the position is the latest of the fix and the heartbeat.
+func ConvertWhatsGPSPosition(data WhatsGPSPosition) *Position {
+	lat := getLatitude(data.Lat)
+	lon := getLongitude(data.Lon)
+	speed, course := data.Speed, data.Dir
+	return &Position{
+		Imei:   strconv.FormatInt(data.CarID, 10),
+		Lat:    &lat,
+		Lng:    &lon,
+		Time:   max(data.PointTime.Unix(), data.HeartTime.Unix()),
+		Speed:  &speed,
+		Course: &course,
+		Acc:    accState(data.AccStatus),
+	}
+}
@@ -19,3 +19,22 @@ type AlarmResponse struct {
 	Code    int64       `json:"code"`
 	Details []AlarmData `json:"details"`
 }
+
+// LocationData is the last position of a device in the IOPGPS API. HeartTime
+// is the time of the last heartbeat, which the devices send while parked, and
+// AccStatus is 1 with the ignition on.
+type LocationData struct {
+	Imei      string  `json:"imei"`
+	Lat       *string `json:"lat,omitempty"`
+	Lng       *string `json:"lng,omitempty"`
+	GpsTime   int64   `json:"gpsTime"`
+	HeartTime int64   `json:"heartTime"`
+	Speed     *int64  `json:"speed,omitempty"`
+	Course    *int64  `json:"course,omitempty"`
+	AccStatus *int64  `json:"accStatus,omitempty"`
+}
+
+type LocationResponse struct {
+	Code int64          `json:"code"`
+	Data []LocationData `json:"data"`
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DEFAULT_ARCHIVE_PATH is the file of the archive, configurable with the
+	// ARCHIVE_PATH environment variable. An empty ARCHIVE_PATH disables it.
+	DEFAULT_ARCHIVE_PATH = "alarms.db"
+	// DEFAULT_ARCHIVE_RETENTION is how long the records are kept, configurable
+	// with the ARCHIVE_RETENTION environment variable.
+	DEFAULT_ARCHIVE_RETENTION = 90 * 24 * time.Hour
+	// ARCHIVE_PRUNE_INTERVAL is how often the expired records are removed.
+	ARCHIVE_PRUNE_INTERVAL = 6 * time.Hour
+	// ARCHIVE_OPEN_TIMEOUT is how long to wait for the lock of the file, held
+	// by another process using the archive.
+	ARCHIVE_OPEN_TIMEOUT = time.Second
+)
+
+// Buckets of the archive. The alarms are keyed by IMEI and time, and indexed
+// by time to query and prune the whole fleet.
+var (
+	alarmsBucket        = []byte("alarms")
+	alarmsByTimeBucket  = []byte("alarms_by_time")
+	notificationsBucket = []byte("notifications")
+	checkpointsBucket   = []byte("checkpoints")
+	// positionsBucket holds the last position of each device, by IMEI.
+	positionsBucket = []byte("positions")
+	// notificationsBySIDBucket indexes the notifications by Twilio SID, to
+	// update their status.
+	notificationsBySIDBucket = []byte("notifications_by_sid")
+)
+
+// alarmArchive is the archive of the service, nil when it is disabled.
+var alarmArchive *Archive
+
+// initArchive opens the archive configured in the environment. The service
+// keeps working without it if it can't be opened.
+func initArchive() {
+	path, ok := os.LookupEnv("ARCHIVE_PATH")
+	if !ok {
+		path = DEFAULT_ARCHIVE_PATH
+	}
+	if path == "" {
+		return
+	}
+	archive, err := OpenArchive(path, getEnvDuration("ARCHIVE_RETENTION", DEFAULT_ARCHIVE_RETENTION))
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Warning("Running without the local archive")
+		return
+	}
+	alarmArchive = archive
+}
+
+// Archive is a local store of the alarms, the notification attempts and the
+// device checkpoints, so they can be consulted while the backend is down.
+type Archive struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+// NotificationAttempt is a message sent, or tried, to a phone for an alarm:
+// an entry of the delivery ledger. The alarm fields are empty for messages not
+// related to an alarm. Status is the last status of the message, reported by
+// Twilio, and Transitions the history of its statuses.
+type NotificationAttempt struct {
+	ID          string             `json:"id"`
+	Imei        string             `json:"imei"`
+	AlarmCode   string             `json:"alarm_code,omitempty"`
+	AlarmTime   int64              `json:"alarm_time,omitempty"`
+	User        string             `json:"user,omitempty"`
+	Phone       string             `json:"phone"`
+	Channel     string             `json:"channel"`
+	SID         string             `json:"sid,omitempty"`
+	Status      NotificationStatus `json:"status"`
+	ErrorCode   int                `json:"error_code,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Transitions []StatusTransition `json:"transitions,omitempty"`
+	At          time.Time          `json:"at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+}
+
+// Checkpoint is the last LastTimeTracked recorded for a device.
+type Checkpoint struct {
+	Imei            string    `json:"imei"`
+	LastTimeTracked int64     `json:"last_time_tracked"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// BoundingBox is a rectangle of coordinates, in degrees.
+type BoundingBox struct {
+	MinLat, MinLng float64
+	MaxLat, MaxLng float64
+}
+
+// Contains reports whether the coordinate is inside the box, borders included.
+func (b BoundingBox) Contains(lat, lng float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && lng >= b.MinLng && lng <= b.MaxLng
+}
+
+// AlarmQuery filters the archived alarms. Zero fields don't filter.
+type AlarmQuery struct {
+	Imei  string
+	From  time.Time // From is inclusive.
+	To    time.Time // To is exclusive.
+	Codes []string
+	Box   *BoundingBox
+	Limit int
+}
+
+func (q AlarmQuery) matches(alarm Alarm) bool {
+	if len(q.Codes) > 0 && !slices.Contains(q.Codes, alarm.AlarmCode) {
+		return false
+	}
+	if q.Box != nil {
+		lat, lng, ok := alarmCoordinates(alarm)
+		if !ok || !q.Box.Contains(lat, lng) {
+			return false
+		}
+	}
+	return true
+}
+
+// alarmCoordinates returns the coordinates of an alarm, if it has valid ones.
+func alarmCoordinates(alarm Alarm) (lat, lng float64, ok bool) {
+	if alarm.Lat == nil || alarm.Lng == nil {
+		return 0, 0, false
+	}
+	lat, errLat := strconv.ParseFloat(*alarm.Lat, 64)
+	lng, errLng := strconv.ParseFloat(*alarm.Lng, 64)
+	return lat, lng, errLat == nil && errLng == nil
+}
+
+// OpenArchive opens, or creates, the archive at path keeping the records for
+// retention.
+func OpenArchive(path string, retention time.Duration) (*Archive, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: ARCHIVE_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("error opening the archive: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{alarmsBucket, alarmsByTimeBucket, notificationsBucket, checkpointsBucket, notificationsBySIDBucket, positionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating the archive buckets: %w", err)
+	}
+	return &Archive{db: db, retention: retention}, nil
+}
+
+// Close closes the archive file.
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+// unixKey encodes a unix time so the keys sort by time.
+func unixKey(t int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t))
+	return key
+}
+
+// alarmKey is IMEI, time and code, so the same alarm is stored once.
+func alarmKey(alarm Alarm) []byte {
+	key := append([]byte(alarm.Imei), 0)
+	key = append(key, unixKey(alarm.Time)...)
+	return append(key, alarm.AlarmCode...)
+}
+
+// alarmTimeKey is the key of an alarm in the time index.
+func alarmTimeKey(alarm Alarm) []byte {
+	return append(unixKey(alarm.Time), alarmKey(alarm)...)
+}
+
+// RecordAlarms stores the alarms. Alarms already stored are replaced.
+func (a *Archive) RecordAlarms(alarms []Alarm) error {
+	if len(alarms) == 0 {
+		return nil
+	}
+	return a.db.Batch(func(tx *bolt.Tx) error {
+		byKey := tx.Bucket(alarmsBucket)
+		byTime := tx.Bucket(alarmsByTimeBucket)
+		for _, alarm := range alarms {
+			data, err := json.Marshal(alarm)
+			if err != nil {
+				return err
+			}
+			key := alarmKey(alarm)
+			if err := byKey.Put(key, data); err != nil {
+				return err
+			}
+			if err := byTime.Put(alarmTimeKey(alarm), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RecordNotification stores a notification attempt. Without status, it is
+// failed if it has an error, sent if it has a SID and queued otherwise.
+func (a *Archive) RecordNotification(attempt NotificationAttempt) error {
+	if attempt.At.IsZero() {
+		attempt.At = time.Now()
+	}
+	if attempt.Status == "" {
+		switch {
+		case attempt.Error != "":
+			attempt.Status = NotificationFailed
+		case attempt.SID != "":
+			attempt.Status = NotificationSent
+		default:
+			attempt.Status = NotificationQueued
+		}
+	}
+	if attempt.UpdatedAt.IsZero() {
+		attempt.UpdatedAt = attempt.At
+	}
+	if len(attempt.Transitions) == 0 {
+		attempt.Transitions = []StatusTransition{{Status: attempt.Status, At: attempt.UpdatedAt}}
+	}
+	return a.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(notificationsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := append(unixKey(attempt.At.UnixNano()), unixKey(int64(seq))...)
+		attempt.ID = hex.EncodeToString(key)
+		data, err := json.Marshal(attempt)
+		if err != nil {
+			return err
+		}
+		if attempt.SID != "" {
+			if err := tx.Bucket(notificationsBySIDBucket).Put([]byte(attempt.SID), key); err != nil {
+				return err
+			}
+		}
+		return bucket.Put(key, data)
+	})
+}
+
+// UpdateNotificationStatus records a status of the notification with the
+// Twilio SID. The statuses that arrive out of order, like sent after
+// delivered, are ignored. It returns false if the SID isn't in the archive.
+func (a *Archive) UpdateNotificationStatus(sid string, status NotificationStatus, errorCode int, errorMessage string, at time.Time) (bool, error) {
+	found := false
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(notificationsBySIDBucket).Get([]byte(sid))
+		if key == nil {
+			return nil
+		}
+		bucket := tx.Bucket(notificationsBucket)
+		data := bucket.Get(key)
+		if data == nil {
+			return nil
+		}
+		found = true
+		var attempt NotificationAttempt
+		if err := json.Unmarshal(data, &attempt); err != nil {
+			return err
+		}
+		if !attempt.Status.CanTransition(status) {
+			return nil
+		}
+		attempt.Status = status
+		attempt.UpdatedAt = at
+		attempt.Transitions = append(attempt.Transitions, StatusTransition{Status: status, At: at})
+		if errorCode != 0 {
+			attempt.ErrorCode = errorCode
+		}
+		if errorMessage != "" {
+			attempt.Error = errorMessage
+		}
+		data, err := json.Marshal(attempt)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	return found, err
+}
+
+// RecordCheckpoint stores the checkpoint of a device.
+func (a *Archive) RecordCheckpoint(imei string, lastTimeTracked int64) error {
+	data, err := json.Marshal(Checkpoint{Imei: imei, LastTimeTracked: lastTimeTracked, UpdatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return a.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointsBucket).Put([]byte(imei), data)
+	})
+}
+
+// RecordPosition stores the last position of a device. The positions aren't
+// pruned, since there is one per device.
+func (a *Archive) RecordPosition(position Position) error {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	return a.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(positionsBucket).Put([]byte(position.Imei), data)
+	})
+}
+
+// Positions returns the last position recorded for each device.
+func (a *Archive) Positions() ([]Position, error) {
+	var positions []Position
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(positionsBucket).ForEach(func(_, data []byte) error {
+			var position Position
+			if err := json.Unmarshal(data, &position); err != nil {
+				return err
+			}
+			positions = append(positions, position)
+			return nil
+		})
+	})
+	return positions, err
+}
+
+// Alarms returns the archived alarms matching the query, sorted by time.
+func (a *Archive) Alarms(q AlarmQuery) ([]Alarm, error) {
+	from := int64(0)
+	if !q.From.IsZero() {
+		from = q.From.Unix()
+	}
+	to := int64(-1)
+	if !q.To.IsZero() {
+		to = q.To.Unix()
+	}
+	inRange := func(t int64) bool { return t >= from && (to < 0 || t < to) }
+
+	var alarms []Alarm
+	err := a.db.View(func(tx *bolt.Tx) error {
+		byKey := tx.Bucket(alarmsBucket)
+		add := func(data []byte) (bool, error) {
+			var alarm Alarm
+			if err := json.Unmarshal(data, &alarm); err != nil {
+				return false, err
+			}
+			if q.matches(alarm) {
+				alarms = append(alarms, alarm)
+			}
+			return q.Limit > 0 && len(alarms) >= q.Limit, nil
+		}
+
+		if q.Imei != "" {
+			prefix := append([]byte(q.Imei), 0)
+			c := byKey.Cursor()
+			for k, v := c.Seek(append(prefix, unixKey(from)...)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				t := int64(binary.BigEndian.Uint64(k[len(prefix):]))
+				if !inRange(t) {
+					break
+				}
+				if done, err := add(v); err != nil || done {
+					return err
+				}
+			}
+			return nil
+		}
+
+		c := tx.Bucket(alarmsByTimeBucket).Cursor()
+		for k, _ := c.Seek(unixKey(from)); k != nil; k, _ = c.Next() {
+			if !inRange(int64(binary.BigEndian.Uint64(k[:8]))) {
+				break
+			}
+			if done, err := add(byKey.Get(k[8:])); err != nil || done {
+				return err
+			}
+		}
+		return nil
+	})
+	return alarms, err
+}
+
+// Notifications returns the notification attempts of a device, or of every
+// device if imei is empty, made in [from, to). Zero times don't filter.
+func (a *Archive) Notifications(imei string, from, to time.Time) ([]NotificationAttempt, error) {
+	start := int64(0)
+	if !from.IsZero() {
+		start = from.UnixNano()
+	}
+	var attempts []NotificationAttempt
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(notificationsBucket).Cursor()
+		for k, v := c.Seek(unixKey(start)); k != nil; k, v = c.Next() {
+			if !to.IsZero() && int64(binary.BigEndian.Uint64(k[:8])) >= to.UnixNano() {
+				break
+			}
+			var attempt NotificationAttempt
+			if err := json.Unmarshal(v, &attempt); err != nil {
+				return err
+			}
+			if imei == "" || attempt.Imei == imei {
+				attempts = append(attempts, attempt)
+			}
+		}
+		return nil
+	})
+	return attempts, err
+}
+
+// Checkpoint returns the last checkpoint recorded for a device.
+func (a *Archive) Checkpoint(imei string) (*Checkpoint, error) {
+	var checkpoint *Checkpoint
+	err := a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(checkpointsBucket).Get([]byte(imei))
+		if data == nil {
+			return nil
+		}
+		checkpoint = &Checkpoint{}
+		return json.Unmarshal(data, checkpoint)
+	})
+	return checkpoint, err
+}
+
+// Prune removes the alarms and notification attempts older than before. It
+// returns the number of records removed.
+func (a *Archive) Prune(before time.Time) (int, error) {
+	removed := 0
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		byKey := tx.Bucket(alarmsBucket)
+		c := tx.Bucket(alarmsByTimeBucket).Cursor()
+		limit := unixKey(before.Unix())
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, _ = c.First() {
+			if err := byKey.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+
+		bySID := tx.Bucket(notificationsBySIDBucket)
+		c = tx.Bucket(notificationsBucket).Cursor()
+		limit = unixKey(before.UnixNano())
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, v = c.First() {
+			var attempt NotificationAttempt
+			if err := json.Unmarshal(v, &attempt); err == nil && attempt.SID != "" {
+				if err := bySID.Delete([]byte(attempt.SID)); err != nil {
+					return err
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// RunRetention prunes the expired records every ARCHIVE_PRUNE_INTERVAL until
+// ctx is done.
+func (a *Archive) RunRetention(ctx context.Context) {
+	ticker := time.NewTicker(ARCHIVE_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		removed, err := a.Prune(time.Now().Add(-a.retention))
+		if err != nil {
+			logrus.WithError(err).Warning("Error pruning the archive")
+		} else if removed > 0 {
+			logrus.WithField("removed", removed).Info("Archive pruned")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestArchive(t *testing.T) *Archive {
+	t.Helper()
+	archive, err := OpenArchive(filepath.Join(t.TempDir(), "alarms.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	t.Cleanup(func() { archive.Close() })
+	return archive
+}
+
+// useTestArchive replaces alarmArchive with a test archive.
+func useTestArchive(t *testing.T) *Archive {
+	t.Helper()
+	archive := openTestArchive(t)
+	previous := alarmArchive
+	alarmArchive = archive
+	t.Cleanup(func() { alarmArchive = previous })
+	return archive
+}
+
+func TestArchiveAlarms(t *testing.T) {
+	archive := openTestArchive(t)
+	lat, lng := "-2.17", "-79.92"
+	farLat, farLng := "-0.18", "-78.47"
+	alarms := []Alarm{
+		{Imei: "1", Time: 100, AlarmCode: "SOS", Lat: &lat, Lng: &lng},
+		{Imei: "2", Time: 150, AlarmCode: "LOWVOT"},
+		{Imei: "1", Time: 200, AlarmCode: "REMOVE", Lat: &farLat, Lng: &farLng},
+		{Imei: "12", Time: 250, AlarmCode: "SOS"},
+	}
+	if err := archive.RecordAlarms(alarms); err != nil {
+		t.Fatalf("RecordAlarms failed: %v", err)
+	}
+	// Recording an alarm again doesn't duplicate it.
+	if err := archive.RecordAlarms(alarms[:1]); err != nil {
+		t.Fatalf("RecordAlarms failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    AlarmQuery
+		expected []int64
+	}{
+		{"all", AlarmQuery{}, []int64{100, 150, 200, 250}},
+		{"imei", AlarmQuery{Imei: "1"}, []int64{100, 200}},
+		{"range", AlarmQuery{From: time.Unix(150, 0), To: time.Unix(250, 0)}, []int64{150, 200}},
+		{"imei and range", AlarmQuery{Imei: "1", From: time.Unix(150, 0)}, []int64{200}},
+		{"codes", AlarmQuery{Codes: []string{"SOS", "LOWVOT"}}, []int64{100, 150, 250}},
+		{"box", AlarmQuery{Box: &BoundingBox{MinLat: -3, MinLng: -81, MaxLat: -2, MaxLng: -79}}, []int64{100}},
+		{"limit", AlarmQuery{Limit: 2}, []int64{100, 150}},
+	}
+	for _, test := range tests {
+		found, err := archive.Alarms(test.query)
+		if err != nil {
+			t.Fatalf("%s: Alarms failed: %v", test.name, err)
+		}
+		var times []int64
+		for _, alarm := range found {
+			times = append(times, alarm.Time)
+		}
+		if len(times) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, times)
+			continue
+		}
+		for i := range times {
+			if times[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, times)
+				break
+			}
+		}
+	}
+}
+
+func TestArchiveNotificationsAndCheckpoints(t *testing.T) {
+	archive := openTestArchive(t)
+	now := time.Now()
+	archive.RecordNotification(NotificationAttempt{Imei: "1", Phone: "+593991234567", Channel: "whatsapp", At: now.Add(-2 * time.Hour)})
+	archive.RecordNotification(NotificationAttempt{Imei: "1", Phone: "+593991234567", Channel: "whatsapp", Error: "failed", At: now})
+	archive.RecordNotification(NotificationAttempt{Imei: "2", Phone: "+593987654321", Channel: "whatsapp", At: now})
+	archive.RecordAlarms([]Alarm{{Imei: "1", Time: now.Add(-2 * time.Hour).Unix()}, {Imei: "1", Time: now.Unix()}})
+
+	attempts, err := archive.Notifications("1", now.Add(-time.Hour), time.Time{})
+	if err != nil || len(attempts) != 1 || attempts[0].Error != "failed" {
+		t.Errorf("unexpected attempts %+v, %v", attempts, err)
+	}
+
+	if err := archive.RecordCheckpoint("1", 1700000000); err != nil {
+		t.Fatalf("RecordCheckpoint failed: %v", err)
+	}
+	checkpoint, err := archive.Checkpoint("1")
+	if err != nil || checkpoint == nil || checkpoint.LastTimeTracked != 1700000000 {
+		t.Errorf("unexpected checkpoint %+v, %v", checkpoint, err)
+	}
+	if checkpoint, _ := archive.Checkpoint("2"); checkpoint != nil {
+		t.Errorf("expected no checkpoint, got %+v", checkpoint)
+	}
+
+	// The records older than the retention are removed.
+	removed, err := archive.Prune(now.Add(-time.Hour))
+	if err != nil || removed != 2 {
+		t.Fatalf("expected 2 records pruned, got %d, %v", removed, err)
+	}
+	if alarms, _ := archive.Alarms(AlarmQuery{Imei: "1"}); len(alarms) != 1 {
+		t.Errorf("expected 1 alarm after pruning, got %d", len(alarms))
+	}
+	if attempts, _ := archive.Notifications("", time.Time{}, time.Time{}); len(attempts) != 2 {
+		t.Errorf("expected 2 attempts after pruning, got %d", len(attempts))
+	}
+}
@@ -1,6 +1,15 @@
 package auth
 
+// Authenticate is the contract used by the rest of the service to obtain
+// IOPGPS access tokens and keep them renewed in the background.
 type Authenticate interface {
-	GetAccessToken() string
+	// GetAccessToken returns a valid access token, requesting a new one
+	// when the cached token is missing or close to its expiry.
+	GetAccessToken() (string, error)
+	// RefreshAccessToken requests a new token even if the cached one is valid.
+	RefreshAccessToken() (string, error)
+	// InitiateTokenRenewal blocks renewing the token until Stop is called.
 	InitiateTokenRenewal()
+	// Stop ends the renewal loop started by InitiateTokenRenewal.
+	Stop()
 }
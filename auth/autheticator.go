@@ -5,33 +5,82 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
 
+// IOPGPS_AUTH_URL is the IOPGPS endpoint that issues access tokens.
+const IOPGPS_AUTH_URL = "https://open.iopgps.com/api/auth"
+
+const (
+	// DEFAULT_TOKEN_LIFETIME is used when the auth response doesn't include expiresIn.
+	DEFAULT_TOKEN_LIFETIME = 2 * time.Hour
+	// TOKEN_RENEWAL_MARGIN is how long before the expiry the token is renewed.
+	TOKEN_RENEWAL_MARGIN = 20 * time.Minute
+	// MIN_RENEWAL_BACKOFF and MAX_RENEWAL_BACKOFF bound the wait between failed renewals.
+	MIN_RENEWAL_BACKOFF = 5 * time.Second
+	MAX_RENEWAL_BACKOFF = 5 * time.Minute
+)
+
 type Authenticator struct {
+	mu          sync.Mutex
 	accessToken string
-	appID       string
-	loginKey    string
-	serviceURL  string
+	createdAt   time.Time
+	lifetime    time.Duration
+
+	appID      string
+	loginKey   string
+	serviceURL string
+	client     *http.Client
+	// envFile is the dotenv file where the token is persisted between restarts.
+	// Persistence is disabled when it is empty.
+	envFile string
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	stop       chan struct{}
+	stopOnce   sync.Once
 }
 
-func InitAuthenticator() *Authenticator {
+// NewAuthenticator creates an Authenticator for the given credentials and auth endpoint.
+// If client is nil, a client with a 10 seconds timeout is used.
+func NewAuthenticator(appID, loginKey, serviceURL string, client *http.Client) *Authenticator {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
 	return &Authenticator{
-		accessToken: os.Getenv("ACCESS_TOKEN"),
-		appID:       os.Getenv("APPID"),
-		loginKey:    os.Getenv("LOGIN_KEY"),
-		serviceURL:  "https://open.iopgps.com/api/auth",
+		appID:      appID,
+		loginKey:   loginKey,
+		serviceURL: serviceURL,
+		client:     client,
+		minBackoff: MIN_RENEWAL_BACKOFF,
+		maxBackoff: MAX_RENEWAL_BACKOFF,
+		stop:       make(chan struct{}),
 	}
 }
 
+// InitAuthenticator creates an Authenticator from the environment and restores
+// the token persisted in the .env file, if any.
+func InitAuthenticator() *Authenticator {
+	serviceURL := os.Getenv("IOPGPS_AUTH_URL")
+	if serviceURL == "" {
+		serviceURL = IOPGPS_AUTH_URL
+	}
+	a := NewAuthenticator(os.Getenv("APPID"), os.Getenv("LOGIN_KEY"), serviceURL, nil)
+	a.envFile = ".env"
+	a.accessToken, a.createdAt, a.lifetime = readToken()
+	return a
+}
+
 func (a *Authenticator) createRequest() AuthRequest {
 	timeNow := time.Now()
 	currentTime := timeNow.Unix()
@@ -46,16 +95,36 @@ func (a *Authenticator) createRequest() AuthRequest {
 	return authRequest
 }
 
+// GetAccessToken returns the cached token while it is outside the renewal margin,
+// otherwise it requests a new one to IOPGPS.
 func (a *Authenticator) GetAccessToken() (string, error) {
-	token, createdAt, err := a.readToken()
-	if err != nil {
-		return "", err
-	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	if token != "" && time.Now().Before(createdAt.Add(2*time.Hour-20*time.Minute)) {
-		return token, nil
+	if a.accessToken != "" && time.Now().Before(a.renewalTime()) {
+		return a.accessToken, nil
 	}
+	return a.requestToken()
+}
+
+// RefreshAccessToken requests a new token regardless of the cached one.
+func (a *Authenticator) RefreshAccessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.requestToken()
+}
+
+// ExpiresAt returns when the cached token expires.
+func (a *Authenticator) ExpiresAt() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.createdAt.Add(a.lifetime)
+}
 
+// requestToken must be called with a.mu held.
+func (a *Authenticator) requestToken() (string, error) {
 	authRequest := a.createRequest()
 
 	response, err := a.sendAuthRequest(authRequest)
@@ -68,25 +137,47 @@ func (a *Authenticator) GetAccessToken() (string, error) {
 		return "", err
 	}
 
-	if authResponse.AccessToken != nil {
-		a.writeToken(*authResponse.AccessToken, time.Now())
+	if authResponse.AccessToken == nil || *authResponse.AccessToken == "" {
+		return "", errors.New("la respuesta de autenticación no contiene un token")
+	}
+
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if authResponse.Expiresin != nil && *authResponse.Expiresin > 0 {
+		lifetime = time.Duration(*authResponse.Expiresin) * time.Second
+	}
+
+	a.accessToken = *authResponse.AccessToken
+	a.createdAt = time.Now()
+	a.lifetime = lifetime
+
+	if err := a.writeToken(); err != nil {
+		logrus.WithError(err).Warning("Error al guardar el token de acceso")
 	}
 
 	return a.accessToken, nil
 }
 
+// renewalTime returns the moment the token must be renewed. The margin is
+// capped to half the token lifetime so short-lived tokens are still used.
+// It must be called with a.mu held.
+func (a *Authenticator) renewalTime() time.Time {
+	margin := min(TOKEN_RENEWAL_MARGIN, a.lifetime/2)
+	return a.createdAt.Add(a.lifetime - margin)
+}
+
 func (a *Authenticator) sendAuthRequest(authRequest AuthRequest) (*http.Response, error) {
 	authRequestBody, err := json.Marshal(authRequest)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := http.Post(a.serviceURL, "application/json", bytes.NewBuffer(authRequestBody))
+	response, err := a.client.Post(a.serviceURL, "application/json", bytes.NewBuffer(authRequestBody))
 	if err != nil {
 		return nil, err
 	}
 
 	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
 		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
 	}
 
@@ -94,11 +185,11 @@ func (a *Authenticator) sendAuthRequest(authRequest AuthRequest) (*http.Response
 }
 
 func (a *Authenticator) parseAuthResponse(response *http.Response) (*AuthResponse, error) {
+	defer response.Body.Close()
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
 
 	var authResponse AuthResponse
 	err = json.Unmarshal(body, &authResponse)
@@ -107,45 +198,47 @@ func (a *Authenticator) parseAuthResponse(response *http.Response) (*AuthRespons
 	}
 
 	if authResponse.Code != 0 {
-		return nil, fmt.Errorf("error al autenticar: %s", *authResponse.Result)
+		result := ""
+		if authResponse.Result != nil {
+			result = *authResponse.Result
+		}
+		return nil, fmt.Errorf("error al autenticar: código %d: %s", authResponse.Code, result)
 	}
 
 	return &authResponse, nil
 }
 
-func (a *Authenticator) readToken() (string, time.Time, error) {
+// readToken restores the token persisted by writeToken. A missing or malformed
+// entry is treated as no token, so a new one is requested.
+func readToken() (string, time.Time, time.Duration) {
 	token := os.Getenv("ACCESS_TOKEN")
-	timeline := os.Getenv("TIME")
 
-	unixTime, err := strconv.ParseInt(timeline, 10, 64)
+	unixTime, err := strconv.ParseInt(os.Getenv("TIME"), 10, 64)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("formato de archivo inválido")
+		return "", time.Time{}, 0
 	}
-	time := time.Unix(unixTime, 0)
 
-	return token, time, nil
-}
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if seconds, err := strconv.ParseInt(os.Getenv("EXPIRES_IN"), 10, 64); err == nil && seconds > 0 {
+		lifetime = time.Duration(seconds) * time.Second
+	}
 
-func setTokenInEnv(token string, time string) {
-	os.Setenv("ACCESS_TOKEN", token)
-	os.Setenv("TIME", time)
+	return token, time.Unix(unixTime, 0), lifetime
 }
 
-func (a *Authenticator) writeToken(token string, createdAt time.Time) {
-	a.accessToken = token
-	time := strconv.FormatInt(createdAt.Unix(), 10)
-
-	setTokenInEnv(token, time)
+// writeToken must be called with a.mu held.
+func (a *Authenticator) writeToken() error {
+	if a.envFile == "" {
+		return nil
+	}
 
 	envMap := map[string]string{
-		"ACCESS_TOKEN": token,
-		"TIME":         time,
+		"ACCESS_TOKEN": a.accessToken,
+		"TIME":         strconv.FormatInt(a.createdAt.Unix(), 10),
+		"EXPIRES_IN":   strconv.FormatInt(int64(a.lifetime/time.Second), 10),
 	}
 
-	err := godotenv.Write(envMap, ".env")
-	if err != nil {
-		logrus.Fatal("Error writing to .env file")
-	}
+	return godotenv.Write(envMap, a.envFile)
 }
 
 func (a *Authenticator) generateSignature(time int64) string {
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newAuthStub starts a fake IOPGPS auth endpoint. The handler receives the
+// number of the current request (starting at 1) and writes the response.
+func newAuthStub(t *testing.T, handler func(n int32, w http.ResponseWriter, req AuthRequest)) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		var req AuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid auth request body: %v", err)
+		}
+		handler(n, w, req)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func writeAuthResponse(w http.ResponseWriter, token string, expiresIn int) {
+	json.NewEncoder(w).Encode(AuthResponse{
+		Code:        0,
+		AccessToken: &token,
+		Expiresin:   &expiresIn,
+	})
+}
+
+func TestGetAccessTokenCachesToken(t *testing.T) {
+	server, calls := newAuthStub(t, func(n int32, w http.ResponseWriter, req AuthRequest) {
+		if req.Appid != "app" {
+			t.Errorf("expected appid app, got %s", req.Appid)
+		}
+		a := &Authenticator{loginKey: "key"}
+		if req.Signature != a.generateSignature(req.Time) {
+			t.Errorf("unexpected signature %s", req.Signature)
+		}
+		writeAuthResponse(w, "token-1", 7200)
+	})
+
+	a := NewAuthenticator("app", "key", server.URL, server.Client())
+	for i := 0; i < 3; i++ {
+		token, err := a.GetAccessToken()
+		if err != nil {
+			t.Fatalf("GetAccessToken failed: %v", err)
+		}
+		if token != "token-1" {
+			t.Fatalf("expected token-1, got %s", token)
+		}
+	}
+
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("expected 1 auth request, got %d", got)
+	}
+	if lifetime := time.Until(a.ExpiresAt()); lifetime < 119*time.Minute || lifetime > 2*time.Hour {
+		t.Errorf("expected the expiry to be derived from expiresIn, got %s", lifetime)
+	}
+}
+
+func TestGetAccessTokenRenewsExpiredToken(t *testing.T) {
+	server, calls := newAuthStub(t, func(n int32, w http.ResponseWriter, req AuthRequest) {
+		writeAuthResponse(w, "token", 1)
+	})
+
+	a := NewAuthenticator("app", "key", server.URL, server.Client())
+	if _, err := a.GetAccessToken(); err != nil {
+		t.Fatalf("GetAccessToken failed: %v", err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if _, err := a.GetAccessToken(); err != nil {
+		t.Fatalf("GetAccessToken failed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("expected the token to be renewed, got %d auth requests", got)
+	}
+}
+
+func TestGetAccessTokenErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(n int32, w http.ResponseWriter, req AuthRequest)
+	}{
+		{"non-200 status", func(n int32, w http.ResponseWriter, req AuthRequest) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}},
+		{"error code", func(n int32, w http.ResponseWriter, req AuthRequest) {
+			result := "invalid signature"
+			json.NewEncoder(w).Encode(AuthResponse{Code: 1001, Result: &result})
+		}},
+		{"missing token", func(n int32, w http.ResponseWriter, req AuthRequest) {
+			json.NewEncoder(w).Encode(AuthResponse{Code: 0})
+		}},
+		{"invalid json", func(n int32, w http.ResponseWriter, req AuthRequest) {
+			w.Write([]byte("{"))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newAuthStub(t, tt.handler)
+			a := NewAuthenticator("app", "key", server.URL, server.Client())
+			if _, err := a.GetAccessToken(); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestInitiateTokenRenewalBacksOffAndStops(t *testing.T) {
+	server, calls := newAuthStub(t, func(n int32, w http.ResponseWriter, req AuthRequest) {
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeAuthResponse(w, "token", 7200)
+	})
+
+	a := NewAuthenticator("app", "key", server.URL, server.Client())
+	a.minBackoff = 10 * time.Millisecond
+	a.maxBackoff = 40 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		a.InitiateTokenRenewal()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(calls) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Once renewed, the loop must wait for the renewal margin instead of spinning.
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(calls); got != 3 {
+		t.Errorf("expected 3 auth requests, got %d", got)
+	}
+
+	a.Stop()
+	a.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("InitiateTokenRenewal didn't return after Stop")
+	}
+}
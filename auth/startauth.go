@@ -6,16 +6,39 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// InitiateTokenRenewal keeps the access token renewed until Stop is called.
+// After a successful renewal it sleeps until the token enters the renewal margin;
+// after a failure it retries with an exponential backoff.
 func (a *Authenticator) InitiateTokenRenewal() {
-	tokenTicker := time.NewTicker(10 * time.Minute)
-	defer tokenTicker.Stop()
+	backoff := a.minBackoff
 	for {
-		_, err := a.GetAccessToken()
-		if err != nil {
-			logrus.WithError(err).Error("Error al obtener el token de acceso")
-			continue
+		var wait time.Duration
+		if _, err := a.GetAccessToken(); err != nil {
+			logrus.WithError(err).WithField("retry_in", backoff.String()).Error("Error al obtener el token de acceso")
+			wait = backoff
+			backoff = min(backoff*2, a.maxBackoff)
+		} else {
+			backoff = a.minBackoff
+			a.mu.Lock()
+			renewAt := a.renewalTime()
+			a.mu.Unlock()
+			wait = max(time.Until(renewAt), a.minBackoff)
+			logrus.WithField("renew_at", renewAt).Println("Token de acceso actualizado")
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-a.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
 		}
-		logrus.Println("Token de acceso actualizado")
-		<-tokenTicker.C
 	}
 }
+
+// Stop ends the renewal loop. It is safe to call it more than once.
+func (a *Authenticator) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BACKFILL_WINDOWS are the longest periods requested to each provider at once.
+var BACKFILL_WINDOWS = map[Provider]time.Duration{
+	WanWayTech: TWENTY_FOUR_HOURS_IN_SECONDS * time.Second,
+	WhatsGPS:   TWENTY_FOUR_HOURS_IN_SECONDS * time.Second,
+}
+
+// BACKFILL_RATE_LIMITS are the requests per second allowed for each provider.
+var BACKFILL_RATE_LIMITS = map[Provider]int{
+	WanWayTech: MAX_REQUESTS_IN_IOPGPS_API_PER_SECOND,
+	WhatsGPS:   MAX_REQUESTS_IN_WHATSGPS_API_PER_SECOND,
+}
+
+// BackfillWindow is a period of unix time requested to a provider.
+type BackfillWindow struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// SplitWindows divides the range [start, end) in consecutive windows of at most size seconds.
+func SplitWindows(start, end int64, size int64) []BackfillWindow {
+	var windows []BackfillWindow
+	if size <= 0 {
+		return windows
+	}
+	for from := start; from < end; from += size {
+		windows = append(windows, BackfillWindow{Start: from, End: min(from+size, end)})
+	}
+	return windows
+}
+
+// BackfillProgress reports a processed window of a device.
+type BackfillProgress struct {
+	Imei      string
+	Window    BackfillWindow
+	Completed int // Completed is the number of windows processed for the device.
+	Total     int // Total is the number of windows of the device.
+	Alarms    int // Alarms is the number of alarms found in the window.
+	Err       error
+}
+
+// BackfillState records the end of the last completed window of each device,
+// so an interrupted backfill resumes where it stopped.
+type BackfillState struct {
+	mu        sync.Mutex
+	path      string
+	From      int64            `json:"from"`
+	To        int64            `json:"to"`
+	Completed map[string]int64 `json:"completed"`
+}
+
+// LoadBackfillState reads the state file of a backfill over [from, to). A missing
+// file, or one written for a different range, starts a new state. A zero to
+// means the end wasn't given: a new state ends now and a resumed one keeps
+// the end it was started with, so the same command resumes it.
+func LoadBackfillState(path string, from, to int64) (*BackfillState, error) {
+	end := to
+	if end == 0 {
+		end = time.Now().Unix()
+	}
+	state := &BackfillState{path: path, From: from, To: end, Completed: map[string]int64{}}
+	if path == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved BackfillState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid backfill state %s: %w", path, err)
+	}
+	if saved.From != from || (to != 0 && saved.To != to) || saved.To <= from || saved.Completed == nil {
+		logrus.WithField("path", path).Warning("Ignoring the backfill state of a different period")
+		return state, nil
+	}
+	state.To = saved.To
+	state.Completed = saved.Completed
+	return state, nil
+}
+
+// ResumeFrom returns where the backfill of the device must continue.
+func (s *BackfillState) ResumeFrom(imei string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end, ok := s.Completed[imei]; ok && end > s.From {
+		return end
+	}
+	return s.From
+}
+
+// Complete records a processed window and saves the state file.
+func (s *BackfillState) Complete(imei string, window BackfillWindow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Completed[imei] = window.End
+	return s.save()
+}
+
+// Remove deletes the state file once the backfill has finished.
+func (s *BackfillState) Remove() error {
+	if s.path == "" {
+		return nil
+	}
+	err := os.Remove(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// save must be called with s.mu held. The file is replaced atomically.
+func (s *BackfillState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// BackfillJob recovers the alarms of a past period for a set of devices. The
+// alarms are saved through the DataSaver, without notifying them, and the
+// checkpoint of the devices (LastTimeTracked) isn't modified.
+type BackfillJob struct {
+	Devices    []Device
+	From       time.Time
+	To         time.Time
+	State      *BackfillState
+	OnProgress func(BackfillProgress)
+
+	executor *RequestExecutor
+	saver    *DataSaver
+}
+
+// NewBackfillJob creates a job saving the alarms through a DataSaver that has
+// no next handler. It has its own AlarmBatcher, flushed after every window.
+func NewBackfillJob(devices []Device, from, to time.Time, state *BackfillState) *BackfillJob {
+	return &BackfillJob{
+		Devices:  devices,
+		From:     from,
+		To:       to,
+		State:    state,
+		executor: &RequestExecutor{},
+		saver: &DataSaver{batcher: NewAlarmBatcher(
+			getEnvInt("ALARM_BATCH_SIZE", DEFAULT_ALARM_BATCH_SIZE),
+			getEnvDuration("ALARM_FLUSH_INTERVAL", DEFAULT_ALARM_FLUSH_INTERVAL),
+		)},
+	}
+}
+
+// Run processes every device, with one goroutine per provider limited to the
+// provider requests per second. It returns the number of alarms saved and the
+// first error found; the failed devices can be resumed with the same state.
+func (j *BackfillJob) Run(ctx context.Context) (int, error) {
+	if j.State == nil {
+		j.State = &BackfillState{From: j.From.Unix(), To: j.To.Unix(), Completed: map[string]int64{}}
+	}
+
+	byProvider := map[Provider][]Device{}
+	for _, device := range j.Devices {
+		if _, ok := BACKFILL_WINDOWS[device.Provider]; !ok {
+			logrus.WithField("imei", device.Imei).Warningf("Skipping device with unknown provider %q", device.Provider)
+			continue
+		}
+		byProvider[device.Provider] = append(byProvider[device.Provider], device)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		total    int
+		firstErr error
+	)
+	for provider, devices := range byProvider {
+		wg.Add(1)
+		go func(provider Provider, devices []Device) {
+			defer wg.Done()
+			saved, err := j.runProvider(ctx, provider, devices)
+			mu.Lock()
+			defer mu.Unlock()
+			total += saved
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(provider, devices)
+	}
+	wg.Wait()
+
+	return total, firstErr
+}
+
+// runProvider backfills the devices of a provider within its rate limit. It
+// fails for a provider without a positive rate limit.
+func (j *BackfillJob) runProvider(ctx context.Context, provider Provider, devices []Device) (int, error) {
+	rate, ok := BACKFILL_RATE_LIMITS[provider]
+	if !ok {
+		return 0, fmt.Errorf("unknown provider %q", provider)
+	}
+	if rate <= 0 {
+		return 0, fmt.Errorf("invalid rate limit %d of provider %q", rate, provider)
+	}
+	limiter := time.NewTicker(time.Second / time.Duration(rate))
+	defer limiter.Stop()
+	windowSize := int64(BACKFILL_WINDOWS[provider] / time.Second)
+
+	total := 0
+	var firstErr error
+	for _, device := range devices {
+		saved, err := j.runDevice(ctx, limiter.C, device, windowSize)
+		total += saved
+		if err != nil {
+			if ctx.Err() != nil {
+				return total, ctx.Err()
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("device %s: %w", device.Imei, err)
+			}
+		}
+	}
+	return total, firstErr
+}
+
+func (j *BackfillJob) runDevice(ctx context.Context, limiter <-chan time.Time, device Device, windowSize int64) (int, error) {
+	allWindows := SplitWindows(j.State.From, j.State.To, windowSize)
+	resumeFrom := j.State.ResumeFrom(device.Imei)
+
+	total := 0
+	for i, window := range allWindows {
+		if window.End <= resumeFrom {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-limiter:
+		}
+
+		alarms, err := j.executor.FetchAlarms(device.GenerateURLForRange(window.Start, window.End))
+		if err == nil && len(alarms) > 0 {
+			// The window is only completed once its alarms are saved.
+			_, err = j.saver.Handle(alarms)
+			if err == nil {
+				err = j.saver.Batcher().Flush()
+			}
+		}
+		j.report(BackfillProgress{
+			Imei:      device.Imei,
+			Window:    window,
+			Completed: i + 1,
+			Total:     len(allWindows),
+			Alarms:    len(alarms),
+			Err:       err,
+		})
+		if err != nil {
+			return total, err
+		}
+
+		total += len(alarms)
+		if err := j.State.Complete(device.Imei, window); err != nil {
+			logrus.WithError(err).Warning("Error saving the backfill state")
+		}
+	}
+	return total, nil
+}
+
+func (j *BackfillJob) report(progress BackfillProgress) {
+	fields := logrus.Fields{
+		"imei":   progress.Imei,
+		"start":  progress.Window.Start,
+		"end":    progress.Window.End,
+		"window": fmt.Sprintf("%d/%d", progress.Completed, progress.Total),
+		"alarms": progress.Alarms,
+	}
+	if progress.Err != nil {
+		logrus.WithFields(fields).WithError(progress.Err).Warning("Backfill window failed")
+	} else {
+		logrus.WithFields(fields).Info("Backfill window completed")
+	}
+	if j.OnProgress != nil {
+		j.OnProgress(progress)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitWindows(t *testing.T) {
+	windows := SplitWindows(0, 250, 100)
+	expected := []BackfillWindow{{0, 100}, {100, 200}, {200, 250}}
+	if !reflect.DeepEqual(windows, expected) {
+		t.Errorf("expected %v, got %v", expected, windows)
+	}
+
+	if windows := SplitWindows(100, 100, 10); len(windows) != 0 {
+		t.Errorf("expected no windows for an empty range, got %v", windows)
+	}
+}
+
+func TestBackfillStateResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backfill.json")
+
+	state, err := LoadBackfillState(path, 0, 300)
+	if err != nil {
+		t.Fatalf("LoadBackfillState failed: %v", err)
+	}
+	if err := state.Complete("123", BackfillWindow{0, 100}); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+
+	resumed, err := LoadBackfillState(path, 0, 300)
+	if err != nil {
+		t.Fatalf("LoadBackfillState failed: %v", err)
+	}
+	if from := resumed.ResumeFrom("123"); from != 100 {
+		t.Errorf("expected to resume from 100, got %d", from)
+	}
+	if from := resumed.ResumeFrom("456"); from != 0 {
+		t.Errorf("expected a new device to start from 0, got %d", from)
+	}
+
+	other, err := LoadBackfillState(path, 0, 500)
+	if err != nil {
+		t.Fatalf("LoadBackfillState failed: %v", err)
+	}
+	if from := other.ResumeFrom("123"); from != 0 {
+		t.Errorf("expected the state of another period to be ignored, got %d", from)
+	}
+
+	if err := resumed.Remove(); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+}
+
+func TestBackfillStateResumeWithoutEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backfill.json")
+	from := time.Now().Add(-48 * time.Hour).Unix()
+
+	state, err := LoadBackfillState(path, from, 0)
+	if err != nil {
+		t.Fatalf("LoadBackfillState failed: %v", err)
+	}
+	if state.To < time.Now().Add(-time.Minute).Unix() {
+		t.Fatalf("expected a new state to end now, got %d", state.To)
+	}
+	// The saved end is older than the next now.
+	state.To -= 60
+	if err := state.Complete("123", BackfillWindow{from, from + 100}); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+
+	resumed, err := LoadBackfillState(path, from, 0)
+	if err != nil {
+		t.Fatalf("LoadBackfillState failed: %v", err)
+	}
+	if resumed.To != state.To || resumed.ResumeFrom("123") != from+100 {
+		t.Fatalf("expected to resume until %d from %d, got until %d from %d", state.To, from+100, resumed.To, resumed.ResumeFrom("123"))
+	}
+}
+
+func TestBackfillRateLimit(t *testing.T) {
+	previous := BACKFILL_RATE_LIMITS[WhatsGPS]
+	BACKFILL_RATE_LIMITS[WhatsGPS] = 0
+	t.Cleanup(func() { BACKFILL_RATE_LIMITS[WhatsGPS] = previous })
+
+	job := &BackfillJob{}
+	devices := []Device{{Imei: "123", Provider: WhatsGPS}}
+	if _, err := job.runProvider(context.Background(), WhatsGPS, devices); err == nil {
+		t.Error("expected an error for a provider without a rate limit")
+	}
+	if _, err := job.runProvider(context.Background(), Provider("unknown"), devices); err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_ALARM_BATCH_SIZE is the number of alarms sent in each bulk
+	// request, configurable with the ALARM_BATCH_SIZE environment variable.
+	DEFAULT_ALARM_BATCH_SIZE = 100
+	// DEFAULT_ALARM_FLUSH_INTERVAL is how often incomplete batches are sent,
+	// configurable with the ALARM_FLUSH_INTERVAL environment variable.
+	DEFAULT_ALARM_FLUSH_INTERVAL = 5 * time.Second
+)
+
+// MAX_PENDING_ALARMS bounds the alarms kept while the backend is unavailable.
+// The oldest ones are discarded when it is exceeded.
+const MAX_PENDING_ALARMS = 10000
+
+var (
+	// pendingAlarmsMetric publishes the number of alarms waiting to be saved.
+	pendingAlarmsMetric = new(expvar.Int)
+	// alarmBatchesMetrics publishes the counters of the bulk requests.
+	alarmBatchesMetrics = expvar.NewMap("alarm_batches")
+)
+
+func init() {
+	expvar.Publish("pending_alarms", pendingAlarmsMetric)
+}
+
+// AlarmBatcher saves the alarms in the backend with bulk requests. Full
+// batches are sent as soon as they are added and the rest every flush
+// interval. The alarms that fail with a retryable status, or that are added
+// while the backend circuit is open, stay queued for the next flush.
+type AlarmBatcher struct {
+	batchSize     int
+	flushInterval time.Duration
+	breaker       *CircuitBreaker
+	submit        func([]Alarm) ([]roadsafety.BulkResult, error)
+
+	mu      sync.Mutex
+	pending []Alarm
+
+	// flushMu serializes the flushes so the batches keep their order.
+	flushMu sync.Mutex
+}
+
+var alarmBatcherInstance *AlarmBatcher
+var alarmBatcherOnce sync.Once
+
+// GetAlarmBatcher returns the batcher shared by the DataSavers, configured
+// from the environment on the first call.
+func GetAlarmBatcher() *AlarmBatcher {
+	alarmBatcherOnce.Do(func() {
+		alarmBatcherInstance = NewAlarmBatcher(
+			getEnvInt("ALARM_BATCH_SIZE", DEFAULT_ALARM_BATCH_SIZE),
+			getEnvDuration("ALARM_FLUSH_INTERVAL", DEFAULT_ALARM_FLUSH_INTERVAL),
+		)
+	})
+	return alarmBatcherInstance
+}
+
+// NewAlarmBatcher creates a batcher sending the alarms with roadSafetyClient.
+func NewAlarmBatcher(batchSize int, flushInterval time.Duration) *AlarmBatcher {
+	if batchSize < 1 {
+		batchSize = DEFAULT_ALARM_BATCH_SIZE
+	}
+	if flushInterval <= 0 {
+		flushInterval = DEFAULT_ALARM_FLUSH_INTERVAL
+	}
+	return &AlarmBatcher{
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		breaker:       roadSafetyBreaker,
+		submit: func(alarms []Alarm) ([]roadsafety.BulkResult, error) {
+			batch := make([]roadsafety.Alarm, len(alarms))
+			for i, alarm := range alarms {
+				batch[i] = roadsafety.Alarm(alarm)
+			}
+			return roadSafetyClient.CreateAlarms(context.Background(), batch)
+		},
+	}
+}
+
+// Add queues the alarms and sends the full batches.
+func (b *AlarmBatcher) Add(alarms []Alarm) {
+	b.queue(alarms)
+	if b.Pending() >= b.batchSize {
+		b.flush(false)
+	}
+}
+
+// Flush sends every queued alarm. It returns an error if some of them remain
+// queued because the backend is unavailable.
+func (b *AlarmBatcher) Flush() error {
+	b.flush(true)
+	if pending := b.Pending(); pending > 0 {
+		return fmt.Errorf("%d alarms are still pending to be saved", pending)
+	}
+	return nil
+}
+
+// Run flushes the batcher every flush interval until ctx is done, and once
+// more before returning.
+func (b *AlarmBatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := b.Flush(); err != nil {
+				logrus.WithError(err).Warning("Alarms lost on shutdown")
+			}
+			return
+		case <-ticker.C:
+			b.flush(true)
+		}
+	}
+}
+
+// flush sends the queued alarms in batches, including the last incomplete
+// one only when partial is true. It stops at the first batch that fails.
+func (b *AlarmBatcher) flush(partial bool) {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	for b.breaker.Ready() {
+		batch := b.take(partial)
+		if len(batch) == 0 {
+			return
+		}
+		if !b.send(batch) {
+			return
+		}
+	}
+}
+
+// send submits a batch and queues again the alarms that may be saved later.
+// It reports whether the whole batch was handled.
+func (b *AlarmBatcher) send(batch []Alarm) bool {
+	alarmBatchesMetrics.Add("batches", 1)
+	results, err := b.submit(batch)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"alarms": len(batch),
+		}).Warning("Error saving the alarms batch")
+		if isRetryable(err) {
+			alarmBatchesMetrics.Add("retried", int64(len(batch)))
+			b.requeue(batch)
+		} else {
+			alarmBatchesMetrics.Add("failed", int64(len(batch)))
+		}
+		return false
+	}
+
+	var retry []Alarm
+	for i, result := range results {
+		switch {
+		case result.Saved():
+			alarmBatchesMetrics.Add("saved", 1)
+		case result.Retryable():
+			retry = append(retry, batch[i])
+		default:
+			alarmBatchesMetrics.Add("failed", 1)
+			logrus.WithFields(logrus.Fields{
+				"status": result.Status,
+				"detail": result.Detail,
+				"alarm":  batch[i],
+			}).Warning("Error saving the alarm")
+		}
+	}
+	if len(retry) > 0 {
+		alarmBatchesMetrics.Add("retried", int64(len(retry)))
+		b.requeue(retry)
+		return false
+	}
+	return true
+}
+
+// queue adds alarms to the pending ones, discarding the oldest if needed.
+func (b *AlarmBatcher) queue(alarms []Alarm) {
+	if len(alarms) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, alarms...)
+	b.trim()
+}
+
+// requeue puts alarms back in front of the pending ones.
+func (b *AlarmBatcher) requeue(alarms []Alarm) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(append([]Alarm(nil), alarms...), b.pending...)
+	b.trim()
+}
+
+// trim must be called with b.mu held.
+func (b *AlarmBatcher) trim() {
+	if excess := len(b.pending) - MAX_PENDING_ALARMS; excess > 0 {
+		logrus.WithField("discarded", excess).Error("Too many pending alarms, discarding the oldest")
+		b.pending = b.pending[excess:]
+	}
+	pendingAlarmsMetric.Set(int64(len(b.pending)))
+}
+
+// take removes and returns the next batch, or nil if there isn't a full one
+// and partial is false.
+func (b *AlarmBatcher) take(partial bool) []Alarm {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := min(b.batchSize, len(b.pending))
+	if n == 0 || (n < b.batchSize && !partial) {
+		return nil
+	}
+	batch := b.pending[:n:n]
+	b.pending = b.pending[n:]
+	pendingAlarmsMetric.Set(int64(len(b.pending)))
+	return batch
+}
+
+// Pending returns the number of alarms waiting to be saved.
+func (b *AlarmBatcher) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAlarmBatcher(t *testing.T) {
+	server := useRoadSafetyServer(t)
+	batcher := NewAlarmBatcher(2, time.Hour)
+	batcher.breaker = NewCircuitBreaker("test", BREAKER_FAILURE_THRESHOLD, BREAKER_OPEN_TIMEOUT)
+
+	// Only the full batch is sent when the alarms are added.
+	batcher.Add([]Alarm{
+		{Imei: "1", Time: 1700000000, AlarmCode: "SOS"},
+		{Imei: "1", Time: 1700000060, AlarmCode: "SOS"},
+		{Imei: "2", Time: 1700000000, AlarmCode: "SOS"},
+	})
+	if saved := len(server.Alarms()); saved != 2 {
+		t.Fatalf("expected 2 alarms saved, got %d", saved)
+	}
+	if pending := batcher.Pending(); pending != 1 {
+		t.Fatalf("expected 1 pending alarm, got %d", pending)
+	}
+
+	// A retryable failure keeps the alarm queued, a rejected one is dropped.
+	server.FailAlarms("2", http.StatusServiceUnavailable)
+	batcher.Add([]Alarm{{Time: 1700000000, AlarmCode: "SOS"}})
+	if err := batcher.Flush(); err == nil {
+		t.Fatal("expected an error while an alarm is pending")
+	}
+	if pending := batcher.Pending(); pending != 1 {
+		t.Fatalf("expected 1 pending alarm, got %d", pending)
+	}
+
+	server.FailAlarms("2", 0)
+	if err := batcher.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if saved := len(server.Alarms()); saved != 3 {
+		t.Errorf("expected 3 alarms saved, got %d", saved)
+	}
+	for _, request := range server.Requests() {
+		if request.Path != "/api/v1/alarms/bulk/" {
+			t.Errorf("unexpected request %s %s", request.Method, request.Path)
+		}
+	}
+}
+
+func TestAlarmBatcherCircuitOpen(t *testing.T) {
+	server := useRoadSafetyServer(t)
+	batcher := NewAlarmBatcher(1, time.Hour)
+	batcher.breaker = NewCircuitBreaker("test", 1, time.Hour)
+	batcher.breaker.Failure()
+
+	batcher.Add([]Alarm{{Imei: "1", Time: 1700000000, AlarmCode: "SOS"}})
+	if len(server.Requests()) != 0 || batcher.Pending() != 1 {
+		t.Errorf("expected the alarm to be queued while the circuit is open")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// BREAKER_FAILURE_THRESHOLD is the number of consecutive failures that opens a circuit.
+	BREAKER_FAILURE_THRESHOLD = 5
+	// BREAKER_OPEN_TIMEOUT is how long a circuit stays open before a probe request is allowed.
+	BREAKER_OPEN_TIMEOUT = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of calling an upstream whose circuit is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every request until BREAKER_OPEN_TIMEOUT elapses.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through to test the upstream.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops calling an upstream after consecutive failures, so the
+// goroutines don't keep waiting for timeouts while it is down.
+type CircuitBreaker struct {
+	name        string
+	threshold   int
+	openTimeout time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	opened   *expvar.Int
+	rejected *expvar.Int
+}
+
+// circuitBreakerMetrics publishes the state of the breakers in /debug/vars.
+var circuitBreakerMetrics = expvar.NewMap("circuit_breakers")
+
+// circuitBreakers holds the breakers of every upstream by name.
+var circuitBreakers = map[string]*CircuitBreaker{}
+
+// Breakers of the upstream dependencies.
+var (
+	roadSafetyBreaker = newUpstreamBreaker("road_safety")
+	geoapifyBreaker   = newUpstreamBreaker("geoapify")
+	iopgpsBreaker     = newUpstreamBreaker("iopgps")
+	whatsgpsBreaker   = newUpstreamBreaker("whatsgps")
+)
+
+// NewCircuitBreaker creates a closed breaker that opens after threshold consecutive
+// failures and allows a probe once openTimeout has elapsed.
+func NewCircuitBreaker(name string, threshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:        name,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		now:         time.Now,
+		opened:      new(expvar.Int),
+		rejected:    new(expvar.Int),
+	}
+}
+
+// newUpstreamBreaker creates a breaker with the default settings and registers it
+// in the metrics and the health check.
+func newUpstreamBreaker(name string) *CircuitBreaker {
+	b := NewCircuitBreaker(name, BREAKER_FAILURE_THRESHOLD, BREAKER_OPEN_TIMEOUT)
+	circuitBreakers[name] = b
+
+	metrics := new(expvar.Map).Init()
+	metrics.Set("state", expvar.Func(func() interface{} { return b.State().String() }))
+	metrics.Set("failures", expvar.Func(func() interface{} { return b.Failures() }))
+	metrics.Set("opened", b.opened)
+	metrics.Set("rejected", b.rejected)
+	circuitBreakerMetrics.Set(name, metrics)
+
+	return b
+}
+
+// providerBreaker returns the breaker of the vendor API of a provider.
+func providerBreaker(provider Provider) *CircuitBreaker {
+	switch provider {
+	case WanWayTech:
+		return iopgpsBreaker
+	case WhatsGPS:
+		return whatsgpsBreaker
+	}
+	return nil
+}
+
+// State returns the current state, moving an open breaker to half-open once its timeout elapsed.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateState()
+	return b.state
+}
+
+// Failures returns the number of consecutive failures.
+func (b *CircuitBreaker) Failures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+// Ready reports whether a request would currently be allowed, without taking
+// the probe of a half-open breaker.
+func (b *CircuitBreaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateState()
+	return b.state == BreakerClosed || (b.state == BreakerHalfOpen && !b.probing)
+}
+
+// Allow returns ErrCircuitOpen if the request must not be made. Every allowed
+// request must be followed by a call to Success or Failure.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateState()
+
+	switch b.state {
+	case BreakerOpen:
+		b.rejected.Add(1)
+		return fmt.Errorf("%s: %w", b.name, ErrCircuitOpen)
+	case BreakerHalfOpen:
+		if b.probing {
+			b.rejected.Add(1)
+			return fmt.Errorf("%s: %w", b.name, ErrCircuitOpen)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Success records a successful request, closing the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerClosed {
+		logrus.WithField("upstream", b.name).Info("Circuit breaker closed")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed request. The breaker opens when the threshold is
+// reached or when the probe of a half-open breaker fails.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+		b.opened.Add(1)
+		logrus.WithFields(logrus.Fields{
+			"upstream": b.name,
+			"failures": b.failures,
+		}).Warning("Circuit breaker opened")
+	}
+}
+
+// Do executes the request with the client through the breaker. Transport errors,
+// 5xx and 429 responses count as failures.
+func (b *CircuitBreaker) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := b.Allow(); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	b.record(resp, err)
+	return resp, err
+}
+
+// record counts the result of a request as a success or a failure.
+func (b *CircuitBreaker) record(resp *http.Response, err error) {
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		b.Failure()
+	} else {
+		b.Success()
+	}
+}
+
+// updateState must be called with b.mu held.
+func (b *CircuitBreaker) updateState() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+}
+
+// Transport returns a RoundTripper that sends the requests of base through
+// the breaker, for clients that don't call Do. A nil base uses the default one.
+func (b *CircuitBreaker) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &breakerTransport{breaker: b, base: base}
+}
+
+type breakerTransport struct {
+	breaker *CircuitBreaker
+	base    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	t.breaker.record(resp, err)
+	return resp, err
+}
+
+// HTTPStatusError is returned when an upstream answers with an unexpected status.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %s", e.Status)
+}
+
+// isRetryable reports whether a request that failed with err may succeed later:
+// the circuit was open, the upstream failed or it couldn't be reached.
+func isRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var apiErr *roadsafety.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	return err != nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker("test", 3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("expected request %d to be allowed: %v", i, err)
+		}
+		b.Failure()
+	}
+	if state := b.State(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to open, got %s", state)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	// After the timeout a single probe is allowed.
+	now = now.Add(time.Minute)
+	if state := b.State(); state != BreakerHalfOpen {
+		t.Fatalf("expected the breaker to be half-open, got %s", state)
+	}
+	if !b.Ready() {
+		t.Error("expected the half-open breaker to be ready")
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected the probe to be allowed: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected a second probe to be rejected, got %v", err)
+	}
+
+	// A failed probe opens it again, a successful one closes it.
+	b.Failure()
+	if state := b.State(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to open again, got %s", state)
+	}
+	now = now.Add(time.Minute)
+	b.Allow()
+	b.Success()
+	if state := b.State(); state != BreakerClosed || b.Failures() != 0 {
+		t.Errorf("expected the breaker to close, got %s with %d failures", state, b.Failures())
+	}
+}
+
+func TestCircuitBreakerDo(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	b := NewCircuitBreaker("test", 2, time.Minute)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := b.Do(server.Client(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := b.Do(server.Client(), req); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected the upstream not to be called, got %v", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if isRetryable(&HTTPStatusError{StatusCode: http.StatusBadRequest}) {
+		t.Error("expected a 400 not to be retryable")
+	}
+	if !isRetryable(&HTTPStatusError{StatusCode: http.StatusBadGateway}) {
+		t.Error("expected a 502 to be retryable")
+	}
+	if isRetryable(&roadsafety.APIError{StatusCode: http.StatusUnauthorized}) {
+		t.Error("expected a backend 401 not to be retryable")
+	}
+	if !isRetryable(ErrCircuitOpen) {
+		t.Error("expected an open circuit to be retryable")
+	}
+}
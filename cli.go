@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a CLI subcommand. Its name may have several words, e.g. "devices list".
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "run", "Track alarms until interrupted (default)", runCommand},
+		{"once", "once", "Run a single tracking cycle over every tracked device", onceCommand},
+		{"backfill", "backfill [--imei IMEI] --from DATE [--to DATE] [--state FILE]", "Save the alarms of a past period without notifying them", backfillCommand},
+		{"devices list", "devices list [--all]", "List the devices registered in the backend", devicesListCommand},
+		{"alarms fetch", "alarms fetch --imei IMEI [--since DURATION | --from DATE --to DATE]", "Fetch the alarms of a device from its provider without saving them", alarmsFetchCommand},
+		{"positions get", "positions get --imei IMEI", "Request the last position of a device to its provider", positionsGetCommand},
+		{"alarms export", "alarms export --format FORMAT [--imei IMEI] --from DATE [--to DATE] [--code CODE] [--output FILE]", "Export the alarm history to csv, geojson, kml or gpx", alarmsExportCommand},
+		{"notifications list", "notifications list [--imei IMEI] [--from DATE] [--to DATE] [--code CODE] [--phone PHONE] [--json]", "Show the delivery ledger of the notifications", notificationsListCommand},
+		{"digest send", "digest send --fleet FLEET [--frequency daily|weekly] [--date DATE] [--email EMAIL] [--dry-run]", "Send the alarm digest of a fleet for the last period before a date", digestSendCommand},
+		{"notify test", "notify test --imei IMEI [--dry-run]", "Send a test message to the phones of a device", notifyTestCommand},
+		{"geocode", "geocode LAT LNG", "Resolve the address of a coordinate", geocodeCommand},
+		{"token refresh", "token refresh", "Request a new IOPGPS access token", tokenRefreshCommand},
+	}
+}
+
+// runCLI dispatches the arguments to the matching command. Without arguments
+// the service runs as usual.
+func runCLI(args []string) error {
+	if len(args) == 0 {
+		return runCommand(nil)
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return nil
+	}
+
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return c.run(args[len(words):])
+		}
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: alarms_notification <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.usage, c.description)
+	}
+	w.Flush()
+}
+
+// newFlagSet creates the flag set of a command, printing its usage on errors.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(os.Stderr, "Usage: alarms_notification %s\n", c.usage)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// cliTimeLayouts are the layouts accepted by the date flags, in local time.
+var cliTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseCLITime parses a date flag. Dates without offset are interpreted in the
+// America/Guayaquil time zone, as in the messages sent to the users.
+func parseCLITime(value string) (time.Time, error) {
+	loc, err := time.LoadLocation("America/Guayaquil")
+	if err != nil {
+		loc = time.Local
+	}
+	for _, layout := range cliTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected one of %s", value, strings.Join(cliTimeLayouts, ", "))
+}
+
+// parseCLIRange parses the --from and --to flags. An empty --to means now.
+func parseCLIRange(from, to string) (time.Time, time.Time, error) {
+	if from == "" {
+		return time.Time{}, time.Time{}, errors.New("--from is required")
+	}
+	start, err := parseCLITime(from)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end := time.Now()
+	if to != "" {
+		end, err = parseCLITime(to)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, errors.New("--from must be before --to")
+	}
+	return start, end, nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func runCommand(args []string) error {
+	if err := newFlagSet("run").Parse(args); err != nil {
+		return err
+	}
+	runService()
+	return nil
+}
+
+func onceCommand(args []string) error {
+	if err := newFlagSet("once").Parse(args); err != nil {
+		return err
+	}
+	director := GetDirectorInstance()
+	director.BuildChain()
+	queryParams := map[string]string{"is_tracking_alarms": "true"}
+	result, err := director.ProcessRequest(queryParams)
+	alarms, ok := result.([]Alarm)
+	if err != nil && !ok {
+		return err
+	}
+	if err != nil {
+		// The devices that failed keep their checkpoint for the next cycle.
+		fmt.Fprintf(os.Stderr, "Error requesting the alarms of some devices: %v\n", err)
+	}
+	GetIncidentCorrelator().Flush()
+	GetNotificationThrottler().Flush()
+	fmt.Printf("Cycle completed, %d alarms notified\n", len(alarms))
+	if err := GetAlarmBatcher().Flush(); err != nil {
+		return err
+	}
+	return GetDeviceSync().Flush(context.Background())
+}
+
+func backfillCommand(args []string) error {
+	fs := newFlagSet("backfill")
+	imei := fs.String("imei", "", "IMEI of the device (default every tracked device)")
+	from := fs.String("from", "", "start of the period")
+	to := fs.String("to", "", "end of the period (default now)")
+	statePath := fs.String("state", "backfill.state.json", "file used to resume an interrupted backfill, empty to disable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	start, end, err := parseCLIRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	var devices []Device
+	if *imei != "" {
+		device, err := GetDeviceByImei(*imei)
+		if err != nil {
+			return err
+		}
+		devices = []Device{*device}
+	} else {
+		devices, err = (&DeviceController{}).getDevices(map[string]string{"is_tracking_alarms": "true"})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Without --to, a resumed backfill keeps the end it was started with.
+	resolvedTo := end.Unix()
+	if *to == "" {
+		resolvedTo = 0
+	}
+	state, err := LoadBackfillState(*statePath, start.Unix(), resolvedTo)
+	if err != nil {
+		return err
+	}
+	end = time.Unix(state.To, 0)
+	if len(state.Completed) > 0 {
+		fmt.Printf("Resuming the backfill of %d devices from %s until %s\n", len(state.Completed), *statePath, end.Format(time.RFC3339))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	job := NewBackfillJob(devices, start, end, state)
+	job.OnProgress = func(p BackfillProgress) {
+		status := fmt.Sprintf("%d alarms", p.Alarms)
+		if p.Err != nil {
+			status = "error: " + p.Err.Error()
+		}
+		fmt.Printf("%s window %d/%d %s - %s: %s\n", p.Imei, p.Completed, p.Total,
+			time.Unix(p.Window.Start, 0).Format(time.RFC3339), time.Unix(p.Window.End, 0).Format(time.RFC3339), status)
+	}
+
+	saved, err := job.Run(ctx)
+	fmt.Printf("%d alarms saved\n", saved)
+	if err != nil {
+		if *statePath != "" {
+			return fmt.Errorf("backfill interrupted, run the same command to resume it: %w", err)
+		}
+		return err
+	}
+	return state.Remove()
+}
+
+func devicesListCommand(args []string) error {
+	fs := newFlagSet("devices list")
+	all := fs.Bool("all", false, "include the devices that aren't tracking alarms")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	queryParams := map[string]string{}
+	if !*all {
+		queryParams["is_tracking_alarms"] = "true"
+	}
+
+	devices, err := (&DeviceController{}).getDevices(queryParams)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMEI\tPROVIDER\tUSER\tLICENSE NUMBER\tTRACKING\tLAST TRACKED")
+	for _, d := range devices {
+		licenseNumber := ""
+		if d.LicenseNumber != nil {
+			licenseNumber = *d.LicenseNumber
+		}
+		lastTracked := "-"
+		if d.LastTimeTracked != 0 {
+			lastTracked = time.Unix(d.LastTimeTracked, 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", d.Imei, d.Provider, d.UserName, licenseNumber, d.IsTrackingAlarms, lastTracked)
+	}
+	return w.Flush()
+}
+
+func alarmsFetchCommand(args []string) error {
+	fs := newFlagSet("alarms fetch")
+	imei := fs.String("imei", "", "IMEI of the device")
+	since := fs.Duration("since", 24*time.Hour, "fetch the alarms of this last period")
+	from := fs.String("from", "", "start of the period, overrides --since")
+	to := fs.String("to", "", "end of the period (default now)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *imei == "" {
+		return errors.New("--imei is required")
+	}
+
+	end := time.Now()
+	start := end.Add(-*since)
+	if *from != "" {
+		var err error
+		start, end, err = parseCLIRange(*from, *to)
+		if err != nil {
+			return err
+		}
+	}
+
+	device, err := GetDeviceByImei(*imei)
+	if err != nil {
+		return err
+	}
+	url := device.GenerateURLForRange(start.Unix(), end.Unix())
+	if url == "" {
+		return fmt.Errorf("device %s has an unknown provider %q", device.Imei, device.Provider)
+	}
+
+	result, err := (&RequestExecutor{}).Handle([]string{url})
+	if err != nil {
+		return err
+	}
+	alarms, _ := result.([]Alarm)
+	if alarms == nil {
+		alarms = []Alarm{}
+	}
+	return printJSON(alarms)
+}
+
+func alarmsExportCommand(args []string) error {
+	fs := newFlagSet("alarms export")
+	formatName := fs.String("format", "csv", "csv, geojson, kml or gpx")
+	imei := fs.String("imei", "", "IMEI of the device (default every device)")
+	from := fs.String("from", "", "start of the period")
+	to := fs.String("to", "", "end of the period (default now)")
+	codes := fs.String("code", "", "comma-separated alarm codes to export (default every code)")
+	output := fs.String("output", "", "file to write (default standard output)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	format, err := ParseExportFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	start, end, err := parseCLIRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	query := AlarmQuery{Imei: *imei, From: start, To: end}
+	if *codes != "" {
+		query.Codes = strings.Split(*codes, ",")
+	}
+	alarms, err := LoadAlarmsForExport(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return ExportAlarms(os.Stdout, format, alarms)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := ExportAlarms(file, format, alarms); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d alarms exported to %s\n", len(alarms), *output)
+	return nil
+}
+
+func notificationsListCommand(args []string) error {
+	fs := newFlagSet("notifications list")
+	imei := fs.String("imei", "", "IMEI of the device (default every device)")
+	since := fs.Duration("since", 24*time.Hour, "show the notifications of this last period")
+	from := fs.String("from", "", "start of the period, overrides --since")
+	to := fs.String("to", "", "end of the period (default now)")
+	code := fs.String("code", "", "alarm codes, comma-separated")
+	phone := fs.String("phone", "", "phone number of the recipient")
+	asJSON := fs.Bool("json", false, "print the entries as JSON, with their status transitions")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if alarmArchive == nil {
+		return errors.New("the archive is disabled or in use by the service, query GET /notifications instead")
+	}
+
+	end := time.Now()
+	start := end.Add(-*since)
+	if *from != "" {
+		var err error
+		start, end, err = parseCLIRange(*from, *to)
+		if err != nil {
+			return err
+		}
+	}
+	attempts, err := LedgerEntries(*imei, start, end, *code, *phone)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if attempts == nil {
+			attempts = []NotificationAttempt{}
+		}
+		return printJSON(attempts)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENT AT\tIMEI\tALARM\tUSER\tPHONE\tCHANNEL\tSTATUS\tUPDATED AT\tSID\tERROR")
+	for _, a := range attempts {
+		alarm := "-"
+		if a.AlarmCode != "" {
+			alarm = a.AlarmCode + " " + time.Unix(a.AlarmTime, 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.At.Format(time.RFC3339), a.Imei, alarm, a.User, a.Phone,
+			a.Channel, a.Status, a.UpdatedAt.Format(time.RFC3339), a.SID, formatLedgerError(a))
+	}
+	return w.Flush()
+}
+
+func digestSendCommand(args []string) error {
+	fs := newFlagSet("digest send")
+	fleet := fs.String("fleet", "", "fleet of the devices, the user of the devices in the backend")
+	frequency := fs.String("frequency", string(DigestDaily), "daily or weekly")
+	date := fs.String("date", "", "send the last complete period before this date (default now)")
+	email := fs.String("email", "", "recipients, comma-separated (default the subscriptions of the fleet)")
+	dryRun := fs.Bool("dry-run", false, "print the digest without sending it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fleet == "" {
+		return errors.New("--fleet is required")
+	}
+	at := time.Now()
+	if *date != "" {
+		var err error
+		if at, err = parseCLITime(*date); err != nil {
+			return err
+		}
+	}
+
+	subscription := DigestSubscription{Fleet: *fleet, Frequency: DigestFrequency(*frequency)}
+	if *email != "" {
+		subscription.Emails = strings.Split(*email, ",")
+	} else {
+		for _, s := range digestSubscriptions {
+			if s.Fleet == subscription.Fleet && s.Frequency == subscription.Frequency {
+				subscription = s
+			}
+		}
+	}
+	if !*dryRun {
+		if err := subscription.Validate(); err != nil {
+			return fmt.Errorf("%w, use --email to set the recipients", err)
+		}
+	}
+
+	devices, err := (&DeviceController{}).getDevices(map[string]string{})
+	if err != nil {
+		return err
+	}
+	from, to := DigestPeriod(subscription.Frequency, at)
+	digest, err := BuildDigest(context.Background(), devices, subscription.Fleet, subscription.Frequency, from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Print(digest.Text(orDefault(subscription.Language, LanguageSpanish)))
+	if *dryRun {
+		return nil
+	}
+	if err := sendDigestEmail(subscription, digest); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Digest sent to %s\n", strings.Join(subscription.Emails, ", "))
+	return nil
+}
+
+func notifyTestCommand(args []string) error {
+	fs := newFlagSet("notify test")
+	imei := fs.String("imei", "", "IMEI of the device")
+	dryRun := fs.Bool("dry-run", false, "print the message without sending it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *imei == "" {
+		return errors.New("--imei is required")
+	}
+
+	device, err := GetDeviceByImei(*imei)
+	if err != nil {
+		return err
+	}
+	alarm := Alarm{
+		Imei:      device.Imei,
+		Time:      time.Now().Unix(),
+		AlarmCode: "TEST",
+	}
+	message := NewMessageBuilder(device, &alarm).BuildMessage()
+	fmt.Println(message)
+	if *dryRun {
+		return nil
+	}
+
+	numbers, err := GetPhoneNumbersFromAPI(device.Imei)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sending to %d phone numbers: %s\n", len(numbers), strings.Join(numbers, ", "))
+	SendMessage(message, device.Imei)
+	return nil
+}
+
+func positionsGetCommand(args []string) error {
+	fs := newFlagSet("positions get")
+	imei := fs.String("imei", "", "IMEI of the device")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *imei == "" {
+		return errors.New("--imei is required")
+	}
+
+	device, err := GetDeviceByImei(*imei)
+	if err != nil {
+		return err
+	}
+	position, err := device.LastPosition()
+	if err != nil {
+		return err
+	}
+	if position == nil {
+		return fmt.Errorf("device %s has no position", device.Imei)
+	}
+	return printJSON(position)
+}
+
+func geocodeCommand(args []string) error {
+	fs := newFlagSet("geocode")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("expected LAT and LNG")
+	}
+	lat, lng := fs.Arg(0), fs.Arg(1)
+	for _, value := range []string{lat, lng} {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("invalid coordinate %q", value)
+		}
+	}
+
+	address := GetAddress(lat, lng)
+	if address == nil {
+		return errors.New("no address found")
+	}
+	fmt.Println(*address)
+	return nil
+}
+
+func tokenRefreshCommand(args []string) error {
+	if err := newFlagSet("token refresh").Parse(args); err != nil {
+		return err
+	}
+	token, err := authenticator.RefreshAccessToken()
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+)
+
+// DEFAULT_HTTP_TIMEOUT is the timeout of the default client of every API.
+const DEFAULT_HTTP_TIMEOUT = 10 * time.Second
+
+// Clients of the external APIs. initClients replaces them with the base URLs
+// and credentials of the environment; the tests replace them with local stubs.
+var (
+	roadSafetyClient = newRoadSafetyClient(roadsafety.DEFAULT_URL, "")
+	iopgpsClient     = NewIOPGPSClient(IOPGPS_API_URL, nil, nil)
+	whatsgpsClient   = NewWhatsGPSClient(WHATSGPS_API_URL, "", nil)
+	geocoderClient   = NewGeocoderClient(GEOAPIFY_API_URL, "", nil)
+)
+
+// initClients configures the API clients from the environment. The base URLs
+// can point to staging backends or local stubs.
+func initClients() {
+	httpClient := newHTTPClient()
+	roadSafetyClient = newRoadSafetyClient(getEnv("ROAD_SAFETY_API_URL", roadsafety.DEFAULT_URL), os.Getenv("API_KEY"))
+	iopgpsClient = NewIOPGPSClient(getEnv("IOPGPS_API_URL", IOPGPS_API_URL), authenticator, httpClient)
+	whatsgpsClient = NewWhatsGPSClient(getEnv("WHATSGPS_API_URL", WHATSGPS_API_URL), os.Getenv("WHATSGPS_API_KEY"), httpClient)
+	geocoderClient = NewGeocoderClient(getEnv("GEOAPIFY_API_URL", GEOAPIFY_API_URL), os.Getenv("GEOAPIFY_KEY"), httpClient)
+}
+
+// newRoadSafetyClient returns a backend client whose requests go through
+// roadSafetyBreaker.
+func newRoadSafetyClient(baseURL, apiKey string) *roadsafety.Client {
+	httpClient := &http.Client{
+		Timeout:   DEFAULT_HTTP_TIMEOUT,
+		Transport: roadSafetyBreaker.Transport(nil),
+	}
+	return roadsafety.NewClient(baseURL, apiKey, httpClient)
+}
+
+// newHTTPClient returns the client used when none is injected.
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: DEFAULT_HTTP_TIMEOUT}
+}
+
+// joinURL appends path to base, with a single slash between them.
+func joinURL(base, path string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
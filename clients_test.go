@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+	"github.com/indrod-group/get_device_alarms/roadsafety/roadsafetytest"
+)
+
+// useRoadSafetyServer points roadSafetyClient to a fake backend until the
+// end of the test.
+func useRoadSafetyServer(t *testing.T) *roadsafetytest.Server {
+	t.Helper()
+	server := roadsafetytest.NewServer("test-key")
+	previous := roadSafetyClient
+	roadSafetyClient = server.Client()
+	t.Cleanup(func() {
+		roadSafetyClient = previous
+		server.Close()
+	})
+	return server
+}
+
+// useTestGeocoder replaces the geocoder with a stub that resolves every
+// coordinate to "Guayaquil, Ecuador".
+func useTestGeocoder(t *testing.T) {
+	t.Helper()
+	geocoder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"type":"FeatureCollection","features":[{"properties":{"formatted":"Guayaquil, Ecuador"}}]}`))
+	}))
+	previous := geocoderClient
+	geocoderClient = NewGeocoderClient(geocoder.URL, "key", geocoder.Client())
+	t.Cleanup(func() {
+		geocoderClient = previous
+		geocoder.Close()
+	})
+}
+
+// staticToken is an auth.Authenticate returning a fixed token.
+type staticToken string
+
+func (s staticToken) GetAccessToken() (string, error)     { return string(s), nil }
+func (s staticToken) RefreshAccessToken() (string, error) { return string(s), nil }
+func (s staticToken) InitiateTokenRenewal()               {}
+func (s staticToken) Stop()                               {}
+
+func TestGetDeviceByImei(t *testing.T) {
+	server := useRoadSafetyServer(t)
+	server.AddDevice(roadsafety.Device{Imei: "123456789012345", Provider: WhatsGPS})
+
+	device, err := GetDeviceByImei("123456789 012345")
+	if err != nil {
+		t.Fatalf("GetDeviceByImei failed: %v", err)
+	}
+	if device.Imei != "123456789012345" || device.Provider != WhatsGPS {
+		t.Errorf("unexpected device %+v", device)
+	}
+}
+
+func TestIOPGPSClientFetchAlarms(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/device/alarm" || r.URL.Query().Get("imei") != "123" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if token := r.Header.Get("AccessToken"); token != "token" {
+			t.Errorf("unexpected access token %q", token)
+		}
+		w.Write([]byte(`{"code":0,"details":[{"imei":"123","time":1700000000,"alarmCode":"SOS","alarmType":99}]}`))
+	}))
+	defer server.Close()
+
+	client := NewIOPGPSClient(server.URL+"/api/", staticToken("token"), server.Client())
+	url := client.AlarmsURL("123", 1699990000, 1700000000)
+	if !client.Owns(url) {
+		t.Fatalf("expected the client to own %s", url)
+	}
+
+	alarms, err := client.FetchAlarms(url)
+	if err != nil {
+		t.Fatalf("FetchAlarms failed: %v", err)
+	}
+	if len(alarms) != 1 || alarms[0].AlarmCode != "SOS" || alarms[0].Imei != "123" {
+		t.Errorf("unexpected alarms %+v", alarms)
+	}
+}
+
+func TestWhatsGPSClientFetchAlarms(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "key" || r.URL.Query().Get("carId") != "42" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"ret":1,"total":1,"data":[{"alarmTime":"2023-11-01 10:00:00","alarmType":4,"carId":42,"lat":-2.1,"lon":-79.9,"speed":30}]}`))
+	}))
+	defer server.Close()
+
+	client := NewWhatsGPSClient(server.URL, "key", server.Client())
+	alarms, err := client.FetchAlarms(client.AlarmsURL("42", time.Now().Add(-time.Hour).Unix(), time.Now().Unix()))
+	if err != nil {
+		t.Fatalf("FetchAlarms failed: %v", err)
+	}
+	if len(alarms) != 1 || alarms[0].AlarmCode != "SOS" || alarms[0].Imei != "42" {
+		t.Errorf("unexpected alarms %+v", alarms)
+	}
+}
+
+func TestIOPGPSClientLastPosition(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/device/location" || r.URL.Query().Get("imei") != "123" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"code":0,"data":[{"imei":"123","lat":"-2.17","lng":"-79.92","gpsTime":1700000000,"heartTime":1700003600,"speed":0}]}`))
+	}))
+	defer server.Close()
+
+	client := NewIOPGPSClient(server.URL+"/api/", staticToken("token"), server.Client())
+	position, err := client.LastPosition("123")
+	if err != nil {
+		t.Fatalf("LastPosition failed: %v", err)
+	}
+	if position == nil || position.Time != 1700003600 || *position.Lat != "-2.17" {
+		t.Errorf("unexpected position %+v", position)
+	}
+}
+
+func TestWhatsGPSClientLastPosition(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/carStatus/getByCarId.do" || r.URL.Query().Get("carId") != "42" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"ret":1,"data":{"carId":42,"lat":-2.1,"lon":-79.9,"pointTime":"2023-11-01 10:00:00","heartTime":null,"speed":30}}`))
+	}))
+	defer server.Close()
+
+	client := NewWhatsGPSClient(server.URL, "key", server.Client())
+	position, err := client.LastPosition("42")
+	if err != nil {
+		t.Fatalf("LastPosition failed: %v", err)
+	}
+	if position == nil || position.Imei != "42" || position.Time != 1698832800 || *position.Lng != "-79.9000000" {
+		t.Errorf("unexpected position %+v", position)
+	}
+}
+
+func TestGeocoderClientReverseGeocode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/v1/geocode/reverse" || query.Get("lat") != "-2.17" || query.Get("lon") != "-79.92" || query.Get("apiKey") != "key" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`{"type":"FeatureCollection","features":[{"properties":{"formatted":"Guayaquil, Ecuador"}}]}`))
+	}))
+	defer server.Close()
+
+	client := NewGeocoderClient(server.URL+"/v1/", "key", server.Client())
+	address, err := client.ReverseGeocode("-2.17", "-79.92")
+	if err != nil {
+		t.Fatalf("ReverseGeocode failed: %v", err)
+	}
+	if address == nil || *address != "Guayaquil, Ecuador" {
+		t.Errorf("unexpected address %v", address)
+	}
+}
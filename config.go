@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -51,3 +53,51 @@ func initLog() {
 		// logrus.AddHook(...)
 	}
 }
+
+// getEnvInt returns the integer value of the environment variable key, or
+// fallback if it isn't set or isn't a valid integer.
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvDuration returns the duration value (e.g. "90s", "1h") of the environment
+// variable key, or fallback if it isn't set or isn't a valid duration.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnv returns the value of the environment variable key, or fallback if it is empty.
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseDurations parses KEY=DURATION pairs separated by commas, e.g.
+// "LOWVOT=1h,REMOVE=15m". Invalid pairs are ignored with a warning that names
+// the setting.
+func parseDurations(value, setting string) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, text, _ := strings.Cut(pair, "=")
+		duration, err := time.ParseDuration(strings.TrimSpace(text))
+		if err != nil || strings.TrimSpace(key) == "" {
+			logrus.WithField("pair", pair).Warning("Ignoring invalid " + setting)
+			continue
+		}
+		durations[strings.TrimSpace(key)] = duration
+	}
+	return durations
+}
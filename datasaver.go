@@ -2,16 +2,19 @@ package main
 
 import (
 	"fmt"
-	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
+// DataSaver records the alarms in the local archive, saves them in the backend
+// through an AlarmBatcher, publishes them on the eventBus and passes them to
+// the next handler without waiting for the batches.
 type DataSaver struct {
 	next Handler
-}
 
-const MAX_ALARMS_TO_REGISTER = 25
+	// batcher is the AlarmBatcher used, GetAlarmBatcher() if nil.
+	batcher *AlarmBatcher
+}
 
 func (ds *DataSaver) Handle(data interface{}) (interface{}, error) {
 	alarms, ok := data.([]Alarm)
@@ -19,30 +22,13 @@ func (ds *DataSaver) Handle(data interface{}) (interface{}, error) {
 		return nil, fmt.Errorf("DataSaver.Handle: expected []AlarmData, got %T", data)
 	}
 
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, MAX_ALARMS_TO_REGISTER)
-
-	for _, alarm := range alarms {
-		wg.Add(1)
-		go func(alarm Alarm) {
-			defer wg.Done()
-
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			err := alarm.CreateAlarm()
-			if err != nil {
-				// Log the alarm information
-				logrus.WithFields(logrus.Fields{
-					"error": err,
-					"alarm": alarm,
-				}).Warning("Error saving the alarm")
-				return
-			}
-		}(alarm)
+	if alarmArchive != nil {
+		if err := alarmArchive.RecordAlarms(alarms); err != nil {
+			logrus.WithError(err).Warning("Error archiving the alarms")
+		}
 	}
-
-	wg.Wait()
+	ds.Batcher().Add(alarms)
+	eventBus.Publish(alarms)
 
 	if ds.next != nil {
 		return ds.next.Handle(alarms)
@@ -50,6 +36,14 @@ func (ds *DataSaver) Handle(data interface{}) (interface{}, error) {
 	return alarms, nil
 }
 
+// Batcher returns the AlarmBatcher used to save the alarms.
+func (ds *DataSaver) Batcher() *AlarmBatcher {
+	if ds.batcher == nil {
+		return GetAlarmBatcher()
+	}
+	return ds.batcher
+}
+
 func (ds *DataSaver) SetNext(next Handler) {
 	ds.next = next
 }
@@ -1,46 +1,30 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
-	"os"
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
 )
 
-// Device represents a device with various properties.
-type Device struct {
-	Imei             string   `json:"imei"`
-	UserName         string   `json:"user_name"`
-	CarOwner         *string  `json:"car_owner"`
-	LicenseNumber    *string  `json:"license_number"`
-	Vin              *string  `json:"vin"`
-	IsTrackingAlarms bool     `json:"is_tracking_alarms"`
-	LastTimeTracked  int64    `json:"last_time_tracked"`
-	Provider         Provider `json:"provider"`
-}
+// Device is the device of the backend, extended with the methods of the service.
+type Device roadsafety.Device
 
-type Provider string
+type Provider = roadsafety.Provider
 
 const (
-	WanWayTech Provider = "WanWayTech"
-	WhatsGPS   Provider = "WhatsGPS"
+	WanWayTech = roadsafety.WanWayTech
+	WhatsGPS   = roadsafety.WhatsGPS
 )
 
-// DEVICE_ALARM_URL is used for IOPGPS
-const DEVICE_ALARM_URL = "https://open.iopgps.com/api/device/alarm?imei=%s&startTime=%d&endTime=%d"
-
-// WHATSGPS_API_URL is used for WhatsGPS
-const WHATSGPS_API_URL = "https://www.whatsgps.com/alarmSta/queryDetail.do"
-
 const TWENTY_FOUR_HOURS_IN_SECONDS = 86400
-const DEVICES_API_URL = "https://api.road-safety-ec.com/api/v1/devices/"
 
+// GenerateURL returns the alarms URL for the period since the device was last
+// tracked and moves LastTimeTracked to the current time.
 func (d *Device) GenerateURL() string {
 	endTime := time.Now().Unix()
 	var startTime int64
@@ -51,56 +35,41 @@ func (d *Device) GenerateURL() string {
 	}
 	d.LastTimeTracked = endTime
 
+	return d.GenerateURLForRange(startTime, endTime)
+}
+
+// GenerateURLForRange returns the alarms URL of the device provider for the
+// given unix time range. It doesn't modify LastTimeTracked.
+func (d *Device) GenerateURLForRange(startTime, endTime int64) string {
 	switch d.Provider {
 	case WanWayTech:
-		return fmt.Sprintf(DEVICE_ALARM_URL, d.Imei, startTime, endTime)
+		return iopgpsClient.AlarmsURL(d.Imei, startTime, endTime)
 	case WhatsGPS:
-		token := os.Getenv("WHATSGPS_API_KEY")
-		startTimeString := time.Unix(startTime, 0).Format("2006-01-02 15:04:05")
-		endTimeString := time.Unix(endTime, 0).Format("2006-01-02 15:04:05")
-
-		u, _ := url.Parse(WHATSGPS_API_URL)
-		q := u.Query()
-		q.Add("token", token)
-		q.Add("carId", d.Imei)
-		q.Add("startTime", startTimeString)
-		q.Add("endTime", endTimeString)
-		u.RawQuery = q.Encode()
-
-		return u.String()
+		return whatsgpsClient.AlarmsURL(d.Imei, startTime, endTime)
 	default:
 		fmt.Println("Unknown provider")
 	}
 	return ""
 }
 
-func (d *Device) UpdateDevice() error {
-	var apiKey = os.Getenv("API_KEY")
-
-	jsonDevice, err := json.Marshal(d)
-	if err != nil {
-		return err
-	}
-
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", DEVICES_API_URL, bytes.NewBuffer(jsonDevice))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", apiKey))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+// LastPosition requests the last position of the device to its provider. It
+// returns nil if the device never reported one.
+func (d *Device) LastPosition() (*Position, error) {
+	switch d.Provider {
+	case WanWayTech:
+		return iopgpsClient.LastPosition(d.Imei)
+	case WhatsGPS:
+		return whatsgpsClient.LastPosition(d.Imei)
 	}
-	defer resp.Body.Close()
+	return nil, fmt.Errorf("unknown provider %q of device %s", d.Provider, d.Imei)
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to update device: %v", resp.Status)
+// UpdateDevice sends the new LastTimeTracked of the device to the backend.
+func (d *Device) UpdateDevice() error {
+	update := roadsafety.DeviceUpdate{LastTimeTracked: &d.LastTimeTracked}
+	if _, err := roadSafetyClient.UpdateDevice(context.Background(), d.Imei, update); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
 	}
-
 	return nil
 }
 
@@ -117,40 +86,17 @@ func CleanAndValidateIMEI(imei string) (string, error) {
 	return cleanIMEI, nil
 }
 
-const DEVICE_INFO_URL = "https://api.road-safety-ec.com/api/v1/devices/%s/"
-
+// GetDeviceByImei returns the device with the given IMEI from the backend.
 func GetDeviceByImei(imei string) (*Device, error) {
-	var apiKey = os.Getenv("API_KEY")
-
 	cleanIMEI, err := CleanAndValidateIMEI(imei)
 	if err != nil {
 		return nil, fmt.Errorf("failed to clean and validate IMEI: %w", err)
 	}
 
-	client := &http.Client{}
-	url := fmt.Sprintf(DEVICE_INFO_URL, cleanIMEI)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new request: %w", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", apiKey))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to do request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("received non-200 response status: %d", resp.StatusCode)
-	}
-
-	var device Device
-	err = json.NewDecoder(resp.Body).Decode(&device)
+	device, err := roadSafetyClient.GetDevice(context.Background(), cleanIMEI)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode response body: %w", err)
+		return nil, fmt.Errorf("failed to get device: %w", err)
 	}
 
-	return &device, nil
+	return (*Device)(device), nil
 }
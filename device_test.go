@@ -1,14 +1,15 @@
 package main
 
 import (
+	"net/http"
 	"testing"
 
-	"github.com/jarcoal/httpmock"
+	"github.com/indrod-group/get_device_alarms/roadsafety"
 )
 
 func TestUpdateDevice(t *testing.T) {
-	httpmock.Activate()
-	defer httpmock.DeactivateAndReset()
+	server := useRoadSafetyServer(t)
+	server.AddDevice(roadsafety.Device{Imei: "123456789012345", UserName: "test_user", IsTrackingAlarms: true})
 
 	device := &Device{
 		Imei:             "123456789012345",
@@ -17,25 +18,19 @@ func TestUpdateDevice(t *testing.T) {
 		LicenseNumber:    nil,
 		Vin:              nil,
 		IsTrackingAlarms: false,
-		LastTimeTracked:  0,
+		LastTimeTracked:  1700000000,
 	}
 
-	httpmock.RegisterResponder(
-		"POST",
-		DEVICES_API_URL,
-		httpmock.NewStringResponder(201, `{"success": true}`),
-	)
-
 	err := device.UpdateDevice()
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
+	saved, _ := server.Device(device.Imei)
+	if saved.LastTimeTracked != device.LastTimeTracked || !saved.IsTrackingAlarms {
+		t.Errorf("expected only last_time_tracked to be updated, got %+v", saved)
+	}
 
-	httpmock.RegisterResponder(
-		"POST",
-		DEVICES_API_URL,
-		httpmock.NewStringResponder(500, `{"success": false}`),
-	)
+	server.Fail(http.StatusInternalServerError, 1)
 
 	err = device.UpdateDevice()
 	if err == nil {
@@ -52,6 +47,7 @@ func TestGenerateURL(t *testing.T) {
 		Vin:              nil,
 		IsTrackingAlarms: false,
 		LastTimeTracked:  0,
+		Provider:         WanWayTech,
 	}
 
 	url := device.GenerateURL()
@@ -2,12 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"net/http"
-	"net/url"
-	"os"
-	"time"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,64 +14,34 @@ type DeviceController struct {
 }
 
 func (dc *DeviceController) getDevices(queryParams map[string]string) ([]Device, error) {
-	var apiKey = os.Getenv("API_KEY")
-
-	// Create a new URL and set the raw query to the encoded query parameters
-	u, _ := url.Parse(DEVICES_API_URL)
-	q := u.Query()
-	for key, value := range queryParams {
-		q.Set(key, value)
-	}
-	u.RawQuery = q.Encode()
-
-	req, err := http.NewRequest("GET", u.String(), nil)
+	backendDevices, err := roadSafetyClient.AllDevices(context.Background(), queryParams)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
-			"error": err,
-			"url":   u.String(),
-		}).Error("Error creating HTTP request")
+			"error":  err,
+			"params": queryParams,
+		}).Error("Error getting the devices")
 		return nil, err
 	}
-	req.Header.Add("Authorization", "Token "+apiKey)
-
-	// Create a context with a timeout of 10 seconds
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Add the context to the request
-	req = req.WithContext(ctx)
 
-	// Create a new HTTP client and execute the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-			"url":   u.String(),
-		}).Error("Error executing HTTP request")
-		return nil, err
+	devices := make([]Device, len(backendDevices))
+	for i, device := range backendDevices {
+		devices[i] = Device(device)
+		knownDevices.Store(device.Imei, devices[i])
 	}
-	defer resp.Body.Close()
+	return devices, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		logrus.WithFields(logrus.Fields{
-			"status_code": resp.StatusCode,
-			"url":         u.String(),
-		}).Error("Received non-200 response status")
-		return nil, errors.New("received non-200 response status")
-	}
+// knownDevices holds the last version obtained from the backend of each
+// device, by IMEI, to find the device of an alarm without requesting it.
+var knownDevices sync.Map
 
-	var devices []Device
-	err = json.NewDecoder(resp.Body).Decode(&devices)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-			"url":   u.String(),
-		}).Error("Error decoding response body")
-		return nil, err
+// knownDevice returns the last version obtained of the device with the IMEI.
+func knownDevice(imei string) (Device, bool) {
+	device, ok := knownDevices.Load(imei)
+	if !ok {
+		return Device{}, false
 	}
-
-	return devices, nil
+	return device.(Device), true
 }
 
 func (dc *DeviceController) Handle(data interface{}) (interface{}, error) {
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+	"github.com/sirupsen/logrus"
+)
+
+// DEFAULT_DEVICE_SYNC_INTERVAL is how often the changed checkpoints are sent
+// to the backend, configurable with the DEVICE_SYNC_INTERVAL environment variable.
+const DEFAULT_DEVICE_SYNC_INTERVAL = 30 * time.Second
+
+var (
+	// deviceSyncMetrics publishes the counters of the checkpoint updates.
+	deviceSyncMetrics = expvar.NewMap("device_sync")
+	// deviceSyncPending is the number of devices whose checkpoint wasn't sent yet.
+	deviceSyncPending = new(expvar.Int)
+)
+
+func init() {
+	deviceSyncMetrics.Set("pending", deviceSyncPending)
+}
+
+// DeviceSync sends the checkpoints (LastTimeTracked) of the devices to the
+// backend. Only the devices whose checkpoint moved since the last update are
+// sent, with a PATCH of that single field so the changes made in the backend
+// to the other fields are kept. Several moves of the same device between two
+// flushes are sent as a single update, and failed updates are retried in the
+// next flush.
+type DeviceSync struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	synced map[string]int64 // synced is the checkpoint the backend has of each device.
+	dirty  map[string]int64 // dirty is the checkpoint to send of each changed device.
+
+	// flushMu serializes the flushes so an older checkpoint never overwrites a newer one.
+	flushMu sync.Mutex
+}
+
+var deviceSyncInstance *DeviceSync
+var deviceSyncOnce sync.Once
+
+// GetDeviceSync returns the DeviceSync shared by the RequestGenerators,
+// configured from the environment on the first call.
+func GetDeviceSync() *DeviceSync {
+	deviceSyncOnce.Do(func() {
+		deviceSyncInstance = NewDeviceSync(getEnvDuration("DEVICE_SYNC_INTERVAL", DEFAULT_DEVICE_SYNC_INTERVAL))
+	})
+	return deviceSyncInstance
+}
+
+// NewDeviceSync creates a DeviceSync flushing every interval when running.
+func NewDeviceSync(interval time.Duration) *DeviceSync {
+	if interval <= 0 {
+		interval = DEFAULT_DEVICE_SYNC_INTERVAL
+	}
+	return &DeviceSync{
+		interval: interval,
+		synced:   map[string]int64{},
+		dirty:    map[string]int64{},
+	}
+}
+
+// Record registers the new checkpoint of a device. previous is the checkpoint
+// it had when it was read from the backend, used the first time the device is
+// seen. Checkpoints that don't move forward are ignored.
+func (s *DeviceSync) Record(imei string, previous, current int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	synced, ok := s.synced[imei]
+	if !ok {
+		synced = previous
+		s.synced[imei] = previous
+	}
+	if current <= synced || current <= s.dirty[imei] {
+		return
+	}
+	s.dirty[imei] = current
+	deviceSyncPending.Set(int64(len(s.dirty)))
+
+	if alarmArchive != nil {
+		if err := alarmArchive.RecordCheckpoint(imei, current); err != nil {
+			logrus.WithError(err).Warning("Error archiving the checkpoint")
+		}
+	}
+}
+
+// Pending returns the number of devices whose checkpoint wasn't sent yet.
+func (s *DeviceSync) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dirty)
+}
+
+// Flush sends the changed checkpoints, with up to MAX_DEVICES_FOR_UPDATE
+// requests in flight. It returns the errors of the updates that failed,
+// which stay pending for the next flush.
+func (s *DeviceSync) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	updates := s.dirty
+	s.dirty = map[string]int64{}
+	s.mu.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, MAX_DEVICES_FOR_UPDATE)
+	for imei, checkpoint := range updates {
+		wg.Add(1)
+		go func(imei string, checkpoint int64) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := s.update(ctx, imei, checkpoint)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("device %s: %w", imei, err))
+				mu.Unlock()
+			}
+		}(imei, checkpoint)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	deviceSyncPending.Set(int64(len(s.dirty)))
+	s.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// update sends a checkpoint and records the result. A failed checkpoint is
+// kept as pending unless the device no longer exists in the backend.
+func (s *DeviceSync) update(ctx context.Context, imei string, checkpoint int64) error {
+	update := roadsafety.DeviceUpdate{LastTimeTracked: &checkpoint}
+	_, err := roadSafetyClient.UpdateDevice(ctx, imei, update)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil:
+		deviceSyncMetrics.Add("updated", 1)
+		s.synced[imei] = max(s.synced[imei], checkpoint)
+	case roadsafety.IsNotFound(err):
+		deviceSyncMetrics.Add("failed", 1)
+		delete(s.synced, imei)
+	default:
+		deviceSyncMetrics.Add("failed", 1)
+		if checkpoint > s.dirty[imei] {
+			s.dirty[imei] = checkpoint
+		}
+	}
+	return err
+}
+
+// Run flushes every interval until ctx is done, and once more before returning.
+func (s *DeviceSync) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(context.Background()); err != nil {
+				logrus.WithError(err).Warning("Device checkpoints lost on shutdown")
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				logrus.WithError(err).Warning("Error updating the device checkpoints")
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+)
+
+func TestDeviceSync(t *testing.T) {
+	server := useRoadSafetyServer(t)
+	server.AddDevice(roadsafety.Device{Imei: "1", LastTimeTracked: 100})
+	server.AddDevice(roadsafety.Device{Imei: "2", LastTimeTracked: 100})
+	ctx := context.Background()
+	deviceSync := NewDeviceSync(time.Hour)
+
+	// Unchanged checkpoints aren't sent, several moves are sent once.
+	deviceSync.Record("1", 100, 100)
+	deviceSync.Record("2", 100, 200)
+	deviceSync.Record("2", 100, 300)
+	if pending := deviceSync.Pending(); pending != 1 {
+		t.Fatalf("expected 1 pending device, got %d", pending)
+	}
+
+	// The fields edited in the backend in the meantime are kept.
+	owner := "Ana"
+	server.AddDevice(roadsafety.Device{Imei: "2", CarOwner: &owner, LastTimeTracked: 100})
+	if err := deviceSync.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	device, _ := server.Device("2")
+	if device.LastTimeTracked != 300 || device.CarOwner == nil || *device.CarOwner != owner {
+		t.Errorf("unexpected device %+v", device)
+	}
+	if requests := server.Requests(); len(requests) != 1 || requests[0].Method != "PATCH" {
+		t.Errorf("expected a single PATCH, got %+v", requests)
+	}
+
+	// A failed update is returned and retried in the next flush.
+	deviceSync.Record("2", 100, 400)
+	server.Fail(http.StatusBadGateway, 1)
+	if err := deviceSync.Flush(ctx); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	if pending := deviceSync.Pending(); pending != 1 {
+		t.Fatalf("expected the checkpoint to stay pending, got %d", pending)
+	}
+	if err := deviceSync.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if device, _ := server.Device("2"); device.LastTimeTracked != 400 {
+		t.Errorf("expected the checkpoint to be retried, got %d", device.LastTimeTracked)
+	}
+
+	// A device removed from the backend is dropped.
+	deviceSync.Record("3", 0, 100)
+	if err := deviceSync.Flush(ctx); !roadsafety.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if pending := deviceSync.Pending(); pending != 0 {
+		t.Errorf("expected the removed device to be dropped, got %d pending", pending)
+	}
+}
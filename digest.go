@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_DIGESTS_PATH is the file of the digest subscriptions,
+	// configurable with the DIGESTS_PATH environment variable.
+	DEFAULT_DIGESTS_PATH = "digests.json"
+	// DEFAULT_DIGEST_STATE_PATH is the file of the last period sent of each
+	// subscription, configurable with DIGEST_STATE_PATH.
+	DEFAULT_DIGEST_STATE_PATH = "digests.state.json"
+	// DEFAULT_DIGEST_HOUR is the local hour at which the digests of the
+	// previous period are sent, configurable with DIGEST_HOUR.
+	DEFAULT_DIGEST_HOUR = 7
+	// DEFAULT_SMTP_PORT is the port of SMTP_HOST, configurable with SMTP_PORT.
+	DEFAULT_SMTP_PORT = "587"
+	// DIGEST_RETRY_DELAY is the time to wait after a digest fails to be sent.
+	DIGEST_RETRY_DELAY = 15 * time.Minute
+)
+
+// digestMetrics publishes the counters of the digests sent and failed.
+var digestMetrics = expvar.NewMap("digests")
+
+// DigestFrequency is how often a digest is sent.
+type DigestFrequency string
+
+const (
+	// DigestDaily digests cover the previous day.
+	DigestDaily DigestFrequency = "daily"
+	// DigestWeekly digests cover the previous week, from Monday.
+	DigestWeekly DigestFrequency = "weekly"
+)
+
+// DigestSubscription sends to Emails the digest of the devices of a fleet,
+// the user of the devices in the backend.
+type DigestSubscription struct {
+	Fleet     string          `json:"fleet"`
+	Emails    []string        `json:"emails"`
+	Frequency DigestFrequency `json:"frequency"`
+	Language  string          `json:"language,omitempty"`
+}
+
+// Validate checks the fleet, the emails, the frequency and the language.
+func (s DigestSubscription) Validate() error {
+	if s.Fleet == "" {
+		return errors.New("the fleet is required")
+	}
+	if len(s.Emails) == 0 {
+		return errors.New("at least one email is required")
+	}
+	for _, email := range s.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return fmt.Errorf("invalid email %q: %w", email, err)
+		}
+	}
+	if s.Frequency != DigestDaily && s.Frequency != DigestWeekly {
+		return fmt.Errorf("unknown frequency %q", s.Frequency)
+	}
+	if s.Language != "" && s.Language != LanguageSpanish && s.Language != LanguageEnglish {
+		return fmt.Errorf("unknown language %q", s.Language)
+	}
+	return nil
+}
+
+// key identifies the subscription in the state file.
+func (s DigestSubscription) key() string {
+	return s.Fleet + "/" + string(s.Frequency)
+}
+
+// digestSubscriptions holds the configured subscriptions.
+var digestSubscriptions []DigestSubscription
+
+// initDigests loads the subscriptions of the file configured in the
+// environment. No digest is sent if it can't be read.
+func initDigests() {
+	path := getEnv("DIGESTS_PATH", DEFAULT_DIGESTS_PATH)
+	subscriptions, err := LoadDigestSubscriptions(path)
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Warning("The digests are disabled")
+		return
+	}
+	digestSubscriptions = subscriptions
+}
+
+// LoadDigestSubscriptions reads the subscriptions of a file, which doesn't
+// need to exist.
+func LoadDigestSubscriptions(path string) ([]DigestSubscription, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []DigestSubscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("invalid digests file %s: %w", path, err)
+	}
+	for i, s := range subscriptions {
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid digest subscription %d: %w", i, err)
+		}
+	}
+	return subscriptions, nil
+}
+
+// digestLocation returns the time zone of the periods of the digests.
+func digestLocation() *time.Location {
+	loc, err := time.LoadLocation("America/Guayaquil")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// DigestPeriod returns the last complete period of the frequency before t, in
+// the America/Guayaquil time zone: the previous day, or the previous week
+// from Monday to Monday.
+func DigestPeriod(frequency DigestFrequency, t time.Time) (from, to time.Time) {
+	local := t.In(digestLocation())
+	to = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	if frequency == DigestWeekly {
+		to = to.AddDate(0, 0, -(int(to.Weekday())+6)%7)
+		return to.AddDate(0, 0, -7), to
+	}
+	return to.AddDate(0, 0, -1), to
+}
+
+// DeviceDigest is the summary of the alarms of a device.
+type DeviceDigest struct {
+	Imei          string         `json:"imei"`
+	LicenseNumber string         `json:"license_number"`
+	Counts        map[string]int `json:"counts"`
+	Total         int            `json:"total"`
+	LastAlarm     int64          `json:"last_alarm,omitempty"`
+}
+
+// Digest is the summary of the alarms of the devices of a fleet over
+// [From, To).
+type Digest struct {
+	Fleet     string          `json:"fleet"`
+	Frequency DigestFrequency `json:"frequency"`
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	Devices   []DeviceDigest  `json:"devices"`
+	Totals    map[string]int  `json:"totals"`
+	Total     int             `json:"total"`
+}
+
+// BuildDigest aggregates, by device and code, the stored alarms of the
+// devices of the fleet over [from, to). The devices are sorted by number of
+// alarms; the devices not tracking alarms are left out unless they have any.
+func BuildDigest(ctx context.Context, devices []Device, fleet string, frequency DigestFrequency, from, to time.Time) (*Digest, error) {
+	digest := &Digest{Fleet: fleet, Frequency: frequency, From: from, To: to, Totals: map[string]int{}}
+	for _, device := range devices {
+		if device.UserName != fleet {
+			continue
+		}
+		alarms, err := LoadAlarmsForExport(ctx, AlarmQuery{Imei: device.Imei, From: from, To: to})
+		if err != nil {
+			return nil, fmt.Errorf("error loading the alarms of %s: %w", device.Imei, err)
+		}
+		if len(alarms) == 0 && !device.IsTrackingAlarms {
+			continue
+		}
+		summary := DeviceDigest{Imei: device.Imei, Counts: map[string]int{}, Total: len(alarms)}
+		if device.LicenseNumber != nil {
+			summary.LicenseNumber = *device.LicenseNumber
+		}
+		for _, alarm := range alarms {
+			summary.Counts[alarm.AlarmCode]++
+			digest.Totals[alarm.AlarmCode]++
+			summary.LastAlarm = max(summary.LastAlarm, alarm.Time)
+		}
+		digest.Total += summary.Total
+		digest.Devices = append(digest.Devices, summary)
+	}
+	sort.SliceStable(digest.Devices, func(i, j int) bool {
+		if digest.Devices[i].Total != digest.Devices[j].Total {
+			return digest.Devices[i].Total > digest.Devices[j].Total
+		}
+		return digest.Devices[i].Imei < digest.Devices[j].Imei
+	})
+	return digest, nil
+}
+
+// Title returns the title of the digest in the language.
+func (d *Digest) Title(language string) string {
+	if d.Frequency == DigestWeekly {
+		return translate(language, "Resumen semanal de alarmas")
+	}
+	return translate(language, "Resumen diario de alarmas")
+}
+
+// Period returns the period of the digest in local time. The last day of the
+// period is inclusive.
+func (d *Digest) Period() string {
+	from, to := d.From.In(digestLocation()), d.To.In(digestLocation()).AddDate(0, 0, -1)
+	if d.Frequency == DigestDaily {
+		return from.Format("2006-01-02")
+	}
+	return from.Format("2006-01-02") + " - " + to.Format("2006-01-02")
+}
+
+// digestTime formats the time of an alarm of a digest in local time.
+func digestTime(unixTime int64) string {
+	if unixTime == 0 {
+		return "-"
+	}
+	return time.Unix(unixTime, 0).In(digestLocation()).Format("2006-01-02 15:04")
+}
+
+// digestDeviceName returns the plate of the device, or its IMEI.
+func digestDeviceName(device DeviceDigest) string {
+	if device.LicenseNumber == "" {
+		return device.Imei
+	}
+	return device.LicenseNumber + " (" + device.Imei + ")"
+}
+
+// Text renders the digest as plain text.
+func (d *Digest) Text(language string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", d.Title(language))
+	fmt.Fprintf(&b, "%s: %s\n", translate(language, "Flota"), d.Fleet)
+	fmt.Fprintf(&b, "%s: %s\n", translate(language, "Periodo"), d.Period())
+	fmt.Fprintf(&b, "%s: %d\n", translate(language, "Total de alarmas"), d.Total)
+	for _, code := range sortedCodes(d.Totals) {
+		fmt.Fprintf(&b, "- %s: %d\n", code, d.Totals[code])
+	}
+	if d.Total == 0 {
+		fmt.Fprintf(&b, "\n%s\n", translate(language, "Sin alarmas en el periodo."))
+		return b.String()
+	}
+	for _, device := range d.Devices {
+		if device.Total == 0 {
+			continue
+		}
+		counts := make([]string, 0, len(device.Counts))
+		for _, code := range sortedCodes(device.Counts) {
+			counts = append(counts, fmt.Sprintf("%s %d", code, device.Counts[code]))
+		}
+		fmt.Fprintf(&b, "\n%s: %d (%s)\n", digestDeviceName(device), device.Total, strings.Join(counts, ", "))
+		fmt.Fprintf(&b, "%s: %s\n", translate(language, "Última alarma"), digestTime(device.LastAlarm))
+	}
+	return b.String()
+}
+
+// digestHTMLTemplate is the template of the HTML emails of the digests.
+var digestHTMLTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; color: #222">
+<h2>{{.Title}}</h2>
+<p>{{.FleetLabel}}: <b>{{.Fleet}}</b><br>{{.PeriodLabel}}: {{.Period}}<br>{{.TotalLabel}}: <b>{{.Total}}</b></p>
+{{if .Total}}<table cellpadding="6" cellspacing="0" style="border-collapse: collapse; border: 1px solid #ccc">
+<tr style="background: #f0f0f0"><th align="left">{{.DeviceLabel}}</th>{{range .Codes}}<th>{{.}}</th>{{end}}<th>Total</th><th>{{.LastLabel}}</th></tr>
+{{range .Rows}}<tr style="border-top: 1px solid #ccc"><td>{{.Name}}</td>{{range .Counts}}<td align="center">{{.}}</td>{{end}}<td align="center"><b>{{.Total}}</b></td><td>{{.Last}}</td></tr>
+{{end}}</table>{{else}}<p>{{.Empty}}</p>{{end}}
+</body>
+</html>
+`))
+
+// HTML renders the digest as an HTML email, with a row per device and a
+// column per code.
+func (d *Digest) HTML(language string) (string, error) {
+	type row struct {
+		Name   string
+		Counts []int
+		Total  int
+		Last   string
+	}
+	codes := sortedCodes(d.Totals)
+	var rows []row
+	for _, device := range d.Devices {
+		r := row{Name: digestDeviceName(device), Total: device.Total, Last: digestTime(device.LastAlarm)}
+		for _, code := range codes {
+			r.Counts = append(r.Counts, device.Counts[code])
+		}
+		rows = append(rows, r)
+	}
+
+	var b bytes.Buffer
+	err := digestHTMLTemplate.Execute(&b, map[string]interface{}{
+		"Title":       d.Title(language),
+		"FleetLabel":  translate(language, "Flota"),
+		"Fleet":       d.Fleet,
+		"PeriodLabel": translate(language, "Periodo"),
+		"Period":      d.Period(),
+		"TotalLabel":  translate(language, "Total de alarmas"),
+		"Total":       d.Total,
+		"DeviceLabel": translate(language, "Dispositivo"),
+		"LastLabel":   translate(language, "Última alarma"),
+		"Codes":       codes,
+		"Rows":        rows,
+		"Empty":       translate(language, "Sin alarmas en el periodo."),
+	})
+	return b.String(), err
+}
+
+// CSV renders the digest as CSV, with a row per device and code.
+func (d *Digest) CSV() ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"fleet", "from", "to", "imei", "license_number", "code", "count", "last_alarm"})
+	for _, device := range d.Devices {
+		for _, code := range sortedCodes(device.Counts) {
+			w.Write([]string{d.Fleet, d.From.Format(time.RFC3339), d.To.Format(time.RFC3339), device.Imei,
+				device.LicenseNumber, code, strconv.Itoa(device.Counts[code]), digestTime(device.LastAlarm)})
+		}
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// sendMail sends an email through SMTP. The tests replace it.
+var sendMail = smtp.SendMail
+
+// sendDigestEmail sends the digest to the emails of the subscription through
+// SMTP_HOST, authenticated with SMTP_USERNAME and SMTP_PASSWORD if set, from
+// SMTP_FROM. The email has a plain text and an HTML version, and the CSV
+// attached.
+func sendDigestEmail(subscription DigestSubscription, digest *Digest) error {
+	host, from := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_FROM")
+	if host == "" || from == "" {
+		return errors.New("SMTP_HOST and SMTP_FROM must be set")
+	}
+	message, err := buildDigestEmail(from, subscription, digest)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	address := net.JoinHostPort(host, getEnv("SMTP_PORT", DEFAULT_SMTP_PORT))
+	return sendMail(address, auth, from, subscription.Emails, message)
+}
+
+// buildDigestEmail builds the MIME message of a digest.
+func buildDigestEmail(from string, subscription DigestSubscription, digest *Digest) ([]byte, error) {
+	language := orDefault(subscription.Language, LanguageSpanish)
+	html, err := digest.HTML(language)
+	if err != nil {
+		return nil, err
+	}
+	attachment, err := digest.CSV()
+	if err != nil {
+		return nil, err
+	}
+
+	// The text and the HTML are the alternatives of the body.
+	var body bytes.Buffer
+	alternative := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", digest.Text(language)},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	mixed := multipart.NewWriter(&b)
+	subject := fmt.Sprintf("%s - %s - %s", digest.Title(language), digest.Fleet, digest.Period())
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(subscription.Emails, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+
+	w, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+
+	filename := fmt.Sprintf("alarmas-%s-%s.csv", digest.Fleet, digest.From.In(digestLocation()).Format("2006-01-02"))
+	w, err = mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/csv; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(w, "%s\r\n", encoded)
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// DigestState records the end of the last period sent of each subscription,
+// so the digests aren't sent twice after a restart.
+type DigestState struct {
+	mu   sync.Mutex
+	path string
+	Sent map[string]int64 `json:"sent"`
+}
+
+// LoadDigestState reads the state file. A missing file starts a new state.
+func LoadDigestState(path string) (*DigestState, error) {
+	state := &DigestState{path: path, Sent: map[string]int64{}}
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid digest state %s: %w", path, err)
+	}
+	if state.Sent == nil {
+		state.Sent = map[string]int64{}
+	}
+	return state, nil
+}
+
+// IsSent reports whether the period ending at to was sent to the subscription.
+func (s *DigestState) IsSent(subscription DigestSubscription, to time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Sent[subscription.key()] >= to.Unix()
+}
+
+// HasSent reports whether any digest was sent to the subscription.
+func (s *DigestState) HasSent(subscription DigestSubscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.Sent[subscription.key()]
+	return ok
+}
+
+// MarkSent records the period ending at to as sent and saves the state file.
+func (s *DigestState) MarkSent(subscription DigestSubscription, to time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sent[subscription.key()] = to.Unix()
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// DigestScheduler sends the digest of each subscription once its period has
+// ended, at DIGEST_HOUR local time.
+type DigestScheduler struct {
+	subscriptions []DigestSubscription
+	state         *DigestState
+	hour          int
+	fetchDevices  func() ([]Device, error)
+	send          func(DigestSubscription, *Digest) error
+	now           func() time.Time
+
+	// retryAt holds when the failed subscriptions may be retried, by key.
+	retryAt map[string]time.Time
+}
+
+// NewDigestScheduler creates a scheduler of the subscriptions that sends the
+// digests with sendDigestEmail.
+func NewDigestScheduler(subscriptions []DigestSubscription, state *DigestState, fetchDevices func() ([]Device, error)) *DigestScheduler {
+	return &DigestScheduler{
+		subscriptions: subscriptions,
+		state:         state,
+		hour:          getEnvInt("DIGEST_HOUR", DEFAULT_DIGEST_HOUR),
+		fetchDevices:  fetchDevices,
+		send:          sendDigestEmail,
+		now:           time.Now,
+		retryAt:       map[string]time.Time{},
+	}
+}
+
+// Tick sends the digests that are due. The devices are fetched once, only if
+// any digest is due.
+func (s *DigestScheduler) Tick(ctx context.Context) {
+	now := s.now()
+	var devices []Device
+	fetched := false
+	for _, subscription := range s.subscriptions {
+		from, to := DigestPeriod(subscription.Frequency, now)
+		if now.Before(to.Add(time.Duration(s.hour) * time.Hour)) {
+			// Before the hour, the previous period is the one due, if it was
+			// missed. A new subscription waits for the hour to send the last one.
+			if !s.state.HasSent(subscription) {
+				continue
+			}
+			from, to = DigestPeriod(subscription.Frequency, from)
+		}
+		if s.state.IsSent(subscription, to) || now.Before(s.retryAt[subscription.key()]) {
+			continue
+		}
+
+		if !fetched {
+			var err error
+			if devices, err = s.fetchDevices(); err != nil {
+				logrus.WithError(err).Error("Error getting the devices of the digests")
+				return
+			}
+			fetched = true
+		}
+		if err := s.sendDigest(ctx, subscription, devices, from, to); err != nil {
+			digestMetrics.Add("failed", 1)
+			s.retryAt[subscription.key()] = now.Add(DIGEST_RETRY_DELAY)
+			logrus.WithError(err).WithField("fleet", subscription.Fleet).Error("Error sending the digest")
+			continue
+		}
+		digestMetrics.Add("sent", 1)
+		delete(s.retryAt, subscription.key())
+		if err := s.state.MarkSent(subscription, to); err != nil {
+			logrus.WithError(err).Warning("Error saving the digest state")
+		}
+	}
+}
+
+func (s *DigestScheduler) sendDigest(ctx context.Context, subscription DigestSubscription, devices []Device, from, to time.Time) error {
+	digest, err := BuildDigest(ctx, devices, subscription.Fleet, subscription.Frequency, from, to)
+	if err != nil {
+		return err
+	}
+	return s.send(subscription, digest)
+}
+
+// runDigests sends the digests of the configured subscriptions until the
+// context is cancelled.
+func runDigests(ctx context.Context, fetchDevices func() ([]Device, error)) {
+	state, err := LoadDigestState(getEnv("DIGEST_STATE_PATH", DEFAULT_DIGEST_STATE_PATH))
+	if err != nil {
+		logrus.WithError(err).Error("The digests are disabled")
+		return
+	}
+	NewDigestScheduler(digestSubscriptions, state, fetchDevices).Run(ctx)
+}
+
+// Run ticks every minute until the context is cancelled.
+func (s *DigestScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		s.Tick(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestPeriod(t *testing.T) {
+	loc := digestLocation()
+	day := func(d int) time.Time { return time.Date(2023, 11, d, 0, 0, 0, 0, loc) }
+	for _, test := range []struct {
+		frequency DigestFrequency
+		at        time.Time
+		from, to  time.Time
+	}{
+		{DigestDaily, time.Date(2023, 11, 8, 10, 0, 0, 0, loc), day(7), day(8)},
+		{DigestDaily, day(8), day(7), day(8)},
+		{DigestWeekly, time.Date(2023, 11, 8, 10, 0, 0, 0, loc), time.Date(2023, 10, 30, 0, 0, 0, 0, loc), day(6)},
+		{DigestWeekly, time.Date(2023, 11, 12, 23, 0, 0, 0, loc), time.Date(2023, 10, 30, 0, 0, 0, 0, loc), day(6)},
+		{DigestWeekly, time.Date(2023, 11, 13, 3, 0, 0, 0, loc), day(6), day(13)},
+	} {
+		from, to := DigestPeriod(test.frequency, test.at)
+		if !from.Equal(test.from) || !to.Equal(test.to) {
+			t.Errorf("%s at %s: expected [%s, %s), got [%s, %s)", test.frequency, test.at, test.from, test.to, from, to)
+		}
+	}
+}
+
+// digestTestDevices returns two devices of the fleet "norte", one without
+// alarms, and a device of another fleet.
+func digestTestDevices(t *testing.T) []Device {
+	t.Helper()
+	archive := useTestArchive(t)
+	archive.RecordAlarms([]Alarm{
+		{Imei: "1", Time: 1699333200, AlarmCode: "SOS"},    // 2023-11-07 00:00 -05
+		{Imei: "1", Time: 1699340400, AlarmCode: "REMOVE"}, // 02:00
+		{Imei: "1", Time: 1699344000, AlarmCode: "REMOVE"}, // 03:00
+		{Imei: "2", Time: 1699419600, AlarmCode: "SOS"},    // 2023-11-08 00:00, the next day
+		{Imei: "3", Time: 1699340400, AlarmCode: "SOS"},
+	})
+	plate := "GBA-1234"
+	return []Device{
+		{Imei: "1", UserName: "norte", LicenseNumber: &plate, IsTrackingAlarms: true},
+		{Imei: "2", UserName: "norte", IsTrackingAlarms: true},
+		{Imei: "3", UserName: "sur", IsTrackingAlarms: true},
+		{Imei: "4", UserName: "norte"},
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	devices := digestTestDevices(t)
+	from, to := DigestPeriod(DigestDaily, time.Date(2023, 11, 8, 10, 0, 0, 0, digestLocation()))
+	digest, err := BuildDigest(context.Background(), devices, "norte", DigestDaily, from, to)
+	if err != nil {
+		t.Fatalf("BuildDigest failed: %v", err)
+	}
+	if digest.Total != 3 || digest.Totals["REMOVE"] != 2 || len(digest.Devices) != 2 {
+		t.Fatalf("unexpected digest %+v", digest)
+	}
+	if first := digest.Devices[0]; first.Imei != "1" || first.Counts["SOS"] != 1 || first.LastAlarm != 1699344000 {
+		t.Fatalf("unexpected first device %+v", first)
+	}
+
+	text := digest.Text(LanguageSpanish)
+	for _, expected := range []string{"Resumen diario de alarmas\nFlota: norte\nPeriodo: 2023-11-07\nTotal de alarmas: 3\n- REMOVE: 2\n- SOS: 1\n",
+		"GBA-1234 (1): 3 (REMOVE 2, SOS 1)\nÚltima alarma: 2023-11-07 03:00"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %q in the text:\n%s", expected, text)
+		}
+	}
+	if strings.Contains(text, "(2)") {
+		t.Errorf("expected the devices without alarms to be left out of the text:\n%s", text)
+	}
+
+	html, err := digest.HTML(LanguageEnglish)
+	if err != nil {
+		t.Fatalf("HTML failed: %v", err)
+	}
+	for _, expected := range []string{"<h2>Daily alarm digest</h2>", "<th>REMOVE</th><th>SOS</th>", `<td>GBA-1234 (1)</td><td align="center">2</td><td align="center">1</td>`} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("expected %q in the HTML:\n%s", expected, html)
+		}
+	}
+
+	data, err := digest.CSV()
+	if err != nil {
+		t.Fatalf("CSV failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "norte,2023-11-07T00:00:00-05:00,2023-11-08T00:00:00-05:00,1,GBA-1234,REMOVE,2,") {
+		t.Fatalf("unexpected CSV:\n%s", data)
+	}
+}
+
+func TestDigestEmail(t *testing.T) {
+	devices := digestTestDevices(t)
+	from, to := DigestPeriod(DigestWeekly, time.Date(2023, 11, 13, 10, 0, 0, 0, digestLocation()))
+	digest, _ := BuildDigest(context.Background(), devices, "norte", DigestWeekly, from, to)
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_FROM", "alarmas@example.com")
+	t.Setenv("SMTP_USERNAME", "alarmas")
+
+	var address string
+	var recipients []string
+	var message []byte
+	previous := sendMail
+	sendMail = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		address, recipients, message = addr, to, msg
+		return nil
+	}
+	t.Cleanup(func() { sendMail = previous })
+
+	subscription := DigestSubscription{Fleet: "norte", Emails: []string{"gerencia@example.com"}, Frequency: DigestWeekly}
+	if err := sendDigestEmail(subscription, digest); err != nil {
+		t.Fatalf("sendDigestEmail failed: %v", err)
+	}
+	if address != "smtp.example.com:587" || len(recipients) != 1 {
+		t.Fatalf("unexpected delivery to %s %v", address, recipients)
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("invalid email: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if subject != "Resumen semanal de alarmas - norte - 2023-11-06 - 2023-11-12" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	_, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	body, err := parts.NextPart()
+	if err != nil || !strings.HasPrefix(body.Header.Get("Content-Type"), "multipart/alternative") {
+		t.Fatalf("expected the alternatives of the body: %v", err)
+	}
+	attachment, err := parts.NextPart()
+	if err != nil || attachment.FileName() != "alarmas-norte-2023-11-06.csv" {
+		t.Fatalf("expected the CSV attachment: %v", err)
+	}
+	data, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	if !strings.Contains(string(data), ",SOS,1,") {
+		t.Fatalf("unexpected attachment:\n%s", data)
+	}
+}
+
+func TestDigestScheduler(t *testing.T) {
+	devices := digestTestDevices(t)
+	statePath := filepath.Join(t.TempDir(), "digests.state.json")
+	state, _ := LoadDigestState(statePath)
+	subscription := DigestSubscription{Fleet: "norte", Emails: []string{"gerencia@example.com"}, Frequency: DigestDaily}
+	s := NewDigestScheduler([]DigestSubscription{subscription}, state, func() ([]Device, error) { return devices, nil })
+	s.hour = 7
+
+	var sent []*Digest
+	var failing bool
+	s.send = func(_ DigestSubscription, digest *Digest) error {
+		if failing {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, digest)
+		return nil
+	}
+	now := time.Date(2023, 11, 8, 6, 0, 0, 0, digestLocation())
+	s.now = func() time.Time { return now }
+
+	// Before the hour, a new subscription doesn't get the digest of the day
+	// before yesterday.
+	s.Tick(context.Background())
+	if len(sent) != 0 {
+		t.Fatalf("expected no digest before the hour, got %d digests", len(sent))
+	}
+
+	// Before the hour, the missed digest of the day before yesterday is due.
+	state.MarkSent(subscription, time.Date(2023, 11, 6, 0, 0, 0, 0, digestLocation()))
+	s.Tick(context.Background())
+	if len(sent) != 1 || sent[0].Period() != "2023-11-06" {
+		t.Fatalf("expected the digest of 2023-11-06, got %d digests", len(sent))
+	}
+	s.Tick(context.Background())
+	if len(sent) != 1 {
+		t.Fatalf("expected the digest to be sent once, got %d", len(sent))
+	}
+
+	// A failed digest is retried after the delay.
+	now = now.Add(90 * time.Minute)
+	failing = true
+	s.Tick(context.Background())
+	failing = false
+	s.Tick(context.Background())
+	if len(sent) != 1 {
+		t.Fatalf("expected the failed digest to wait, got %d digests", len(sent))
+	}
+	now = now.Add(DIGEST_RETRY_DELAY)
+	s.Tick(context.Background())
+	if len(sent) != 2 || sent[1].Period() != "2023-11-07" || sent[1].Total != 3 {
+		t.Fatalf("expected the digest of 2023-11-07, got %+v", sent)
+	}
+
+	// The state survives a restart.
+	restored, err := LoadDigestState(statePath)
+	if err != nil || !restored.IsSent(subscription, sent[1].To) {
+		t.Fatalf("expected the state to be saved: %v", err)
+	}
+}
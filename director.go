@@ -1,15 +1,15 @@
 package main
 
 import (
+	"context"
+	"os"
 	"sync"
-	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
 // Director manages a chain of responsibility pattern for handling requests.
 type Director struct {
-	first Handler // first points to the first handler in the chain.
+	first   Handler // first points to the first handler in the chain.
+	devices Handler // devices points to the handler that receives the list of devices.
 }
 
 // directorInstance holds a singleton instance of Director.
@@ -29,16 +29,21 @@ func (d *Director) BuildChain() {
 	deviceController := &DeviceController{}
 	requestGenerator := &RequestGenerator{}
 	requestExecutor := &RequestExecutor{}
+	watchdog := GetDeviceWatchdog()
 	dataSaver := &DataSaver{}
 	messageSender := &MessageSender{}
 
 	// Sets the next handler for each component in the chain.
 	deviceController.SetNext(requestGenerator)
 	requestGenerator.SetNext(requestExecutor)
-	requestExecutor.SetNext(dataSaver)
+	requestExecutor.SetNext(watchdog)
+	watchdog.SetNext(dataSaver)
 	dataSaver.SetNext(messageSender)
+	// The alarms raised from the positions skip the vendor requests.
+	GetOverspeedEvaluator().SetNext(dataSaver)
 
 	d.first = deviceController
+	d.devices = requestGenerator
 }
 
 // ProcessRequest processes a request through the chain of handlers.
@@ -50,10 +55,25 @@ func (d *Director) ProcessRequest(request interface{}) (interface{}, error) {
 	return request, nil
 }
 
+// ProcessDevices processes the given devices through the chain, skipping the
+// DeviceController. The devices are updated with their new LastTimeTracked,
+// except the ones whose alarms couldn't be requested, which are returned as
+// FetchErrors with the alarms of the others.
+func (d *Director) ProcessDevices(devices []Device) ([]Alarm, error) {
+	if d.devices == nil {
+		return nil, nil
+	}
+	result, err := d.devices.Handle(devices)
+	alarms, _ := result.([]Alarm)
+	return alarms, err
+}
+
 var trackingAlarmsStarted bool    // trackingAlarmsStarted indicates whether alarm tracking has started.
 var trackingAlarmsLock sync.Mutex // trackingAlarmsLock provides a mutex for controlling access to trackingAlarmsStarted.
 
 // InitiateTrackingAlarms starts the alarm tracking process, ensuring it runs only once.
+// Each device is scheduled by the Scheduler according to its activity and
+// polled by the WorkQueue workers of its provider.
 func InitiateTrackingAlarms() {
 	trackingAlarmsLock.Lock()
 	defer trackingAlarmsLock.Unlock()
@@ -65,24 +85,48 @@ func InitiateTrackingAlarms() {
 	trackingAlarmsStarted = true
 	director := GetDirectorInstance()
 	director.BuildChain()
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	running := make(chan bool, 1) // running controls the execution overlap of process invocations.
-	for range ticker.C {
-		select {
-		case running <- true:
-			go func() {
-				defer func() { <-running }()
-				queryParams := map[string]string{"is_tracking_alarms": "true"}
-				_, err := director.ProcessRequest(queryParams)
-				if err != nil {
-					logrus.Println(err)
-				}
-			}()
-		default:
-			// Skips this tick if the previous process is still running.
-			logrus.Warn("Skipping this tick as the previous one is still processing")
-		}
+
+	deviceController := &DeviceController{}
+	fetchDevices := func() ([]Device, error) {
+		return deviceController.getDevices(map[string]string{"is_tracking_alarms": "true"})
+	}
+
+	// The scheduler decides when each device is due and the work queue polls it
+	// with the workers of its provider, reporting back to the scheduler.
+	var scheduler *Scheduler
+	workQueue := NewWorkQueue(director.ProcessDevices, func(device Device, alarms []Alarm) {
+		scheduler.Completed(device, alarms)
+	})
+	scheduler = NewScheduler(fetchDevices, workQueue.Enqueue)
+
+	ctx := context.Background()
+	go GetAlarmBatcher().Run(ctx)
+	go GetDeviceSync().Run(ctx)
+	go GetIncidentCorrelator().Run(ctx)
+	go GetNotificationThrottler().Run(ctx)
+	go GetDeviceWatchdog().Run(ctx, getEnvDuration("WATCHDOG_INTERVAL", DEFAULT_WATCHDOG_INTERVAL), fetchDevices)
+	if interval := getEnvDuration("POSITION_POLL_INTERVAL", DEFAULT_POSITION_POLL_INTERVAL); interval > 0 {
+		GetPositionTracker().OnUpdate(func(position Position) {
+			GetDeviceWatchdog().ObservePosition(position)
+			GetOverspeedEvaluator().Observe(position)
+		})
+		go GetPositionTracker().Run(ctx, interval, fetchDevices)
+	}
+	if os.Getenv("TWILIO_INCOMING_URL") != "" {
+		// The phone index is built before the first incoming message.
+		GetPhoneIndex().Refresh()
+	}
+	if alarmArchive != nil {
+		go alarmArchive.RunRetention(ctx)
+	}
+	if webhookRegistry != nil {
+		go NewWebhookDispatcher(webhookRegistry, eventBus, nil).Run(ctx)
+	}
+	if len(digestSubscriptions) > 0 {
+		go runDigests(ctx, func() ([]Device, error) {
+			return deviceController.getDevices(map[string]string{})
+		})
 	}
+	workQueue.Start(ctx)
+	scheduler.Run(ctx)
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EVENT_BUFFER_SIZE is the number of past events kept to resume the streams.
+	EVENT_BUFFER_SIZE = 1000
+	// SUBSCRIBER_BUFFER_SIZE is the number of events a subscriber may fall
+	// behind before it is disconnected.
+	SUBSCRIBER_BUFFER_SIZE = 256
+)
+
+// AlarmEvent is an alarm published on the EventBus. Fleet is the user name of
+// the device, empty if the device isn't known yet.
+type AlarmEvent struct {
+	ID    uint64 `json:"id"`
+	Imei  string `json:"imei"`
+	Fleet string `json:"fleet,omitempty"`
+	Alarm Alarm  `json:"alarm"`
+}
+
+// EventFilter selects the events of a subscription. Empty sets don't filter.
+type EventFilter struct {
+	Imeis  map[string]bool
+	Fleets map[string]bool
+	Codes  map[string]bool
+}
+
+// NewEventFilter creates a filter from lists of comma-separated values, as
+// received in the query parameters.
+func NewEventFilter(imeis, fleets, codes []string) EventFilter {
+	toSet := func(values []string) map[string]bool {
+		set := map[string]bool{}
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					set[item] = true
+				}
+			}
+		}
+		return set
+	}
+	return EventFilter{Imeis: toSet(imeis), Fleets: toSet(fleets), Codes: toSet(codes)}
+}
+
+// Matches reports whether the event passes the filter.
+func (f EventFilter) Matches(event AlarmEvent) bool {
+	return (len(f.Imeis) == 0 || f.Imeis[event.Imei]) &&
+		(len(f.Fleets) == 0 || f.Fleets[event.Fleet]) &&
+		(len(f.Codes) == 0 || f.Codes[event.Alarm.AlarmCode])
+}
+
+// Subscription receives the events of the bus matching its filter. C is
+// closed when the subscriber falls too far behind or Unsubscribe is called.
+type Subscription struct {
+	C <-chan AlarmEvent
+
+	c      chan AlarmEvent
+	filter EventFilter
+	bus    *EventBus
+	closed bool
+}
+
+// Unsubscribe stops the subscription and closes C.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.remove(s)
+}
+
+// EventBus distributes the saved alarms to the live streams. It keeps the last
+// EVENT_BUFFER_SIZE events so a client can resume from the last ID it received.
+// The IDs start at the creation time in milliseconds, so the IDs given before
+// a restart are lower than the new ones and a resuming client gets every event
+// since the restart.
+type EventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	buffer      []AlarmEvent
+	size        int
+	subscribers map[*Subscription]bool
+}
+
+// eventBus is the bus where the DataSaver publishes the alarms.
+var eventBus = NewEventBus(EVENT_BUFFER_SIZE)
+
+// NewEventBus creates a bus keeping size past events.
+func NewEventBus(size int) *EventBus {
+	return &EventBus{
+		nextID:      uint64(time.Now().UnixMilli()),
+		size:        size,
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Publish sends the alarms to the subscribers. Subscribers whose buffer is
+// full are disconnected instead of blocking the publisher.
+func (b *EventBus) Publish(alarms []Alarm) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, alarm := range alarms {
+		event := AlarmEvent{ID: b.nextID, Imei: alarm.Imei, Alarm: alarm}
+		if device, ok := knownDevice(alarm.Imei); ok {
+			event.Fleet = device.UserName
+		}
+		b.nextID++
+
+		b.buffer = append(b.buffer, event)
+		if len(b.buffer) > b.size {
+			b.buffer = b.buffer[len(b.buffer)-b.size:]
+		}
+
+		for s := range b.subscribers {
+			if !s.filter.Matches(event) {
+				continue
+			}
+			select {
+			case s.c <- event:
+			default:
+				b.remove(s)
+			}
+		}
+	}
+}
+
+// Subscribe starts a subscription with the filter. If lastID isn't zero, the
+// buffered events after it are sent first.
+func (b *EventBus) Subscribe(filter EventFilter, lastID uint64) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []AlarmEvent
+	if lastID > 0 {
+		for _, event := range b.buffer {
+			if event.ID > lastID && filter.Matches(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	c := make(chan AlarmEvent, len(replay)+SUBSCRIBER_BUFFER_SIZE)
+	for _, event := range replay {
+		c <- event
+	}
+	s := &Subscription{C: c, c: c, filter: filter, bus: b}
+	b.subscribers[s] = true
+	return s
+}
+
+// Subscribers returns the number of active subscriptions.
+func (b *EventBus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// remove must be called with b.mu held.
+func (b *EventBus) remove(s *Subscription) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(b.subscribers, s)
+	close(s.c)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus(3)
+	sos := bus.Subscribe(NewEventFilter(nil, nil, []string{"SOS,REMOVE"}), 0)
+	device := bus.Subscribe(NewEventFilter([]string{"2"}, nil, nil), 0)
+
+	bus.Publish([]Alarm{
+		{Imei: "1", Time: 1700000000, AlarmCode: "SOS"},
+		{Imei: "2", Time: 1700000000, AlarmCode: "LOWVOT"},
+		{Imei: "2", Time: 1700000060, AlarmCode: "REMOVE"},
+		{Imei: "3", Time: 1700000000, AlarmCode: "LOWVOT"},
+	})
+
+	var first uint64
+	for i, expected := range []string{"1", "2"} {
+		event := <-sos.C
+		if event.Imei != expected {
+			t.Fatalf("SOS event %d: expected IMEI %s, got %s", i, expected, event.Imei)
+		}
+		if i == 0 {
+			first = event.ID
+		}
+	}
+	if len(device.C) != 2 {
+		t.Fatalf("expected 2 events for the device, got %d", len(device.C))
+	}
+
+	// Only the last 3 events are kept, the first one can't be replayed.
+	resumed := bus.Subscribe(EventFilter{}, first-1)
+	if len(resumed.C) != 3 {
+		t.Fatalf("expected 3 replayed events, got %d", len(resumed.C))
+	}
+	if event := <-resumed.C; event.ID != first+1 {
+		t.Fatalf("expected the replay to start at %d, got %d", first+1, event.ID)
+	}
+	resumed.Unsubscribe()
+	for range resumed.C {
+		// The buffered events are still delivered before the channel closes.
+	}
+	if subscribers := bus.Subscribers(); subscribers != 2 {
+		t.Fatalf("expected 2 subscribers, got %d", subscribers)
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus(EVENT_BUFFER_SIZE)
+	slow := bus.Subscribe(EventFilter{}, 0)
+
+	alarms := make([]Alarm, SUBSCRIBER_BUFFER_SIZE+1)
+	bus.Publish(alarms)
+
+	received := 0
+	for range slow.C {
+		received++
+	}
+	if received != SUBSCRIBER_BUFFER_SIZE {
+		t.Fatalf("expected %d events before the disconnection, got %d", SUBSCRIBER_BUFFER_SIZE, received)
+	}
+	if subscribers := bus.Subscribers(); subscribers != 0 {
+		t.Fatalf("expected the slow subscriber to be removed, got %d subscribers", subscribers)
+	}
+	// Unsubscribing an already disconnected subscription is harmless.
+	slow.Unsubscribe()
+}
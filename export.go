@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ExportFormat is a file format of the alarm exports.
+type ExportFormat string
+
+const (
+	ExportCSV     ExportFormat = "csv"
+	ExportGeoJSON ExportFormat = "geojson"
+	ExportKML     ExportFormat = "kml"
+	ExportGPX     ExportFormat = "gpx"
+)
+
+// exporter writes the alarms in a format.
+type exporter struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, alarms []Alarm) error
+}
+
+var exporters = map[ExportFormat]exporter{
+	ExportCSV:     {"text/csv", "csv", writeAlarmsCSV},
+	ExportGeoJSON: {"application/geo+json", "geojson", writeAlarmsGeoJSON},
+	ExportKML:     {"application/vnd.google-earth.kml+xml", "kml", writeAlarmsKML},
+	ExportGPX:     {"application/gpx+xml", "gpx", writeAlarmsGPX},
+}
+
+// ParseExportFormat returns the format with the given name.
+func ParseExportFormat(name string) (ExportFormat, error) {
+	format := ExportFormat(strings.ToLower(name))
+	if _, ok := exporters[format]; !ok {
+		return "", fmt.Errorf("unknown export format %q, expected csv, geojson, kml or gpx", name)
+	}
+	return format, nil
+}
+
+// ExportAlarms writes the alarms to w in the given format.
+func ExportAlarms(w io.Writer, format ExportFormat, alarms []Alarm) error {
+	e, ok := exporters[format]
+	if !ok {
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	return e.write(w, alarms)
+}
+
+// LoadAlarmsForExport returns the alarms matching the query, sorted by time.
+// They are read from the local archive when it is enabled, and from the
+// backend otherwise.
+func LoadAlarmsForExport(ctx context.Context, q AlarmQuery) ([]Alarm, error) {
+	if alarmArchive != nil {
+		return alarmArchive.Alarms(q)
+	}
+
+	filters := map[string]string{}
+	if q.Imei != "" {
+		filters["device_imei"] = q.Imei
+	}
+	backendAlarms, err := roadSafetyClient.AllAlarms(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// The backend is filtered by device only, the rest of the query is applied here.
+	var alarms []Alarm
+	for _, backendAlarm := range backendAlarms {
+		alarm := Alarm(backendAlarm)
+		if !q.From.IsZero() && alarm.Time < q.From.Unix() {
+			continue
+		}
+		if !q.To.IsZero() && alarm.Time >= q.To.Unix() {
+			continue
+		}
+		if q.matches(alarm) {
+			alarms = append(alarms, alarm)
+		}
+	}
+	sort.SliceStable(alarms, func(i, j int) bool { return alarms[i].Time < alarms[j].Time })
+	if q.Limit > 0 && len(alarms) > q.Limit {
+		alarms = alarms[:q.Limit]
+	}
+	return alarms, nil
+}
+
+// exportFileName returns the name of the file of an export.
+func exportFileName(format ExportFormat, q AlarmQuery) string {
+	name := "alarms"
+	if q.Imei != "" {
+		name += "-" + q.Imei
+	}
+	if !q.From.IsZero() {
+		name += "-" + q.From.Format("20060102")
+	}
+	return name + "." + exporters[format].extension
+}
+
+// exportHandler serves the alarm history in the format of the "format"
+// parameter. The "from" and "to" parameters accept the same dates as the CLI,
+// "imei" selects a device and "code" a comma-separated list of alarm codes.
+// It requires the bearer token of EXPORT_ADMIN_TOKEN, since the history
+// locates the vehicles of the users.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(w, r, "EXPORT_ADMIN_TOKEN") {
+		return
+	}
+	params := r.URL.Query()
+	format, err := ParseExportFormat(getParam(params, "format", string(ExportCSV)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseCLIRange(params.Get("from"), params.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := AlarmQuery{Imei: params.Get("imei"), From: start, To: end}
+	if codes := params.Get("code"); codes != "" {
+		query.Codes = strings.Split(codes, ",")
+	}
+
+	alarms, err := LoadAlarmsForExport(r.Context(), query)
+	if err != nil {
+		logrus.WithError(err).Error("Error loading the alarms to export")
+		http.Error(w, "error loading the alarms", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", exporters[format].contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(format, query)))
+	if err := ExportAlarms(w, format, alarms); err != nil {
+		logrus.WithError(err).Warning("Error writing the export")
+	}
+}
+
+// getParam returns the query parameter key, or fallback if it is empty.
+func getParam(params url.Values, key, fallback string) string {
+	if value := params.Get(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// alarmDescription returns the name of the alarm shown in the exports.
+func alarmDescription(alarm Alarm) string {
+	switch alarm.AlarmCode {
+	case "SOS":
+		return "Alerta de SOS"
+	case "REMOVE":
+		switch alarm.AlarmType {
+		case 1:
+			return "Alerta de desmontaje"
+		case 10:
+			return "Alerta de sensor de luz"
+		default:
+			return "Alerta de corte de corriente"
+		}
+	case "LOWVOT":
+		return "Alerta de corriente baja"
+	case "OFFLINE":
+		return "Dispositivo sin reportar"
+	case "RECOVERED":
+		return "Dispositivo reportando nuevamente"
+	case "OVERSPEED":
+		return "Exceso de velocidad"
+	}
+	return "Alarma " + alarm.AlarmCode
+}
+
+// exportTime formats the time of an alarm in the local time of the fleet.
+func exportTime(unixTime int64) string {
+	t, err := unixToLocal(unixTime)
+	if err != nil {
+		t = time.Unix(unixTime, 0).UTC()
+	}
+	return t.Format(time.RFC3339)
+}
+
+func optionalString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func optionalInt(value *int64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*value, 10)
+}
+
+func writeAlarmsCSV(w io.Writer, alarms []Alarm) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"imei", "time", "alarm_code", "alarm_type", "description", "lat", "lng", "speed", "course", "address"})
+	for _, alarm := range alarms {
+		writer.Write([]string{
+			alarm.Imei,
+			exportTime(alarm.Time),
+			alarm.AlarmCode,
+			strconv.FormatInt(alarm.AlarmType, 10),
+			alarmDescription(alarm),
+			optionalString(alarm.Lat),
+			optionalString(alarm.Lng),
+			optionalInt(alarm.Speed),
+			optionalInt(alarm.Course),
+			optionalString(alarm.Address),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONPoint          `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// writeAlarmsGeoJSON writes a FeatureCollection with a Point per alarm. The
+// alarms without coordinates have a null geometry.
+func writeAlarmsGeoJSON(w io.Writer, alarms []Alarm) error {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, alarm := range alarms {
+		feature := geoJSONFeature{
+			Type: "Feature",
+			Properties: map[string]interface{}{
+				"imei":        alarm.Imei,
+				"time":        exportTime(alarm.Time),
+				"alarm_code":  alarm.AlarmCode,
+				"alarm_type":  alarm.AlarmType,
+				"description": alarmDescription(alarm),
+			},
+		}
+		if lat, lng, ok := alarmCoordinates(alarm); ok {
+			feature.Geometry = &geoJSONPoint{Type: "Point", Coordinates: [2]float64{lng, lat}}
+		}
+		if alarm.Speed != nil {
+			feature.Properties["speed"] = *alarm.Speed
+		}
+		if alarm.Address != nil {
+			feature.Properties["address"] = *alarm.Address
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(collection)
+}
+
+// kmlStyleColors are the colors, in KML aabbggrr notation, of the placemarks
+// of each alarm code.
+var kmlStyleColors = map[string]string{
+	"SOS":    "ff0000ff",
+	"REMOVE": "ff00a5ff",
+	"LOWVOT": "ff00ffff",
+}
+
+const kmlDefaultColor = "ffffffff"
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"kml"`
+	Namespace  string         `xml:"xmlns,attr"`
+	Name       string         `xml:"Document>name"`
+	Styles     []kmlStyle     `xml:"Document>Style"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlStyle struct {
+	ID    string `xml:"id,attr"`
+	Color string `xml:"IconStyle>color"`
+	Icon  string `xml:"IconStyle>Icon>href"`
+}
+
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	When        string `xml:"TimeStamp>when"`
+	StyleURL    string `xml:"styleUrl"`
+	Coordinates string `xml:"Point>coordinates"`
+}
+
+// writeAlarmsKML writes a placemark per alarm with coordinates, styled by code.
+func writeAlarmsKML(w io.Writer, alarms []Alarm) error {
+	document := kmlDocument{Namespace: "http://www.opengis.net/kml/2.2", Name: "Alarmas"}
+	styles := map[string]bool{}
+	for _, alarm := range alarms {
+		lat, lng, ok := alarmCoordinates(alarm)
+		if !ok {
+			continue
+		}
+		styleID := "alarm-" + strings.ToLower(alarm.AlarmCode)
+		if !styles[styleID] {
+			styles[styleID] = true
+			color, ok := kmlStyleColors[alarm.AlarmCode]
+			if !ok {
+				color = kmlDefaultColor
+			}
+			document.Styles = append(document.Styles, kmlStyle{
+				ID:    styleID,
+				Color: color,
+				Icon:  "http://maps.google.com/mapfiles/kml/paddle/wht-blank.png",
+			})
+		}
+		description := "IMEI: " + alarm.Imei
+		if alarm.Address != nil {
+			description += "\nDirección: " + *alarm.Address
+		}
+		document.Placemarks = append(document.Placemarks, kmlPlacemark{
+			Name:        alarmDescription(alarm),
+			Description: description,
+			When:        exportTime(alarm.Time),
+			StyleURL:    "#" + styleID,
+			Coordinates: strconv.FormatFloat(lng, 'f', -1, 64) + "," + strconv.FormatFloat(lat, 'f', -1, 64),
+		})
+	}
+	return writeXML(w, document)
+}
+
+type gpxDocument struct {
+	XMLName   xml.Name      `xml:"gpx"`
+	Namespace string        `xml:"xmlns,attr"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+}
+
+type gpxWaypoint struct {
+	Lat         float64 `xml:"lat,attr"`
+	Lon         float64 `xml:"lon,attr"`
+	Time        string  `xml:"time"`
+	Name        string  `xml:"name"`
+	Description string  `xml:"desc,omitempty"`
+	Type        string  `xml:"type"`
+}
+
+// writeAlarmsGPX writes a waypoint per alarm with coordinates.
+func writeAlarmsGPX(w io.Writer, alarms []Alarm) error {
+	document := gpxDocument{Namespace: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "get_device_alarms"}
+	for _, alarm := range alarms {
+		lat, lng, ok := alarmCoordinates(alarm)
+		if !ok {
+			continue
+		}
+		document.Waypoints = append(document.Waypoints, gpxWaypoint{
+			Lat:         lat,
+			Lon:         lng,
+			Time:        time.Unix(alarm.Time, 0).UTC().Format(time.RFC3339),
+			Name:        alarmDescription(alarm) + " " + alarm.Imei,
+			Description: optionalString(alarm.Address),
+			Type:        alarm.AlarmCode,
+		})
+	}
+	return writeXML(w, document)
+}
+
+func writeXML(w io.Writer, document interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exportTestAlarms() []Alarm {
+	lat, lng, address := "-2.17", "-79.92", "Guayaquil, Ecuador"
+	return []Alarm{
+		{Imei: "1", Time: 1700000000, AlarmCode: "SOS", Lat: &lat, Lng: &lng, Address: &address},
+		{Imei: "1", Time: 1700000060, AlarmCode: "REMOVE", AlarmType: 1, Lat: &lat, Lng: &lng},
+		{Imei: "2", Time: 1700000120, AlarmCode: "LOWVOT"},
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExportAlarms(&buf, ExportCSV, exportTestAlarms()); err != nil {
+		t.Fatalf("ExportAlarms failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(records) != 4 || records[0][0] != "imei" {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if records[1][1] != "2023-11-14T17:13:20-05:00" || records[1][9] != "Guayaquil, Ecuador" || records[2][4] != "Alerta de desmontaje" {
+		t.Errorf("unexpected rows %v", records[1:])
+	}
+}
+
+func TestExportGeoJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExportAlarms(&buf, ExportGeoJSON, exportTestAlarms()); err != nil {
+		t.Fatalf("ExportAlarms failed: %v", err)
+	}
+	var collection geoJSONFeatureCollection
+	if err := json.Unmarshal(buf.Bytes(), &collection); err != nil {
+		t.Fatalf("invalid GeoJSON: %v", err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 3 {
+		t.Fatalf("unexpected collection %+v", collection)
+	}
+	if point := collection.Features[0].Geometry; point == nil || point.Coordinates != [2]float64{-79.92, -2.17} {
+		t.Errorf("unexpected geometry %+v", point)
+	}
+	if collection.Features[2].Geometry != nil {
+		t.Errorf("expected a null geometry for the alarm without coordinates")
+	}
+}
+
+func TestExportKMLAndGPX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExportAlarms(&buf, ExportKML, exportTestAlarms()); err != nil {
+		t.Fatalf("ExportAlarms failed: %v", err)
+	}
+	var document kmlDocument
+	if err := xml.Unmarshal(buf.Bytes(), &document); err != nil {
+		t.Fatalf("invalid KML: %v", err)
+	}
+	if len(document.Placemarks) != 2 || len(document.Styles) != 2 {
+		t.Fatalf("unexpected KML %+v", document)
+	}
+	if document.Placemarks[0].StyleURL != "#alarm-sos" || document.Placemarks[0].Coordinates != "-79.92,-2.17" {
+		t.Errorf("unexpected placemark %+v", document.Placemarks[0])
+	}
+
+	buf.Reset()
+	if err := ExportAlarms(&buf, ExportGPX, exportTestAlarms()); err != nil {
+		t.Fatalf("ExportAlarms failed: %v", err)
+	}
+	var gpx gpxDocument
+	if err := xml.Unmarshal(buf.Bytes(), &gpx); err != nil {
+		t.Fatalf("invalid GPX: %v", err)
+	}
+	if len(gpx.Waypoints) != 2 || gpx.Waypoints[0].Lat != -2.17 || gpx.Waypoints[0].Time != "2023-11-14T22:13:20Z" {
+		t.Errorf("unexpected GPX %+v", gpx)
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	useTestArchive(t).RecordAlarms(exportTestAlarms())
+
+	server := httptest.NewServer(http.HandlerFunc(exportHandler))
+	defer server.Close()
+	get := func(query, token string) (*http.Response, error) {
+		r, _ := http.NewRequest(http.MethodGet, server.URL+query, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return http.DefaultClient.Do(r)
+	}
+
+	// The export is disabled without a token, and requires it.
+	resp, err := get("?format=csv", "secret")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 without EXPORT_ADMIN_TOKEN, got %s", resp.Status)
+	}
+	t.Setenv("EXPORT_ADMIN_TOKEN", "secret")
+	resp, err = get("?format=csv", "invalid")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with an invalid token, got %s", resp.Status)
+	}
+
+	resp, err = get("?format=geojson&imei=1&from=2023-11-14&to=2023-11-15&code=SOS", "secret")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/geo+json" {
+		t.Fatalf("unexpected response %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); !strings.Contains(disposition, "alarms-1-20231114.geojson") {
+		t.Errorf("unexpected disposition %q", disposition)
+	}
+	var collection geoJSONFeatureCollection
+	json.NewDecoder(resp.Body).Decode(&collection)
+	if len(collection.Features) != 1 || collection.Features[0].Properties["alarm_code"] != "SOS" {
+		t.Errorf("unexpected features %+v", collection.Features)
+	}
+
+	resp, err = get("?format=pdf&from=2023-11-14", "secret")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %s", resp.Status)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 )
 
 func UnmarshalGeoapifyResponse(data []byte) (GeoapifyResponse, error) {
@@ -90,35 +90,78 @@ type Query struct {
 	PlusCode string  `json:"plus_code"`
 }
 
-const GEOAPIFY_URL_REVERSE_GEOCODING = "https://api.geoapify.com/v1/geocode/reverse?lat=%s&lon=%s&apiKey=%s"
+// GEOAPIFY_API_URL is the default base URL of Geoapify, configurable with the
+// GEOAPIFY_API_URL environment variable.
+const GEOAPIFY_API_URL = "https://api.geoapify.com/v1/"
 
-func GetAddress(lat string, lng string) *string {
-	apiKey := os.Getenv("GEOAPIFY_KEY")
-	url := fmt.Sprintf(GEOAPIFY_URL_REVERSE_GEOCODING, lat, lng, apiKey)
+// GeocoderClient resolves addresses with the Geoapify reverse geocoding API.
+type GeocoderClient struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	breaker    *CircuitBreaker
+}
+
+// NewGeocoderClient creates a client for the Geoapify API at baseURL. If
+// httpClient is nil, a client with DEFAULT_HTTP_TIMEOUT is used.
+func NewGeocoderClient(baseURL, apiKey string, httpClient *http.Client) *GeocoderClient {
+	if httpClient == nil {
+		httpClient = newHTTPClient()
+	}
+	return &GeocoderClient{
+		baseURL:    baseURL,
+		apiKey:     apiKey,
+		httpClient: httpClient,
+		breaker:    geoapifyBreaker,
+	}
+}
+
+// ReverseGeocode returns the formatted address of the coordinates, or nil if
+// Geoapify doesn't know any.
+func (c *GeocoderClient) ReverseGeocode(lat, lng string) (*string, error) {
+	query := url.Values{}
+	query.Set("lat", lat)
+	query.Set("lon", lng)
+	query.Set("apiKey", c.apiKey)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", joinURL(c.baseURL, "geocode/reverse")+"?"+query.Encode(), nil)
 	if err != nil {
-		fmt.Printf("Error making the request to Geoapify: %s\n", err)
-		return nil
+		return nil, fmt.Errorf("error creating the request to Geoapify: %w", err)
+	}
+	resp, err := c.breaker.Do(c.httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("error making the request to Geoapify: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Error reading the response body: %s\n", err)
-		return nil
+		return nil, fmt.Errorf("error reading the response body: %w", err)
 	}
 
-	var data GeoapifyResponse
-	data, err = UnmarshalGeoapifyResponse(body)
+	data, err := UnmarshalGeoapifyResponse(body)
 	if err != nil {
-		fmt.Printf("Error unmarshalling the JSON response: %s\n", err)
-		return nil
+		return nil, fmt.Errorf("error unmarshalling the JSON response: %w", err)
 	}
 
 	if len(data.Features) > 0 {
-		return &data.Features[0].Properties.Formatted
+		return &data.Features[0].Properties.Formatted, nil
 	}
 
-	return nil
+	return nil, nil
+}
+
+// GetAddress returns the address of the coordinates, or nil if it can't be resolved.
+// Geocoding is skipped while Geoapify is failing, the messages include the coordinates instead.
+func GetAddress(lat string, lng string) *string {
+	address, err := geocoderClient.ReverseGeocode(lat, lng)
+	if err != nil {
+		fmt.Printf("Error getting the address: %s\n", err)
+		return nil
+	}
+	return address
 }
@@ -3,14 +3,16 @@ module github.com/indrod-group/get_device_alarms
 go 1.21
 
 require (
+	github.com/beevik/etree v1.1.0 // indirect
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	golang.org/x/sys v0.9.0 // indirect
 )
 
 require (
-	github.com/jarcoal/httpmock v1.3.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
 	github.com/sirupsen/logrus v1.9.3
 	github.com/twilio/twilio-go v1.15.3
+	go.etcd.io/bbolt v1.3.10
 )
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_INCIDENT_WINDOW is the maximum time between two alarms of a
+	// device to group them in the same incident, configurable with the
+	// INCIDENT_WINDOW environment variable.
+	DEFAULT_INCIDENT_WINDOW = 10 * time.Minute
+	// DEFAULT_INCIDENT_HOLD is how long a new incident waits since its last
+	// alarm for related alarms before it is notified, configurable with
+	// INCIDENT_HOLD. It is the window, so the alarms of a correlation rule are
+	// notified together. Critical incidents are notified without waiting.
+	DEFAULT_INCIDENT_HOLD = DEFAULT_INCIDENT_WINDOW
+	// DEFAULT_INCIDENT_CLOSE_AFTER is the time without new alarms after which an
+	// incident is closed, configurable with INCIDENT_CLOSE_AFTER.
+	DEFAULT_INCIDENT_CLOSE_AFTER = 30 * time.Minute
+	// INCIDENT_HISTORY_SIZE is the number of closed incidents kept.
+	INCIDENT_HISTORY_SIZE = 500
+	// MAX_CONCURRENT_NOTIFICATIONS bounds the incidents notified at the same time.
+	MAX_CONCURRENT_NOTIFICATIONS = 25
+)
+
+// incidentMetrics publishes the counters of the incidents.
+var incidentMetrics = expvar.NewMap("incidents")
+
+// ErrIncidentNotFound is returned for an unknown incident ID.
+var ErrIncidentNotFound = errors.New("incident not found")
+
+// Severity is the importance of an incident. Incidents below SeverityLow
+// aren't notified.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = []string{"info", "low", "medium", "high", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	for i, name := range severityNames {
+		if name == string(text) {
+			*s = Severity(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %q", text)
+}
+
+// IncidentStatus is the stage of the lifecycle of an incident.
+type IncidentStatus string
+
+const (
+	IncidentOpen         IncidentStatus = "open"
+	IncidentAcknowledged IncidentStatus = "acknowledged"
+	IncidentClosed       IncidentStatus = "closed"
+)
+
+// AlarmMatcher matches the alarms with a code and, if it isn't zero, a type.
+type AlarmMatcher struct {
+	Code string
+	Type int64
+}
+
+func (m AlarmMatcher) Matches(alarm Alarm) bool {
+	return alarm.AlarmCode == m.Code && (m.Type == 0 || alarm.AlarmType == m.Type)
+}
+
+// CorrelationRule recognizes a kind of incident: an alarm of every matcher
+// of the rule, in any order, within Window.
+type CorrelationRule struct {
+	Name     string
+	Title    string
+	Severity Severity
+	Window   time.Duration
+	Matchers []AlarmMatcher
+}
+
+// Matches reports whether the alarms, sorted by time, satisfy the rule.
+func (r CorrelationRule) Matches(alarms []Alarm) bool {
+	window := int64(r.Window / time.Second)
+	for i, first := range alarms {
+		found := make([]bool, len(r.Matchers))
+		remaining := len(r.Matchers)
+		for _, alarm := range alarms[i:] {
+			if alarm.Time-first.Time > window {
+				break
+			}
+			for j, matcher := range r.Matchers {
+				if !found[j] && matcher.Matches(alarm) {
+					found[j] = true
+					remaining--
+					break
+				}
+			}
+			if remaining == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// correlationRules are the rules of the service, the most severe first.
+var correlationRules = []CorrelationRule{
+	{
+		Name:     "theft",
+		Title:    "🚨🚨 POSIBLE ROBO DEL VEHÍCULO 🚨🚨",
+		Severity: SeverityCritical,
+		Window:   10 * time.Minute,
+		Matchers: []AlarmMatcher{{Code: "REMOVE", Type: 11}, {Code: "REMOVE", Type: 1}, {Code: "SHAKE"}},
+	},
+	{
+		Name:     "tampering",
+		Title:    "🔧🔧 MANIPULACIÓN DEL DISPOSITIVO 🔧🔧",
+		Severity: SeverityHigh,
+		Window:   10 * time.Minute,
+		Matchers: []AlarmMatcher{{Code: "REMOVE", Type: 11}, {Code: "REMOVE", Type: 1}},
+	},
+}
+
+// alarmSeverity is the severity of an incident made of a single alarm.
+func alarmSeverity(alarm Alarm) Severity {
+	switch alarm.AlarmCode {
+	case "SOS":
+		return SeverityCritical
+	case "REMOVE":
+		if alarm.AlarmType == 1 {
+			return SeverityHigh
+		}
+		return SeverityMedium
+	case "OFFLINE", "OVERSPEED":
+		return SeverityMedium
+	case "LOWVOT", "RECOVERED":
+		return SeverityLow
+	default:
+		return SeverityInfo
+	}
+}
+
+// Incident groups the related alarms of a device. Rule is the name of the
+// correlation rule that matched, empty while the incident has unrelated or
+// single alarms.
+type Incident struct {
+	ID               string         `json:"id"`
+	Imei             string         `json:"imei"`
+	Rule             string         `json:"rule,omitempty"`
+	Title            string         `json:"title,omitempty"`
+	Severity         Severity       `json:"severity"`
+	Status           IncidentStatus `json:"status"`
+	Alarms           []Alarm        `json:"alarms"`
+	OpenedAt         time.Time      `json:"opened_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	NotifiedAt       *time.Time     `json:"notified_at,omitempty"`
+	NotifiedSeverity Severity       `json:"notified_severity,omitempty"`
+	AcknowledgedAt   *time.Time     `json:"acknowledged_at,omitempty"`
+	ClosedAt         *time.Time     `json:"closed_at,omitempty"`
+}
+
+// LastAlarm returns the most recent alarm of the incident.
+func (i *Incident) LastAlarm() Alarm {
+	return i.Alarms[len(i.Alarms)-1]
+}
+
+// contains reports whether the incident already has the alarm, polled twice.
+func (i *Incident) contains(alarm Alarm) bool {
+	for _, a := range i.Alarms {
+		if a.Time == alarm.Time && a.AlarmCode == alarm.AlarmCode && a.AlarmType == alarm.AlarmType {
+			return true
+		}
+	}
+	return false
+}
+
+// classify sets the rule, title and severity of the incident from its alarms.
+func (i *Incident) classify(rules []CorrelationRule) {
+	sort.SliceStable(i.Alarms, func(a, b int) bool { return i.Alarms[a].Time < i.Alarms[b].Time })
+	severity := SeverityInfo
+	for _, alarm := range i.Alarms {
+		severity = max(severity, alarmSeverity(alarm))
+	}
+	i.Rule, i.Title = "", ""
+	for _, rule := range rules {
+		if rule.Severity >= severity && rule.Matches(i.Alarms) {
+			i.Rule, i.Title, severity = rule.Name, rule.Title, rule.Severity
+			break
+		}
+	}
+	i.Severity = severity
+}
+
+// IncidentCorrelator groups the alarms of each device into incidents and
+// notifies each incident once, when its hold expires, instead of every alarm.
+// An incident is notified again only if its severity rises, unless it was
+// acknowledged.
+type IncidentCorrelator struct {
+	rules      []CorrelationRule
+	window     time.Duration
+	hold       time.Duration
+	closeAfter time.Duration
+	notify     func(Incident)
+	now        func() time.Time
+
+	mu        sync.Mutex
+	nextID    int64
+	incidents map[string]*Incident // incidents holds the open and acknowledged incidents.
+	byDevice  map[string]*Incident // byDevice holds the current incident of each device.
+	history   []*Incident          // history holds the last closed incidents.
+}
+
+var incidentCorrelatorInstance *IncidentCorrelator
+var incidentCorrelatorOnce sync.Once
+
+// GetIncidentCorrelator returns the correlator shared by the MessageSenders,
+// configured from the environment on the first call.
+func GetIncidentCorrelator() *IncidentCorrelator {
+	incidentCorrelatorOnce.Do(func() {
+		incidentCorrelatorInstance = NewIncidentCorrelator(
+			correlationRules,
+			getEnvDuration("INCIDENT_WINDOW", DEFAULT_INCIDENT_WINDOW),
+			getEnvDuration("INCIDENT_HOLD", DEFAULT_INCIDENT_HOLD),
+			getEnvDuration("INCIDENT_CLOSE_AFTER", DEFAULT_INCIDENT_CLOSE_AFTER),
+			notifyIncident,
+		)
+	})
+	return incidentCorrelatorInstance
+}
+
+// NewIncidentCorrelator creates a correlator that calls notify for the
+// incidents that must be notified.
+func NewIncidentCorrelator(rules []CorrelationRule, window, hold, closeAfter time.Duration, notify func(Incident)) *IncidentCorrelator {
+	return &IncidentCorrelator{
+		rules:      rules,
+		window:     window,
+		hold:       hold,
+		closeAfter: closeAfter,
+		notify:     notify,
+		now:        time.Now,
+		nextID:     time.Now().UnixMilli(),
+		incidents:  map[string]*Incident{},
+		byDevice:   map[string]*Incident{},
+	}
+}
+
+// Add groups the alarms into incidents and notifies the critical ones.
+func (c *IncidentCorrelator) Add(alarms []Alarm) {
+	sorted := append([]Alarm(nil), alarms...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
+
+	c.mu.Lock()
+	now := c.now()
+	for _, alarm := range sorted {
+		incident := c.byDevice[alarm.Imei]
+		if incident == nil || alarm.Time-incident.LastAlarm().Time > int64(c.window/time.Second) {
+			if incident != nil {
+				c.close(incident, now)
+			}
+			incident = c.open(alarm, now)
+		} else if incident.contains(alarm) {
+			continue
+		} else {
+			incident.Alarms = append(incident.Alarms, alarm)
+		}
+		incident.UpdatedAt = now
+		incident.classify(c.rules)
+	}
+	due := c.due(now, false)
+	c.mu.Unlock()
+
+	c.notifyAll(due)
+}
+
+// Tick notifies the incidents whose hold expired and closes the inactive ones.
+func (c *IncidentCorrelator) Tick() {
+	c.mu.Lock()
+	now := c.now()
+	for _, incident := range c.incidents {
+		if now.Sub(incident.UpdatedAt) >= c.closeAfter {
+			c.close(incident, now)
+		}
+	}
+	due := c.due(now, false)
+	c.mu.Unlock()
+
+	c.notifyAll(due)
+}
+
+// Flush notifies the held incidents without waiting for their hold.
+func (c *IncidentCorrelator) Flush() {
+	c.mu.Lock()
+	due := c.due(c.now(), true)
+	c.mu.Unlock()
+
+	c.notifyAll(due)
+}
+
+// Run ticks until the context is cancelled.
+func (c *IncidentCorrelator) Run(ctx context.Context) {
+	ticker := time.NewTicker(min(c.hold, c.closeAfter)/4 + time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Tick()
+		}
+	}
+}
+
+// Acknowledge marks an open incident as being handled, which stops its
+// escalation notifications.
+func (c *IncidentCorrelator) Acknowledge(id string) (Incident, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	incident, ok := c.incidents[id]
+	if !ok {
+		return Incident{}, ErrIncidentNotFound
+	}
+	if incident.Status == IncidentOpen {
+		now := c.now()
+		incident.Status = IncidentAcknowledged
+		incident.AcknowledgedAt = &now
+		incidentMetrics.Add("acknowledged", 1)
+	}
+	return copyIncident(incident), nil
+}
+
+// Close closes an incident. The next alarm of the device opens a new one.
+func (c *IncidentCorrelator) Close(id string) (Incident, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	incident, ok := c.incidents[id]
+	if !ok {
+		return Incident{}, ErrIncidentNotFound
+	}
+	c.close(incident, c.now())
+	return copyIncident(incident), nil
+}
+
+// Get returns the incident with the ID, including the closed ones kept.
+func (c *IncidentCorrelator) Get(id string) (Incident, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if incident, ok := c.incidents[id]; ok {
+		return copyIncident(incident), true
+	}
+	for _, incident := range c.history {
+		if incident.ID == id {
+			return copyIncident(incident), true
+		}
+	}
+	return Incident{}, false
+}
+
+// List returns the incidents with the status, or every incident kept if it
+// is empty, the most recent first.
+func (c *IncidentCorrelator) List(status IncidentStatus) []Incident {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []Incident
+	for _, incident := range c.incidents {
+		if status == "" || incident.Status == status {
+			list = append(list, copyIncident(incident))
+		}
+	}
+	if status == "" || status == IncidentClosed {
+		for _, incident := range c.history {
+			list = append(list, copyIncident(incident))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].OpenedAt.After(list[j].OpenedAt) })
+	return list
+}
+
+// open must be called with c.mu held.
+func (c *IncidentCorrelator) open(alarm Alarm, now time.Time) *Incident {
+	c.nextID++
+	incident := &Incident{
+		ID:       fmt.Sprintf("%d", c.nextID),
+		Imei:     alarm.Imei,
+		Status:   IncidentOpen,
+		Alarms:   []Alarm{alarm},
+		OpenedAt: now,
+	}
+	c.incidents[incident.ID] = incident
+	c.byDevice[alarm.Imei] = incident
+	incidentMetrics.Add("opened", 1)
+	return incident
+}
+
+// close must be called with c.mu held. A held incident is still notified.
+func (c *IncidentCorrelator) close(incident *Incident, now time.Time) {
+	if incident.Status == IncidentClosed {
+		return
+	}
+	incident.Status = IncidentClosed
+	incident.ClosedAt = &now
+	delete(c.incidents, incident.ID)
+	if c.byDevice[incident.Imei] == incident {
+		delete(c.byDevice, incident.Imei)
+	}
+	c.history = append(c.history, incident)
+	if len(c.history) > INCIDENT_HISTORY_SIZE {
+		c.history = c.history[len(c.history)-INCIDENT_HISTORY_SIZE:]
+	}
+	incidentMetrics.Add("closed", 1)
+}
+
+// due must be called with c.mu held. It returns the incidents to notify and
+// marks them as notified: the new ones whose hold expired since their last
+// alarm, or every new one if force is set, the critical ones at once and the
+// escalated ones. An incident whose alarms keep coming isn't held longer than
+// closeAfter since it was opened.
+func (c *IncidentCorrelator) due(now time.Time, force bool) []Incident {
+	var due []Incident
+	check := func(incident *Incident) {
+		if incident.Severity < SeverityLow || (incident.NotifiedAt != nil && incident.Severity <= incident.NotifiedSeverity) {
+			return
+		}
+		if incident.NotifiedAt == nil {
+			held := now.Sub(incident.UpdatedAt) < c.hold && now.Sub(incident.OpenedAt) < c.closeAfter
+			if !force && incident.Severity < SeverityCritical && held {
+				return
+			}
+		} else if incident.Status != IncidentOpen {
+			// Acknowledged and closed incidents aren't escalated.
+			return
+		} else {
+			incidentMetrics.Add("escalated", 1)
+		}
+		incident.NotifiedAt = &now
+		incident.NotifiedSeverity = incident.Severity
+		due = append(due, copyIncident(incident))
+	}
+	for _, incident := range c.incidents {
+		check(incident)
+	}
+	// The incidents closed before their hold expired are notified too.
+	for _, incident := range c.history {
+		if incident.NotifiedAt == nil {
+			check(incident)
+		}
+	}
+	return due
+}
+
+// notifyAll calls notify for each incident, MAX_CONCURRENT_NOTIFICATIONS at a time.
+func (c *IncidentCorrelator) notifyAll(incidents []Incident) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MAX_CONCURRENT_NOTIFICATIONS)
+	for _, incident := range incidents {
+		wg.Add(1)
+		go func(incident Incident) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			incidentMetrics.Add("notified", 1)
+			c.notify(incident)
+		}(incident)
+	}
+	wg.Wait()
+}
+
+// copyIncident returns a copy that doesn't share the alarms with the original.
+func copyIncident(incident *Incident) Incident {
+	copied := *incident
+	copied.Alarms = append([]Alarm(nil), incident.Alarms...)
+	return copied
+}
+
+// Code returns the code used to throttle the notifications of the incident:
+// its rule, or the code of its most severe alarm.
+func (i *Incident) Code() string {
+	if i.Rule != "" {
+		return i.Rule
+	}
+	code, severity := "", SeverityInfo
+	for _, alarm := range i.Alarms {
+		if s := alarmSeverity(alarm); code == "" || s > severity {
+			code, severity = alarm.AlarmCode, s
+		}
+	}
+	return code
+}
+
+// notifyIncident sends the consolidated message of an incident to the phones
+// of its device. The critical incidents always pass the throttler, and their
+// users are also called until one acknowledges them.
+func notifyIncident(incident Incident) {
+	if incident.Severity < SeverityCritical && !GetNotificationThrottler().Allow(incident.Imei, incident.Code()) {
+		logrus.WithFields(logrus.Fields{"imei": incident.Imei, "code": incident.Code()}).Info("Notification suppressed")
+		return
+	}
+	device, err := GetDeviceByImei(incident.Imei)
+	if err != nil {
+		logrus.WithError(err).Error("Error getting device by IMEI")
+		return
+	}
+	if device == nil {
+		logrus.Warning("Device is nil")
+		return
+	}
+	alarm := locateAlarm(incident.LastAlarm(), device)
+	codes := make([]string, len(incident.Alarms))
+	for i, a := range incident.Alarms {
+		codes[i] = a.AlarmCode
+	}
+	sendNotification(Notification{
+		Imei:     incident.Imei,
+		Codes:    codes,
+		Critical: incident.Severity >= SeverityCritical,
+		Alarm:    &alarm,
+		Build: func(language string) string {
+			return NewMessageBuilder(device, &alarm).WithLanguage(language).BuildIncidentMessage(incident)
+		},
+		Template: func(language string) map[string]string {
+			return NewMessageBuilder(device, &alarm).WithLanguage(language).TemplateValues(incident)
+		},
+	})
+	if incident.Severity >= SeverityCritical {
+		GetVoiceNotifier().Call(incident, device)
+	}
+}
+
+// incidentsHandler lists and updates the incidents. It requires the bearer
+// token of INCIDENTS_ADMIN_TOKEN, since the incidents locate the vehicles of
+// the users, and is disabled if it isn't set.
+//
+//	GET  /incidents[?status=open]       list the incidents
+//	GET  /incidents/{id}                get an incident
+//	POST /incidents/{id}/acknowledge    acknowledge an incident
+//	POST /incidents/{id}/close          close an incident
+func incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r, "INCIDENTS_ADMIN_TOKEN") {
+		return
+	}
+	correlator := GetIncidentCorrelator()
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/incidents"), "/")
+	id, action, _ := strings.Cut(path, "/")
+
+	if r.Method == http.MethodGet && action == "" {
+		if id == "" {
+			writeJSON(w, http.StatusOK, correlator.List(IncidentStatus(r.URL.Query().Get("status"))))
+			return
+		}
+		incident, ok := correlator.Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, incident)
+		return
+	}
+
+	if r.Method != http.MethodPost || id == "" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var incident Incident
+	var err error
+	switch action {
+	case "acknowledge":
+		incident, err = correlator.Acknowledge(id)
+	case "close":
+		incident, err = correlator.Close(id)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, ErrIncidentNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, incident)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCorrelator returns a correlator with a fake clock and the notified incidents.
+func testCorrelator() (*IncidentCorrelator, *time.Time, func() []Incident) {
+	var mu sync.Mutex
+	var notified []Incident
+	c := NewIncidentCorrelator(correlationRules, DEFAULT_INCIDENT_WINDOW, DEFAULT_INCIDENT_HOLD, DEFAULT_INCIDENT_CLOSE_AFTER, func(incident Incident) {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, incident)
+	})
+	now := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now, func() []Incident {
+		mu.Lock()
+		defer mu.Unlock()
+		result := notified
+		notified = nil
+		return result
+	}
+}
+
+func TestIncidentCorrelation(t *testing.T) {
+	c, now, notified := testCorrelator()
+
+	// A power cut, a dismount and a shake within minutes are a single theft.
+	c.Add([]Alarm{{Imei: "1", Time: 1700000000, AlarmCode: "REMOVE", AlarmType: 11}})
+	*now = now.Add(20 * time.Second)
+	c.Add([]Alarm{{Imei: "1", Time: 1700000030, AlarmCode: "REMOVE", AlarmType: 1}})
+	c.Tick()
+	if n := len(notified()); n != 0 {
+		t.Fatalf("expected the incident to be held, got %d notifications", n)
+	}
+	*now = now.Add(20 * time.Second)
+	c.Add([]Alarm{
+		{Imei: "1", Time: 1700000090, AlarmCode: "SHAKE"},
+		{Imei: "1", Time: 1700000030, AlarmCode: "REMOVE", AlarmType: 1}, // polled again
+	})
+
+	incidents := notified()
+	if len(incidents) != 1 {
+		t.Fatalf("expected the critical incident to be notified at once, got %d notifications", len(incidents))
+	}
+	theft := incidents[0]
+	if theft.Rule != "theft" || theft.Severity != SeverityCritical || len(theft.Alarms) != 3 {
+		t.Fatalf("unexpected incident %+v", theft)
+	}
+	*now = now.Add(2 * time.Minute)
+	c.Tick()
+	if n := len(notified()); n != 0 {
+		t.Fatalf("expected a single notification, got %d more", n)
+	}
+
+	// An alarm after the window opens a new incident, notified after the hold.
+	c.Add([]Alarm{{Imei: "1", Time: 1700003600, AlarmCode: "LOWVOT"}})
+	if previous, _ := c.Get(theft.ID); previous.Status != IncidentClosed {
+		t.Fatalf("expected the previous incident to be closed, got %s", previous.Status)
+	}
+	*now = now.Add(DEFAULT_INCIDENT_HOLD)
+	c.Tick()
+	incidents = notified()
+	if len(incidents) != 1 || incidents[0].Severity != SeverityLow || incidents[0].ID == theft.ID {
+		t.Fatalf("unexpected notifications %+v", incidents)
+	}
+
+	// The incident is escalated when its severity rises.
+	c.Add([]Alarm{{Imei: "1", Time: 1700003660, AlarmCode: "REMOVE", AlarmType: 1}})
+	if incidents = notified(); len(incidents) != 1 || incidents[0].Severity != SeverityHigh {
+		t.Fatalf("expected an escalation, got %+v", incidents)
+	}
+
+	// Shakes alone aren't notified.
+	c.Add([]Alarm{{Imei: "2", Time: 1700000000, AlarmCode: "SHAKE"}})
+	c.Flush()
+	if n := len(notified()); n != 0 {
+		t.Fatalf("expected no notification for a shake, got %d", n)
+	}
+}
+
+func TestIncidentHeldUntilCorrelated(t *testing.T) {
+	c, now, notified := testCorrelator()
+
+	// A power cut, a dismount and a shake minutes apart are notified once,
+	// as a theft, instead of a medium, a high and a critical incident.
+	alarms := []Alarm{
+		{Imei: "1", Time: 1700000000, AlarmCode: "REMOVE", AlarmType: 11},
+		{Imei: "1", Time: 1700000240, AlarmCode: "REMOVE", AlarmType: 1},
+		{Imei: "1", Time: 1700000480, AlarmCode: "SHAKE"},
+	}
+	var incidents []Incident
+	for _, alarm := range alarms {
+		c.Add([]Alarm{alarm})
+		*now = now.Add(4 * time.Minute)
+		c.Tick()
+		incidents = append(incidents, notified()...)
+	}
+	*now = now.Add(DEFAULT_INCIDENT_CLOSE_AFTER)
+	c.Tick()
+	incidents = append(incidents, notified()...)
+	if len(incidents) != 1 || incidents[0].Rule != "theft" || len(incidents[0].Alarms) != 3 {
+		t.Fatalf("expected a single theft notification, got %+v", incidents)
+	}
+
+	// The incident is notified after the hold since its last alarm.
+	c.Add([]Alarm{{Imei: "2", Time: 1700000000, AlarmCode: "REMOVE", AlarmType: 11}})
+	*now = now.Add(DEFAULT_INCIDENT_HOLD / 2)
+	c.Add([]Alarm{{Imei: "2", Time: 1700000300, AlarmCode: "LOWVOT"}})
+	*now = now.Add(DEFAULT_INCIDENT_HOLD / 2)
+	c.Tick()
+	if n := len(notified()); n != 0 {
+		t.Fatalf("expected the incident to be held, got %d notifications", n)
+	}
+	*now = now.Add(DEFAULT_INCIDENT_HOLD / 2)
+	c.Tick()
+	if incidents := notified(); len(incidents) != 1 || len(incidents[0].Alarms) != 2 {
+		t.Fatalf("expected a single notification after the hold, got %+v", incidents)
+	}
+}
+
+func TestIncidentLifecycle(t *testing.T) {
+	c, now, notified := testCorrelator()
+
+	c.Add([]Alarm{{Imei: "1", Time: 1700000000, AlarmCode: "REMOVE", AlarmType: 11}})
+	c.Flush()
+	incidents := notified()
+	if len(incidents) != 1 {
+		t.Fatalf("expected Flush to notify the held incident, got %d", len(incidents))
+	}
+	id := incidents[0].ID
+
+	incident, err := c.Acknowledge(id)
+	if err != nil || incident.Status != IncidentAcknowledged {
+		t.Fatalf("Acknowledge failed: %v %+v", err, incident)
+	}
+	// Acknowledged incidents aren't escalated.
+	c.Add([]Alarm{{Imei: "1", Time: 1700000060, AlarmCode: "SOS"}})
+	if n := len(notified()); n != 0 {
+		t.Fatalf("expected no escalation, got %d notifications", n)
+	}
+
+	// Inactive incidents are closed.
+	*now = now.Add(31 * time.Minute)
+	c.Tick()
+	if incident, _ := c.Get(id); incident.Status != IncidentClosed || incident.ClosedAt == nil {
+		t.Fatalf("expected the incident to be closed, got %+v", incident)
+	}
+	if open := c.List(IncidentOpen); len(open) != 0 {
+		t.Fatalf("expected no open incidents, got %d", len(open))
+	}
+	if _, err := c.Close("unknown"); err != ErrIncidentNotFound {
+		t.Fatalf("expected ErrIncidentNotFound, got %v", err)
+	}
+}
+
+func TestIncidentsHandler(t *testing.T) {
+	c, _, _ := testCorrelator()
+	incidentCorrelatorOnce.Do(func() {})
+	previous := incidentCorrelatorInstance
+	incidentCorrelatorInstance = c
+	t.Cleanup(func() { incidentCorrelatorInstance = previous })
+	t.Setenv("INCIDENTS_ADMIN_TOKEN", "admin")
+
+	c.Add([]Alarm{{Imei: "1", Time: 1700000000, AlarmCode: "LOWVOT"}})
+	id := c.List("")[0].ID
+
+	w := httptest.NewRecorder()
+	incidentsHandler(w, httptest.NewRequest(http.MethodGet, "/incidents?status=open", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 listing without token, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	incidentsHandler(w, httptest.NewRequest(http.MethodGet, "/incidents/"+id, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 getting without token, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/incidents?status=open", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	incidentsHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	incidentsHandler(w, httptest.NewRequest(http.MethodPost, "/incidents/"+id+"/acknowledge", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without token, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/incidents/"+id+"/close", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	incidentsHandler(w, r)
+	if incident, _ := c.Get(id); w.Code != http.StatusOK || incident.Status != IncidentClosed {
+		t.Fatalf("expected the incident to be closed, got status %d and %+v", w.Code, incident)
+	}
+}
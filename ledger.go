@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	twilioclient "github.com/twilio/twilio-go/client"
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// NotificationStatus is the delivery status of a notification in the ledger.
+type NotificationStatus string
+
+const (
+	NotificationQueued    NotificationStatus = "queued"
+	NotificationSent      NotificationStatus = "sent"
+	NotificationDelivered NotificationStatus = "delivered"
+	NotificationRead      NotificationStatus = "read"
+	NotificationFailed    NotificationStatus = "failed"
+)
+
+// notificationStatusRanks orders the statuses of a successful delivery.
+var notificationStatusRanks = map[NotificationStatus]int{
+	NotificationQueued:    0,
+	NotificationSent:      1,
+	NotificationDelivered: 2,
+	NotificationRead:      3,
+}
+
+// CanTransition reports whether a notification with the status may move to
+// next. The statuses only move forward, and failed is final.
+func (s NotificationStatus) CanTransition(next NotificationStatus) bool {
+	if s == NotificationFailed || s == next {
+		return false
+	}
+	if next == NotificationFailed {
+		return true
+	}
+	current, ok := notificationStatusRanks[s]
+	if !ok {
+		return true
+	}
+	rank, ok := notificationStatusRanks[next]
+	return ok && rank > current
+}
+
+// StatusTransition is a status of a notification and when it was reached.
+type StatusTransition struct {
+	Status NotificationStatus `json:"status"`
+	At     time.Time          `json:"at"`
+}
+
+// twilioNotificationStatus maps the status of a Twilio message or call to the
+// ledger. An answered call is delivered.
+func twilioNotificationStatus(status string) (NotificationStatus, bool) {
+	switch status {
+	case "accepted", "scheduled", "queued":
+		return NotificationQueued, true
+	case "sending", "sent", "initiated", "ringing":
+		return NotificationSent, true
+	case "delivered", "in-progress", "completed":
+		return NotificationDelivered, true
+	case "read":
+		return NotificationRead, true
+	case "failed", "undelivered", "canceled", "busy", "no-answer":
+		return NotificationFailed, true
+	default:
+		return "", false
+	}
+}
+
+// ledgerMetrics publishes the counters of the status callbacks by status.
+var ledgerMetrics = expvar.NewMap("notification_ledger")
+
+// recordNotification archives the result of sending a message to a phone in
+// the delivery ledger.
+func recordNotification(imei string, alarm *Alarm, user, phone, channel string, resp *api.ApiV2010Message, sendErr error) {
+	var sid, status string
+	if resp != nil {
+		sid, status = stringValue(resp.Sid), stringValue(resp.Status)
+	}
+	recordAttempt(imei, alarm, user, phone, channel, sid, status, sendErr)
+}
+
+// recordAttempt archives a notification with the SID and the Twilio status
+// returned when it was created.
+func recordAttempt(imei string, alarm *Alarm, user, phone, channel, sid, twilioStatus string, sendErr error) {
+	if alarmArchive == nil {
+		return
+	}
+	now := time.Now()
+	attempt := NotificationAttempt{
+		Imei:        imei,
+		User:        user,
+		Phone:       phone,
+		Channel:     channel,
+		At:          now,
+		Transitions: []StatusTransition{{Status: NotificationQueued, At: now}},
+	}
+	if alarm != nil {
+		attempt.AlarmCode = alarm.AlarmCode
+		attempt.AlarmTime = alarm.Time
+	}
+
+	status := NotificationQueued
+	if sendErr != nil {
+		status = NotificationFailed
+		attempt.Error = sendErr.Error()
+		var restErr *twilioclient.TwilioRestError
+		if errors.As(sendErr, &restErr) {
+			attempt.ErrorCode = restErr.Code
+			attempt.Error = restErr.Message
+		}
+	} else {
+		if sid != "" {
+			attempt.SID = sid
+			status = NotificationSent
+		}
+		if mapped, ok := twilioNotificationStatus(twilioStatus); ok {
+			status = mapped
+		}
+	}
+	attempt.Status = status
+	if status != NotificationQueued {
+		attempt.Transitions = append(attempt.Transitions, StatusTransition{Status: status, At: now})
+	}
+
+	if err := alarmArchive.RecordNotification(attempt); err != nil {
+		logrus.WithError(err).Warning("Error archiving the notification")
+	}
+}
+
+// stringValue returns the string of an optional field of the Twilio API.
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// twilioStatusHandler receives the status callbacks of the messages sent with
+// TWILIO_STATUS_CALLBACK_URL, the public URL of this route, and records them
+// in the ledger. The requests must be signed by Twilio.
+func twilioStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	if !validTwilioRequest(r, os.Getenv("TWILIO_STATUS_CALLBACK_URL")) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	sid := r.PostForm.Get("MessageSid")
+	status, ok := twilioNotificationStatus(r.PostForm.Get("MessageStatus"))
+	if sid == "" || !ok {
+		// Unknown statuses are acknowledged so Twilio doesn't retry them.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	errorCode, _ := strconv.Atoi(r.PostForm.Get("ErrorCode"))
+	ledgerMetrics.Add(string(status), 1)
+
+	if alarmArchive != nil {
+		found, err := alarmArchive.UpdateNotificationStatus(sid, status, errorCode, r.PostForm.Get("ErrorMessage"), time.Now())
+		if err != nil {
+			logrus.WithError(err).Warning("Error updating the notification status")
+			http.Error(w, "error updating the status", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			ledgerMetrics.Add("unknown_sid", 1)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validTwilioRequest checks the X-Twilio-Signature of a callback, signed
+// over its public URL with TWILIO_AUTH_TOKEN.
+func validTwilioRequest(r *http.Request, callbackURL string) bool {
+	authToken := os.Getenv("TWILIO_AUTH_TOKEN")
+	if callbackURL == "" || authToken == "" {
+		return false
+	}
+	params := map[string]string{}
+	for key, values := range r.PostForm {
+		params[key] = values[0]
+	}
+	validator := twilioclient.NewRequestValidator(authToken)
+	return validator.Validate(callbackURL, params, r.Header.Get("X-Twilio-Signature"))
+}
+
+// notificationsHandler lists the ledger entries. It requires the bearer token
+// of NOTIFICATIONS_ADMIN_TOKEN, since the entries have the users' phones.
+//
+//	GET /notifications?imei=IMEI&from=DATE&to=DATE&code=SOS,REMOVE&phone=PHONE
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(w, r, "NOTIFICATIONS_ADMIN_TOKEN") {
+		return
+	}
+	if alarmArchive == nil {
+		http.Error(w, "the archive is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	var from, to time.Time
+	if params.Get("from") != "" {
+		var err error
+		from, to, err = parseCLIRange(params.Get("from"), params.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	attempts, err := LedgerEntries(params.Get("imei"), from, to, params.Get("code"), params.Get("phone"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, attempts)
+}
+
+// LedgerEntries returns the notifications of the archive in [from, to),
+// filtered by device, alarm codes (comma-separated) and phone. Empty
+// arguments don't filter.
+func LedgerEntries(imei string, from, to time.Time, codes, phone string) ([]NotificationAttempt, error) {
+	if alarmArchive == nil {
+		return nil, errors.New("the archive is disabled")
+	}
+	attempts, err := alarmArchive.Notifications(imei, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if phone != "" {
+		if normalized, err := NormalizePhoneNumber(phone); err == nil {
+			phone = normalized
+		}
+	}
+	filter := NewEventFilter(nil, nil, []string{codes})
+	filtered := attempts[:0]
+	for _, attempt := range attempts {
+		if len(filter.Codes) > 0 && !filter.Codes[attempt.AlarmCode] {
+			continue
+		}
+		if phone != "" && attempt.Phone != phone {
+			continue
+		}
+		filtered = append(filtered, attempt)
+	}
+	return filtered, nil
+}
+
+// formatLedgerError returns the error of an entry with its code, if any.
+func formatLedgerError(attempt NotificationAttempt) string {
+	if attempt.ErrorCode == 0 {
+		return attempt.Error
+	}
+	return strings.TrimSpace(strconv.Itoa(attempt.ErrorCode) + " " + attempt.Error)
+}
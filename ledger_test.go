@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	twilioclient "github.com/twilio/twilio-go/client"
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+func TestNotificationStatusTransitions(t *testing.T) {
+	for _, test := range []struct {
+		from, to NotificationStatus
+		allowed  bool
+	}{
+		{NotificationQueued, NotificationSent, true},
+		{NotificationSent, NotificationRead, true},
+		{NotificationDelivered, NotificationSent, false},
+		{NotificationRead, NotificationDelivered, false},
+		{NotificationDelivered, NotificationFailed, true},
+		{NotificationFailed, NotificationDelivered, false},
+		{NotificationSent, NotificationSent, false},
+	} {
+		if got := test.from.CanTransition(test.to); got != test.allowed {
+			t.Errorf("%s -> %s: expected %t, got %t", test.from, test.to, test.allowed, got)
+		}
+	}
+}
+
+func TestNotificationLedger(t *testing.T) {
+	archive := useTestArchive(t)
+	alarm := &Alarm{Imei: "1", Time: 1700000000, AlarmCode: "SOS"}
+	sid, queued := "SM1", "queued"
+	recordNotification("1", alarm, "owner", "+593991234567", ChannelWhatsApp, &api.ApiV2010Message{Sid: &sid, Status: &queued}, nil)
+	recordNotification("1", alarm, "driver", "+593987654321", ChannelSMS, nil,
+		&twilioclient.TwilioRestError{Code: 21211, Message: "Invalid 'To' Phone Number"})
+	recordNotification("1", &Alarm{Imei: "1", Time: 1700000060, AlarmCode: "LOWVOT"}, "owner", "+593991234567", ChannelWhatsApp, nil, errors.New("timeout"))
+
+	// The statuses only move forward.
+	at := time.Now()
+	for _, status := range []NotificationStatus{NotificationSent, NotificationDelivered, NotificationSent, NotificationRead} {
+		at = at.Add(time.Second)
+		if found, err := archive.UpdateNotificationStatus(sid, status, 0, "", at); err != nil || !found {
+			t.Fatalf("UpdateNotificationStatus failed: %v %t", err, found)
+		}
+	}
+	if found, _ := archive.UpdateNotificationStatus("unknown", NotificationRead, 0, "", at); found {
+		t.Fatal("expected an unknown SID not to be found")
+	}
+
+	entries, err := LedgerEntries("1", time.Time{}, time.Time{}, "SOS", "")
+	if err != nil {
+		t.Fatalf("LedgerEntries failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 SOS entries, got %d", len(entries))
+	}
+	owner, driver := entries[0], entries[1]
+	var statuses []string
+	for _, transition := range owner.Transitions {
+		statuses = append(statuses, string(transition.Status))
+	}
+	if owner.User != "owner" || owner.Status != NotificationRead || strings.Join(statuses, ",") != "queued,sent,delivered,read" {
+		t.Fatalf("unexpected owner entry %+v", owner)
+	}
+	if driver.Status != NotificationFailed || driver.ErrorCode != 21211 || driver.SID != "" {
+		t.Fatalf("unexpected driver entry %+v", driver)
+	}
+	if entries, _ := LedgerEntries("", time.Time{}, time.Time{}, "", "0991234567"); len(entries) != 2 {
+		t.Fatalf("expected 2 entries of the owner's phone, got %d", len(entries))
+	}
+}
+
+// signTwilioRequest returns the X-Twilio-Signature of a form posted to url.
+func signTwilioRequest(authToken, url string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data := url
+	for _, key := range keys {
+		data += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTwilioStatusHandler(t *testing.T) {
+	archive := useTestArchive(t)
+	callbackURL := "https://alarms.example.com/twilio/status"
+	t.Setenv("TWILIO_STATUS_CALLBACK_URL", callbackURL)
+	t.Setenv("TWILIO_AUTH_TOKEN", "token")
+	archive.RecordNotification(NotificationAttempt{Imei: "1", AlarmCode: "SOS", Phone: "+593991234567", Channel: ChannelWhatsApp, SID: "SM1"})
+
+	post := func(form url.Values, signature string) int {
+		r := httptest.NewRequest(http.MethodPost, "/twilio/status", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Twilio-Signature", signature)
+		w := httptest.NewRecorder()
+		twilioStatusHandler(w, r)
+		return w.Code
+	}
+
+	form := url.Values{"MessageSid": {"SM1"}, "MessageStatus": {"undelivered"}, "ErrorCode": {"63016"}}
+	if code := post(form, "invalid"); code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for an invalid signature, got %d", code)
+	}
+	if code := post(form, signTwilioRequest("token", callbackURL, form)); code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", code)
+	}
+
+	attempts, _ := archive.Notifications("1", time.Time{}, time.Time{})
+	if len(attempts) != 1 || attempts[0].Status != NotificationFailed || attempts[0].ErrorCode != 63016 {
+		t.Fatalf("unexpected ledger %+v", attempts)
+	}
+}
+
+func TestNotificationsHandler(t *testing.T) {
+	archive := useTestArchive(t)
+	archive.RecordNotification(NotificationAttempt{Imei: "1", AlarmCode: "SOS", Phone: "+593991234567", Channel: ChannelWhatsApp, SID: "SM1"})
+	archive.RecordNotification(NotificationAttempt{Imei: "2", AlarmCode: "SOS", Phone: "+593987654321", Channel: ChannelWhatsApp, SID: "SM2"})
+	t.Setenv("NOTIFICATIONS_ADMIN_TOKEN", "admin")
+
+	r := httptest.NewRequest(http.MethodGet, "/notifications?imei=1&code=SOS", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	notificationsHandler(w, r)
+	var attempts []NotificationAttempt
+	if err := json.NewDecoder(w.Body).Decode(&attempts); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %v", w.Code, err)
+	}
+	if len(attempts) != 1 || attempts[0].SID != "SM1" || attempts[0].Status != NotificationSent || attempts[0].ID == "" {
+		t.Fatalf("unexpected entries %+v", attempts)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,27 +12,51 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// init performs initial setup before the main function executes.
+// setup performs the initial setup before any command executes.
 // It initializes logging and loads environment variables from .env files.
-// It also initializes the authenticator for handling API authentication.
-func init() {
+// It also initializes the authenticator for handling API authentication, the
+// API clients, the local archive, the webhook subscriptions, the recipient
+// preferences, the WhatsApp templates, the digest subscriptions and the speed
+// limits.
+func setup() {
 	initLog()
 	err := godotenv.Load(".env", ".env.development")
 	if err != nil {
 		logrus.Fatal("Error loading .env file")
 	}
 	authenticator = auth.InitAuthenticator()
+	initClients()
+	initArchive()
+	initWebhooks()
+	initRecipients()
+	initWhatsAppTemplates()
+	initDigests()
+	initSpeedLimits()
 }
 
-// authenticator holds an instance of the Authenticator which manages authentication.
-var authenticator *auth.Authenticator
+// authenticator manages the IOPGPS access token used by the alarm requests.
+var authenticator auth.Authenticate
 
-// main sets up signal handling and starts background goroutines.
-// It listens for OS termination signals to gracefully shut down the application.
+// main runs the command given in the arguments, "run" by default.
 func main() {
+	setup()
+	err := runCLI(os.Args[1:])
+	if alarmArchive != nil {
+		alarmArchive.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// runService sets up signal handling and starts background goroutines.
+// It listens for OS termination signals to gracefully shut down the application.
+func runService() {
 	// Initiates token renewal and alarm tracking in separate goroutines.
 	go authenticator.InitiateTokenRenewal()
 	go InitiateTrackingAlarms()
+	server := startHTTPServer()
 
 	// Creates a channel to receive operating system signals.
 	sigChan := make(chan os.Signal, 1)
@@ -38,7 +64,18 @@ func main() {
 
 	// Blocks until a signal is received.
 	<-sigChan
-	// Logs the reception of the signal and exits the program.
+	// Logs the reception of the signal, stops the token renewal, notifies the
+	// held incidents and the flood summaries, saves the queued alarms and
+	// checkpoints and stops the HTTP server.
 	logrus.Info("Program terminated by interrupt signal")
-	os.Exit(0)
+	authenticator.Stop()
+	GetIncidentCorrelator().Flush()
+	GetNotificationThrottler().Flush()
+	if err := GetAlarmBatcher().Flush(); err != nil {
+		logrus.WithError(err).Warning("Alarms lost on shutdown")
+	}
+	if err := GetDeviceSync().Flush(context.Background()); err != nil {
+		logrus.WithError(err).Warning("Device checkpoints lost on shutdown")
+	}
+	stopHTTPServer(server)
 }
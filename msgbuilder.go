@@ -2,23 +2,107 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type MessageBuilder struct {
-	device *Device
-	alarm  *Alarm
+	device   *Device
+	alarm    *Alarm
+	language string
 }
 
 func NewMessageBuilder(device *Device, alarm *Alarm) *MessageBuilder {
 	return &MessageBuilder{
-		device: device,
-		alarm:  alarm,
+		device:   device,
+		alarm:    alarm,
+		language: LanguageSpanish,
 	}
 }
 
+// WithLanguage sets the language of the messages, Spanish by default.
+func (mb *MessageBuilder) WithLanguage(language string) *MessageBuilder {
+	mb.language = language
+	return mb
+}
+
+// englishTexts are the translations of the texts of the messages.
+var englishTexts = map[string]string{
+	"\nUbicación desconocida\n":              "\nUnknown location\n",
+	"Ubicación":                              "Location",
+	"\nEnlace a Google Maps: ":               "\nGoogle Maps link: ",
+	"%s\nDatos del usuario:\nUsuario: %s":    "%s\nUser details:\nUser: %s",
+	"Propietario":                            "Owner",
+	"Placa del vehículo":                     "License plate",
+	"\nHora de alarma: %s":                   "\nAlarm time: %s",
+	"%d ALERTAS RELACIONADAS":                "%d RELATED ALERTS",
+	"\nAlertas:":                             "\nAlerts:",
+	"⚠️⚠️ RÁFAGA DE ALERTAS ⚠️⚠️":            "⚠️⚠️ ALERT FLOOD ⚠️⚠️",
+	"\nSe omitieron %d alertas:":             "\n%d alerts were omitted:",
+	"🚨🚨 POSIBLE ROBO DEL VEHÍCULO 🚨🚨":        "🚨🚨 POSSIBLE VEHICLE THEFT 🚨🚨",
+	"🔧🔧 MANIPULACIÓN DEL DISPOSITIVO 🔧🔧":     "🔧🔧 DEVICE TAMPERING 🔧🔧",
+	"🚨🚨 ALERTA DE SOS 🚨🚨":                    "🚨🚨 SOS ALERT 🚨🚨",
+	"🔧🔧 ALERTA DE DESMONTAJE 🔧🔧":             "🔧🔧 DISMOUNT ALERT 🔧🔧",
+	"💡💡 ALERTA DE SENSOR DE LUZ 💡💡":          "💡💡 LIGHT SENSOR ALERT 💡💡",
+	"⚡⚡ ALERTA DE CORTE DE CORRIENTE ⚡⚡":     "⚡⚡ POWER CUT ALERT ⚡⚡",
+	"⚡⚡ ALERTA DE CORRIENTE BAJA ⚡⚡":         "⚡⚡ LOW BATTERY ALERT ⚡⚡",
+	"📳📳 ALERTA DE VIBRACIÓN 📳📳":              "📳📳 VIBRATION ALERT 📳📳",
+	"🧪🧪 MENSAJE DE PRUEBA 🧪🧪":                "🧪🧪 TEST MESSAGE 🧪🧪",
+	"ALERTA DESCONOCIDA":                     "UNKNOWN ALERT",
+	"%s. Vehículo de %s":                     "%s. Vehicle of %s",
+	", placa %s":                             ", license plate %s",
+	". Ubicación: %s":                        ". Location: %s",
+	". Ubicación desconocida":                ". Unknown location",
+	". Presione 1 para confirmar la alerta.": ". Press 1 to acknowledge the alert.",
+	"Alerta confirmada. Gracias.":            "Alert acknowledged. Thank you.",
+	"Ubicación de la alarma":                 "Alarm location",
+	"Resumen diario de alarmas":              "Daily alarm digest",
+	"Resumen semanal de alarmas":             "Weekly alarm digest",
+	"Flota":                                  "Fleet",
+	"Periodo":                                "Period",
+	"Total de alarmas":                       "Total alarms",
+	"Dispositivo":                            "Device",
+	"Última alarma":                          "Last alarm",
+	"Sin alarmas en el periodo.":             "No alarms in the period.",
+	"No se confirmó la alerta.":              "The alert was not acknowledged.",
+
+	// Alarms of the DeviceWatchdog.
+	"📴📴 DISPOSITIVO SIN REPORTAR 📴📴":          "📴📴 DEVICE NOT REPORTING 📴📴",
+	"📶📶 DISPOSITIVO REPORTANDO NUEVAMENTE 📶📶": "📶📶 DEVICE REPORTING AGAIN 📶📶",
+
+	// Replies to UBICACION.
+	"📍📍 UBICACIÓN DEL VEHÍCULO 📍📍":               "📍📍 VEHICLE LOCATION 📍📍",
+	"\nEl vehículo no ha reportado su posición.": "\nThe vehicle has not reported its position.",
+	"\nHora del reporte: %s":                     "\nReport time: %s",
+	"Velocidad":                                  "Speed",
+	"Motor":                                      "Engine",
+	"encendido":                                  "on",
+	"apagado":                                    "off",
+	"No hay vehículos con la placa %s.":          "There are no vehicles with the license plate %s.",
+	"Envíe UBICACION seguido de la placa para ver otro vehículo.": "Send UBICACION followed by the license plate to see another vehicle.",
+
+	// Alarms of the OverspeedEvaluator.
+	"🚗🚗 ALERTA DE EXCESO DE VELOCIDAD 🚗🚗": "🚗🚗 OVERSPEED ALERT 🚗🚗",
+}
+
+// text returns the text in the language of the builder.
+func (mb *MessageBuilder) text(spanish string) string {
+	return translate(mb.language, spanish)
+}
+
+// translate returns the text in the language. The texts are written in
+// Spanish.
+func translate(language, spanish string) string {
+	if language == LanguageEnglish {
+		if english, ok := englishTexts[spanish]; ok {
+			return english
+		}
+	}
+	return spanish
+}
+
 func unixToLocal(unixTime int64) (time.Time, error) {
 	loc, err := time.LoadLocation("America/Guayaquil")
 	if err != nil {
@@ -38,20 +122,21 @@ func (mb *MessageBuilder) getCoordinates() (lat, lng string) {
 }
 
 func (mb *MessageBuilder) getAlarmAddress() string {
-	const defaultLocation = "\nUbicación desconocida\n"
+	defaultLocation := mb.text("\nUbicación desconocida\n")
 	lat, lng := mb.getCoordinates()
 	if lat == "" || lng == "" {
 		return defaultLocation
 	}
+	googleMapsLink := mb.getGoogleMapsLink()
 	address := GetAddress(lat, lng)
 	if address == nil {
-		return defaultLocation
+		// Without geocoding the coordinates and the link still locate the alarm.
+		return mb.addDetail(mb.text("Ubicación"), lat+", "+lng) + mb.text("\nEnlace a Google Maps: ") + googleMapsLink
 	}
-	googleMapsLink := mb.getGoogleMapsLink()
 	if googleMapsLink != "" {
-		return mb.addDetail("Ubicación", *address) + "\nEnlace a Google Maps: " + googleMapsLink
+		return mb.addDetail(mb.text("Ubicación"), *address) + mb.text("\nEnlace a Google Maps: ") + googleMapsLink
 	}
-	return mb.addDetail("Ubicación", *address)
+	return mb.addDetail(mb.text("Ubicación"), *address)
 }
 
 func (mb *MessageBuilder) getGoogleMapsLink() string {
@@ -70,15 +155,166 @@ func (mb *MessageBuilder) BuildMessage() string {
 	}
 	carOwner, licenseNumber, vin := mb.getUserDetails()
 	alert := mb.getAlert()
-	message := fmt.Sprintf("%s\nDatos del usuario:\nUsuario: %s", alert, mb.device.UserName)
-	message += mb.addDetail("Propietario", carOwner)
-	message += mb.addDetail("Placa del vehículo", licenseNumber)
+	message := fmt.Sprintf(mb.text("%s\nDatos del usuario:\nUsuario: %s"), alert, mb.device.UserName)
+	message += mb.addDetail(mb.text("Propietario"), carOwner)
+	message += mb.addDetail(mb.text("Placa del vehículo"), licenseNumber)
 	message += mb.addDetail("Vin", vin)
-	message += fmt.Sprintf("\nHora de alarma: %s", localTime)
+	message += fmt.Sprintf(mb.text("\nHora de alarma: %s"), localTime)
+	if mb.alarm.AlarmCode == "OVERSPEED" && mb.alarm.Speed != nil {
+		message += mb.addDetail(mb.text("Velocidad"), fmt.Sprintf("%d km/h", *mb.alarm.Speed))
+	}
 	message += mb.getAlarmAddress()
 	return message
 }
 
+// BuildIncidentMessage builds the consolidated message of an incident. An
+// incident of a single alarm gets the message of the alarm. mb.alarm must be
+// the last alarm of the incident, whose location is sent.
+func (mb *MessageBuilder) BuildIncidentMessage(incident Incident) string {
+	if len(incident.Alarms) == 1 {
+		return mb.BuildMessage()
+	}
+	title := mb.text(incident.Title)
+	if title == "" {
+		title = fmt.Sprintf(mb.text("%d ALERTAS RELACIONADAS"), len(incident.Alarms))
+	}
+	carOwner, licenseNumber, vin := mb.getUserDetails()
+	message := fmt.Sprintf(mb.text("%s\nDatos del usuario:\nUsuario: %s"), title, mb.device.UserName)
+	message += mb.addDetail(mb.text("Propietario"), carOwner)
+	message += mb.addDetail(mb.text("Placa del vehículo"), licenseNumber)
+	message += mb.addDetail("Vin", vin)
+	message += mb.text("\nAlertas:")
+	for i := range incident.Alarms {
+		alarm := incident.Alarms[i]
+		localTime, err := unixToLocal(alarm.Time)
+		if err != nil {
+			logrus.WithError(err).Error("Error converting unix time to local")
+		}
+		alert := NewMessageBuilder(mb.device, &alarm).WithLanguage(mb.language).getAlert()
+		message += fmt.Sprintf("\n- %s: %s", localTime.Format("15:04:05"), strings.Trim(alert, "🚨🔧💡⚡📳📴📶🚗🧪 "))
+	}
+	message += mb.getAlarmAddress()
+	return message
+}
+
+// BuildFloodSummaryMessage builds the summary of the notifications of the
+// device suppressed during a flood, by code. mb.alarm isn't used.
+func (mb *MessageBuilder) BuildFloodSummaryMessage(suppressed map[string]int) string {
+	total := 0
+	for _, count := range suppressed {
+		total += count
+	}
+	carOwner, licenseNumber, vin := mb.getUserDetails()
+	message := fmt.Sprintf(mb.text("%s\nDatos del usuario:\nUsuario: %s"), mb.text("⚠️⚠️ RÁFAGA DE ALERTAS ⚠️⚠️"), mb.device.UserName)
+	message += mb.addDetail(mb.text("Propietario"), carOwner)
+	message += mb.addDetail(mb.text("Placa del vehículo"), licenseNumber)
+	message += mb.addDetail("Vin", vin)
+	message += fmt.Sprintf(mb.text("\nSe omitieron %d alertas:"), total)
+	for _, code := range sortedCodes(suppressed) {
+		message += fmt.Sprintf("\n- %s: %d", code, suppressed[code])
+	}
+	return message
+}
+
+// BuildVoiceMessage builds the text read in the voice calls of an incident,
+// without emojis or links. The plate is spelled out and the address is read
+// instead of the coordinates. mb.alarm must be the last alarm of the incident.
+func (mb *MessageBuilder) BuildVoiceMessage(incident Incident) string {
+	title := mb.getAlert()
+	if len(incident.Alarms) > 1 && incident.Title != "" {
+		title = mb.text(incident.Title)
+	}
+	_, licenseNumber, _ := mb.getUserDetails()
+	message := fmt.Sprintf(mb.text("%s. Vehículo de %s"), strings.Trim(title, "🚨🔧💡⚡📳📴📶🚗🧪 "), mb.device.UserName)
+	if licenseNumber != "" {
+		message += fmt.Sprintf(mb.text(", placa %s"), spellOut(licenseNumber))
+	}
+	lat, lng := mb.getCoordinates()
+	var address *string
+	if lat != "" && lng != "" {
+		address = GetAddress(lat, lng)
+	}
+	if address != nil {
+		message += fmt.Sprintf(mb.text(". Ubicación: %s"), *address)
+	} else {
+		message += mb.text(". Ubicación desconocida")
+	}
+	return message + mb.text(". Presione 1 para confirmar la alerta.")
+}
+
+// TemplateValues returns the values of the WhatsApp templates of an incident,
+// by variable name. mb.alarm must be the last alarm of the incident.
+func (mb *MessageBuilder) TemplateValues(incident Incident) map[string]string {
+	title := mb.getAlert()
+	if len(incident.Alarms) > 1 && incident.Title != "" {
+		title = mb.text(incident.Title)
+	}
+	carOwner, licenseNumber, vin := mb.getUserDetails()
+	values := map[string]string{
+		"alert":     strings.Trim(title, "🚨🔧💡⚡📳📴📶🚗🧪 "),
+		"user":      mb.device.UserName,
+		"owner":     carOwner,
+		"plate":     licenseNumber,
+		"vin":       vin,
+		"imei":      mb.alarm.Imei,
+		"maps_link": mb.getGoogleMapsLink(),
+	}
+	if localTime, err := unixToLocal(mb.alarm.Time); err == nil {
+		values["time"] = localTime.Format("2006-01-02 15:04:05")
+	}
+	lat, lng := mb.getCoordinates()
+	if lat != "" && lng != "" {
+		if address := GetAddress(lat, lng); address != nil {
+			values["address"] = *address
+		} else {
+			values["address"] = lat + ", " + lng
+		}
+	}
+	return values
+}
+
+// BuildPositionMessage builds the reply to UBICACION with the last position
+// of the device, nil if it never reported one.
+func (mb *MessageBuilder) BuildPositionMessage(position *Position) string {
+	carOwner, licenseNumber, vin := mb.getUserDetails()
+	message := fmt.Sprintf(mb.text("%s\nDatos del usuario:\nUsuario: %s"), mb.text("📍📍 UBICACIÓN DEL VEHÍCULO 📍📍"), mb.device.UserName)
+	message += mb.addDetail(mb.text("Propietario"), carOwner)
+	message += mb.addDetail(mb.text("Placa del vehículo"), licenseNumber)
+	message += mb.addDetail("Vin", vin)
+	if position == nil {
+		return message + mb.text("\nEl vehículo no ha reportado su posición.")
+	}
+	localTime, err := unixToLocal(position.Time)
+	if err != nil {
+		logrus.WithError(err).Error("Error converting unix time to local")
+	}
+	message += fmt.Sprintf(mb.text("\nHora del reporte: %s"), localTime)
+	if position.Speed != nil {
+		message += mb.addDetail(mb.text("Velocidad"), fmt.Sprintf("%d km/h", *position.Speed))
+	}
+	if position.Acc != nil {
+		state := mb.text("apagado")
+		if *position.Acc {
+			state = mb.text("encendido")
+		}
+		message += mb.addDetail(mb.text("Motor"), state)
+	}
+	located := Alarm{Imei: position.Imei, Lat: position.Lat, Lng: position.Lng, Time: position.Time}
+	return message + NewMessageBuilder(mb.device, &located).WithLanguage(mb.language).getAlarmAddress()
+}
+
+// spellOut separates the characters of a code, so the text-to-speech reads
+// them one by one.
+func spellOut(code string) string {
+	var chars []string
+	for _, r := range code {
+		if r != '-' && r != ' ' {
+			chars = append(chars, string(r))
+		}
+	}
+	return strings.Join(chars, " ")
+}
+
 func (mb *MessageBuilder) getUserDetails() (carOwner, licenseNumber, vin string) {
 	if mb.device.CarOwner != nil {
 		carOwner = *mb.device.CarOwner
@@ -98,20 +334,30 @@ func (mb *MessageBuilder) getUserDetails() (carOwner, licenseNumber, vin string)
 func (mb *MessageBuilder) getAlert() string {
 	switch mb.alarm.AlarmCode {
 	case "SOS":
-		return "🚨🚨 ALERTA DE SOS 🚨🚨"
+		return mb.text("🚨🚨 ALERTA DE SOS 🚨🚨")
 	case "REMOVE":
 		switch mb.alarm.AlarmType {
 		case 1:
-			return "🔧🔧 ALERTA DE DESMONTAJE 🔧🔧"
+			return mb.text("🔧🔧 ALERTA DE DESMONTAJE 🔧🔧")
 		case 10:
-			return "💡💡 ALERTA DE SENSOR DE LUZ 💡💡"
+			return mb.text("💡💡 ALERTA DE SENSOR DE LUZ 💡💡")
 		default:
-			return "⚡⚡ ALERTA DE CORTE DE CORRIENTE ⚡⚡"
+			return mb.text("⚡⚡ ALERTA DE CORTE DE CORRIENTE ⚡⚡")
 		}
 	case "LOWVOT":
-		return "⚡⚡ ALERTA DE CORRIENTE BAJA ⚡⚡"
+		return mb.text("⚡⚡ ALERTA DE CORRIENTE BAJA ⚡⚡")
+	case "SHAKE":
+		return mb.text("📳📳 ALERTA DE VIBRACIÓN 📳📳")
+	case "OFFLINE":
+		return mb.text("📴📴 DISPOSITIVO SIN REPORTAR 📴📴")
+	case "RECOVERED":
+		return mb.text("📶📶 DISPOSITIVO REPORTANDO NUEVAMENTE 📶📶")
+	case "OVERSPEED":
+		return mb.text("🚗🚗 ALERTA DE EXCESO DE VELOCIDAD 🚗🚗")
+	case "TEST":
+		return mb.text("🧪🧪 MENSAJE DE PRUEBA 🧪🧪")
 	default:
-		return "ALERTA DESCONOCIDA"
+		return mb.text("ALERTA DESCONOCIDA")
 	}
 }
 
@@ -3,18 +3,29 @@ package main
 import (
 	"fmt"
 	"os"
-	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/twilio/twilio-go"
 	api "github.com/twilio/twilio-go/rest/api/v2010"
 )
 
+// MessageSender passes the alarms that may be notified to an
+// IncidentCorrelator, which groups the related alarms of each device and
+// sends a single message per incident.
 type MessageSender struct {
 	next Handler
-	mu   sync.Mutex
+
+	// correlator is the IncidentCorrelator used, GetIncidentCorrelator() if nil.
+	correlator *IncidentCorrelator
 }
 
+// notifiedAlarmCodes are the codes of the alarms correlated into incidents.
+// SHAKE alarms aren't notified alone, but they raise the severity of an
+// incident with other alarms. OFFLINE and RECOVERED are raised by the
+// DeviceWatchdog and OVERSPEED by the OverspeedEvaluator.
+var notifiedAlarmCodes = map[string]bool{"SOS": true, "LOWVOT": true, "REMOVE": true, "SHAKE": true, "OFFLINE": true, "RECOVERED": true, "OVERSPEED": true}
+
 /*
 SendMessage sends a WhatsApp message to multiple recipients using the Twilio API.
 
@@ -34,41 +45,124 @@ Example Usage:
 
 This code will send the message "Hello, World!"
 to the WhatsApp numbers associated with the device specified by the IMEI.
+The message goes through the channel of each user and respects their quiet
+hours, but isn't translated.
 */
 func SendMessage(message, imei string) {
-	if discardMessage(message) {
-		return
-	}
+	sendNotification(Notification{
+		Imei:  imei,
+		Build: func(string) string { return message },
+	})
+}
+
+// Notification is a message for the users of a device. Build returns the
+// message in a language. The users subscribed to none of Codes don't get it,
+// and Critical notifications are sent during the quiet hours. Alarm, if not
+// nil, is recorded with the attempts and located with a pin. Template, if not
+// nil, returns the values of the WhatsApp templates in a language.
+type Notification struct {
+	Imei     string
+	Codes    []string
+	Critical bool
+	Alarm    *Alarm
+	Build    func(language string) string
+	Template func(language string) map[string]string
+}
+
+// DEFAULT_TWILIO_WHATSAPP_FROM is the WhatsApp sender of the messages,
+// configurable with the TWILIO_WHATSAPP_FROM environment variable. The SMS are
+// sent from TWILIO_SMS_FROM.
+const DEFAULT_TWILIO_WHATSAPP_FROM = "+14155238886"
+
+// createTwilioMessage sends a message through Twilio. The tests replace it.
+var createTwilioMessage = func(params *api.CreateMessageParams) (*api.ApiV2010Message, error) {
 	client := twilio.NewRestClientWithParams(twilio.ClientParams{
 		Username: os.Getenv("TWILIO_ACCOUNT_SID"),
 		Password: os.Getenv("TWILIO_AUTH_TOKEN"),
 	})
+	return client.Api.CreateMessage(params)
+}
 
-	numbers, err := GetPhoneNumbersFromAPI(imei)
+// sendNotification sends the notification to the phones of the users of the
+// device, each one through its channel and in its language, and records each
+// attempt in the archive. The WhatsApp messages that fail are sent by SMS if
+// TWILIO_SMS_FROM is set.
+func sendNotification(n Notification) {
+	recipients, err := GetRecipients(n.Imei)
 	if err != nil {
 		logrus.WithError(err).Error("Error retrieving phone numbers")
 		return
 	}
 
-	for _, number := range numbers {
-		params := &api.CreateMessageParams{}
-		params.SetFrom("whatsapp:+14155238886")
-		params.SetBody(message)
-		formatedNumber := fmt.Sprintf("whatsapp:%s", number)
-		params.SetTo(formatedNumber)
-
-		resp, err := client.Api.CreateMessage(params)
-		if err != nil {
-			logrus.WithError(err).Error("Error sending message")
+	messages := map[string]outgoingMessage{}
+	for _, recipient := range uniquePhones(ResolveRecipients(recipients, n.Codes, n.Critical, time.Now())) {
+		language := recipient.Preferences.Language
+		message, ok := messages[language]
+		if !ok {
+			message = buildOutgoingMessage(n, language)
+			messages[language] = message
+		}
+		if discardMessage(message.Body) {
 			continue
 		}
 
-		if resp.Sid != nil {
-			logrus.Printf("Message sent successfully, SID: %s\n", *resp.Sid)
+		for _, number := range recipient.Phones {
+			channel := recipient.Preferences.Channel
+			resp, err := sendTwilioMessage(channel, number, message)
+			recordNotification(n.Imei, n.Alarm, recipient.User, number, channel, resp, err)
+			if err != nil && channel == ChannelWhatsApp && os.Getenv("TWILIO_SMS_FROM") != "" {
+				logrus.WithError(err).WithField("number", number).Warning("Error sending the WhatsApp message, sending an SMS")
+				templateMetrics.Add("sms_fallback", 1)
+				channel = ChannelSMS
+				resp, err = sendTwilioMessage(channel, number, message)
+				recordNotification(n.Imei, n.Alarm, recipient.User, number, channel, resp, err)
+			}
+			if err != nil {
+				logrus.WithError(err).Error("Error sending message")
+				continue
+			}
+			if channel == ChannelWhatsApp && message.ContentSid != "" {
+				templateMetrics.Add("sent", 1)
+			}
+
+			if resp.Sid != nil {
+				logrus.Printf("Message sent successfully, SID: %s\n", *resp.Sid)
+			} else {
+				logrus.Warningf("Message sent successfully, but no SID returned")
+			}
+		}
+	}
+}
+
+// sendTwilioMessage sends a message to a phone through the channel.
+func sendTwilioMessage(channel, number string, message outgoingMessage) (*api.ApiV2010Message, error) {
+	params := &api.CreateMessageParams{}
+	if callbackURL := os.Getenv("TWILIO_STATUS_CALLBACK_URL"); callbackURL != "" {
+		params.SetStatusCallback(callbackURL)
+	}
+	switch channel {
+	case ChannelSMS:
+		from := os.Getenv("TWILIO_SMS_FROM")
+		if from == "" {
+			return nil, fmt.Errorf("TWILIO_SMS_FROM isn't set")
+		}
+		params.SetFrom(from)
+		params.SetTo(number)
+		params.SetBody(message.Body)
+	default:
+		params.SetFrom("whatsapp:" + getEnv("TWILIO_WHATSAPP_FROM", DEFAULT_TWILIO_WHATSAPP_FROM))
+		params.SetTo("whatsapp:" + number)
+		if message.ContentSid != "" {
+			params.SetContentSid(message.ContentSid)
+			params.SetContentVariables(message.ContentVariables)
 		} else {
-			logrus.Warningf("Message sent successfully, but no SID returned")
+			params.SetBody(message.Body)
+			if message.Location != "" {
+				params.SetPersistentAction([]string{"geo:" + message.Location + "|" + message.LocationLabel})
+			}
 		}
 	}
+	return createTwilioMessage(params)
 }
 
 func discardMessage(message string) bool {
@@ -89,39 +183,11 @@ func (ms *MessageSender) Handle(data interface{}) (interface{}, error) {
 
 	var filteredAlarms []Alarm
 	for _, alarm := range alarms {
-		if alarm.AlarmCode == "SOS" || alarm.AlarmCode == "LOWVOT" || alarm.AlarmCode == "REMOVE" {
-			ms.mu.Lock()
+		if notifiedAlarmCodes[alarm.AlarmCode] {
 			filteredAlarms = append(filteredAlarms, alarm)
-			ms.mu.Unlock()
 		}
 	}
-
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 25)
-
-	for _, alarm := range filteredAlarms {
-		wg.Add(1)
-		go func(alarm Alarm) {
-			defer wg.Done()
-			sem <- struct{}{}        // Acquire a token
-			defer func() { <-sem }() // Release the token back into the pool
-
-			device, err := GetDeviceByImei(alarm.Imei)
-			if err != nil {
-				logrus.WithError(err).Error("Error getting device by IMEI")
-				return
-			}
-			if device == nil {
-				logrus.Warning("Device is nil")
-				return
-			}
-			mb := NewMessageBuilder(device, &alarm)
-			message := mb.BuildMessage()
-			SendMessage(message, alarm.Imei)
-		}(alarm)
-	}
-
-	wg.Wait()
+	ms.Correlator().Add(filteredAlarms)
 
 	if ms.next != nil {
 		return ms.next.Handle(filteredAlarms)
@@ -129,6 +195,14 @@ func (ms *MessageSender) Handle(data interface{}) (interface{}, error) {
 	return filteredAlarms, nil
 }
 
+// Correlator returns the IncidentCorrelator that notifies the alarms.
+func (ms *MessageSender) Correlator() *IncidentCorrelator {
+	if ms.correlator == nil {
+		return GetIncidentCorrelator()
+	}
+	return ms.correlator
+}
+
 func (ms *MessageSender) SetNext(next Handler) {
 	ms.next = next
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_SPEED_LIMITS_PATH is the file of the speed limits, configurable
+	// with the SPEED_LIMITS_PATH environment variable. Without limits, the
+	// overspeed of the positions isn't evaluated.
+	DEFAULT_SPEED_LIMITS_PATH = "speed_limits.json"
+	// DEFAULT_OVERSPEED_MIN_DURATION is how long a device must exceed its limit
+	// to raise an OVERSPEED alarm, configurable with OVERSPEED_MIN_DURATION.
+	// It is measured between the polled positions, so it is rounded up to a
+	// multiple of POSITION_POLL_INTERVAL: by default, two positions in a row.
+	DEFAULT_OVERSPEED_MIN_DURATION = DEFAULT_POSITION_POLL_INTERVAL
+	// DEFAULT_OVERSPEED_HYSTERESIS is how far below the limit, in km/h, the
+	// speed must drop before a new OVERSPEED alarm of the device can be
+	// raised, configurable with OVERSPEED_HYSTERESIS.
+	DEFAULT_OVERSPEED_HYSTERESIS = 5
+	// OVERSPEED_ALARM_TYPE is the type of the OVERSPEED alarms, the one of the
+	// vendor alarms.
+	OVERSPEED_ALARM_TYPE = 12
+)
+
+// overspeedMetrics counts the OVERSPEED alarms raised, by the zone of their
+// limit or "device".
+var overspeedMetrics = expvar.NewMap("overspeed")
+
+// SpeedZone is an area with a speed limit, in km/h. Polygon is the list of
+// its vertices as [lat, lng] pairs.
+type SpeedZone struct {
+	Name    string       `json:"name"`
+	Limit   int64        `json:"limit"`
+	Polygon [][2]float64 `json:"polygon"`
+}
+
+// Validate checks the limit and the vertices of the zone.
+func (z SpeedZone) Validate() error {
+	if z.Name == "" {
+		return errors.New("missing zone name")
+	}
+	if z.Limit <= 0 {
+		return fmt.Errorf("invalid limit %d of zone %s", z.Limit, z.Name)
+	}
+	if len(z.Polygon) < 3 {
+		return fmt.Errorf("zone %s needs at least 3 vertices", z.Name)
+	}
+	for _, vertex := range z.Polygon {
+		if vertex[0] < -90 || vertex[0] > 90 || vertex[1] < -180 || vertex[1] > 180 {
+			return fmt.Errorf("invalid vertex %v of zone %s", vertex, z.Name)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether a coordinate is inside the polygon of the zone,
+// by counting the edges crossed by a ray towards the east.
+func (z SpeedZone) Contains(lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(z.Polygon)-1; i < len(z.Polygon); j, i = i, i+1 {
+		a, b := z.Polygon[i], z.Polygon[j]
+		if (a[0] > lat) != (b[0] > lat) && lng < (b[1]-a[1])*(lat-a[0])/(b[0]-a[0])+a[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// SpeedLimits are the speed limits of the devices, in km/h: Default for every
+// device, Devices by IMEI and Zones for the positions inside their polygons.
+// The lowest limit that applies to a position is used; zero means no limit.
+type SpeedLimits struct {
+	Default int64            `json:"default"`
+	Devices map[string]int64 `json:"devices"`
+	Zones   []SpeedZone      `json:"zones"`
+}
+
+// Validate checks the limits and the zones.
+func (l SpeedLimits) Validate() error {
+	if l.Default < 0 {
+		return fmt.Errorf("invalid default limit %d", l.Default)
+	}
+	for imei, limit := range l.Devices {
+		if limit < 0 {
+			return fmt.Errorf("invalid limit %d of device %s", limit, imei)
+		}
+	}
+	for _, zone := range l.Zones {
+		if err := zone.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enabled reports whether any limit is set.
+func (l SpeedLimits) Enabled() bool {
+	if l.Default > 0 || len(l.Zones) > 0 {
+		return true
+	}
+	for _, limit := range l.Devices {
+		if limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Limit returns the limit of a device at a position, and the name of the zone
+// that sets it, empty for the limit of the device or the default one. The
+// zones are ignored for the positions without coordinates.
+func (l SpeedLimits) Limit(imei string, position Position) (int64, string) {
+	limit, source := l.Default, ""
+	if deviceLimit, ok := l.Devices[imei]; ok {
+		limit = deviceLimit
+	}
+	lat, lng, ok := alarmCoordinates(Alarm{Lat: position.Lat, Lng: position.Lng})
+	if !ok {
+		return limit, source
+	}
+	for _, zone := range l.Zones {
+		if zone.Contains(lat, lng) && (limit <= 0 || zone.Limit < limit) {
+			limit, source = zone.Limit, zone.Name
+		}
+	}
+	return limit, source
+}
+
+// speedLimits holds the limits of the service.
+var speedLimits SpeedLimits
+
+// initSpeedLimits loads the limits of the file configured in the environment.
+// The overspeed isn't evaluated if it can't be read.
+func initSpeedLimits() {
+	path := getEnv("SPEED_LIMITS_PATH", DEFAULT_SPEED_LIMITS_PATH)
+	limits, err := LoadSpeedLimits(path)
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Warning("The overspeed detection is disabled")
+		return
+	}
+	speedLimits = limits
+}
+
+// LoadSpeedLimits reads the limits of a file, which doesn't need to exist.
+func LoadSpeedLimits(path string) (SpeedLimits, error) {
+	var limits SpeedLimits
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return limits, nil
+	}
+	if err != nil {
+		return limits, err
+	}
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return SpeedLimits{}, fmt.Errorf("invalid speed limits file %s: %w", path, err)
+	}
+	if err := limits.Validate(); err != nil {
+		return SpeedLimits{}, fmt.Errorf("invalid speed limits file %s: %w", path, err)
+	}
+	return limits, nil
+}
+
+// overspeedState is the overspeed of a device: since is the time of the
+// first position over the limit, zero if it is under it, and alarmed whether
+// the OVERSPEED alarm of the episode was raised.
+type overspeedState struct {
+	last    int64
+	since   int64
+	alarmed bool
+}
+
+// OverspeedEvaluator raises an OVERSPEED alarm when the positions of a device
+// exceed its limit for minDuration. Another alarm isn't raised until the
+// speed drops hysteresis km/h below the limit, so a vehicle driving around
+// the limit doesn't raise one per position. The alarms are passed to the next
+// handler of the chain, like the ones of the vendors.
+type OverspeedEvaluator struct {
+	next        Handler
+	limits      SpeedLimits
+	minDuration time.Duration
+	hysteresis  int64
+
+	mu     sync.Mutex
+	states map[string]*overspeedState
+}
+
+var overspeedEvaluatorInstance *OverspeedEvaluator
+var overspeedEvaluatorOnce sync.Once
+
+// GetOverspeedEvaluator returns the evaluator of the limits of the service.
+// A minimum duration shorter than the poll interval of the positions can't be
+// measured, so a warning is logged.
+func GetOverspeedEvaluator() *OverspeedEvaluator {
+	overspeedEvaluatorOnce.Do(func() {
+		minDuration := getEnvDuration("OVERSPEED_MIN_DURATION", DEFAULT_OVERSPEED_MIN_DURATION)
+		interval := getEnvDuration("POSITION_POLL_INTERVAL", DEFAULT_POSITION_POLL_INTERVAL)
+		if speedLimits.Enabled() && minDuration > 0 && minDuration < interval {
+			logrus.WithFields(logrus.Fields{
+				"min_duration":  minDuration,
+				"poll_interval": interval,
+			}).Warning("The overspeed minimum duration is shorter than the poll interval, an OVERSPEED alarm needs two positions over the limit")
+		}
+		overspeedEvaluatorInstance = NewOverspeedEvaluator(
+			speedLimits,
+			minDuration,
+			int64(getEnvInt("OVERSPEED_HYSTERESIS", DEFAULT_OVERSPEED_HYSTERESIS)),
+		)
+	})
+	return overspeedEvaluatorInstance
+}
+
+// NewOverspeedEvaluator creates an evaluator of the given limits.
+func NewOverspeedEvaluator(limits SpeedLimits, minDuration time.Duration, hysteresis int64) *OverspeedEvaluator {
+	return &OverspeedEvaluator{
+		limits:      limits,
+		minDuration: minDuration,
+		hysteresis:  hysteresis,
+		states:      map[string]*overspeedState{},
+	}
+}
+
+// SetNext sets the handler that receives the OVERSPEED alarms.
+func (e *OverspeedEvaluator) SetNext(next Handler) {
+	e.next = next
+}
+
+// Observe evaluates a new position of a device. The positions without speed
+// or not newer than the last one of the device are ignored.
+func (e *OverspeedEvaluator) Observe(position Position) {
+	if position.Speed == nil || !e.limits.Enabled() {
+		return
+	}
+	limit, zone := e.limits.Limit(position.Imei, position)
+	speed := *position.Speed
+
+	e.mu.Lock()
+	state, ok := e.states[position.Imei]
+	if !ok {
+		state = &overspeedState{}
+		e.states[position.Imei] = state
+	}
+	if position.Time <= state.last {
+		e.mu.Unlock()
+		return
+	}
+	state.last = position.Time
+	raise := false
+	switch {
+	case limit <= 0:
+		state.since, state.alarmed = 0, false
+	case state.alarmed:
+		if speed <= limit-e.hysteresis {
+			state.since, state.alarmed = 0, false
+		}
+	case speed <= limit:
+		state.since = 0
+	default:
+		if state.since == 0 {
+			state.since = position.Time
+		}
+		if time.Duration(position.Time-state.since)*time.Second >= e.minDuration {
+			state.alarmed, raise = true, true
+		}
+	}
+	e.mu.Unlock()
+	if !raise {
+		return
+	}
+
+	overspeedMetrics.Add(orDefault(zone, "device"), 1)
+	logrus.WithFields(logrus.Fields{
+		"imei":  position.Imei,
+		"speed": speed,
+		"limit": limit,
+		"zone":  zone,
+	}).Info("Overspeed detected")
+	if e.next == nil {
+		return
+	}
+	alarm := Alarm{
+		Imei:      position.Imei,
+		Lat:       position.Lat,
+		Lng:       position.Lng,
+		Time:      position.Time,
+		AlarmCode: "OVERSPEED",
+		AlarmType: OVERSPEED_ALARM_TYPE,
+		Speed:     position.Speed,
+		Course:    position.Course,
+	}
+	if _, err := e.next.Handle([]Alarm{alarm}); err != nil {
+		logrus.WithError(err).Error("Error handling the OVERSPEED alarm")
+	}
+}
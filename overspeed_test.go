@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSpeedLimits limits the devices to 100 km/h, the device "2" to 80 km/h
+// and the square around (-2.19, -79.88) to 50 km/h.
+var testSpeedLimits = SpeedLimits{
+	Default: 100,
+	Devices: map[string]int64{"2": 80, "3": 0},
+	Zones: []SpeedZone{{
+		Name:    "centro",
+		Limit:   50,
+		Polygon: [][2]float64{{-2.18, -79.89}, {-2.18, -79.87}, {-2.2, -79.87}, {-2.2, -79.89}},
+	}},
+}
+
+func TestSpeedLimits(t *testing.T) {
+	inside, outside, lng := "-2.19", "-2.3", "-79.88"
+	for _, test := range []struct {
+		imei     string
+		lat      *string
+		limit    int64
+		zoneName string
+	}{
+		{"1", &outside, 100, ""},
+		{"2", &outside, 80, ""},
+		{"3", &outside, 0, ""},
+		{"1", &inside, 50, "centro"},
+		{"3", &inside, 50, "centro"},
+		{"1", nil, 100, ""},
+	} {
+		limit, zone := testSpeedLimits.Limit(test.imei, Position{Lat: test.lat, Lng: &lng})
+		if limit != test.limit || zone != test.zoneName {
+			t.Errorf("device %s at %v: expected %d %q, got %d %q", test.imei, test.lat, test.limit, test.zoneName, limit, zone)
+		}
+	}
+}
+
+func TestOverspeedEvaluator(t *testing.T) {
+	handler := &recordingHandler{}
+	evaluator := NewOverspeedEvaluator(testSpeedLimits, time.Minute, 5)
+	evaluator.SetNext(handler)
+	observe := func(imei string, at, speed int64) int {
+		evaluator.Observe(Position{Imei: imei, Time: 1700000000 + at, Speed: &speed})
+		return len(handler.alarms)
+	}
+
+	// A single position over the limit isn't enough.
+	if observe("1", 0, 120) != 0 || observe("1", 30, 90) != 0 || observe("1", 60, 120) != 0 {
+		t.Fatalf("expected no alarm before the minimum duration, got %+v", handler.alarms)
+	}
+	if observe("1", 120, 110) != 1 {
+		t.Fatalf("expected an alarm after the minimum duration, got %+v", handler.alarms)
+	}
+	alarm := handler.alarms[0]
+	if alarm.AlarmCode != "OVERSPEED" || alarm.Imei != "1" || *alarm.Speed != 110 || alarm.Time != 1700000120 {
+		t.Fatalf("unexpected alarm %+v", alarm)
+	}
+
+	// Another alarm needs the speed to drop below the hysteresis.
+	if observe("1", 180, 98) != 1 || observe("1", 240, 120) != 1 || observe("1", 300, 120) != 1 {
+		t.Fatalf("expected a single alarm within the hysteresis, got %+v", handler.alarms)
+	}
+	if observe("1", 360, 90) != 1 || observe("1", 420, 120) != 1 || observe("1", 480, 120) != 2 {
+		t.Fatalf("expected a new alarm after the speed dropped, got %+v", handler.alarms)
+	}
+
+	// Older positions and the devices without limit are ignored.
+	if observe("1", 100, 150) != 2 || observe("3", 0, 150) != 2 || observe("3", 120, 150) != 2 {
+		t.Fatalf("expected no more alarms, got %+v", handler.alarms)
+	}
+}
+
+func TestLoadSpeedLimits(t *testing.T) {
+	dir := t.TempDir()
+	if limits, err := LoadSpeedLimits(filepath.Join(dir, "missing.json")); err != nil || limits.Enabled() {
+		t.Fatalf("expected no limits without the file, got %+v: %v", limits, err)
+	}
+
+	path := filepath.Join(dir, "speed_limits.json")
+	os.WriteFile(path, []byte(`{"default": 90, "zones": [{"name": "centro", "limit": 50, "polygon": [[-2.18, -79.89], [-2.18, -79.87], [-2.2, -79.87]]}]}`), 0o644)
+	limits, err := LoadSpeedLimits(path)
+	if err != nil || limits.Default != 90 || len(limits.Zones) != 1 {
+		t.Fatalf("unexpected limits %+v: %v", limits, err)
+	}
+
+	os.WriteFile(path, []byte(`{"zones": [{"name": "centro", "limit": 50, "polygon": [[-2.18, -79.89], [-2.18, -79.87]]}]}`), 0o644)
+	if _, err := LoadSpeedLimits(path); err == nil {
+		t.Fatal("expected an error for a zone with two vertices")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ECUADOR_CALLING_CODE is the calling code of the numbers without one, as
+// the users register them in the backend.
+const ECUADOR_CALLING_CODE = "593"
+
+// ErrInvalidPhoneNumber is returned for the numbers that can't be normalized.
+var ErrInvalidPhoneNumber = errors.New("invalid phone number")
+
+// NormalizePhoneNumber returns the number in E.164 format (+593991234567).
+// The spaces, dashes, dots and parentheses are removed, and a 00 prefix is
+// replaced by +. The numbers without calling code are Ecuadorian, with or
+// without the trunk prefix 0: 0991234567, 991234567 and 593991234567 are the
+// same number. Ecuadorian numbers must be mobiles (9 digits starting with 9)
+// or landlines (8 digits starting with 2 to 7); other countries are only
+// checked to have between 8 and 15 digits.
+func NormalizePhoneNumber(raw string) (string, error) {
+	number := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')', '\t':
+			return -1
+		}
+		return r
+	}, strings.TrimPrefix(strings.TrimSpace(raw), "whatsapp:"))
+
+	international := false
+	if strings.HasPrefix(number, "+") {
+		number, international = number[1:], true
+	} else if strings.HasPrefix(number, "00") {
+		number, international = number[2:], true
+	}
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return "", fmt.Errorf("%w %q", ErrInvalidPhoneNumber, raw)
+	}
+
+	switch {
+	case international && !strings.HasPrefix(number, ECUADOR_CALLING_CODE):
+		if len(number) < 8 || len(number) > 15 || number[0] == '0' {
+			return "", fmt.Errorf("%w %q", ErrInvalidPhoneNumber, raw)
+		}
+		return "+" + number, nil
+	case international || (strings.HasPrefix(number, ECUADOR_CALLING_CODE) && len(number) > 10):
+		number = strings.TrimPrefix(number, ECUADOR_CALLING_CODE)
+	default:
+		number = strings.TrimPrefix(number, "0")
+	}
+
+	if !validEcuadorianNumber(number) {
+		return "", fmt.Errorf("%w %q", ErrInvalidPhoneNumber, raw)
+	}
+	return "+" + ECUADOR_CALLING_CODE + number, nil
+}
+
+// validEcuadorianNumber checks a national number without trunk prefix.
+func validEcuadorianNumber(number string) bool {
+	switch {
+	case len(number) == 9:
+		return number[0] == '9'
+	case len(number) == 8:
+		return number[0] >= '2' && number[0] <= '7'
+	default:
+		return false
+	}
+}
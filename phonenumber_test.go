@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"0991234567":             "+593991234567",
+		"099 123 4567":           "+593991234567",
+		"991234567":              "+593991234567",
+		"593991234567":           "+593991234567",
+		"+593 99-123-4567":       "+593991234567",
+		"00593991234567":         "+593991234567",
+		"whatsapp:+593991234567": "+593991234567",
+		"(02) 234-5678":          "+59322345678",
+		"+57 300 123 4567":       "+573001234567",
+		"+1 (415) 523-8886":      "+14155238886",
+	} {
+		number, err := NormalizePhoneNumber(raw)
+		if err != nil || number != expected {
+			t.Errorf("%q: expected %s, got %q %v", raw, expected, number, err)
+		}
+	}
+
+	for _, raw := range []string{"", "abc", "12345", "0891234567", "09912345678", "+593091234567", "+0123456789", "+1234567890123456"} {
+		if number, err := NormalizePhoneNumber(raw); !errors.Is(err, ErrInvalidPhoneNumber) {
+			t.Errorf("%q: expected ErrInvalidPhoneNumber, got %q %v", raw, number, err)
+		}
+	}
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+	"github.com/sirupsen/logrus"
 )
 
 // UserPhoneNumbers is a slice of UserPhoneNumber.
-type UserPhoneNumbers []UserPhoneNumber
+type UserPhoneNumbers = roadsafety.UserPhoneNumbers
+
+// UserPhoneNumber represents a user and their phone numbers.
+type UserPhoneNumber = roadsafety.UserPhoneNumber
+
+// PhoneNumber represents a phone number.
+type PhoneNumber = roadsafety.PhoneNumber
 
 // UnmarshalUserPhoneNumbers takes a byte slice and deserializes it into a UserPhoneNumbers.
 // It returns a UserPhoneNumbers and an error if any occurred during deserialization.
@@ -19,61 +27,59 @@ func UnmarshalUserPhoneNumbers(data []byte) (UserPhoneNumbers, error) {
 	return r, err
 }
 
-// Marshal serializes a UserPhoneNumbers into a byte slice.
-// It returns a byte slice and an error if any occurred during serialization.
-func (r *UserPhoneNumbers) Marshal() ([]byte, error) {
-	return json.Marshal(r)
-}
-
-// UserPhoneNumber represents a user and their phone numbers.
-// User is a UUID that uniquely identifies each user.
-// PhoneNumbers is a slice of PhoneNumber that contains the user's phone numbers.
-type UserPhoneNumber struct {
-	User         string        `json:"user"`
-	PhoneNumbers []PhoneNumber `json:"phone_numbers"`
-}
-
-// PhoneNumber represents a phone number.
-// PhoneNumber is a string that contains the phone number.
-type PhoneNumber struct {
-	PhoneNumber string `json:"phone_number"`
-}
+// invalidPhoneNumbersMetric counts the numbers discarded by NormalizePhoneNumber.
+var invalidPhoneNumbersMetric = expvar.NewInt("invalid_phone_numbers")
 
+// GetPhoneNumbersFromAPI returns the phone numbers of every user related to
+// the device, in E.164 format and without duplicates.
 func GetPhoneNumbersFromAPI(imei string) ([]string, error) {
-	var apiKey = os.Getenv("API_KEY")
-	url := fmt.Sprintf("https://api.road-safety-ec.com/api/v1/devices/%s/phones/", imei)
-
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error making the request: %v", err)
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", apiKey))
-
-	resp, err := client.Do(req)
+	userPhoneNumbers, err := roadSafetyClient.ListPhoneNumbers(context.Background(), imei)
 	if err != nil {
-		return nil, fmt.Errorf("error doing the request: %v", err)
+		return nil, fmt.Errorf("error getting the phone numbers: %w", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading the response: %v", err)
+	var phoneNumbers []string
+	seen := map[string]bool{}
+	for _, userPhoneNumber := range normalizeUserPhoneNumbers(imei, userPhoneNumbers) {
+		for _, phoneNumber := range userPhoneNumber.PhoneNumbers {
+			if !seen[phoneNumber.PhoneNumber] {
+				seen[phoneNumber.PhoneNumber] = true
+				phoneNumbers = append(phoneNumbers, phoneNumber.PhoneNumber)
+			}
+		}
 	}
 
-	var userPhoneNumbers []UserPhoneNumber
-	err = json.Unmarshal(body, &userPhoneNumbers)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling the JSON: %v", err)
-	}
+	return phoneNumbers, nil
+}
 
-	var phoneNumbers []string
+// normalizeUserPhoneNumbers returns the users with their numbers in E.164
+// format and without the repeated numbers of each user. A number shared by
+// several users is kept in all of them, since each user has its own
+// preferences; uniquePhones removes it once the recipients are resolved. The
+// invalid numbers are reported and discarded.
+func normalizeUserPhoneNumbers(imei string, userPhoneNumbers UserPhoneNumbers) UserPhoneNumbers {
+	normalized := make(UserPhoneNumbers, 0, len(userPhoneNumbers))
 	for _, userPhoneNumber := range userPhoneNumbers {
+		seen := map[string]bool{}
+		user := UserPhoneNumber{User: userPhoneNumber.User}
 		for _, phoneNumber := range userPhoneNumber.PhoneNumbers {
-			phoneNumbers = append(phoneNumbers, phoneNumber.PhoneNumber)
+			number, err := NormalizePhoneNumber(phoneNumber.PhoneNumber)
+			if err != nil {
+				invalidPhoneNumbersMetric.Add(1)
+				logrus.WithFields(logrus.Fields{
+					"imei":  imei,
+					"user":  userPhoneNumber.User,
+					"phone": phoneNumber.PhoneNumber,
+				}).Warning("Discarding invalid phone number")
+				continue
+			}
+			if seen[number] {
+				continue
+			}
+			seen[number] = true
+			user.PhoneNumbers = append(user.PhoneNumbers, PhoneNumber{PhoneNumber: number})
 		}
+		normalized = append(normalized, user)
 	}
-
-	return phoneNumbers, nil
+	return normalized
 }
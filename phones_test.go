@@ -1,20 +1,47 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 )
 
 func TestGetPhoneNumbersFromAPI(t *testing.T) {
 	imei := "860419050021378"
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers(imei, UserPhoneNumbers{
+		{User: "a", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593991234567"}, {PhoneNumber: "+593987654321"}}},
+		{User: "b", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593912345678"}}},
+	})
 
-	// Llamar a la función con la URL de la API
+	// Llamar a la función con la API local
 	phoneNumbers, err := GetPhoneNumbersFromAPI(imei)
 	if err != nil {
 		t.Fatalf("GetPhoneNumbersFromAPI failed: %v", err)
 	}
 
-	// Comprobar que la función devolvió los números de teléfono
-	if len(phoneNumbers) == 1 {
-		t.Fatalf("No phone numbers returned")
+	// Comprobar que la función devolvió los números de teléfono de todos los usuarios
+	expected := []string{"+593991234567", "+593987654321", "+593912345678"}
+	if !reflect.DeepEqual(phoneNumbers, expected) {
+		t.Fatalf("expected %v, got %v", expected, phoneNumbers)
+	}
+}
+
+func TestGetPhoneNumbersFromAPINormalizes(t *testing.T) {
+	imei := "860419050021378"
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers(imei, UserPhoneNumbers{
+		{User: "a", PhoneNumbers: []PhoneNumber{{PhoneNumber: "0991234567"}, {PhoneNumber: "12345"}}},
+		{User: "b", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593 99 123 4567"}, {PhoneNumber: "02 234 5678"}}},
+	})
+
+	// The numbers are in E.164 format, the invalid one is discarded and the
+	// number shared by both users is returned once.
+	phoneNumbers, err := GetPhoneNumbersFromAPI(imei)
+	if err != nil {
+		t.Fatalf("GetPhoneNumbersFromAPI failed: %v", err)
+	}
+	expected := []string{"+593991234567", "+59322345678"}
+	if !reflect.DeepEqual(phoneNumbers, expected) {
+		t.Fatalf("expected %v, got %v", expected, phoneNumbers)
 	}
 }
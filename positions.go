@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_POSITION_POLL_INTERVAL is the time between two requests of the
+	// last positions of the tracked devices, configurable with the
+	// POSITION_POLL_INTERVAL environment variable. Zero disables the polling.
+	DEFAULT_POSITION_POLL_INTERVAL = 5 * time.Minute
+	// DEFAULT_POSITION_MAX_AGE is the maximum difference between the time of
+	// an alarm without coordinates and the position used to locate it,
+	// configurable with POSITION_MAX_AGE. The UBICACION replies request a new
+	// position if the last one is older.
+	DEFAULT_POSITION_MAX_AGE = 15 * time.Minute
+	// POSITION_POLL_WORKERS bounds the positions requested at the same time.
+	POSITION_POLL_WORKERS = 4
+)
+
+// positionMetrics counts the positions polled, updated and failed.
+var positionMetrics = expvar.NewMap("positions")
+
+// PositionTracker keeps the last position of each device, polled from the
+// vendor APIs and recorded in the archive, so the messages can locate the
+// alarms without coordinates.
+type PositionTracker struct {
+	// fetch requests the last position of a device to its vendor.
+	fetch func(Device) (*Position, error)
+	// onUpdate, if not nil, is called with every new position.
+	onUpdate func(Position)
+	now      func() time.Time
+
+	mu        sync.RWMutex
+	positions map[string]Position
+}
+
+var positionTrackerInstance *PositionTracker
+var positionTrackerOnce sync.Once
+
+// GetPositionTracker returns the tracker of the service, with the positions
+// of the archive.
+func GetPositionTracker() *PositionTracker {
+	positionTrackerOnce.Do(func() {
+		positionTrackerInstance = NewPositionTracker(func(device Device) (*Position, error) {
+			return device.LastPosition()
+		})
+		if alarmArchive == nil {
+			return
+		}
+		positions, err := alarmArchive.Positions()
+		if err != nil {
+			logrus.WithError(err).Warning("Error reading the archived positions")
+		}
+		for _, position := range positions {
+			positionTrackerInstance.positions[position.Imei] = position
+		}
+	})
+	return positionTrackerInstance
+}
+
+// NewPositionTracker creates a tracker that requests the positions with fetch.
+func NewPositionTracker(fetch func(Device) (*Position, error)) *PositionTracker {
+	return &PositionTracker{
+		fetch:     fetch,
+		now:       time.Now,
+		positions: map[string]Position{},
+	}
+}
+
+// OnUpdate sets the function called with every new position.
+func (t *PositionTracker) OnUpdate(onUpdate func(Position)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onUpdate = onUpdate
+}
+
+// Update records a position if it is newer than the last one of the device.
+// It reports whether the position was recorded.
+func (t *PositionTracker) Update(position Position) bool {
+	t.mu.Lock()
+	if last, ok := t.positions[position.Imei]; ok && last.Time >= position.Time {
+		t.mu.Unlock()
+		return false
+	}
+	t.positions[position.Imei] = position
+	onUpdate := t.onUpdate
+	t.mu.Unlock()
+
+	positionMetrics.Add("updated", 1)
+	if alarmArchive != nil {
+		if err := alarmArchive.RecordPosition(position); err != nil {
+			logrus.WithError(err).Warning("Error archiving the position")
+		}
+	}
+	if onUpdate != nil {
+		onUpdate(position)
+	}
+	return true
+}
+
+// Last returns the last position of a device.
+func (t *PositionTracker) Last(imei string) (Position, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	position, ok := t.positions[imei]
+	return position, ok
+}
+
+// All returns the last position of every device, sorted by IMEI.
+func (t *PositionTracker) All() []Position {
+	t.mu.RLock()
+	positions := make([]Position, 0, len(t.positions))
+	for _, position := range t.positions {
+		positions = append(positions, position)
+	}
+	t.mu.RUnlock()
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Imei < positions[j].Imei })
+	return positions
+}
+
+// Refresh requests the last position of a device and records it. It returns
+// the last position known, which may be older than the one requested if the
+// vendor returned none, or nil if there is none.
+func (t *PositionTracker) Refresh(device Device) (*Position, error) {
+	positionMetrics.Add("polled", 1)
+	position, err := t.fetch(device)
+	if err != nil {
+		positionMetrics.Add("failed", 1)
+		return nil, err
+	}
+	if position != nil {
+		position.Imei = device.Imei
+		t.Update(*position)
+	}
+	if last, ok := t.Last(device.Imei); ok {
+		return &last, nil
+	}
+	return nil, nil
+}
+
+// Recent returns the last position of a device if it is within maxAge of
+// the given time, requesting a new one to the vendor otherwise.
+func (t *PositionTracker) Recent(device Device, at time.Time, maxAge time.Duration) *Position {
+	if position, ok := t.Last(device.Imei); ok && absDuration(at.Sub(time.Unix(position.Time, 0))) <= maxAge {
+		return &position
+	}
+	position, err := t.Refresh(device)
+	if err != nil {
+		logrus.WithError(err).WithField("imei", device.Imei).Warning("Error requesting the last position")
+		return nil
+	}
+	return position
+}
+
+// Poll requests the last positions of the devices, POSITION_POLL_WORKERS at a
+// time.
+func (t *PositionTracker) Poll(devices []Device) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, POSITION_POLL_WORKERS)
+	for _, device := range devices {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(device Device) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if _, err := t.Refresh(device); err != nil {
+				logrus.WithError(err).WithField("imei", device.Imei).Debug("Error polling the last position")
+			}
+		}(device)
+	}
+	wg.Wait()
+}
+
+// Run polls the positions of the tracked devices every interval until the
+// context is cancelled.
+func (t *PositionTracker) Run(ctx context.Context, interval time.Duration, fetchDevices func() ([]Device, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		devices, err := fetchDevices()
+		if err != nil {
+			logrus.WithError(err).Warning("Error getting the devices of the position polling")
+		} else {
+			t.Poll(devices)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// locateAlarm returns the alarm with the coordinates of the last position of
+// its device, if it has none and the position is within POSITION_MAX_AGE of
+// the alarm. Only the copy sent in the messages is located; the saved alarm
+// keeps the coordinates reported by the device.
+func locateAlarm(alarm Alarm, device *Device) Alarm {
+	if alarm.Lat != nil && alarm.Lng != nil && *alarm.Lat != "" && *alarm.Lng != "" {
+		return alarm
+	}
+	maxAge := getEnvDuration("POSITION_MAX_AGE", DEFAULT_POSITION_MAX_AGE)
+	position := GetPositionTracker().Recent(*device, time.Unix(alarm.Time, 0), maxAge)
+	if position == nil || position.Lat == nil || position.Lng == nil || absDuration(time.Unix(alarm.Time, 0).Sub(time.Unix(position.Time, 0))) > maxAge {
+		return alarm
+	}
+	alarm.Lat, alarm.Lng = position.Lat, position.Lng
+	return alarm
+}
+
+// absDuration returns the absolute value of d.
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// positionsHandler returns the last positions of the devices. It requires the
+// bearer token of POSITIONS_ADMIN_TOKEN, since the positions locate the
+// vehicles of the users.
+//
+//	GET /positions                      the last position of every device
+//	GET /positions/{imei}[?refresh=1]   the last position of a device
+func positionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(w, r, "POSITIONS_ADMIN_TOKEN") {
+		return
+	}
+	tracker := GetPositionTracker()
+	imei := strings.Trim(strings.TrimPrefix(r.URL.Path, "/positions"), "/")
+	if imei == "" {
+		writeJSON(w, http.StatusOK, tracker.All())
+		return
+	}
+
+	if r.URL.Query().Get("refresh") != "" {
+		device, err := GetDeviceByImei(imei)
+		if err != nil || device == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := tracker.Refresh(*device); err != nil {
+			logrus.WithError(err).WithField("imei", imei).Warning("Error requesting the last position")
+			http.Error(w, "error requesting the position", http.StatusBadGateway)
+			return
+		}
+	}
+	position, ok := tracker.Last(imei)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, position)
+}
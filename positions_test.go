@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// usePositionTracker replaces the tracker of the service with one that
+// requests the positions of the returned map, counting the requests.
+func usePositionTracker(t *testing.T) (*PositionTracker, map[string]*Position, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	positions := map[string]*Position{}
+	requests := 0
+	GetPositionTracker()
+	previous := positionTrackerInstance
+	positionTrackerInstance = NewPositionTracker(func(device Device) (*Position, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if device.Imei == "down" {
+			return nil, errors.New("connection refused")
+		}
+		if position := positions[device.Imei]; position != nil {
+			copied := *position
+			return &copied, nil
+		}
+		return nil, nil
+	})
+	t.Cleanup(func() { positionTrackerInstance = previous })
+	return positionTrackerInstance, positions, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestPositionTrackerPoll(t *testing.T) {
+	archive := useTestArchive(t)
+	tracker, positions, _ := usePositionTracker(t)
+	var updates []string
+	tracker.OnUpdate(func(position Position) { updates = append(updates, position.Imei) })
+
+	lat, lng := "-2.17", "-79.92"
+	positions["1"] = &Position{Lat: &lat, Lng: &lng, Time: 1700000000}
+	tracker.Poll([]Device{{Imei: "1"}, {Imei: "2"}, {Imei: "down"}})
+	if position, ok := tracker.Last("1"); !ok || position.Imei != "1" || *position.Lat != lat {
+		t.Fatalf("unexpected position %+v", position)
+	}
+	if _, ok := tracker.Last("2"); ok {
+		t.Fatal("expected no position of a device that never reported one")
+	}
+
+	// An older position doesn't replace the last one.
+	if tracker.Update(Position{Imei: "1", Time: 1699990000}) {
+		t.Fatal("expected an older position to be ignored")
+	}
+	if len(updates) != 1 {
+		t.Fatalf("expected a single update, got %v", updates)
+	}
+	archived, err := archive.Positions()
+	if err != nil || len(archived) != 1 || archived[0].Time != 1700000000 {
+		t.Fatalf("expected the position to be archived, got %+v: %v", archived, err)
+	}
+}
+
+func TestLocateAlarm(t *testing.T) {
+	tracker, positions, requests := usePositionTracker(t)
+	lat, lng := "-2.17", "-79.92"
+	tracker.Update(Position{Imei: "1", Lat: &lat, Lng: &lng, Time: 1700000000})
+	device := &Device{Imei: "1"}
+
+	located := locateAlarm(Alarm{Imei: "1", Time: 1700000300, AlarmCode: "SOS"}, device)
+	if located.Lat == nil || *located.Lat != lat || requests() != 0 {
+		t.Fatalf("expected the alarm at the tracked position, got %+v", located)
+	}
+
+	// An old position is requested again, and not used if it is still old.
+	positions["1"] = &Position{Lat: &lat, Lng: &lng, Time: 1700000000}
+	if located := locateAlarm(Alarm{Imei: "1", Time: 1700007200, AlarmCode: "SOS"}, device); located.Lat != nil || requests() != 1 {
+		t.Fatalf("expected the alarm without coordinates, got %+v", located)
+	}
+
+	// The coordinates of the device are kept.
+	alarmLat, alarmLng := "-2.2", "-79.9"
+	if located := locateAlarm(Alarm{Imei: "1", Time: 1700000300, Lat: &alarmLat, Lng: &alarmLng}, device); *located.Lat != alarmLat {
+		t.Fatalf("expected the coordinates of the alarm, got %s", *located.Lat)
+	}
+}
+
+func TestBuildPositionMessage(t *testing.T) {
+	useTestGeocoder(t)
+	plate := "GBA-1234"
+	device := &Device{Imei: "1", UserName: "Flota Norte", LicenseNumber: &plate}
+	lat, lng := "-2.17", "-79.92"
+	speed, acc := int64(42), true
+	position := &Position{Imei: "1", Lat: &lat, Lng: &lng, Time: 1700000000, Speed: &speed, Acc: &acc}
+
+	message := NewMessageBuilder(device, &Alarm{Imei: "1"}).WithLanguage(LanguageEnglish).BuildPositionMessage(position)
+	for _, expected := range []string{"📍📍 VEHICLE LOCATION 📍📍", "License plate: GBA-1234", "Report time: 2023-11-14 17:13:20", "Speed: 42 km/h", "Engine: on", "Location: Guayaquil, Ecuador", "query=-2.17,-79.92"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("expected %q in the message:\n%s", expected, message)
+		}
+	}
+	if message := NewMessageBuilder(device, &Alarm{Imei: "1"}).BuildPositionMessage(nil); !strings.HasSuffix(message, "El vehículo no ha reportado su posición.") {
+		t.Errorf("unexpected message without position:\n%s", message)
+	}
+}
+
+func TestPositionsHandler(t *testing.T) {
+	tracker, _, _ := usePositionTracker(t)
+	tracker.Update(Position{Imei: "1", Time: 1700000000})
+	t.Setenv("POSITIONS_ADMIN_TOKEN", "secret")
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		positionsHandler(w, r)
+		return w
+	}
+	if w := get("/positions", "invalid"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", w.Code)
+	}
+	if w := get("/positions", "secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"imei":"1"`) {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if w := get("/positions/1", "secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"time":1700000000`) {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if w := get("/positions/2", "secret"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for an unknown device, got %d", w.Code)
+	}
+}
+
+func TestPositionTrackerRecent(t *testing.T) {
+	tracker, positions, requests := usePositionTracker(t)
+	now := time.Unix(1700000000, 0)
+	positions["1"] = &Position{Time: now.Unix()}
+	if position := tracker.Recent(Device{Imei: "1"}, now, time.Minute); position == nil || position.Time != now.Unix() || requests() != 1 {
+		t.Fatalf("expected the position to be requested, got %+v", position)
+	}
+	if position := tracker.Recent(Device{Imei: "1"}, now.Add(30*time.Second), time.Minute); position == nil || requests() != 1 {
+		t.Fatalf("expected the recent position without a request, got %+v", position)
+	}
+	if position := tracker.Recent(Device{Imei: "down"}, now, time.Minute); position != nil {
+		t.Fatalf("expected no position of an unreachable vendor, got %+v", position)
+	}
+}
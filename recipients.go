@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DEFAULT_RECIPIENTS_PATH is the file of the recipient preferences, keyed by
+// user UUID, configurable with the RECIPIENTS_PATH environment variable. The
+// users without preferences get every alarm by WhatsApp in Spanish.
+const DEFAULT_RECIPIENTS_PATH = "recipients.json"
+
+// recipientMetrics counts the recipients skipped by their preferences.
+var recipientMetrics = expvar.NewMap("recipients")
+
+// Channels of the notifications. The voice calls of the critical incidents
+// are placed besides the channel of each user.
+const (
+	ChannelWhatsApp = "whatsapp"
+	ChannelSMS      = "sms"
+	ChannelVoice    = "voice"
+)
+
+// Languages of the messages.
+const (
+	LanguageSpanish = "es"
+	LanguageEnglish = "en"
+)
+
+// QuietHours is a daily period, from Start to End ("HH:MM", End may be on the
+// next day), in which the user only gets the critical notifications.
+// Timezone defaults to America/Guayaquil.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// parseClock returns the minutes since midnight of an "HH:MM" time.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks the times and the time zone.
+func (q QuietHours) Validate() error {
+	if _, err := parseClock(q.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(q.End); err != nil {
+		return err
+	}
+	if q.Timezone != "" {
+		if _, err := time.LoadLocation(q.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", q.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// Contains reports whether t is within the quiet hours.
+func (q QuietHours) Contains(t time.Time) bool {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(orDefault(q.Timezone, "America/Guayaquil"))
+	if err != nil {
+		loc = time.Local
+	}
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// RecipientPreferences are the notification settings of a user. Empty Codes
+// subscribe to every alarm code.
+type RecipientPreferences struct {
+	Channel    string      `json:"channel,omitempty"`
+	Language   string      `json:"language,omitempty"`
+	Codes      []string    `json:"codes,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+}
+
+// defaultRecipientPreferences are the preferences of the users not configured.
+var defaultRecipientPreferences = RecipientPreferences{Channel: ChannelWhatsApp, Language: LanguageSpanish}
+
+// withDefaults fills the empty channel and language.
+func (p RecipientPreferences) withDefaults() RecipientPreferences {
+	p.Channel = orDefault(p.Channel, defaultRecipientPreferences.Channel)
+	p.Language = orDefault(p.Language, defaultRecipientPreferences.Language)
+	return p
+}
+
+// Validate checks the channel, the language and the quiet hours.
+func (p RecipientPreferences) Validate() error {
+	if p.Channel != "" && p.Channel != ChannelWhatsApp && p.Channel != ChannelSMS {
+		return fmt.Errorf("unknown channel %q", p.Channel)
+	}
+	if p.Language != "" && p.Language != LanguageSpanish && p.Language != LanguageEnglish {
+		return fmt.Errorf("unknown language %q", p.Language)
+	}
+	if p.QuietHours != nil {
+		return p.QuietHours.Validate()
+	}
+	return nil
+}
+
+// Wants reports whether the user is subscribed to any of the codes. An empty
+// list of codes, as in the messages not related to an alarm, is always wanted.
+func (p RecipientPreferences) Wants(codes []string) bool {
+	if len(p.Codes) == 0 || len(codes) == 0 {
+		return true
+	}
+	for _, code := range codes {
+		for _, subscribed := range p.Codes {
+			if code == subscribed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recipientPreferences holds the preferences of the configured users, by UUID.
+var recipientPreferences = map[string]RecipientPreferences{}
+
+// initRecipients loads the preferences of the file configured in the
+// environment. The users keep the default preferences if it can't be read.
+func initRecipients() {
+	path := getEnv("RECIPIENTS_PATH", DEFAULT_RECIPIENTS_PATH)
+	preferences, err := LoadRecipientPreferences(path)
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Warning("Using the default recipient preferences")
+		return
+	}
+	recipientPreferences = preferences
+}
+
+// LoadRecipientPreferences reads the preferences of a file, which doesn't
+// need to exist.
+func LoadRecipientPreferences(path string) (map[string]RecipientPreferences, error) {
+	preferences := map[string]RecipientPreferences{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return preferences, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &preferences); err != nil {
+		return nil, fmt.Errorf("invalid recipients file %s: %w", path, err)
+	}
+	for user, p := range preferences {
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid preferences of user %s: %w", user, err)
+		}
+	}
+	return preferences, nil
+}
+
+// Recipient is a user related to a device, with its phones and preferences.
+type Recipient struct {
+	User        string
+	Phones      []string
+	Preferences RecipientPreferences
+}
+
+// GetRecipients returns the users related to the device with their
+// preferences and their valid phone numbers in E.164 format.
+func GetRecipients(imei string) ([]Recipient, error) {
+	userPhoneNumbers, err := roadSafetyClient.ListPhoneNumbers(context.Background(), imei)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the phone numbers: %w", err)
+	}
+
+	recipients := make([]Recipient, 0, len(userPhoneNumbers))
+	for _, userPhoneNumber := range normalizeUserPhoneNumbers(imei, userPhoneNumbers) {
+		recipient := Recipient{
+			User:        userPhoneNumber.User,
+			Preferences: recipientPreferences[userPhoneNumber.User].withDefaults(),
+		}
+		for _, phoneNumber := range userPhoneNumber.PhoneNumbers {
+			recipient.Phones = append(recipient.Phones, phoneNumber.PhoneNumber)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// ResolveRecipients returns the recipients that must get a notification of
+// the codes at the time: the ones subscribed to any of the codes and not in
+// their quiet hours, unless the notification is critical.
+func ResolveRecipients(recipients []Recipient, codes []string, critical bool, at time.Time) []Recipient {
+	var resolved []Recipient
+	for _, recipient := range recipients {
+		p := recipient.Preferences
+		if !p.Wants(codes) {
+			recipientMetrics.Add("unsubscribed", 1)
+			continue
+		}
+		if !critical && p.QuietHours != nil && p.QuietHours.Contains(at) {
+			recipientMetrics.Add("quiet_hours", 1)
+			continue
+		}
+		resolved = append(resolved, recipient)
+	}
+	return resolved
+}
+
+// uniquePhones returns the recipients with each phone only in the first one
+// that has it, so a phone shared by several users gets a single message or
+// call. It is applied to the resolved recipients, so a shared phone is kept
+// if any of its users wants the notification.
+func uniquePhones(recipients []Recipient) []Recipient {
+	seen := map[string]bool{}
+	unique := make([]Recipient, 0, len(recipients))
+	for _, recipient := range recipients {
+		phones := make([]string, 0, len(recipient.Phones))
+		for _, phone := range recipient.Phones {
+			if !seen[phone] {
+				seen[phone] = true
+				phones = append(phones, phone)
+			}
+		}
+		recipient.Phones = phones
+		unique = append(unique, recipient)
+	}
+	return unique
+}
+
+// orDefault returns value, or fallback if it is empty.
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
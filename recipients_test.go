@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// sentMessage is a message sent through the stubbed Twilio API.
+type sentMessage struct {
+	From, To, Body               string
+	ContentSid, ContentVariables string
+	PersistentAction             string
+}
+
+// useTwilioStub replaces the Twilio API with a stub that records the messages.
+func useTwilioStub(t *testing.T) func() []sentMessage {
+	t.Helper()
+	var mu sync.Mutex
+	var sent []sentMessage
+	previous := createTwilioMessage
+	createTwilioMessage = func(params *api.CreateMessageParams) (*api.ApiV2010Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		message := sentMessage{From: *params.From, To: *params.To}
+		for field, value := range map[*string]*string{
+			&message.Body:             params.Body,
+			&message.ContentSid:       params.ContentSid,
+			&message.ContentVariables: params.ContentVariables,
+		} {
+			if value != nil {
+				*field = *value
+			}
+		}
+		if params.PersistentAction != nil {
+			message.PersistentAction = strings.Join(*params.PersistentAction, " ")
+		}
+		sent = append(sent, message)
+		sid := "SM" + strings.Repeat("0", 32)
+		return &api.ApiV2010Message{Sid: &sid}, nil
+	}
+	t.Cleanup(func() { createTwilioMessage = previous })
+	return func() []sentMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		result := append([]sentMessage(nil), sent...)
+		sort.Slice(result, func(i, j int) bool { return result[i].To < result[j].To })
+		return result
+	}
+}
+
+// useRecipientPreferences replaces the preferences for the duration of the test.
+func useRecipientPreferences(t *testing.T, preferences map[string]RecipientPreferences) {
+	t.Helper()
+	previous := recipientPreferences
+	recipientPreferences = preferences
+	t.Cleanup(func() { recipientPreferences = previous })
+}
+
+func TestQuietHours(t *testing.T) {
+	loc, _ := time.LoadLocation("America/Guayaquil")
+	night := QuietHours{Start: "22:00", End: "07:00"}
+	afternoon := QuietHours{Start: "13:00", End: "15:00", Timezone: "UTC"}
+	for _, test := range []struct {
+		quiet    QuietHours
+		at       time.Time
+		expected bool
+	}{
+		{night, time.Date(2023, 11, 1, 23, 30, 0, 0, loc), true},
+		{night, time.Date(2023, 11, 1, 6, 59, 0, 0, loc), true},
+		{night, time.Date(2023, 11, 1, 7, 0, 0, 0, loc), false},
+		{night, time.Date(2023, 11, 1, 12, 0, 0, 0, loc), false},
+		{afternoon, time.Date(2023, 11, 1, 14, 0, 0, 0, time.UTC), true},
+		{afternoon, time.Date(2023, 11, 1, 14, 0, 0, 0, loc), false},
+	} {
+		if got := test.quiet.Contains(test.at); got != test.expected {
+			t.Errorf("%+v at %s: expected %t, got %t", test.quiet, test.at, test.expected, got)
+		}
+	}
+}
+
+func TestLoadRecipientPreferences(t *testing.T) {
+	dir := t.TempDir()
+	if preferences, err := LoadRecipientPreferences(filepath.Join(dir, "missing.json")); err != nil || len(preferences) != 0 {
+		t.Fatalf("expected no preferences for a missing file, got %v %v", preferences, err)
+	}
+
+	path := filepath.Join(dir, "recipients.json")
+	os.WriteFile(path, []byte(`{"a": {"channel": "sms", "language": "en", "codes": ["SOS"], "quiet_hours": {"start": "22:00", "end": "07:00"}}}`), 0644)
+	preferences, err := LoadRecipientPreferences(path)
+	if err != nil {
+		t.Fatalf("LoadRecipientPreferences failed: %v", err)
+	}
+	if p := preferences["a"]; p.Channel != ChannelSMS || p.Language != LanguageEnglish || p.QuietHours == nil {
+		t.Fatalf("unexpected preferences %+v", p)
+	}
+
+	os.WriteFile(path, []byte(`{"a": {"quiet_hours": {"start": "25:00", "end": "07:00"}}}`), 0644)
+	if _, err := LoadRecipientPreferences(path); err == nil {
+		t.Fatal("expected an error for invalid quiet hours")
+	}
+}
+
+func TestSendNotificationPreferences(t *testing.T) {
+	imei := "860419050021378"
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers(imei, UserPhoneNumbers{
+		{User: "default", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000001"}}},
+		{User: "english-sms", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000002"}}},
+		{User: "sos-only", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000003"}}},
+		{User: "always-quiet", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000004"}}},
+	})
+	useRecipientPreferences(t, map[string]RecipientPreferences{
+		"english-sms":  {Channel: ChannelSMS, Language: LanguageEnglish},
+		"sos-only":     {Codes: []string{"SOS"}},
+		"always-quiet": {QuietHours: &QuietHours{Start: "00:00", End: "23:59"}},
+	})
+	t.Setenv("TWILIO_SMS_FROM", "+15005550006")
+	sent := useTwilioStub(t)
+
+	build := func(language string) string {
+		return NewMessageBuilder(&Device{UserName: "fleet"}, &Alarm{AlarmCode: "LOWVOT"}).WithLanguage(language).getAlert()
+	}
+	sendNotification(Notification{Imei: imei, Codes: []string{"LOWVOT"}, Build: build})
+
+	messages := sent()
+	expected := []sentMessage{
+		{From: "+15005550006", To: "+593990000002", Body: "⚡⚡ LOW BATTERY ALERT ⚡⚡"},
+		{From: "whatsapp:" + DEFAULT_TWILIO_WHATSAPP_FROM, To: "whatsapp:+593990000001", Body: "⚡⚡ ALERTA DE CORRIENTE BAJA ⚡⚡"},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %+v", len(expected), messages)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Errorf("message %d: expected %+v, got %+v", i, expected[i], messages[i])
+		}
+	}
+
+	// A critical notification overrides the quiet hours, not the subscriptions.
+	sent = useTwilioStub(t)
+	sendNotification(Notification{Imei: imei, Codes: []string{"LOWVOT"}, Critical: true, Build: build})
+	if messages := sent(); len(messages) != 3 || messages[2].To != "whatsapp:+593990000004" {
+		t.Fatalf("expected the quiet user to get the critical notification, got %+v", messages)
+	}
+}
+
+func TestSendNotificationSharedPhone(t *testing.T) {
+	imei := "860419050021378"
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers(imei, UserPhoneNumbers{
+		{User: "sos-only", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000001"}}},
+		{User: "default", PhoneNumbers: []PhoneNumber{{PhoneNumber: "0990000001"}, {PhoneNumber: "+593990000002"}}},
+		{User: "other", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000002"}}},
+	})
+	useRecipientPreferences(t, map[string]RecipientPreferences{"sos-only": {Codes: []string{"SOS"}}})
+	sent := useTwilioStub(t)
+
+	// The phone shared with an unsubscribed user gets the message of the other
+	// user, and the phone shared by two subscribed users gets it once.
+	build := func(language string) string {
+		return NewMessageBuilder(&Device{UserName: "fleet"}, &Alarm{AlarmCode: "LOWVOT"}).WithLanguage(language).getAlert()
+	}
+	sendNotification(Notification{Imei: imei, Codes: []string{"LOWVOT"}, Build: build})
+	messages := sent()
+	if len(messages) != 2 || messages[0].To != "whatsapp:+593990000001" || messages[1].To != "whatsapp:+593990000002" {
+		t.Fatalf("expected a message to each phone, got %+v", messages)
+	}
+}
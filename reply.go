@@ -0,0 +1,226 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/twilio/twilio-go/twiml"
+)
+
+const (
+	// DEFAULT_PHONE_INDEX_TTL is how long the devices of each phone are kept
+	// before they are requested again to the backend, configurable with the
+	// PHONE_INDEX_TTL environment variable.
+	DEFAULT_PHONE_INDEX_TTL = time.Hour
+	// REPLY_MAX_DEVICES bounds the positions sent in a reply to UBICACION; the
+	// users with more vehicles ask for one by its plate.
+	REPLY_MAX_DEVICES = 5
+)
+
+// replyMetrics counts the incoming messages: "ubicacion" and "other".
+var replyMetrics = expvar.NewMap("replies")
+
+// phoneDevice is a device of a user, with the language of the user.
+type phoneDevice struct {
+	Device   Device
+	Language string
+}
+
+// PhoneIndex finds the tracked devices related to a phone, the reverse of the
+// phone numbers of each device in the backend. Building it takes a request per
+// device, longer than Twilio waits for a reply, so the index is rebuilt in the
+// background when it is older than its TTL and the previous one is served in
+// the meantime.
+type PhoneIndex struct {
+	fetchDevices func() ([]Device, error)
+	ttl          time.Duration
+	now          func() time.Time
+
+	mu       sync.Mutex
+	builtAt  time.Time
+	building bool
+	devices  map[string][]phoneDevice
+}
+
+var phoneIndexInstance *PhoneIndex
+var phoneIndexOnce sync.Once
+
+// GetPhoneIndex returns the index of the tracked devices of the backend.
+func GetPhoneIndex() *PhoneIndex {
+	phoneIndexOnce.Do(func() {
+		phoneIndexInstance = NewPhoneIndex(func() ([]Device, error) {
+			return (&DeviceController{}).getDevices(map[string]string{"is_tracking_alarms": "true"})
+		}, getEnvDuration("PHONE_INDEX_TTL", DEFAULT_PHONE_INDEX_TTL))
+	})
+	return phoneIndexInstance
+}
+
+// NewPhoneIndex creates an index of the devices returned by fetchDevices.
+func NewPhoneIndex(fetchDevices func() ([]Device, error), ttl time.Duration) *PhoneIndex {
+	return &PhoneIndex{fetchDevices: fetchDevices, ttl: ttl, now: time.Now}
+}
+
+// Devices returns the devices of the users with the phone, in E.164 format.
+// A stale index is refreshed in the background; until the first build ends,
+// no phone has devices.
+func (i *PhoneIndex) Devices(phone string) []phoneDevice {
+	i.mu.Lock()
+	stale := i.devices == nil || i.now().Sub(i.builtAt) >= i.ttl
+	devices := i.devices[phone]
+	i.mu.Unlock()
+	if stale {
+		i.Refresh()
+	}
+	return devices
+}
+
+// Refresh rebuilds the index in the background, unless it is already being
+// rebuilt.
+func (i *PhoneIndex) Refresh() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.building {
+		return
+	}
+	i.building = true
+	go func() {
+		if err := i.Rebuild(); err != nil {
+			logrus.WithError(err).Warning("Error building the phone index")
+		}
+		i.mu.Lock()
+		i.building = false
+		i.mu.Unlock()
+	}()
+}
+
+// Rebuild requests the devices and their phone numbers and replaces the index.
+func (i *PhoneIndex) Rebuild() error {
+	devices, err := i.fetchDevices()
+	if err != nil {
+		return err
+	}
+	index := map[string][]phoneDevice{}
+	for _, device := range devices {
+		recipients, err := GetRecipients(device.Imei)
+		if err != nil {
+			logrus.WithError(err).WithField("imei", device.Imei).Warning("Error getting the phone numbers of the index")
+			continue
+		}
+		for _, recipient := range recipients {
+			for _, phone := range recipient.Phones {
+				index[phone] = append(index[phone], phoneDevice{Device: device, Language: recipient.Preferences.Language})
+			}
+		}
+	}
+	i.mu.Lock()
+	i.devices, i.builtAt = index, i.now()
+	i.mu.Unlock()
+	return nil
+}
+
+// parseCommand returns the command of an incoming message, in upper case and
+// without accents, and its argument, e.g. "UBICACION" and "GBA-1234".
+func parseCommand(body string) (command, argument string) {
+	body = strings.NewReplacer("Á", "A", "É", "E", "Í", "I", "Ó", "O", "Ú", "U").Replace(strings.ToUpper(strings.TrimSpace(body)))
+	command, argument, _ = strings.Cut(body, " ")
+	return command, strings.TrimSpace(argument)
+}
+
+// normalizePlate removes the separators of a license plate, so "gba 1234"
+// matches "GBA-1234".
+func normalizePlate(plate string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(plate))
+}
+
+// locationReplies builds the replies to UBICACION of the devices of a phone:
+// the last position of each one, or of the one with the plate if given.
+func locationReplies(devices []phoneDevice, plate string) []string {
+	language := LanguageSpanish
+	if len(devices) > 0 {
+		language = devices[0].Language
+	}
+	if plate != "" {
+		var matching []phoneDevice
+		for _, d := range devices {
+			if d.Device.LicenseNumber != nil && normalizePlate(*d.Device.LicenseNumber) == normalizePlate(plate) {
+				matching = append(matching, d)
+			}
+		}
+		if len(matching) == 0 {
+			return []string{fmt.Sprintf(translate(language, "No hay vehículos con la placa %s."), plate)}
+		}
+		devices = matching
+	}
+
+	maxAge := getEnvDuration("POSITION_MAX_AGE", DEFAULT_POSITION_MAX_AGE)
+	var replies []string
+	seen := map[string]bool{}
+	for _, d := range devices {
+		if seen[d.Device.Imei] {
+			continue
+		}
+		seen[d.Device.Imei] = true
+		if len(replies) == REPLY_MAX_DEVICES {
+			replies = append(replies, translate(language, "Envíe UBICACION seguido de la placa para ver otro vehículo."))
+			break
+		}
+		device := d.Device
+		position := GetPositionTracker().Recent(device, time.Now(), maxAge)
+		replies = append(replies, NewMessageBuilder(&device, &Alarm{Imei: device.Imei}).WithLanguage(language).BuildPositionMessage(position))
+	}
+	return replies
+}
+
+// incomingMessageHandler answers the messages sent by the users to the
+// WhatsApp and SMS numbers of the service, configured in Twilio with the
+// public URL of TWILIO_INCOMING_URL. "UBICACION [PLACA]" replies the last
+// position of the vehicles of the sender; the other messages and the unknown
+// senders get no reply.
+//
+//	POST /twilio/incoming
+func incomingMessageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	if !validTwilioRequest(r, os.Getenv("TWILIO_INCOMING_URL")) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var replies []string
+	command, argument := parseCommand(r.PostForm.Get("Body"))
+	if command != "UBICACION" {
+		replyMetrics.Add("other", 1)
+	} else {
+		replyMetrics.Add("ubicacion", 1)
+		phone, err := NormalizePhoneNumber(r.PostForm.Get("From"))
+		if err == nil {
+			if devices := GetPhoneIndex().Devices(phone); len(devices) > 0 {
+				replies = locationReplies(devices, argument)
+			}
+		}
+	}
+
+	verbs := make([]twiml.Element, len(replies))
+	for i, reply := range replies {
+		verbs[i] = &twiml.MessagingMessage{Body: reply}
+	}
+	response, err := twiml.Messages(verbs)
+	if err != nil {
+		http.Error(w, "error building the reply", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(response))
+}
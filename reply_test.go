@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		body, command, argument string
+	}{
+		{"ubicación", "UBICACION", ""},
+		{"  Ubicacion   gba-1234 ", "UBICACION", "GBA-1234"},
+		{"Hola", "HOLA", ""},
+		{"", "", ""},
+	} {
+		if command, argument := parseCommand(test.body); command != test.command || argument != test.argument {
+			t.Errorf("%q: expected %q %q, got %q %q", test.body, test.command, test.argument, command, argument)
+		}
+	}
+}
+
+func TestPhoneIndex(t *testing.T) {
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers("1", UserPhoneNumbers{{User: "owner", PhoneNumbers: []PhoneNumber{{PhoneNumber: "0991234567"}}}})
+	server.SetPhoneNumbers("2", UserPhoneNumbers{{User: "owner", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593991234567"}}}})
+	var fetches atomic.Int32
+	index := NewPhoneIndex(func() ([]Device, error) {
+		fetches.Add(1)
+		return []Device{{Imei: "1"}, {Imei: "2"}}, nil
+	}, time.Hour)
+	var mu sync.Mutex
+	now := time.Unix(1700000000, 0)
+	index.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	// The first lookup builds the index in the background.
+	if devices := index.Devices("+593991234567"); len(devices) != 0 {
+		t.Fatalf("expected no devices before the index is built, got %+v", devices)
+	}
+	built := func(builds int32) func() bool {
+		return func() bool {
+			index.mu.Lock()
+			defer index.mu.Unlock()
+			return !index.building && fetches.Load() == builds
+		}
+	}
+	waitFor(t, "the index to be built", built(1))
+	if devices := index.Devices("+593991234567"); len(devices) != 2 {
+		t.Fatalf("expected both devices of the phone, got %+v", devices)
+	}
+	index.Devices("+593990000000")
+	if fetches.Load() != 1 {
+		t.Fatalf("expected a single build, got %d fetches", fetches.Load())
+	}
+
+	// After its TTL the stale index is served while it is rebuilt.
+	mu.Lock()
+	now = now.Add(time.Hour)
+	mu.Unlock()
+	if devices := index.Devices("+593991234567"); len(devices) != 2 {
+		t.Fatalf("expected the stale devices, got %+v", devices)
+	}
+	waitFor(t, "the index to be rebuilt", built(2))
+}
+
+func TestIncomingMessageHandler(t *testing.T) {
+	incomingURL := "https://alarms.example.com/twilio/incoming"
+	t.Setenv("TWILIO_INCOMING_URL", incomingURL)
+	t.Setenv("TWILIO_AUTH_TOKEN", "token")
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers("1", UserPhoneNumbers{{User: "owner", PhoneNumbers: []PhoneNumber{{PhoneNumber: "0991234567"}}}})
+	server.SetPhoneNumbers("2", UserPhoneNumbers{{User: "owner", PhoneNumbers: []PhoneNumber{{PhoneNumber: "0991234567"}}}})
+	tracker, _, _ := usePositionTracker(t)
+	speed := int64(60)
+	tracker.Update(Position{Imei: "1", Time: time.Now().Unix(), Speed: &speed})
+	tracker.Update(Position{Imei: "2", Time: time.Now().Unix()})
+
+	first, second := "GBA-1234", "PBC-5678"
+	GetPhoneIndex()
+	previous := phoneIndexInstance
+	phoneIndexInstance = NewPhoneIndex(func() ([]Device, error) {
+		return []Device{{Imei: "1", UserName: "norte", LicenseNumber: &first}, {Imei: "2", UserName: "norte", LicenseNumber: &second}}, nil
+	}, time.Hour)
+	t.Cleanup(func() { phoneIndexInstance = previous })
+	if err := phoneIndexInstance.Rebuild(); err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+
+	post := func(from, body string, signed bool) *httptest.ResponseRecorder {
+		form := url.Values{"From": {from}, "Body": {body}}
+		r := httptest.NewRequest(http.MethodPost, "/twilio/incoming", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if signed {
+			r.Header.Set("X-Twilio-Signature", signTwilioRequest("token", incomingURL, form))
+		}
+		w := httptest.NewRecorder()
+		incomingMessageHandler(w, r)
+		return w
+	}
+
+	if w := post("whatsapp:+593991234567", "UBICACION", false); w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 without signature, got %d", w.Code)
+	}
+	w := post("whatsapp:+593991234567", "Ubicación", true)
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "<Message>") != 2 || !strings.Contains(w.Body.String(), "Velocidad: 60 km/h") {
+		t.Fatalf("expected the positions of both vehicles, got %d: %s", w.Code, w.Body.String())
+	}
+	w = post("whatsapp:+593991234567", "ubicacion pbc 5678", true)
+	if body := w.Body.String(); strings.Count(body, "<Message>") != 1 || !strings.Contains(body, "PBC-5678") {
+		t.Fatalf("expected the position of the plate, got %s", body)
+	}
+	w = post("whatsapp:+593991234567", "ubicacion XYZ-1", true)
+	if !strings.Contains(w.Body.String(), "No hay vehículos con la placa XYZ-1.") {
+		t.Fatalf("expected an unknown plate reply, got %s", w.Body.String())
+	}
+
+	// Unknown senders and other messages get no reply.
+	for _, test := range [][2]string{{"+593990000000", "UBICACION"}, {"+593991234567", "Hola"}} {
+		if w := post(test[0], test[1], true); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<Message>") {
+			t.Errorf("expected no reply to %q from %s, got %s", test[1], test[0], w.Body.String())
+		}
+	}
+}
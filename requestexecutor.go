@@ -1,14 +1,9 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"os"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -17,6 +12,42 @@ type RequestExecutor struct {
 	next Handler
 }
 
+// FetchError is the error of the alarms request of a URL.
+type FetchError struct {
+	URL string
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching the alarms: %v", e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// failedURLs returns the URLs of the FetchErrors joined in err.
+func failedURLs(err error) map[string]bool {
+	failed := map[string]bool{}
+	var walk func(error)
+	walk = func(err error) {
+		var fetchErr *FetchError
+		switch e := err.(type) {
+		case nil:
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		default:
+			if errors.As(err, &fetchErr) {
+				failed[fetchErr.URL] = true
+			}
+		}
+	}
+	walk(err)
+	return failed
+}
+
 // Don't change this value by any reason.
 const (
 	MAX_REQUESTS_IN_IOPGPS_API_PER_SECOND   = 5
@@ -27,6 +58,7 @@ const (
 // It limits the number of concurrent requests to MAX_REQUEST_PER_SECOND using a semaphore channel.
 // It uses a mutex to protect the shared slice of alarm data and a wait group to synchronize the goroutines.
 // It passes the collected alarm data to the next handler in the chain, if any, or returns it as the final result.
+// The requests that failed are returned as FetchErrors joined with the error of the next handler.
 func (re *RequestExecutor) Handle(data interface{}) (interface{}, error) {
 	urls, ok := data.([]string)
 	if !ok {
@@ -34,6 +66,7 @@ func (re *RequestExecutor) Handle(data interface{}) (interface{}, error) {
 	}
 
 	var alarms []Alarm
+	var errs []error
 	var mutex sync.Mutex
 	var wg sync.WaitGroup
 
@@ -42,10 +75,10 @@ func (re *RequestExecutor) Handle(data interface{}) (interface{}, error) {
 
 	for _, url := range urls {
 		wg.Add(1)
-		if strings.Contains(url, "iopgps") {
-			go re.processIOPGPSURL(url, &alarms, &mutex, &wg, semIOPGPS)
-		} else if strings.Contains(url, "whatsgps") {
-			go re.processWHATSGPSURL(url, &alarms, &mutex, &wg, semWHATSGPS)
+		if iopgpsClient.Owns(url) {
+			go re.processURL(url, &alarms, &errs, &mutex, &wg, semIOPGPS)
+		} else if whatsgpsClient.Owns(url) {
+			go re.processURL(url, &alarms, &errs, &mutex, &wg, semWHATSGPS)
 		} else {
 			logrus.Warning("Unknown provider for URL:", url)
 			wg.Done()
@@ -55,131 +88,48 @@ func (re *RequestExecutor) Handle(data interface{}) (interface{}, error) {
 	wg.Wait()
 
 	if re.next != nil {
-		return re.next.Handle(alarms)
+		result, err := re.next.Handle(alarms)
+		return result, errors.Join(append(errs, err)...)
 	}
-	return alarms, nil
+	return alarms, errors.Join(errs...)
 }
 
-func (re *RequestExecutor) processIOPGPSURL(url string, alarms *[]Alarm, mutex *sync.Mutex, wg *sync.WaitGroup, sem chan struct{}) {
+func (re *RequestExecutor) processURL(url string, alarms *[]Alarm, errs *[]error, mutex *sync.Mutex, wg *sync.WaitGroup, sem chan struct{}) {
 	defer wg.Done()
 
 	sem <- struct{}{}
 	defer func() { <-sem }()
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-			"url":   url,
-		}).Warning("Error creating request for URL")
-	}
-
-	token := os.Getenv("ACCESS_TOKEN")
-	req.Header.Add("AccessToken", token)
-
-	// Create a context with a timeout of 10 seconds
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Add the context to the request
-	req = req.WithContext(ctx)
-
-	resp, err := http.DefaultClient.Do(req)
+	urlAlarms, err := re.FetchAlarms(url)
 	if err != nil {
-		logrus.Warning(err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		logrus.WithFields(logrus.Fields{
-			"status": resp.StatusCode,
-			"url":    url,
-		}).Warning("Received non-200 HTTP status")
-		return
-	}
-
-	var alarmResponse AlarmResponse
-	err = json.NewDecoder(resp.Body).Decode(&alarmResponse)
-	if err != nil {
-		// Log the alarm information even if there is an error
-		logrus.Info("Alarm details: ", alarmResponse.Details)
 		logrus.WithFields(logrus.Fields{
 			"error": err,
 			"url":   url,
-		}).Warning("Error decoding the response body")
+		}).Warning("Error fetching the alarms")
+		mutex.Lock()
+		*errs = append(*errs, &FetchError{URL: url, Err: err})
+		mutex.Unlock()
 		return
 	}
-	// Check if alarmResponse.Details is empty
-	if len(alarmResponse.Details) == 0 {
+	// Check if there are alarms
+	if len(urlAlarms) == 0 {
 		return
 	}
 
 	mutex.Lock()
-	for _, alarmData := range alarmResponse.Details {
-		alarm := ConvertAlarmDataToRequest(alarmData)
-		*alarms = append(*alarms, alarm)
-	}
+	*alarms = append(*alarms, urlAlarms...)
 	mutex.Unlock()
 }
 
-func (re *RequestExecutor) processWHATSGPSURL(url string, alarms *[]Alarm, mutex *sync.Mutex, wg *sync.WaitGroup, sem chan struct{}) {
-	defer wg.Done()
-
-	sem <- struct{}{}
-	defer func() { <-sem }()
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-			"url":   url,
-		}).Warning("Error creating request for URL")
-	}
-
-	// Create a context with a timeout of 10 seconds
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Add the context to the request
-	req = req.WithContext(ctx)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		logrus.Warning(err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		logrus.WithFields(logrus.Fields{
-			"status": resp.StatusCode,
-			"url":    url,
-		}).Warning("Received non-200 HTTP status")
-		return
+// FetchAlarms requests the alarms of a single URL generated by Device.GenerateURL
+// and converts them to Alarm, choosing the provider from the URL.
+func (re *RequestExecutor) FetchAlarms(url string) ([]Alarm, error) {
+	if iopgpsClient.Owns(url) {
+		return iopgpsClient.FetchAlarms(url)
+	} else if whatsgpsClient.Owns(url) {
+		return whatsgpsClient.FetchAlarms(url)
 	}
-
-	var alarmResponse WhatsGPSAlarmData
-	err = json.NewDecoder(resp.Body).Decode(&alarmResponse)
-	if err != nil {
-		// Log the alarm information even if there is an error
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-			"url":   url,
-		}).Warning("Error decoding the response body")
-		return
-	}
-	// Check if alarmResponse.Details is empty
-	if len(alarmResponse.Data) == 0 {
-		return
-	}
-
-	mutex.Lock()
-	for _, alarmData := range alarmResponse.Data {
-		alarm := ConvertWhatsGPSAlarmDataToRequest(alarmData)
-		*alarms = append(*alarms, alarm)
-	}
-	mutex.Unlock()
+	return nil, fmt.Errorf("unknown provider for URL: %s", url)
 }
 
 func (re *RequestExecutor) SetNext(next Handler) {
@@ -2,17 +2,25 @@ package main
 
 import (
 	"errors"
-	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
 type RequestGenerator struct {
 	next Handler
+
+	// deviceSync receives the new checkpoints, GetDeviceSync() if nil.
+	deviceSync *DeviceSync
 }
 
+// MAX_DEVICES_FOR_UPDATE bounds the device updates sent at the same time.
 const MAX_DEVICES_FOR_UPDATE = 10
 
+// Handle generates the alarms URL of every device. The devices are updated in
+// place, so the caller sees the new LastTimeTracked of each one, and the new
+// checkpoints are sent to the backend by the DeviceSync. A device whose
+// alarms couldn't be requested keeps its previous checkpoint, so its window
+// is requested again in the next poll.
 func (rg *RequestGenerator) Handle(data interface{}) (interface{}, error) {
 	devices, ok := data.([]Device)
 	if !ok {
@@ -20,30 +28,31 @@ func (rg *RequestGenerator) Handle(data interface{}) (interface{}, error) {
 		return nil, errors.New("unable to cast data to []Device")
 	}
 
-	urls := make([]string, len(devices))
-	var wg sync.WaitGroup
-
-	sem := make(chan struct{}, MAX_DEVICES_FOR_UPDATE)
-
-	for i, device := range devices {
-		wg.Add(1)
-		go func(i int, device Device) {
-			defer wg.Done()
-
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			urls[i] = device.GenerateURL()
-			device.UpdateDevice()
-		}(i, device)
+	deviceSync := rg.deviceSync
+	if deviceSync == nil {
+		deviceSync = GetDeviceSync()
 	}
 
-	wg.Wait()
+	urls := make([]string, len(devices))
+	previous := make([]int64, len(devices))
+	for i := range devices {
+		previous[i] = devices[i].LastTimeTracked
+		urls[i] = devices[i].GenerateURL()
+	}
 
-	if rg.next != nil {
-		return rg.next.Handle(urls)
+	if rg.next == nil {
+		return urls, nil
+	}
+	result, err := rg.next.Handle(urls)
+	failed := failedURLs(err)
+	for i := range devices {
+		if failed[urls[i]] {
+			devices[i].LastTimeTracked = previous[i]
+			continue
+		}
+		deviceSync.Record(devices[i].Imei, previous[i], devices[i].LastTimeTracked)
 	}
-	return urls, nil
+	return result, err
 }
 
 func (rg *RequestGenerator) SetNext(next Handler) {
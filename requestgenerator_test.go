@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingExecutor is a Handler that fails the URLs of the IMEI fail, as the
+// RequestExecutor does, rejected by an open circuit.
+type failingExecutor struct {
+	fail string
+}
+
+func (h *failingExecutor) Handle(data interface{}) (interface{}, error) {
+	var errs []error
+	for _, url := range data.([]string) {
+		if strings.Contains(url, h.fail) {
+			errs = append(errs, &FetchError{URL: url, Err: fmt.Errorf("iopgps: %w", ErrCircuitOpen)})
+		}
+	}
+	return []Alarm{}, errors.Join(errs...)
+}
+
+func (h *failingExecutor) SetNext(Handler) {}
+
+func TestRequestGeneratorKeepsFailedCheckpoints(t *testing.T) {
+	deviceSync := NewDeviceSync(time.Hour)
+	generator := &RequestGenerator{deviceSync: deviceSync}
+	generator.SetNext(&failingExecutor{fail: "222222222222222"})
+
+	checkpoint := time.Now().Add(-time.Hour).Unix()
+	devices := []Device{
+		{Imei: "111111111111111", Provider: WanWayTech, LastTimeTracked: checkpoint},
+		{Imei: "222222222222222", Provider: WanWayTech, LastTimeTracked: checkpoint},
+	}
+	_, err := generator.Handle(devices)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the error of the failed request, got %v", err)
+	}
+	if devices[0].LastTimeTracked <= checkpoint || devices[1].LastTimeTracked != checkpoint {
+		t.Fatalf("expected only the checkpoint of the polled device to move, got %+v", devices)
+	}
+	if pending := deviceSync.Pending(); pending != 1 {
+		t.Fatalf("expected only the polled device to be synced, got %d pending", pending)
+	}
+}
@@ -0,0 +1,321 @@
+// Package roadsafety is a client of the road-safety backend, which stores the
+// devices, the alarms, the users and their phones.
+package roadsafety
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_URL is the base URL of the production backend.
+const DEFAULT_URL = "https://api.road-safety-ec.com/api/v1/"
+
+// DEFAULT_TIMEOUT is the timeout of the client used when none is given.
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// MAX_ERROR_BODY bounds the bytes of a response body kept in an APIError.
+const MAX_ERROR_BODY = 4096
+
+// Client calls the road-safety backend with an API key.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the backend at baseURL. If httpClient is
+// nil, a client with DEFAULT_TIMEOUT is used.
+func NewClient(baseURL, apiKey string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/") + "/",
+		apiKey:     apiKey,
+		httpClient: httpClient,
+	}
+}
+
+// ListOptions selects a page of a list endpoint. Filters are sent as query
+// parameters, e.g. is_tracking_alarms=true. A zero Page asks for the whole
+// list, which the backend doesn't paginate.
+type ListOptions struct {
+	Page     int
+	PageSize int
+	Filters  map[string]string
+}
+
+func (o ListOptions) values() url.Values {
+	query := url.Values{}
+	for key, value := range o.Filters {
+		query.Set(key, value)
+	}
+	if o.Page > 0 {
+		query.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.PageSize > 0 {
+		query.Set("page_size", strconv.Itoa(o.PageSize))
+	}
+	return query
+}
+
+// do sends a request and decodes the response into out when it is not nil.
+// Any status not in expected is returned as an *APIError.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}, expected ...int) (int, error) {
+	u := c.baseURL + strings.TrimLeft(path, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("road-safety: encoding the request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Token "+c.apiKey)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if !containsStatus(expected, resp.StatusCode) {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY))
+		return resp.StatusCode, &APIError{
+			Method:     method,
+			URL:        u,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       strings.TrimSpace(string(data)),
+		}
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("road-safety: decoding the response of %s %s: %w", method, u, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// list requests a page of a list endpoint. The backend answers with a plain
+// array when the request isn't paginated, which is returned as a single page.
+func list[T any](ctx context.Context, c *Client, path string, opts ListOptions) (*Page[T], error) {
+	var raw json.RawMessage
+	if _, err := c.do(ctx, "GET", path, opts.values(), nil, &raw, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	page := &Page[T]{}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &page.Results); err != nil {
+			return nil, fmt.Errorf("road-safety: decoding the list of %s: %w", path, err)
+		}
+		page.Count = len(page.Results)
+		return page, nil
+	}
+	if err := json.Unmarshal(raw, page); err != nil {
+		return nil, fmt.Errorf("road-safety: decoding the page of %s: %w", path, err)
+	}
+	return page, nil
+}
+
+// listAll requests every page of a list endpoint.
+func listAll[T any](ctx context.Context, c *Client, path string, opts ListOptions) ([]T, error) {
+	if opts.Page == 0 {
+		opts.Page = 1
+	}
+	var results []T
+	for {
+		page, err := list[T](ctx, c, path, opts)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, page.Results...)
+		if page.Next == nil {
+			return results, nil
+		}
+		opts.Page++
+	}
+}
+
+func devicePath(imei string) string {
+	return "devices/" + url.PathEscape(imei) + "/"
+}
+
+// ListDevices returns a page of the devices matching opts.
+func (c *Client) ListDevices(ctx context.Context, opts ListOptions) (*Page[Device], error) {
+	return list[Device](ctx, c, "devices/", opts)
+}
+
+// AllDevices returns every device matching the filters, following the pages.
+func (c *Client) AllDevices(ctx context.Context, filters map[string]string) ([]Device, error) {
+	return listAll[Device](ctx, c, "devices/", ListOptions{Filters: filters})
+}
+
+// GetDevice returns the device with the given IMEI.
+func (c *Client) GetDevice(ctx context.Context, imei string) (*Device, error) {
+	var device Device
+	if _, err := c.do(ctx, "GET", devicePath(imei), nil, nil, &device, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// CreateDevice registers a device. The backend stores it by IMEI.
+func (c *Client) CreateDevice(ctx context.Context, device *Device) error {
+	_, err := c.do(ctx, "POST", "devices/", nil, device, nil, http.StatusCreated)
+	return err
+}
+
+// UpdateDevice changes the fields of update of the device and returns it.
+func (c *Client) UpdateDevice(ctx context.Context, imei string, update DeviceUpdate) (*Device, error) {
+	var device Device
+	if _, err := c.do(ctx, "PATCH", devicePath(imei), nil, update, &device, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// ListPhoneNumbers returns the users related to a device and their phones.
+func (c *Client) ListPhoneNumbers(ctx context.Context, imei string) (UserPhoneNumbers, error) {
+	var phones UserPhoneNumbers
+	if _, err := c.do(ctx, "GET", devicePath(imei)+"phones/", nil, nil, &phones, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return phones, nil
+}
+
+func alarmPath(id int64) string {
+	return "alarms/" + strconv.FormatInt(id, 10) + "/"
+}
+
+// ListAlarms returns a page of the alarms matching opts, e.g. device_imei.
+func (c *Client) ListAlarms(ctx context.Context, opts ListOptions) (*Page[Alarm], error) {
+	return list[Alarm](ctx, c, "alarms/", opts)
+}
+
+// AllAlarms returns every alarm matching the filters, following the pages.
+func (c *Client) AllAlarms(ctx context.Context, filters map[string]string) ([]Alarm, error) {
+	return listAll[Alarm](ctx, c, "alarms/", ListOptions{Filters: filters})
+}
+
+// GetAlarm returns the alarm with the given ID.
+func (c *Client) GetAlarm(ctx context.Context, id int64) (*Alarm, error) {
+	var alarm Alarm
+	if _, err := c.do(ctx, "GET", alarmPath(id), nil, nil, &alarm, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &alarm, nil
+}
+
+// CreateAlarm saves an alarm. It reports false, without error, when the
+// backend already had it.
+func (c *Client) CreateAlarm(ctx context.Context, alarm *Alarm) (bool, error) {
+	status, err := c.do(ctx, "POST", "alarms/", nil, alarm, nil, http.StatusCreated, http.StatusAlreadyReported)
+	if err != nil {
+		return false, err
+	}
+	return status == http.StatusCreated, nil
+}
+
+// CreateAlarms saves several alarms in a single request and returns the
+// result of each one, in the same order. An error is returned only when the
+// whole request fails.
+func (c *Client) CreateAlarms(ctx context.Context, alarms []Alarm) ([]BulkResult, error) {
+	if len(alarms) == 0 {
+		return nil, nil
+	}
+	var response struct {
+		Results []BulkResult `json:"results"`
+	}
+	if _, err := c.do(ctx, "POST", "alarms/bulk/", nil, alarms, &response, http.StatusMultiStatus); err != nil {
+		return nil, err
+	}
+	if len(response.Results) != len(alarms) {
+		return nil, fmt.Errorf("road-safety: bulk request of %d alarms returned %d results", len(alarms), len(response.Results))
+	}
+	results := make([]BulkResult, len(alarms))
+	for _, result := range response.Results {
+		if result.Index < 0 || result.Index >= len(alarms) {
+			return nil, fmt.Errorf("road-safety: bulk result with invalid index %d", result.Index)
+		}
+		results[result.Index] = result
+	}
+	return results, nil
+}
+
+// UpdateAlarm changes the fields of update of the alarm and returns it.
+func (c *Client) UpdateAlarm(ctx context.Context, id int64, update AlarmUpdate) (*Alarm, error) {
+	var alarm Alarm
+	if _, err := c.do(ctx, "PATCH", alarmPath(id), nil, update, &alarm, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &alarm, nil
+}
+
+func userPath(uuid string) string {
+	return "users/" + url.PathEscape(uuid) + "/"
+}
+
+// ListUsers returns a page of the users matching opts.
+func (c *Client) ListUsers(ctx context.Context, opts ListOptions) (*Page[User], error) {
+	return list[User](ctx, c, "users/", opts)
+}
+
+// GetUser returns the user with the given UUID.
+func (c *Client) GetUser(ctx context.Context, uuid string) (*User, error) {
+	var user User
+	if _, err := c.do(ctx, "GET", userPath(uuid), nil, nil, &user, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser registers a user and returns it with the UUID assigned by the backend.
+func (c *Client) CreateUser(ctx context.Context, user *User) (*User, error) {
+	var created User
+	if _, err := c.do(ctx, "POST", "users/", nil, user, &created, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateUser changes the fields of update of the user and returns it.
+func (c *Client) UpdateUser(ctx context.Context, uuid string, update UserUpdate) (*User, error) {
+	var user User
+	if _, err := c.do(ctx, "PATCH", userPath(uuid), nil, update, &user, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
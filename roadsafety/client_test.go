@@ -0,0 +1,176 @@
+package roadsafety_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+	"github.com/indrod-group/get_device_alarms/roadsafety/roadsafetytest"
+)
+
+func TestDevices(t *testing.T) {
+	server := roadsafetytest.NewServer("key")
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	for _, imei := range []string{"1", "2", "3"} {
+		err := client.CreateDevice(ctx, &roadsafety.Device{Imei: imei, IsTrackingAlarms: imei != "2", Provider: roadsafety.WhatsGPS})
+		if err != nil {
+			t.Fatalf("CreateDevice(%s) failed: %v", imei, err)
+		}
+	}
+
+	tracked, err := client.AllDevices(ctx, map[string]string{"is_tracking_alarms": "true"})
+	if err != nil {
+		t.Fatalf("AllDevices failed: %v", err)
+	}
+	if len(tracked) != 2 || tracked[0].Imei != "1" || tracked[1].Imei != "3" {
+		t.Errorf("unexpected tracked devices %+v", tracked)
+	}
+
+	page, err := client.ListDevices(ctx, roadsafety.ListOptions{Page: 1, PageSize: 2})
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if page.Count != 3 || len(page.Results) != 2 || page.Next == nil {
+		t.Errorf("unexpected first page %+v", page)
+	}
+
+	lastTimeTracked := int64(1700000000)
+	device, err := client.UpdateDevice(ctx, "1", roadsafety.DeviceUpdate{LastTimeTracked: &lastTimeTracked})
+	if err != nil {
+		t.Fatalf("UpdateDevice failed: %v", err)
+	}
+	if device.LastTimeTracked != lastTimeTracked || !device.IsTrackingAlarms || device.Provider != roadsafety.WhatsGPS {
+		t.Errorf("expected only last_time_tracked to change, got %+v", device)
+	}
+	requests := server.Requests()
+	if last := requests[len(requests)-1]; last.Method != "PATCH" || last.Body != `{"last_time_tracked":1700000000}` {
+		t.Errorf("unexpected update request %+v", last)
+	}
+
+	if _, err := client.GetDevice(ctx, "4"); !roadsafety.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestAlarms(t *testing.T) {
+	server := roadsafetytest.NewServer("key")
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	alarm := roadsafety.Alarm{Imei: "1", Time: 1700000000, AlarmCode: "SOS"}
+	created, err := client.CreateAlarm(ctx, &alarm)
+	if err != nil || !created {
+		t.Fatalf("expected the alarm to be created, got %v, %v", created, err)
+	}
+	created, err = client.CreateAlarm(ctx, &alarm)
+	if err != nil || created {
+		t.Fatalf("expected the duplicate to be skipped, got %v, %v", created, err)
+	}
+
+	server.FailAlarms("3", http.StatusServiceUnavailable)
+	results, err := client.CreateAlarms(ctx, []roadsafety.Alarm{
+		alarm,
+		{Imei: "1", Time: 1700000060, AlarmCode: "REMOVE"},
+		{Imei: "2", Time: 1700000000, AlarmCode: "SOS"},
+		{Imei: "3", Time: 1700000000, AlarmCode: "SOS"},
+		{Time: 1700000000, AlarmCode: "SOS"},
+	})
+	if err != nil {
+		t.Fatalf("CreateAlarms failed: %v", err)
+	}
+	expected := []int{http.StatusAlreadyReported, http.StatusCreated, http.StatusCreated, http.StatusServiceUnavailable, http.StatusBadRequest}
+	for i, result := range results {
+		if result.Index != i || result.Status != expected[i] {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+	}
+	if !results[0].Saved() || !results[3].Retryable() || results[4].Saved() || results[4].Retryable() {
+		t.Errorf("unexpected classification of the results %+v", results)
+	}
+	if saved := server.Alarms(); len(saved) != 3 {
+		t.Fatalf("expected 3 alarms, got %+v", saved)
+	}
+
+	page, err := client.ListAlarms(ctx, roadsafety.ListOptions{Filters: map[string]string{"device_imei": "1"}})
+	if err != nil {
+		t.Fatalf("ListAlarms failed: %v", err)
+	}
+	if page.Count != 2 || page.Next != nil {
+		t.Errorf("unexpected alarms %+v", page)
+	}
+
+	address := "Guayaquil, Ecuador"
+	updated, err := client.UpdateAlarm(ctx, page.Results[1].ID, roadsafety.AlarmUpdate{Address: &address})
+	if err != nil {
+		t.Fatalf("UpdateAlarm failed: %v", err)
+	}
+	fetched, err := client.GetAlarm(ctx, updated.ID)
+	if err != nil {
+		t.Fatalf("GetAlarm failed: %v", err)
+	}
+	if fetched.Address == nil || *fetched.Address != address || fetched.AlarmCode != "REMOVE" {
+		t.Errorf("unexpected alarm %+v", fetched)
+	}
+}
+
+func TestUsersAndPhones(t *testing.T) {
+	server := roadsafetytest.NewServer("key")
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	user, err := client.CreateUser(ctx, &roadsafety.User{Username: "ana"})
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	email := "ana@example.com"
+	if _, err := client.UpdateUser(ctx, user.UUID, roadsafety.UserUpdate{Email: &email}); err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	fetched, err := client.GetUser(ctx, user.UUID)
+	if err != nil || fetched.Email != email || fetched.Username != "ana" {
+		t.Errorf("unexpected user %+v, %v", fetched, err)
+	}
+	users, err := client.ListUsers(ctx, roadsafety.ListOptions{})
+	if err != nil || users.Count != 1 {
+		t.Errorf("unexpected users %+v, %v", users, err)
+	}
+
+	server.SetPhoneNumbers("1", roadsafety.UserPhoneNumbers{
+		{User: user.UUID, PhoneNumbers: []roadsafety.PhoneNumber{{PhoneNumber: "+593991234567"}}},
+	})
+	phones, err := client.ListPhoneNumbers(ctx, "1")
+	if err != nil {
+		t.Fatalf("ListPhoneNumbers failed: %v", err)
+	}
+	if len(phones) != 1 || phones[0].PhoneNumbers[0].PhoneNumber != "+593991234567" {
+		t.Errorf("unexpected phones %+v", phones)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server := roadsafetytest.NewServer("key")
+	defer server.Close()
+	ctx := context.Background()
+
+	_, err := roadsafety.NewClient(server.BaseURL, "wrong", nil).GetDevice(ctx, "1")
+	var apiErr *roadsafety.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.Body != `{"detail":"Invalid token."}` || apiErr.Retryable() {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+
+	server.Fail(http.StatusServiceUnavailable, 1)
+	_, err = server.Client().ListDevices(ctx, roadsafety.ListOptions{})
+	if !errors.As(err, &apiErr) || !apiErr.Retryable() {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package roadsafety
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// APIError is returned when the backend answers with an unexpected status.
+// Body holds the response body, which usually explains the error.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("road-safety: %s %s: %s", e.Method, e.URL, e.Status)
+	}
+	return fmt.Sprintf("road-safety: %s %s: %s: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// Retryable reports whether the same request may succeed later: server
+// errors and rate limits are retryable, other client errors are not.
+func (e *APIError) Retryable() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsNotFound reports whether err is an APIError with status 404.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
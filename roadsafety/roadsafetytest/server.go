@@ -0,0 +1,465 @@
+// Package roadsafetytest provides an in-memory road-safety backend for tests.
+package roadsafetytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/indrod-group/get_device_alarms/roadsafety"
+)
+
+// API_PREFIX is the path where the fake backend serves the API, as the real one.
+const API_PREFIX = "/api/v1/"
+
+// DEFAULT_PAGE_SIZE is the page size used when a paginated list doesn't set one.
+const DEFAULT_PAGE_SIZE = 100
+
+// Request is a request received by the fake backend.
+type Request struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// Server is a fake road-safety backend backed by memory. Alarms with the same
+// IMEI, time and code are duplicates, answered with 208 as the real backend.
+type Server struct {
+	*httptest.Server
+
+	// BaseURL is the base URL to give to roadsafety.NewClient.
+	BaseURL string
+	// APIKey is the key required in the Authorization header.
+	APIKey string
+
+	mu        sync.Mutex
+	devices   map[string]roadsafety.Device
+	phones    map[string]roadsafety.UserPhoneNumbers
+	alarms    []roadsafety.Alarm
+	users     map[string]roadsafety.User
+	failures  []int
+	requests  []Request
+	nextAlarm int64
+	nextUser  int
+
+	alarmFailures map[string]int
+}
+
+// NewServer starts a fake backend requiring apiKey. Close it when done.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		APIKey:    apiKey,
+		devices:   map[string]roadsafety.Device{},
+		phones:    map[string]roadsafety.UserPhoneNumbers{},
+		users:     map[string]roadsafety.User{},
+		nextAlarm: 1,
+		nextUser:  1,
+
+		alarmFailures: map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.BaseURL = s.Server.URL + API_PREFIX
+	return s
+}
+
+// Client returns a client of the fake backend.
+func (s *Server) Client() *roadsafety.Client {
+	return roadsafety.NewClient(s.BaseURL, s.APIKey, s.Server.Client())
+}
+
+// AddDevice stores a device.
+func (s *Server) AddDevice(device roadsafety.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[device.Imei] = device
+}
+
+// Device returns the stored device with the given IMEI.
+func (s *Server) Device(imei string) (roadsafety.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[imei]
+	return device, ok
+}
+
+// SetPhoneNumbers sets the users and phones related to a device.
+func (s *Server) SetPhoneNumbers(imei string, phones roadsafety.UserPhoneNumbers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phones[imei] = phones
+}
+
+// AddUser stores a user. A UUID is assigned if it has none.
+func (s *Server) AddUser(user roadsafety.User) roadsafety.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addUser(user)
+}
+
+func (s *Server) addUser(user roadsafety.User) roadsafety.User {
+	if user.UUID == "" {
+		user.UUID = fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextUser)
+		s.nextUser++
+	}
+	s.users[user.UUID] = user
+	return user
+}
+
+// Alarms returns the stored alarms, in the order they were saved.
+func (s *Server) Alarms() []roadsafety.Alarm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]roadsafety.Alarm(nil), s.alarms...)
+}
+
+// Requests returns the requests received, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Fail answers the next times requests with status instead of serving them.
+func (s *Server) Fail(status, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < times; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// FailAlarms answers the alarms of imei with status, alone or in a bulk
+// request, until it is called again with status 0.
+func (s *Server) FailAlarms(imei string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == 0 {
+		delete(s.alarmFailures, imei)
+		return
+	}
+	s.alarmFailures[imei] = status
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Body: string(body)})
+
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, status, "injected failure")
+		return
+	}
+	if r.Header.Get("Authorization") != "Token "+s.APIKey {
+		writeError(w, http.StatusUnauthorized, "Invalid token.")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, API_PREFIX) {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/"), "/")
+	switch {
+	case parts[0] == "devices" && len(parts) == 1:
+		s.serveDevices(w, r, body)
+	case parts[0] == "devices" && len(parts) == 2:
+		s.serveDevice(w, r, parts[1], body)
+	case parts[0] == "devices" && len(parts) == 3 && parts[2] == "phones" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, append(roadsafety.UserPhoneNumbers{}, s.phones[parts[1]]...))
+	case parts[0] == "alarms" && len(parts) == 1:
+		s.serveAlarms(w, r, body)
+	case parts[0] == "alarms" && len(parts) == 2 && parts[1] == "bulk" && r.Method == "POST":
+		s.serveBulkAlarms(w, body)
+	case parts[0] == "alarms" && len(parts) == 2:
+		s.serveAlarm(w, r, parts[1], body)
+	case parts[0] == "users" && len(parts) == 1:
+		s.serveUsers(w, r, body)
+	case parts[0] == "users" && len(parts) == 2:
+		s.serveUser(w, r, parts[1], body)
+	default:
+		writeError(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+func (s *Server) serveDevices(w http.ResponseWriter, r *http.Request, body []byte) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		devices := []roadsafety.Device{}
+		for _, device := range s.devices {
+			if v := query.Get("is_tracking_alarms"); v != "" && v != strconv.FormatBool(device.IsTrackingAlarms) {
+				continue
+			}
+			if v := query.Get("user_name"); v != "" && v != device.UserName {
+				continue
+			}
+			if v := query.Get("provider"); v != "" && v != string(device.Provider) {
+				continue
+			}
+			devices = append(devices, device)
+		}
+		sort.Slice(devices, func(i, j int) bool { return devices[i].Imei < devices[j].Imei })
+		writeList(w, r, devices)
+	case "POST":
+		var device roadsafety.Device
+		if err := json.Unmarshal(body, &device); err != nil || device.Imei == "" {
+			writeError(w, http.StatusBadRequest, "Invalid device.")
+			return
+		}
+		s.devices[device.Imei] = device
+		writeJSON(w, http.StatusCreated, device)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+func (s *Server) serveDevice(w http.ResponseWriter, r *http.Request, imei string, body []byte) {
+	device, ok := s.devices[imei]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, device)
+	case "PATCH":
+		var update roadsafety.DeviceUpdate
+		if err := json.Unmarshal(body, &update); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid update.")
+			return
+		}
+		if update.UserName != nil {
+			device.UserName = *update.UserName
+		}
+		if update.CarOwner != nil {
+			device.CarOwner = update.CarOwner
+		}
+		if update.LicenseNumber != nil {
+			device.LicenseNumber = update.LicenseNumber
+		}
+		if update.Vin != nil {
+			device.Vin = update.Vin
+		}
+		if update.IsTrackingAlarms != nil {
+			device.IsTrackingAlarms = *update.IsTrackingAlarms
+		}
+		if update.LastTimeTracked != nil {
+			device.LastTimeTracked = *update.LastTimeTracked
+		}
+		if update.Provider != nil {
+			device.Provider = *update.Provider
+		}
+		s.devices[imei] = device
+		writeJSON(w, http.StatusOK, device)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+// createAlarm stores an alarm and returns the status of the result: 201 if it
+// was new, 208 if it was a duplicate or the status set with FailAlarms.
+func (s *Server) createAlarm(alarm roadsafety.Alarm) int {
+	if alarm.Imei == "" {
+		return http.StatusBadRequest
+	}
+	if status, ok := s.alarmFailures[alarm.Imei]; ok {
+		return status
+	}
+	for _, saved := range s.alarms {
+		if saved.Imei == alarm.Imei && saved.Time == alarm.Time && saved.AlarmCode == alarm.AlarmCode {
+			return http.StatusAlreadyReported
+		}
+	}
+	alarm.ID = s.nextAlarm
+	s.nextAlarm++
+	s.alarms = append(s.alarms, alarm)
+	return http.StatusCreated
+}
+
+func (s *Server) serveAlarms(w http.ResponseWriter, r *http.Request, body []byte) {
+	switch r.Method {
+	case "GET":
+		imei := r.URL.Query().Get("device_imei")
+		alarms := []roadsafety.Alarm{}
+		for _, alarm := range s.alarms {
+			if imei == "" || alarm.Imei == imei {
+				alarms = append(alarms, alarm)
+			}
+		}
+		writeList(w, r, alarms)
+	case "POST":
+		var alarm roadsafety.Alarm
+		if err := json.Unmarshal(body, &alarm); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid alarm.")
+			return
+		}
+		status := s.createAlarm(alarm)
+		if status != http.StatusCreated {
+			writeError(w, status, http.StatusText(status))
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.alarms[len(s.alarms)-1])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+func (s *Server) serveBulkAlarms(w http.ResponseWriter, body []byte) {
+	var alarms []roadsafety.Alarm
+	if err := json.Unmarshal(body, &alarms); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid alarms.")
+		return
+	}
+	results := make([]roadsafety.BulkResult, len(alarms))
+	for i, alarm := range alarms {
+		results[i] = roadsafety.BulkResult{Index: i, Status: s.createAlarm(alarm)}
+		if results[i].Status != http.StatusCreated {
+			results[i].Detail = http.StatusText(results[i].Status)
+		}
+	}
+	writeJSON(w, http.StatusMultiStatus, map[string]interface{}{"results": results})
+}
+
+func (s *Server) serveAlarm(w http.ResponseWriter, r *http.Request, rawID string, body []byte) {
+	id, _ := strconv.ParseInt(rawID, 10, 64)
+	index := -1
+	for i, alarm := range s.alarms {
+		if alarm.ID == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.alarms[index])
+	case "PATCH":
+		var update roadsafety.AlarmUpdate
+		if err := json.Unmarshal(body, &update); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid update.")
+			return
+		}
+		if update.Address != nil {
+			s.alarms[index].Address = update.Address
+		}
+		writeJSON(w, http.StatusOK, s.alarms[index])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+func (s *Server) serveUsers(w http.ResponseWriter, r *http.Request, body []byte) {
+	switch r.Method {
+	case "GET":
+		users := []roadsafety.User{}
+		for _, user := range s.users {
+			users = append(users, user)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].UUID < users[j].UUID })
+		writeList(w, r, users)
+	case "POST":
+		var user roadsafety.User
+		if err := json.Unmarshal(body, &user); err != nil || user.Username == "" {
+			writeError(w, http.StatusBadRequest, "Invalid user.")
+			return
+		}
+		user.UUID = ""
+		writeJSON(w, http.StatusCreated, s.addUser(user))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+func (s *Server) serveUser(w http.ResponseWriter, r *http.Request, uuid string, body []byte) {
+	user, ok := s.users[uuid]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, user)
+	case "PATCH":
+		var update roadsafety.UserUpdate
+		if err := json.Unmarshal(body, &update); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid update.")
+			return
+		}
+		if update.Email != nil {
+			user.Email = *update.Email
+		}
+		if update.FirstName != nil {
+			user.FirstName = *update.FirstName
+		}
+		if update.LastName != nil {
+			user.LastName = *update.LastName
+		}
+		s.users[uuid] = user
+		writeJSON(w, http.StatusOK, user)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+// writeList answers with the whole list, or with a page of it when the
+// request has a page parameter.
+func writeList[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	query := r.URL.Query()
+	if query.Get("page") == "" {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		writeError(w, http.StatusNotFound, "Invalid page.")
+		return
+	}
+	size, err := strconv.Atoi(query.Get("page_size"))
+	if err != nil || size < 1 {
+		size = DEFAULT_PAGE_SIZE
+	}
+
+	start := (page - 1) * size
+	if start > len(items) || (start == len(items) && page > 1) {
+		writeError(w, http.StatusNotFound, "Invalid page.")
+		return
+	}
+	end := min(start+size, len(items))
+
+	result := roadsafety.Page[T]{Count: len(items), Results: items[start:end]}
+	pageURL := func(n int) *string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(n))
+		u := "http://" + r.Host + r.URL.Path + "?" + q.Encode()
+		return &u
+	}
+	if end < len(items) {
+		result.Next = pageURL(page + 1)
+	}
+	if page > 1 {
+		result.Previous = pageURL(page - 1)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, map[string]string{"detail": detail})
+}
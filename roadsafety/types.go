@@ -0,0 +1,125 @@
+package roadsafety
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Provider is the vendor platform that reports the alarms of a device.
+type Provider string
+
+const (
+	WanWayTech Provider = "WanWayTech"
+	WhatsGPS   Provider = "WhatsGPS"
+)
+
+// Device represents a device with various properties.
+type Device struct {
+	Imei             string   `json:"imei"`
+	UserName         string   `json:"user_name"`
+	CarOwner         *string  `json:"car_owner"`
+	LicenseNumber    *string  `json:"license_number"`
+	Vin              *string  `json:"vin"`
+	IsTrackingAlarms bool     `json:"is_tracking_alarms"`
+	LastTimeTracked  int64    `json:"last_time_tracked"`
+	Provider         Provider `json:"provider"`
+}
+
+// DeviceUpdate holds the fields of a partial device update. Nil fields are
+// not sent, so the backend keeps their current value.
+type DeviceUpdate struct {
+	UserName         *string   `json:"user_name,omitempty"`
+	CarOwner         *string   `json:"car_owner,omitempty"`
+	LicenseNumber    *string   `json:"license_number,omitempty"`
+	Vin              *string   `json:"vin,omitempty"`
+	IsTrackingAlarms *bool     `json:"is_tracking_alarms,omitempty"`
+	LastTimeTracked  *int64    `json:"last_time_tracked,omitempty"`
+	Provider         *Provider `json:"provider,omitempty"`
+}
+
+// Alarm is an alarm reported by a device. ID is assigned by the backend.
+type Alarm struct {
+	ID           int64   `json:"id,omitempty"`
+	Imei         string  `json:"device_imei"`
+	PositionType *string `json:"position_type,omitempty"`
+	Lat          *string `json:"lat,omitempty"`
+	Lng          *string `json:"lng,omitempty"`
+	Time         int64   `json:"time"`
+	Address      *string `json:"address,omitempty"`
+	AlarmCode    string  `json:"alarm_code"`
+	AlarmType    int64   `json:"alarm_type"`
+	Course       *int64  `json:"course,omitempty"`
+	DeviceType   int64   `json:"device_type"`
+	Speed        *int64  `json:"speed,omitempty"`
+}
+
+// BulkResult is the result of an alarm of a bulk request. Index is its
+// position in the request and Status the status it would have had alone.
+type BulkResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Saved reports whether the alarm was created or the backend already had it.
+func (r BulkResult) Saved() bool {
+	return r.Status == http.StatusCreated || r.Status == http.StatusAlreadyReported
+}
+
+// Retryable reports whether the alarm may be saved by sending it again.
+func (r BulkResult) Retryable() bool {
+	return r.Status >= http.StatusInternalServerError || r.Status == http.StatusTooManyRequests
+}
+
+// AlarmUpdate holds the fields of a partial alarm update.
+type AlarmUpdate struct {
+	Address *string `json:"address,omitempty"`
+}
+
+// User is a user of the road-safety platform. UUID uniquely identifies it.
+type User struct {
+	UUID         string        `json:"uuid"`
+	Username     string        `json:"username"`
+	Email        string        `json:"email,omitempty"`
+	FirstName    string        `json:"first_name,omitempty"`
+	LastName     string        `json:"last_name,omitempty"`
+	PhoneNumbers []PhoneNumber `json:"phone_numbers,omitempty"`
+}
+
+// UserUpdate holds the fields of a partial user update.
+type UserUpdate struct {
+	Email     *string `json:"email,omitempty"`
+	FirstName *string `json:"first_name,omitempty"`
+	LastName  *string `json:"last_name,omitempty"`
+}
+
+// UserPhoneNumbers is a slice of UserPhoneNumber.
+type UserPhoneNumbers []UserPhoneNumber
+
+// Marshal serializes a UserPhoneNumbers into a byte slice.
+// It returns a byte slice and an error if any occurred during serialization.
+func (r *UserPhoneNumbers) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// UserPhoneNumber represents a user and their phone numbers.
+// User is a UUID that uniquely identifies each user.
+// PhoneNumbers is a slice of PhoneNumber that contains the user's phone numbers.
+type UserPhoneNumber struct {
+	User         string        `json:"user"`
+	PhoneNumbers []PhoneNumber `json:"phone_numbers"`
+}
+
+// PhoneNumber represents a phone number.
+// PhoneNumber is a string that contains the phone number.
+type PhoneNumber struct {
+	PhoneNumber string `json:"phone_number"`
+}
+
+// Page is a page of a list endpoint. Next is nil on the last page.
+type Page[T any] struct {
+	Count    int     `json:"count"`
+	Next     *string `json:"next"`
+	Previous *string `json:"previous"`
+	Results  []T     `json:"results"`
+}
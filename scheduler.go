@@ -0,0 +1,257 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// POLL_INTERVAL is the polling interval of a device with regular activity.
+	POLL_INTERVAL = 30 * time.Second
+	// FAST_POLL_INTERVAL is used for devices with recent alarms or SOS-capable trackers.
+	FAST_POLL_INTERVAL = 10 * time.Second
+	// IDLE_POLL_INTERVAL is used for devices without alarms in the last IDLE_AFTER.
+	IDLE_POLL_INTERVAL = 2 * time.Minute
+	// RECENT_ALARM_WINDOW is how long a device is polled faster after an alarm.
+	RECENT_ALARM_WINDOW = 15 * time.Minute
+	// IDLE_AFTER is the time without alarms after which a device is considered idle.
+	IDLE_AFTER = 6 * time.Hour
+	// POLL_JITTER is the fraction of the interval randomly added or subtracted
+	// to spread the requests across the provider rate limits.
+	POLL_JITTER = 0.1
+	// DEVICES_REFRESH_INTERVAL is how often the device list is requested to the backend.
+	DEVICES_REFRESH_INTERVAL = 5 * time.Minute
+)
+
+// scheduledDevice is the polling state of a device.
+type scheduledDevice struct {
+	device     Device
+	nextPoll   time.Time
+	lastAlarm  time.Time
+	sosCapable bool // sosCapable is set once the device has reported a SOS alarm.
+	index      int  // index is the position in the pollQueue.
+}
+
+// pollQueue is a priority queue of devices ordered by their next poll time.
+type pollQueue []*scheduledDevice
+
+func (q pollQueue) Len() int           { return len(q) }
+func (q pollQueue) Less(i, j int) bool { return q[i].nextPoll.Before(q[j].nextPoll) }
+func (q pollQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *pollQueue) Push(x interface{}) {
+	sd := x.(*scheduledDevice)
+	sd.index = len(*q)
+	*q = append(*q, sd)
+}
+
+func (q *pollQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	sd := old[n-1]
+	old[n-1] = nil
+	sd.index = -1
+	*q = old[:n-1]
+	return sd
+}
+
+// Scheduler decides when each device is polled: faster for devices with recent
+// alarms or SOS-capable trackers and slower for idle ones.
+type Scheduler struct {
+	mu      sync.Mutex
+	queue   pollQueue
+	devices map[string]*scheduledDevice
+	started time.Time
+	wake    chan struct{} // wake interrupts the wait of Run when the queue changes.
+
+	fetchDevices func() ([]Device, error)
+	dispatch     func(device Device, due time.Time) bool
+	now          func() time.Time
+	rand         *rand.Rand
+}
+
+// NewScheduler creates a scheduler that obtains the devices with fetchDevices
+// and hands the due ones to dispatch, usually WorkQueue.Enqueue. A dispatched
+// device isn't scheduled again until Completed is called for it.
+func NewScheduler(fetchDevices func() ([]Device, error), dispatch func(device Device, due time.Time) bool) *Scheduler {
+	return &Scheduler{
+		devices:      map[string]*scheduledDevice{},
+		wake:         make(chan struct{}, 1),
+		fetchDevices: fetchDevices,
+		dispatch:     dispatch,
+		now:          time.Now,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Run polls the devices until the context is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.started = s.now()
+	s.refreshDevices()
+
+	refresh := time.NewTicker(DEVICES_REFRESH_INTERVAL)
+	defer refresh.Stop()
+
+	for {
+		timer := time.NewTimer(s.untilNextPoll())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-refresh.C:
+			timer.Stop()
+			s.refreshDevices()
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+			s.pollDue()
+		}
+	}
+}
+
+// refreshDevices synchronizes the scheduled devices with the backend. The
+// current devices are kept if the request fails.
+func (s *Scheduler) refreshDevices() {
+	devices, err := s.fetchDevices()
+	if err != nil {
+		logrus.WithError(err).Warning("Error refreshing the devices, keeping the current ones")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	seen := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		seen[device.Imei] = true
+		if sd, ok := s.devices[device.Imei]; ok {
+			// The backend may not have the checkpoint of the last poll yet.
+			lastTimeTracked := max(sd.device.LastTimeTracked, device.LastTimeTracked)
+			sd.device = device
+			sd.device.LastTimeTracked = lastTimeTracked
+			continue
+		}
+		// New devices are spread over the first interval.
+		sd := &scheduledDevice{
+			device:   device,
+			nextPoll: now.Add(time.Duration(s.rand.Int63n(int64(POLL_INTERVAL)))),
+		}
+		s.devices[device.Imei] = sd
+		heap.Push(&s.queue, sd)
+	}
+
+	for imei, sd := range s.devices {
+		if !seen[imei] {
+			// Devices being polled aren't in the queue.
+			if sd.index >= 0 {
+				heap.Remove(&s.queue, sd.index)
+			}
+			delete(s.devices, imei)
+		}
+	}
+}
+
+// untilNextPoll returns the time until the earliest poll.
+func (s *Scheduler) untilNextPoll() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return POLL_INTERVAL
+	}
+	return max(s.queue[0].nextPoll.Sub(s.now()), 0)
+}
+
+// popDue removes from the queue the devices whose poll time has arrived.
+func (s *Scheduler) popDue() []*scheduledDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var due []*scheduledDevice
+	for len(s.queue) > 0 && !s.queue[0].nextPoll.After(now) {
+		due = append(due, heap.Pop(&s.queue).(*scheduledDevice))
+	}
+	return due
+}
+
+// pollDue dispatches the due devices. The devices that can't be dispatched
+// are scheduled again as if they had been polled without alarms.
+func (s *Scheduler) pollDue() {
+	for _, sd := range s.popDue() {
+		if !s.dispatch(sd.device, sd.nextPoll) {
+			s.reschedule(sd)
+		}
+	}
+}
+
+// Completed records the result of polling a device and schedules it again.
+// The device carries the new LastTimeTracked and alarms are the ones found.
+func (s *Scheduler) Completed(device Device, alarms []Alarm) {
+	s.mu.Lock()
+	sd, ok := s.devices[device.Imei]
+	if ok {
+		sd.device.LastTimeTracked = max(sd.device.LastTimeTracked, device.LastTimeTracked)
+		for _, alarm := range alarms {
+			sd.lastAlarm = s.now()
+			if alarm.AlarmCode == "SOS" {
+				sd.sosCapable = true
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	// The device may have been removed by a refresh during the poll.
+	if ok {
+		s.reschedule(sd)
+	}
+}
+
+func (s *Scheduler) reschedule(sd *scheduledDevice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.devices[sd.device.Imei] != sd || sd.index >= 0 {
+		return
+	}
+	now := s.now()
+	sd.nextPoll = now.Add(s.jitter(s.pollInterval(sd, now)))
+	heap.Push(&s.queue, sd)
+	s.notifyQueueChange()
+}
+
+// notifyQueueChange wakes up Run without blocking.
+func (s *Scheduler) notifyQueueChange() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pollInterval returns the interval of a device according to its activity.
+func (s *Scheduler) pollInterval(sd *scheduledDevice, now time.Time) time.Duration {
+	if sd.sosCapable || (!sd.lastAlarm.IsZero() && now.Sub(sd.lastAlarm) < RECENT_ALARM_WINDOW) {
+		return FAST_POLL_INTERVAL
+	}
+	lastActivity := sd.lastAlarm
+	if lastActivity.Before(s.started) {
+		lastActivity = s.started
+	}
+	if now.Sub(lastActivity) >= IDLE_AFTER {
+		return IDLE_POLL_INTERVAL
+	}
+	return POLL_INTERVAL
+}
+
+// jitter randomly changes the interval up to POLL_JITTER of its value.
+func (s *Scheduler) jitter(interval time.Duration) time.Duration {
+	delta := (s.rand.Float64()*2 - 1) * POLL_JITTER * float64(interval)
+	return interval + time.Duration(delta)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerPollInterval(t *testing.T) {
+	now := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	s := NewScheduler(nil, nil)
+	s.started = now.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		device   *scheduledDevice
+		expected time.Duration
+	}{
+		{"regular", &scheduledDevice{}, POLL_INTERVAL},
+		{"recent alarm", &scheduledDevice{lastAlarm: now.Add(-time.Minute)}, FAST_POLL_INTERVAL},
+		{"sos capable", &scheduledDevice{sosCapable: true}, FAST_POLL_INTERVAL},
+		{"old alarm", &scheduledDevice{lastAlarm: now.Add(-time.Hour)}, POLL_INTERVAL},
+	}
+	for _, tt := range tests {
+		if got := s.pollInterval(tt.device, now); got != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, got)
+		}
+	}
+
+	s.started = now.Add(-IDLE_AFTER)
+	if got := s.pollInterval(&scheduledDevice{}, now); got != IDLE_POLL_INTERVAL {
+		t.Errorf("idle: expected %s, got %s", IDLE_POLL_INTERVAL, got)
+	}
+}
+
+func TestSchedulerDispatchesDueDevices(t *testing.T) {
+	now := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	devices := []Device{{Imei: "1"}, {Imei: "2"}, {Imei: "3"}}
+
+	var dispatched []Device
+	s := NewScheduler(
+		func() ([]Device, error) { return devices, nil },
+		func(device Device, due time.Time) bool {
+			dispatched = append(dispatched, device)
+			return true
+		},
+	)
+	s.now = func() time.Time { return now }
+	s.started = now
+	s.refreshDevices()
+
+	// Every new device is scheduled within the first interval.
+	now = now.Add(POLL_INTERVAL)
+	s.pollDue()
+	if len(dispatched) != 3 || len(s.queue) != 0 {
+		t.Fatalf("expected 3 devices dispatched, got %v", dispatched)
+	}
+
+	// Dispatched devices are scheduled again once completed.
+	for _, device := range dispatched {
+		device.LastTimeTracked = now.Unix()
+		var alarms []Alarm
+		if device.Imei == "2" {
+			alarms = []Alarm{{Imei: "2", AlarmCode: "SOS"}}
+		}
+		s.Completed(device, alarms)
+	}
+	if len(s.queue) != 3 {
+		t.Fatalf("expected 3 devices scheduled, got %d", len(s.queue))
+	}
+	if s.devices["1"].device.LastTimeTracked != now.Unix() {
+		t.Errorf("expected the checkpoint to be kept by the scheduler")
+	}
+
+	// The device with the SOS alarm is polled faster than the others.
+	dispatched = nil
+	now = now.Add(FAST_POLL_INTERVAL + FAST_POLL_INTERVAL/5)
+	s.pollDue()
+	if len(dispatched) != 1 || dispatched[0].Imei != "2" {
+		t.Errorf("expected only device 2 to be dispatched, got %v", dispatched)
+	}
+
+	// Removed devices aren't scheduled anymore, even if they were being polled.
+	devices = devices[:1]
+	s.refreshDevices()
+	s.Completed(dispatched[0], nil)
+	if len(s.queue) != 1 || len(s.devices) != 1 {
+		t.Errorf("expected a single device scheduled, got %d", len(s.queue))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DEFAULT_HTTP_ADDR is the address of the HTTP server, configurable with the
+// HTTP_ADDR environment variable.
+const DEFAULT_HTTP_ADDR = ":8080"
+
+// httpMux holds the routes of the HTTP server. Metrics are published in /debug/vars.
+var httpMux = http.NewServeMux()
+
+func init() {
+	httpMux.Handle("/debug/vars", expvar.Handler())
+	httpMux.HandleFunc("/healthz", healthHandler)
+	httpMux.HandleFunc("/alarms/export", exportHandler)
+	httpMux.HandleFunc("/alarms/stream", sseHandler)
+	httpMux.HandleFunc("/alarms/ws", websocketHandler)
+	httpMux.HandleFunc("/webhooks", webhooksHandler)
+	httpMux.HandleFunc("/webhooks/", webhooksHandler)
+	httpMux.HandleFunc("/incidents", incidentsHandler)
+	httpMux.HandleFunc("/incidents/", incidentsHandler)
+	httpMux.HandleFunc("/notifications", notificationsHandler)
+	httpMux.HandleFunc("/twilio/status", twilioStatusHandler)
+	httpMux.HandleFunc("/twilio/voice/", voiceHandler)
+	httpMux.HandleFunc("/twilio/incoming", incomingMessageHandler)
+	httpMux.HandleFunc("/positions", positionsHandler)
+	httpMux.HandleFunc("/positions/", positionsHandler)
+}
+
+// healthResponse is the body of /healthz.
+type healthResponse struct {
+	Status          string            `json:"status"`
+	CircuitBreakers map[string]string `json:"circuit_breakers"`
+	PendingAlarms   int64             `json:"pending_alarms"`
+}
+
+// healthHandler reports "degraded" while any upstream circuit isn't closed.
+// It always answers 200 because the service keeps working in degraded mode.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	response := healthResponse{
+		Status:          "ok",
+		CircuitBreakers: map[string]string{},
+		PendingAlarms:   pendingAlarmsMetric.Value(),
+	}
+	for name, breaker := range circuitBreakers {
+		state := breaker.State()
+		response.CircuitBreakers[name] = state.String()
+		if state != BreakerClosed {
+			response.Status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkAdminToken checks the bearer token of the request against the
+// environment variable key. It answers 404 if the variable isn't set, so the
+// route is disabled, and 401 if the token is wrong.
+func checkAdminToken(w http.ResponseWriter, r *http.Request, key string) bool {
+	given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return checkToken(w, r, key, given)
+}
+
+// checkToken checks a token given in the request against the environment
+// variable key, answering like checkAdminToken.
+func checkToken(w http.ResponseWriter, r *http.Request, key, given string) bool {
+	token := os.Getenv(key)
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// startHTTPServer serves httpMux in the background until Shutdown is called.
+func startHTTPServer() *http.Server {
+	server := &http.Server{
+		Addr:              getEnv("HTTP_ADDR", DEFAULT_HTTP_ADDR),
+		Handler:           httpMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		logrus.WithField("addr", server.Addr).Info("Starting HTTP server")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Error("HTTP server stopped")
+		}
+	}()
+	return server
+}
+
+// stopHTTPServer gracefully shuts down the server, waiting up to 5 seconds.
+func stopHTTPServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Warning("Error shutting down the HTTP server")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// STREAM_HEARTBEAT_INTERVAL is how often the idle streams send a heartbeat,
+	// so the proxies don't close them and the clients detect dead connections.
+	STREAM_HEARTBEAT_INTERVAL = 15 * time.Second
+	// STREAM_WRITE_TIMEOUT bounds the time to write a message to a client.
+	STREAM_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// streamUpgrader upgrades the WebSocket connections. Cross-origin clients are
+// accepted only from the origins of STREAM_ALLOWED_ORIGINS, comma-separated.
+var streamUpgrader = websocket.Upgrader{
+	CheckOrigin: checkStreamOrigin,
+}
+
+func checkStreamOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host {
+		return true
+	}
+	for _, allowed := range strings.Split(os.Getenv("STREAM_ALLOWED_ORIGINS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStreamToken checks the token of STREAM_ADMIN_TOKEN, given as a bearer
+// token or, for the EventSource and WebSocket clients of the browsers, which
+// can't set headers, in the token parameter.
+func checkStreamToken(w http.ResponseWriter, r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		given = r.URL.Query().Get("token")
+	}
+	return checkToken(w, r, "STREAM_ADMIN_TOKEN", given)
+}
+
+// streamSubscription subscribes to eventBus with the filters of the query
+// parameters imei, fleet and code, which accept several comma-separated
+// values. The stream is resumed after the Last-Event-ID header or the
+// last_event_id parameter.
+func streamSubscription(r *http.Request) (*Subscription, error) {
+	params := r.URL.Query()
+	filter := NewEventFilter(params["imei"], params["fleet"], params["code"])
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = params.Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last event ID %q", lastEventID)
+		}
+	}
+	return eventBus.Subscribe(filter, lastID), nil
+}
+
+// sseHandler streams the alarms as Server-Sent Events of type "alarm".
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkStreamToken(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	subscription, err := streamSubscription(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer subscription.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(STREAM_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-subscription.C:
+			if !ok {
+				// The client fell behind, it reconnects with its last event ID.
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logrus.WithError(err).Warning("Error encoding the alarm event")
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: alarm\ndata: %s\n\n", event.ID, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// websocketHandler streams the alarms as JSON messages over a WebSocket. The
+// heartbeats are WebSocket pings.
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkStreamToken(w, r) {
+		return
+	}
+	subscription, err := streamSubscription(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer subscription.Unsubscribe()
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the client.
+		logrus.WithError(err).Debug("Error upgrading the WebSocket connection")
+		return
+	}
+	defer conn.Close()
+
+	// The reader handles the pongs and detects the client closing the connection.
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * STREAM_HEARTBEAT_INTERVAL))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * STREAM_HEARTBEAT_INTERVAL))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(STREAM_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(STREAM_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+		case event, ok := <-subscription.C:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow, resume with last_event_id"),
+					time.Now().Add(STREAM_WRITE_TIMEOUT))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
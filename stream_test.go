@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// useEventBus replaces eventBus for the duration of the test, and sets the
+// token of the streams to "secret".
+func useEventBus(t *testing.T) *EventBus {
+	t.Helper()
+	t.Setenv("STREAM_ADMIN_TOKEN", "secret")
+	previous := eventBus
+	eventBus = NewEventBus(EVENT_BUFFER_SIZE)
+	t.Cleanup(func() { eventBus = previous })
+	return eventBus
+}
+
+// waitSubscribers waits until the bus has n subscribers.
+func waitSubscribers(t *testing.T, bus *EventBus, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for bus.Subscribers() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscribers, got %d", n, bus.Subscribers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSEStream(t *testing.T) {
+	bus := useEventBus(t)
+	bus.Publish([]Alarm{{Imei: "1", Time: 1700000000, AlarmCode: "SOS"}})
+	first := bus.nextID - 1
+
+	server := httptest.NewServer(http.HandlerFunc(sseHandler))
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"?code=SOS", nil)
+	request.Header.Set("Last-Event-ID", "1")
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	waitSubscribers(t, bus, 1)
+	bus.Publish([]Alarm{
+		{Imei: "2", Time: 1700000000, AlarmCode: "LOWVOT"},
+		{Imei: "2", Time: 1700000060, AlarmCode: "SOS"},
+	})
+
+	// The replayed event comes first, then the new SOS alarm.
+	reader := bufio.NewReader(response.Body)
+	for _, expected := range []struct {
+		id   uint64
+		imei string
+	}{{first, "1"}, {first + 2, "2"}} {
+		var id, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading the stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" && data != "" {
+				break
+			}
+			if value, ok := strings.CutPrefix(line, "id: "); ok {
+				id = value
+			}
+			if value, ok := strings.CutPrefix(line, "data: "); ok {
+				data = value
+			}
+		}
+		var event AlarmEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("decoding the event: %v", err)
+		}
+		if event.ID != expected.id || event.Imei != expected.imei || id != strconv.FormatUint(expected.id, 10) {
+			t.Fatalf("unexpected event %+v (id %s), expected ID %d of IMEI %s", event, id, expected.id, expected.imei)
+		}
+	}
+}
+
+func TestSSEStreamInvalidLastEventID(t *testing.T) {
+	useEventBus(t)
+	recorder := httptest.NewRecorder()
+	sseHandler(recorder, httptest.NewRequest(http.MethodGet, "/alarms/stream?token=secret&last_event_id=abc", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", recorder.Code)
+	}
+}
+
+func TestWebSocketStream(t *testing.T) {
+	bus := useEventBus(t)
+	server := httptest.NewServer(http.HandlerFunc(websocketHandler))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?imei=2&token=secret"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	waitSubscribers(t, bus, 1)
+	bus.Publish([]Alarm{
+		{Imei: "1", Time: 1700000000, AlarmCode: "SOS"},
+		{Imei: "2", Time: 1700000000, AlarmCode: "REMOVE"},
+	})
+
+	var event AlarmEvent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("reading the event: %v", err)
+	}
+	if event.Imei != "2" || event.Alarm.AlarmCode != "REMOVE" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// Closing the connection ends the subscription.
+	conn.Close()
+	waitSubscribers(t, bus, 0)
+}
+
+func TestStreamToken(t *testing.T) {
+	useEventBus(t)
+	for _, test := range []struct {
+		target, authorization string
+		status                int
+	}{
+		{"/alarms/stream", "", http.StatusUnauthorized},
+		{"/alarms/stream?token=invalid", "", http.StatusUnauthorized},
+		{"/alarms/stream?token=secret", "Bearer invalid", http.StatusUnauthorized},
+		{"/alarms/ws?token=invalid", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		if strings.HasPrefix(test.target, "/alarms/ws") {
+			websocketHandler(recorder, r)
+		} else {
+			sseHandler(recorder, r)
+		}
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.target, test.status, recorder.Code)
+		}
+	}
+
+	// The streams are disabled without a token.
+	t.Setenv("STREAM_ADMIN_TOKEN", "")
+	recorder := httptest.NewRecorder()
+	sseHandler(recorder, httptest.NewRequest(http.MethodGet, "/alarms/stream?token=secret", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 without STREAM_ADMIN_TOKEN, got %d", recorder.Code)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	t.Setenv("STREAM_ALLOWED_ORIGINS", "https://panel.example.com")
+	request := httptest.NewRequest(http.MethodGet, "http://localhost:8080/alarms/ws", nil)
+	for origin, allowed := range map[string]bool{
+		"":                          true,
+		"http://localhost:8080":     true,
+		"https://panel.example.com": true,
+		"https://evil.example.com":  false,
+	} {
+		request.Header.Set("Origin", origin)
+		if checkStreamOrigin(request) != allowed {
+			t.Errorf("origin %q: expected allowed=%t", origin, allowed)
+		}
+	}
+}
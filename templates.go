@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DEFAULT_WHATSAPP_TEMPLATES_PATH is the file of the approved WhatsApp
+// templates, keyed by language, configurable with the
+// WHATSAPP_TEMPLATES_PATH environment variable. Without a template for the
+// language of a user, the messages are sent as free-form bodies, which
+// WhatsApp only accepts within the 24-hour session of the user.
+const DEFAULT_WHATSAPP_TEMPLATES_PATH = "whatsapp_templates.json"
+
+// templateMetrics counts the messages sent with templates and the ones that
+// fell back to SMS.
+var templateMetrics = expvar.NewMap("whatsapp_templates")
+
+// templateVariables are the names of the values a template may use, built by
+// MessageBuilder.TemplateValues.
+var templateVariables = map[string]bool{
+	"alert":     true,
+	"user":      true,
+	"owner":     true,
+	"plate":     true,
+	"vin":       true,
+	"imei":      true,
+	"time":      true,
+	"address":   true,
+	"maps_link": true,
+}
+
+// WhatsAppTemplate is a content template approved in Twilio. Variables are the
+// names of the values of its placeholders {{1}}, {{2}}... in order.
+type WhatsAppTemplate struct {
+	ContentSid string   `json:"content_sid"`
+	Variables  []string `json:"variables"`
+}
+
+// Validate checks the SID and the names of the variables.
+func (t WhatsAppTemplate) Validate() error {
+	if !strings.HasPrefix(t.ContentSid, "HX") {
+		return fmt.Errorf("invalid content SID %q", t.ContentSid)
+	}
+	for _, variable := range t.Variables {
+		if !templateVariables[variable] {
+			return fmt.Errorf("unknown template variable %q", variable)
+		}
+	}
+	return nil
+}
+
+// ContentVariables returns the JSON of the placeholders of the template with
+// the values. WhatsApp rejects empty placeholders, so the missing values are
+// replaced with a dash.
+func (t WhatsAppTemplate) ContentVariables(values map[string]string) (string, error) {
+	variables := make(map[string]string, len(t.Variables))
+	for i, variable := range t.Variables {
+		variables[strconv.Itoa(i+1)] = orDefault(strings.TrimSpace(values[variable]), "-")
+	}
+	data, err := json.Marshal(variables)
+	return string(data), err
+}
+
+// whatsAppTemplates holds the approved templates, by language.
+var whatsAppTemplates = map[string]WhatsAppTemplate{}
+
+// initWhatsAppTemplates loads the templates of the file configured in the
+// environment. The messages are sent as free-form bodies if it can't be read.
+func initWhatsAppTemplates() {
+	path := getEnv("WHATSAPP_TEMPLATES_PATH", DEFAULT_WHATSAPP_TEMPLATES_PATH)
+	templates, err := LoadWhatsAppTemplates(path)
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Warning("Sending the WhatsApp messages without templates")
+		return
+	}
+	whatsAppTemplates = templates
+}
+
+// LoadWhatsAppTemplates reads the templates of a file, which doesn't need to
+// exist.
+func LoadWhatsAppTemplates(path string) (map[string]WhatsAppTemplate, error) {
+	templates := map[string]WhatsAppTemplate{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return templates, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("invalid templates file %s: %w", path, err)
+	}
+	for language, template := range templates {
+		if language != LanguageSpanish && language != LanguageEnglish {
+			return nil, fmt.Errorf("unknown language %q", language)
+		}
+		if err := template.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid template of language %s: %w", language, err)
+		}
+	}
+	return templates, nil
+}
+
+// outgoingMessage is a message for the phones of a language. The WhatsApp
+// messages are sent with the template, if any, and the free-form ones carry a
+// pin of Location ("lat,lng"). The SMS are always sent with Body.
+type outgoingMessage struct {
+	Body             string
+	ContentSid       string
+	ContentVariables string
+	Location         string
+	LocationLabel    string
+}
+
+// buildOutgoingMessage builds the message of a notification in a language.
+func buildOutgoingMessage(n Notification, language string) outgoingMessage {
+	message := outgoingMessage{Body: n.Build(language)}
+	if template, ok := whatsAppTemplates[language]; ok && n.Template != nil {
+		variables, err := template.ContentVariables(n.Template(language))
+		if err != nil {
+			logrus.WithError(err).Warning("Error building the template variables")
+		} else {
+			message.ContentSid, message.ContentVariables = template.ContentSid, variables
+		}
+	}
+	if n.Alarm != nil && n.Alarm.Lat != nil && n.Alarm.Lng != nil && *n.Alarm.Lat != "" && *n.Alarm.Lng != "" {
+		message.Location = *n.Alarm.Lat + "," + *n.Alarm.Lng
+		message.LocationLabel = translate(language, "Ubicación de la alarma")
+	}
+	return message
+}
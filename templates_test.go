@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	twilioclient "github.com/twilio/twilio-go/client"
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+func TestLoadWhatsAppTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whatsapp_templates.json")
+	if templates, err := LoadWhatsAppTemplates(path); err != nil || len(templates) != 0 {
+		t.Fatalf("expected no templates for a missing file, got %v %v", templates, err)
+	}
+
+	os.WriteFile(path, []byte(`{"es": {"content_sid": "HX123", "variables": ["alert", "plate", "address"]}}`), 0o600)
+	templates, err := LoadWhatsAppTemplates(path)
+	if err != nil {
+		t.Fatalf("LoadWhatsAppTemplates failed: %v", err)
+	}
+	variables, _ := templates[LanguageSpanish].ContentVariables(map[string]string{"alert": "ALERTA DE SOS", "plate": "GBA-1234"})
+	if expected := `{"1":"ALERTA DE SOS","2":"GBA-1234","3":"-"}`; variables != expected {
+		t.Fatalf("expected %s, got %s", expected, variables)
+	}
+
+	for _, invalid := range []string{
+		`{"es": {"content_sid": "SM123"}}`,
+		`{"es": {"content_sid": "HX123", "variables": ["speed"]}}`,
+		`{"pt": {"content_sid": "HX123"}}`,
+	} {
+		os.WriteFile(path, []byte(invalid), 0o600)
+		if _, err := LoadWhatsAppTemplates(path); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestSendNotificationTemplates(t *testing.T) {
+	imei := "860419050021378"
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers(imei, UserPhoneNumbers{
+		{User: "spanish", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000001"}, {PhoneNumber: "+593990000002"}}},
+		{User: "english", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000003"}}},
+	})
+	useRecipientPreferences(t, map[string]RecipientPreferences{"english": {Language: LanguageEnglish}})
+	previous := whatsAppTemplates
+	whatsAppTemplates = map[string]WhatsAppTemplate{LanguageSpanish: {ContentSid: "HX123", Variables: []string{"alert", "plate", "address"}}}
+	t.Cleanup(func() { whatsAppTemplates = previous })
+	t.Setenv("TWILIO_SMS_FROM", "+15005550006")
+	sent := useTwilioStub(t)
+
+	// The second phone doesn't have WhatsApp.
+	stub := createTwilioMessage
+	createTwilioMessage = func(params *api.CreateMessageParams) (*api.ApiV2010Message, error) {
+		if *params.To == "whatsapp:+593990000002" {
+			return nil, &twilioclient.TwilioRestError{Code: 63003, Message: "Channel could not find To address"}
+		}
+		return stub(params)
+	}
+
+	plate := "GBA-1234"
+	device := &Device{UserName: "fleet", LicenseNumber: &plate}
+	lat, lng := "-2.170998", "-79.922359"
+	alarm := &Alarm{Imei: imei, Time: 1700000000, AlarmCode: "SOS", Lat: &lat, Lng: &lng}
+	incident := Incident{Alarms: []Alarm{*alarm}}
+	useTestGeocoder(t)
+	sendNotification(Notification{
+		Imei:  imei,
+		Codes: []string{"SOS"},
+		Alarm: alarm,
+		Build: func(language string) string {
+			return NewMessageBuilder(device, alarm).WithLanguage(language).getAlert()
+		},
+		Template: func(language string) map[string]string {
+			return NewMessageBuilder(device, alarm).WithLanguage(language).TemplateValues(incident)
+		},
+	})
+
+	messages := sent()
+	expected := []sentMessage{
+		{From: "+15005550006", To: "+593990000002", Body: "🚨🚨 ALERTA DE SOS 🚨🚨"},
+		{From: "whatsapp:" + DEFAULT_TWILIO_WHATSAPP_FROM, To: "whatsapp:+593990000001", ContentSid: "HX123", ContentVariables: `{"1":"ALERTA DE SOS","2":"GBA-1234","3":"Guayaquil, Ecuador"}`},
+		{From: "whatsapp:" + DEFAULT_TWILIO_WHATSAPP_FROM, To: "whatsapp:+593990000003", Body: "🚨🚨 SOS ALERT 🚨🚨", PersistentAction: "geo:-2.170998,-79.922359|Alarm location"},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %+v", len(expected), messages)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Errorf("message %d: expected %+v, got %+v", i, expected[i], messages[i])
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_NOTIFY_THROTTLE is the minimum interval between two notifications
+	// of the same code to a device, as CODE=DURATION pairs separated by commas.
+	// It is configurable with the NOTIFY_THROTTLE environment variable.
+	DEFAULT_NOTIFY_THROTTLE = "LOWVOT=1h,OVERSPEED=15m"
+	// DEFAULT_FLOOD_THRESHOLD is the number of notifications a device may get
+	// within the flood window, configurable with FLOOD_THRESHOLD.
+	DEFAULT_FLOOD_THRESHOLD = 5
+	// DEFAULT_FLOOD_WINDOW is the window of the flood detection, configurable
+	// with FLOOD_WINDOW. The notifications suppressed during a flood are
+	// summarized in a single message at the end of the window.
+	DEFAULT_FLOOD_WINDOW = 10 * time.Minute
+)
+
+var (
+	// throttleMetrics publishes the counters of the notification throttling.
+	throttleMetrics = expvar.NewMap("notification_throttle")
+	// suppressedByCodeMetrics counts the suppressed notifications of each code.
+	suppressedByCodeMetrics = new(expvar.Map).Init()
+)
+
+func init() {
+	throttleMetrics.Set("suppressed_by_code", suppressedByCodeMetrics)
+}
+
+// ParseThrottleIntervals parses CODE=DURATION pairs separated by commas,
+// e.g. "LOWVOT=1h,REMOVE=15m". Invalid pairs are ignored with a warning.
+func ParseThrottleIntervals(value string) map[string]time.Duration {
+	return parseDurations(value, "notification throttle")
+}
+
+// floodState is the recent notifications of a device and the ones
+// suppressed since it started flooding.
+type floodState struct {
+	sent       []time.Time
+	suppressed map[string]int
+	since      time.Time
+}
+
+// NotificationThrottler limits the notifications of each device: one per
+// code within the throttle interval of the code, and at most floodThreshold
+// within floodWindow. The notifications suppressed by the flood detection are
+// passed to summarize once the window ends, so the users know about them.
+type NotificationThrottler struct {
+	intervals      map[string]time.Duration
+	floodThreshold int
+	floodWindow    time.Duration
+	summarize      func(imei string, suppressed map[string]int)
+	now            func() time.Time
+
+	mu     sync.Mutex
+	last   map[string]time.Time // last holds the last notification by IMEI and code.
+	floods map[string]*floodState
+}
+
+var notificationThrottlerInstance *NotificationThrottler
+var notificationThrottlerOnce sync.Once
+
+// GetNotificationThrottler returns the throttler of the incident
+// notifications, configured from the environment on the first call.
+func GetNotificationThrottler() *NotificationThrottler {
+	notificationThrottlerOnce.Do(func() {
+		notificationThrottlerInstance = NewNotificationThrottler(
+			ParseThrottleIntervals(getEnv("NOTIFY_THROTTLE", DEFAULT_NOTIFY_THROTTLE)),
+			getEnvInt("FLOOD_THRESHOLD", DEFAULT_FLOOD_THRESHOLD),
+			getEnvDuration("FLOOD_WINDOW", DEFAULT_FLOOD_WINDOW),
+			sendFloodSummary,
+		)
+	})
+	return notificationThrottlerInstance
+}
+
+// NewNotificationThrottler creates a throttler. A floodThreshold of zero
+// disables the flood detection.
+func NewNotificationThrottler(intervals map[string]time.Duration, floodThreshold int, floodWindow time.Duration, summarize func(string, map[string]int)) *NotificationThrottler {
+	return &NotificationThrottler{
+		intervals:      intervals,
+		floodThreshold: floodThreshold,
+		floodWindow:    floodWindow,
+		summarize:      summarize,
+		now:            time.Now,
+		last:           map[string]time.Time{},
+		floods:         map[string]*floodState{},
+	}
+}
+
+// Allow reports whether a notification of the code may be sent to the
+// device, and records it if so.
+func (t *NotificationThrottler) Allow(imei, code string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+
+	key := imei + "/" + code
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.intervals[code] {
+		throttleMetrics.Add("throttled", 1)
+		suppressedByCodeMetrics.Add(code, 1)
+		return false
+	}
+
+	if t.floodThreshold > 0 {
+		flood := t.floods[imei]
+		if flood == nil {
+			flood = &floodState{}
+			t.floods[imei] = flood
+		}
+		recent := flood.sent[:0]
+		for _, sent := range flood.sent {
+			if now.Sub(sent) < t.floodWindow {
+				recent = append(recent, sent)
+			}
+		}
+		flood.sent = recent
+		if len(flood.sent) >= t.floodThreshold {
+			if flood.suppressed == nil {
+				flood.suppressed = map[string]int{}
+				flood.since = now
+			}
+			flood.suppressed[code]++
+			throttleMetrics.Add("flood_suppressed", 1)
+			suppressedByCodeMetrics.Add(code, 1)
+			return false
+		}
+		flood.sent = append(flood.sent, now)
+	}
+
+	t.last[key] = now
+	throttleMetrics.Add("passed", 1)
+	return true
+}
+
+// Tick summarizes the floods whose window ended and forgets the idle devices.
+func (t *NotificationThrottler) Tick() {
+	t.summarizeFloods(false)
+}
+
+// Flush summarizes every flood without waiting for its window.
+func (t *NotificationThrottler) Flush() {
+	t.summarizeFloods(true)
+}
+
+// Run ticks until the context is cancelled.
+func (t *NotificationThrottler) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Tick()
+		}
+	}
+}
+
+func (t *NotificationThrottler) summarizeFloods(force bool) {
+	type summary struct {
+		imei       string
+		suppressed map[string]int
+	}
+	var summaries []summary
+
+	t.mu.Lock()
+	now := t.now()
+	for imei, flood := range t.floods {
+		if flood.suppressed != nil && (force || now.Sub(flood.since) >= t.floodWindow) {
+			summaries = append(summaries, summary{imei, flood.suppressed})
+			flood.suppressed = nil
+		}
+		if flood.suppressed == nil && (len(flood.sent) == 0 || now.Sub(flood.sent[len(flood.sent)-1]) >= t.floodWindow) {
+			delete(t.floods, imei)
+		}
+	}
+	for key, last := range t.last {
+		code := key[strings.LastIndex(key, "/")+1:]
+		if now.Sub(last) >= t.intervals[code] {
+			delete(t.last, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, s := range summaries {
+		throttleMetrics.Add("summaries", 1)
+		t.summarize(s.imei, s.suppressed)
+	}
+}
+
+// sendFloodSummary sends to the phones of the device the summary of the
+// notifications suppressed during a flood.
+func sendFloodSummary(imei string, suppressed map[string]int) {
+	device, err := GetDeviceByImei(imei)
+	if err != nil {
+		logrus.WithError(err).Error("Error getting device by IMEI")
+		return
+	}
+	if device == nil {
+		logrus.Warning("Device is nil")
+		return
+	}
+	codes := sortedCodes(suppressed)
+	sendNotification(Notification{
+		Imei:  imei,
+		Codes: codes,
+		Build: func(language string) string {
+			return NewMessageBuilder(device, nil).WithLanguage(language).BuildFloodSummaryMessage(suppressed)
+		},
+	})
+}
+
+// sortedCodes returns the codes of the counts in alphabetical order.
+func sortedCodes(counts map[string]int) []string {
+	codes := make([]string, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseThrottleIntervals(t *testing.T) {
+	intervals := ParseThrottleIntervals("LOWVOT=1h, REMOVE=15m,invalid,SOS=x")
+	if len(intervals) != 2 || intervals["LOWVOT"] != time.Hour || intervals["REMOVE"] != 15*time.Minute {
+		t.Fatalf("unexpected intervals %v", intervals)
+	}
+}
+
+func TestNotificationThrottler(t *testing.T) {
+	var summaries []map[string]int
+	throttler := NewNotificationThrottler(map[string]time.Duration{"LOWVOT": time.Hour}, 3, 10*time.Minute,
+		func(imei string, suppressed map[string]int) {
+			if imei != "1" {
+				t.Errorf("unexpected summary for %s", imei)
+			}
+			summaries = append(summaries, suppressed)
+		})
+	now := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+	throttler.now = func() time.Time { return now }
+
+	// A single LOWVOT per hour and device.
+	if !throttler.Allow("1", "LOWVOT") || throttler.Allow("1", "LOWVOT") {
+		t.Fatal("expected only the first LOWVOT to pass")
+	}
+	if !throttler.Allow("2", "LOWVOT") {
+		t.Fatal("expected the LOWVOT of another device to pass")
+	}
+	now = now.Add(time.Hour)
+	if !throttler.Allow("1", "LOWVOT") {
+		t.Fatal("expected a LOWVOT to pass after the interval")
+	}
+
+	// The notifications over the flood threshold are summarized at the end of the window.
+	if !throttler.Allow("1", "REMOVE") || !throttler.Allow("1", "REMOVE") {
+		t.Fatal("expected the notifications under the threshold to pass")
+	}
+	if throttler.Allow("1", "REMOVE") || throttler.Allow("1", "tampering") {
+		t.Fatal("expected the flood to be suppressed")
+	}
+	throttler.Tick()
+	if len(summaries) != 0 {
+		t.Fatalf("expected no summary before the end of the window, got %v", summaries)
+	}
+	now = now.Add(10 * time.Minute)
+	throttler.Tick()
+	if len(summaries) != 1 || summaries[0]["REMOVE"] != 1 || summaries[0]["tampering"] != 1 {
+		t.Fatalf("unexpected summaries %v", summaries)
+	}
+	if !throttler.Allow("1", "REMOVE") {
+		t.Fatal("expected the notifications to pass after the flood")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/indrod-group/get_device_alarms/auth"
+	"github.com/sirupsen/logrus"
+)
+
+// Default base URLs of the vendor APIs, configurable with the IOPGPS_API_URL
+// and WHATSGPS_API_URL environment variables.
+const (
+	IOPGPS_API_URL   = "https://open.iopgps.com/api/"
+	WHATSGPS_API_URL = "https://www.whatsgps.com/"
+)
+
+// Paths of the alarm and last position endpoints of the vendor APIs.
+const (
+	IOPGPS_ALARMS_PATH     = "device/alarm"
+	IOPGPS_LOCATION_PATH   = "device/location"
+	WHATSGPS_ALARMS_PATH   = "alarmSta/queryDetail.do"
+	WHATSGPS_LOCATION_PATH = "carStatus/getByCarId.do"
+)
+
+// Position is the last position reported by a device to its vendor. Time is
+// the unix time of the last report, which may be a heartbeat without a new
+// fix. Acc is the ignition state, nil if the device doesn't report it.
+type Position struct {
+	Imei   string  `json:"imei"`
+	Lat    *string `json:"lat,omitempty"`
+	Lng    *string `json:"lng,omitempty"`
+	Time   int64   `json:"time"`
+	Speed  *int64  `json:"speed,omitempty"`
+	Course *int64  `json:"course,omitempty"`
+	Acc    *bool   `json:"acc,omitempty"`
+}
+
+// IOPGPSClient requests the alarms of the WanWayTech devices to the IOPGPS API.
+type IOPGPSClient struct {
+	baseURL       string
+	httpClient    *http.Client
+	authenticator auth.Authenticate
+	breaker       *CircuitBreaker
+}
+
+// NewIOPGPSClient creates a client for the IOPGPS API at baseURL. The access
+// token is obtained from authenticator. If httpClient is nil, a client with
+// DEFAULT_HTTP_TIMEOUT is used.
+func NewIOPGPSClient(baseURL string, authenticator auth.Authenticate, httpClient *http.Client) *IOPGPSClient {
+	if httpClient == nil {
+		httpClient = newHTTPClient()
+	}
+	return &IOPGPSClient{
+		baseURL:       baseURL,
+		httpClient:    httpClient,
+		authenticator: authenticator,
+		breaker:       iopgpsBreaker,
+	}
+}
+
+// Owns reports whether the URL belongs to this API.
+func (c *IOPGPSClient) Owns(rawURL string) bool {
+	return strings.HasPrefix(rawURL, c.baseURL)
+}
+
+// AlarmsURL returns the URL of the alarms of a device in the given unix time range.
+func (c *IOPGPSClient) AlarmsURL(imei string, startTime, endTime int64) string {
+	query := url.Values{}
+	query.Set("imei", imei)
+	query.Set("startTime", strconv.FormatInt(startTime, 10))
+	query.Set("endTime", strconv.FormatInt(endTime, 10))
+	return joinURL(c.baseURL, IOPGPS_ALARMS_PATH) + "?" + query.Encode()
+}
+
+// FetchAlarms requests a URL returned by AlarmsURL and converts the alarms.
+func (c *IOPGPSClient) FetchAlarms(rawURL string) ([]Alarm, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for URL: %w", err)
+	}
+
+	if c.authenticator == nil {
+		return nil, errors.New("the IOPGPS client has no authenticator")
+	}
+	token, err := c.authenticator.GetAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the IOPGPS access token: %w", err)
+	}
+	req.Header.Add("AccessToken", token)
+
+	resp, err := c.breaker.Do(c.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var alarmResponse AlarmResponse
+	err = json.NewDecoder(resp.Body).Decode(&alarmResponse)
+	if err != nil {
+		// Log the alarm information even if there is an error
+		logrus.Info("Alarm details: ", alarmResponse.Details)
+		return nil, fmt.Errorf("error decoding the response body: %w", err)
+	}
+
+	alarms := make([]Alarm, 0, len(alarmResponse.Details))
+	for _, alarmData := range alarmResponse.Details {
+		alarms = append(alarms, ConvertAlarmDataToRequest(alarmData))
+	}
+	return alarms, nil
+}
+
+// LastPosition requests the last position of a device. It returns nil if the
+// device never reported one.
+func (c *IOPGPSClient) LastPosition(imei string) (*Position, error) {
+	query := url.Values{}
+	query.Set("imei", imei)
+	req, err := http.NewRequest("GET", joinURL(c.baseURL, IOPGPS_LOCATION_PATH)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for URL: %w", err)
+	}
+
+	if c.authenticator == nil {
+		return nil, errors.New("the IOPGPS client has no authenticator")
+	}
+	token, err := c.authenticator.GetAccessToken()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the IOPGPS access token: %w", err)
+	}
+	req.Header.Add("AccessToken", token)
+
+	resp, err := c.breaker.Do(c.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var locationResponse LocationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&locationResponse); err != nil {
+		return nil, fmt.Errorf("error decoding the response body: %w", err)
+	}
+	for _, location := range locationResponse.Data {
+		if location.Imei == imei && location.GpsTime > 0 {
+			return &Position{
+				Imei:   imei,
+				Lat:    location.Lat,
+				Lng:    location.Lng,
+				Time:   max(location.GpsTime, location.HeartTime),
+				Speed:  location.Speed,
+				Course: location.Course,
+				Acc:    accState(location.AccStatus),
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// accState converts the ACC status of the vendor APIs, 1 with the ignition
+// on, to the state of a Position.
+func accState(status *int64) *bool {
+	if status == nil {
+		return nil
+	}
+	on := *status == 1
+	return &on
+}
+
+// WhatsGPSClient requests the alarms of the WhatsGPS devices.
+type WhatsGPSClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	breaker    *CircuitBreaker
+}
+
+// NewWhatsGPSClient creates a client for the WhatsGPS API at baseURL. If
+// httpClient is nil, a client with DEFAULT_HTTP_TIMEOUT is used.
+func NewWhatsGPSClient(baseURL, token string, httpClient *http.Client) *WhatsGPSClient {
+	if httpClient == nil {
+		httpClient = newHTTPClient()
+	}
+	return &WhatsGPSClient{
+		baseURL:    baseURL,
+		token:      token,
+		httpClient: httpClient,
+		breaker:    whatsgpsBreaker,
+	}
+}
+
+// Owns reports whether the URL belongs to this API.
+func (c *WhatsGPSClient) Owns(rawURL string) bool {
+	return strings.HasPrefix(rawURL, c.baseURL)
+}
+
+// AlarmsURL returns the URL of the alarms of a device in the given unix time range.
+func (c *WhatsGPSClient) AlarmsURL(carID string, startTime, endTime int64) string {
+	query := url.Values{}
+	query.Add("token", c.token)
+	query.Add("carId", carID)
+	query.Add("startTime", time.Unix(startTime, 0).Format(ctLayout))
+	query.Add("endTime", time.Unix(endTime, 0).Format(ctLayout))
+	return joinURL(c.baseURL, WHATSGPS_ALARMS_PATH) + "?" + query.Encode()
+}
+
+// FetchAlarms requests a URL returned by AlarmsURL and converts the alarms.
+func (c *WhatsGPSClient) FetchAlarms(rawURL string) ([]Alarm, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for URL: %w", err)
+	}
+
+	resp, err := c.breaker.Do(c.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var alarmResponse WhatsGPSAlarmData
+	err = json.NewDecoder(resp.Body).Decode(&alarmResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the response body: %w", err)
+	}
+
+	alarms := make([]Alarm, 0, len(alarmResponse.Data))
+	for _, alarmData := range alarmResponse.Data {
+		alarms = append(alarms, ConvertWhatsGPSAlarmDataToRequest(alarmData))
+	}
+	return alarms, nil
+}
+
+// LastPosition requests the last position of a device. It returns nil if the
+// device never reported one.
+func (c *WhatsGPSClient) LastPosition(carID string) (*Position, error) {
+	query := url.Values{}
+	query.Add("token", c.token)
+	query.Add("carId", carID)
+	req, err := http.NewRequest("GET", joinURL(c.baseURL, WHATSGPS_LOCATION_PATH)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for URL: %w", err)
+	}
+
+	resp, err := c.breaker.Do(c.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var positionResponse WhatsGPSPositionData
+	if err := json.NewDecoder(resp.Body).Decode(&positionResponse); err != nil {
+		return nil, fmt.Errorf("error decoding the response body: %w", err)
+	}
+	if positionResponse.Data == nil || positionResponse.Data.PointTime.IsZero() {
+		return nil, nil
+	}
+	position := ConvertWhatsGPSPosition(*positionResponse.Data)
+	position.Imei = carID
+	return position, nil
+}
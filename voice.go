@@ -0,0 +1,362 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/twilio/twilio-go"
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+	"github.com/twilio/twilio-go/twiml"
+)
+
+const (
+	// DEFAULT_VOICE_RING_TIMEOUT is the time a call rings before it is
+	// considered unanswered, configurable with VOICE_RING_TIMEOUT.
+	DEFAULT_VOICE_RING_TIMEOUT = 30 * time.Second
+	// VOICE_GATHER_TIMEOUT is the time, in seconds, the user has to press a
+	// key after the message is read.
+	VOICE_GATHER_TIMEOUT = "10"
+	// VOICE_ACKNOWLEDGE_DIGIT is the key that acknowledges the incident.
+	VOICE_ACKNOWLEDGE_DIGIT = "1"
+	// VOICE_CALL_EXPIRY is the time after which a call without a final status
+	// callback is forgotten.
+	VOICE_CALL_EXPIRY = time.Hour
+)
+
+// voiceLanguages are the languages of the text-to-speech of the calls.
+var voiceLanguages = map[string]string{
+	LanguageSpanish: "es-MX",
+	LanguageEnglish: "en-US",
+}
+
+// voiceMetrics publishes the counters of the voice calls.
+var voiceMetrics = expvar.NewMap("voice_calls")
+
+// createTwilioCall places a call through Twilio. The tests replace it.
+var createTwilioCall = func(params *api.CreateCallParams) (*api.ApiV2010Call, error) {
+	client := twilio.NewRestClientWithParams(twilio.ClientParams{
+		Username: os.Getenv("TWILIO_ACCOUNT_SID"),
+		Password: os.Getenv("TWILIO_AUTH_TOKEN"),
+	})
+	return client.Api.CreateCall(params)
+}
+
+// voiceTarget is a phone called for an incident.
+type voiceTarget struct {
+	User     string
+	Phone    string
+	Language string
+}
+
+// voiceCall is the escalation of an incident through the phones of its
+// device, one call at a time, until one of the users acknowledges it.
+type voiceCall struct {
+	id           string
+	incident     Incident
+	alarm        Alarm
+	device       *Device
+	targets      []voiceTarget
+	index        int
+	sid          string
+	acknowledged bool
+	startedAt    time.Time
+}
+
+// VoiceNotifier calls the users of a device for its critical incidents. The
+// message is read in the language of each user, and pressing 1 acknowledges
+// the incident. When a call isn't answered or acknowledged, the next phone is
+// called.
+//
+// The calls are enabled with TWILIO_VOICE_FROM, the caller number, and
+// TWILIO_VOICE_CALLBACK_URL, the public URL of /twilio/voice.
+type VoiceNotifier struct {
+	// correlator is the IncidentCorrelator of the incidents,
+	// GetIncidentCorrelator() if nil.
+	correlator *IncidentCorrelator
+	now        func() time.Time
+
+	mu     sync.Mutex
+	nextID int64
+	calls  map[string]*voiceCall
+}
+
+var voiceNotifierInstance *VoiceNotifier
+var voiceNotifierOnce sync.Once
+
+// GetVoiceNotifier returns the notifier of the voice calls.
+func GetVoiceNotifier() *VoiceNotifier {
+	voiceNotifierOnce.Do(func() {
+		voiceNotifierInstance = NewVoiceNotifier(nil)
+	})
+	return voiceNotifierInstance
+}
+
+// NewVoiceNotifier creates a notifier that acknowledges the incidents of the
+// correlator.
+func NewVoiceNotifier(correlator *IncidentCorrelator) *VoiceNotifier {
+	return &VoiceNotifier{
+		correlator: correlator,
+		now:        time.Now,
+		nextID:     time.Now().UnixMilli(),
+		calls:      map[string]*voiceCall{},
+	}
+}
+
+// Correlator returns the IncidentCorrelator of the incidents.
+func (v *VoiceNotifier) Correlator() *IncidentCorrelator {
+	if v.correlator == nil {
+		return GetIncidentCorrelator()
+	}
+	return v.correlator
+}
+
+// Enabled reports whether the voice calls are configured.
+func (v *VoiceNotifier) Enabled() bool {
+	return os.Getenv("TWILIO_VOICE_FROM") != "" && os.Getenv("TWILIO_VOICE_CALLBACK_URL") != ""
+}
+
+// Call starts calling the users of the device of the incident, in the order
+// of the backend, unless the incident is already being called.
+func (v *VoiceNotifier) Call(incident Incident, device *Device) {
+	if !v.Enabled() {
+		return
+	}
+	recipients, err := GetRecipients(incident.Imei)
+	if err != nil {
+		logrus.WithError(err).Error("Error retrieving phone numbers")
+		return
+	}
+	codes := make([]string, len(incident.Alarms))
+	for i, alarm := range incident.Alarms {
+		codes[i] = alarm.AlarmCode
+	}
+	var targets []voiceTarget
+	for _, recipient := range uniquePhones(ResolveRecipients(recipients, codes, true, v.now())) {
+		for _, phone := range recipient.Phones {
+			targets = append(targets, voiceTarget{User: recipient.User, Phone: phone, Language: recipient.Preferences.Language})
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	v.mu.Lock()
+	now := v.now()
+	for id, call := range v.calls {
+		if now.Sub(call.startedAt) >= VOICE_CALL_EXPIRY {
+			delete(v.calls, id)
+		} else if call.incident.ID == incident.ID {
+			v.mu.Unlock()
+			return
+		}
+	}
+	v.nextID++
+	call := &voiceCall{
+		id:        strconv.FormatInt(v.nextID, 10),
+		incident:  incident,
+		alarm:     incident.LastAlarm(),
+		device:    device,
+		targets:   targets,
+		startedAt: now,
+	}
+	v.calls[call.id] = call
+	v.mu.Unlock()
+
+	voiceMetrics.Add("escalations", 1)
+	v.dial(call)
+}
+
+// dial calls the current phone of the call, skipping the phones Twilio
+// rejects. The call ends when there are no phones left or the incident is no
+// longer open.
+func (v *VoiceNotifier) dial(call *voiceCall) {
+	for {
+		v.mu.Lock()
+		if call.acknowledged || call.index >= len(call.targets) {
+			if !call.acknowledged {
+				voiceMetrics.Add("unacknowledged", 1)
+				logrus.WithFields(logrus.Fields{"imei": call.incident.Imei, "incident": call.incident.ID}).Warning("No user acknowledged the incident call")
+			}
+			delete(v.calls, call.id)
+			v.mu.Unlock()
+			return
+		}
+		target := call.targets[call.index]
+		v.mu.Unlock()
+
+		if incident, ok := v.Correlator().Get(call.incident.ID); !ok || incident.Status != IncidentOpen {
+			v.mu.Lock()
+			delete(v.calls, call.id)
+			v.mu.Unlock()
+			return
+		}
+
+		resp, err := v.place(call, target)
+		var sid, status string
+		if resp != nil {
+			sid, status = stringValue(resp.Sid), stringValue(resp.Status)
+		}
+		recordAttempt(call.incident.Imei, &call.alarm, target.User, target.Phone, ChannelVoice, sid, status, err)
+		voiceMetrics.Add("calls", 1)
+
+		v.mu.Lock()
+		if err == nil {
+			call.sid = sid
+			v.mu.Unlock()
+			return
+		}
+		call.index++
+		v.mu.Unlock()
+		logrus.WithError(err).WithField("imei", call.incident.Imei).Error("Error placing the incident call")
+	}
+}
+
+// place creates the Twilio call of a phone, with the TwiML of the incident.
+func (v *VoiceNotifier) place(call *voiceCall, target voiceTarget) (*api.ApiV2010Call, error) {
+	callbackURL := strings.TrimSuffix(os.Getenv("TWILIO_VOICE_CALLBACK_URL"), "/")
+	message := NewMessageBuilder(call.device, &call.alarm).WithLanguage(target.Language).BuildVoiceMessage(call.incident)
+	response, err := incidentCallTwiML(message, target.Language, callbackURL+"/gather?call="+call.id)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &api.CreateCallParams{}
+	params.SetFrom(os.Getenv("TWILIO_VOICE_FROM"))
+	params.SetTo(target.Phone)
+	params.SetTwiml(response)
+	params.SetTimeout(int(getEnvDuration("VOICE_RING_TIMEOUT", DEFAULT_VOICE_RING_TIMEOUT) / time.Second))
+	params.SetStatusCallback(callbackURL + "/status?call=" + call.id)
+	params.SetStatusCallbackEvent([]string{"initiated", "ringing", "answered", "completed"})
+	return createTwilioCall(params)
+}
+
+// incidentCallTwiML returns the TwiML of an incident call: the message is
+// read twice while waiting for a key, which is posted to action.
+func incidentCallTwiML(message, language, action string) (string, error) {
+	say := &twiml.VoiceSay{Message: message, Language: voiceLanguages[language], Loop: "2"}
+	return twiml.Voice([]twiml.Element{
+		&twiml.VoiceGather{
+			Action:        action,
+			NumDigits:     "1",
+			Timeout:       VOICE_GATHER_TIMEOUT,
+			InnerElements: []twiml.Element{say},
+		},
+		&twiml.VoiceSay{
+			Message:  translate(language, "No se confirmó la alerta."),
+			Language: voiceLanguages[language],
+		},
+	})
+}
+
+// Gather handles the key pressed in the call with the SID and returns the
+// TwiML of the answer. The acknowledge key acknowledges the incident; after
+// any other key the call ends and the next phone is called.
+func (v *VoiceNotifier) Gather(id, sid, digits string) (string, error) {
+	v.mu.Lock()
+	call, ok := v.calls[id]
+	var target voiceTarget
+	if ok {
+		target = call.targets[min(call.index, len(call.targets)-1)]
+	}
+	acknowledged := ok && sid == call.sid && digits == VOICE_ACKNOWLEDGE_DIGIT && !call.acknowledged
+	if acknowledged {
+		call.acknowledged = true
+	}
+	v.mu.Unlock()
+
+	message := translate(target.Language, "No se confirmó la alerta.")
+	if acknowledged {
+		message = translate(target.Language, "Alerta confirmada. Gracias.")
+		voiceMetrics.Add("acknowledged", 1)
+		if _, err := v.Correlator().Acknowledge(call.incident.ID); err != nil {
+			logrus.WithError(err).WithField("incident", call.incident.ID).Warning("Error acknowledging the incident")
+		}
+		if alarmArchive != nil {
+			if _, err := alarmArchive.UpdateNotificationStatus(sid, NotificationRead, 0, "", v.now()); err != nil {
+				logrus.WithError(err).Warning("Error updating the notification status")
+			}
+		}
+		logrus.WithFields(logrus.Fields{"incident": call.incident.ID, "user": target.User}).Info("Incident acknowledged by phone")
+	}
+	return twiml.Voice([]twiml.Element{
+		&twiml.VoiceSay{Message: message, Language: voiceLanguages[orDefault(target.Language, LanguageSpanish)]},
+		&twiml.VoiceHangup{},
+	})
+}
+
+// Status handles a status callback of a call. When the call ends without
+// being acknowledged, the next phone is called.
+func (v *VoiceNotifier) Status(id, sid, status string) {
+	v.mu.Lock()
+	call, ok := v.calls[id]
+	if !ok || call.sid != sid {
+		v.mu.Unlock()
+		return
+	}
+	final := false
+	switch status {
+	case "completed", "busy", "no-answer", "failed", "canceled":
+		final = true
+		if !call.acknowledged {
+			voiceMetrics.Add(status, 1)
+			call.index++
+		}
+	}
+	v.mu.Unlock()
+
+	if final {
+		go v.dial(call)
+	}
+}
+
+// voiceHandler receives the callbacks of the incident calls, signed by Twilio
+// over TWILIO_VOICE_CALLBACK_URL:
+//
+//	POST /twilio/voice/gather?call=ID
+//	POST /twilio/voice/status?call=ID
+func voiceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, "/twilio/voice/")
+	callbackURL := strings.TrimSuffix(os.Getenv("TWILIO_VOICE_CALLBACK_URL"), "/")
+	if callbackURL == "" || !validTwilioRequest(r, callbackURL+"/"+action+"?"+r.URL.RawQuery) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	notifier := GetVoiceNotifier()
+	id := r.URL.Query().Get("call")
+	switch action {
+	case "gather":
+		response, err := notifier.Gather(id, r.PostForm.Get("CallSid"), r.PostForm.Get("Digits"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(response))
+	case "status":
+		sid, status := r.PostForm.Get("CallSid"), r.PostForm.Get("CallStatus")
+		if mapped, ok := twilioNotificationStatus(status); ok && alarmArchive != nil {
+			if _, err := alarmArchive.UpdateNotificationStatus(sid, mapped, 0, "", time.Now()); err != nil {
+				logrus.WithError(err).Warning("Error updating the notification status")
+			}
+		}
+		notifier.Status(id, sid, status)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// placedCall is a call placed through the stubbed Twilio API.
+type placedCall struct {
+	To, Twiml, StatusCallback string
+}
+
+// useTwilioCallStub replaces the Twilio calls API with a stub that records the
+// calls. The calls to the failing numbers return an error.
+func useTwilioCallStub(t *testing.T, failing ...string) func() []placedCall {
+	t.Helper()
+	var mu sync.Mutex
+	var placed []placedCall
+	previous := createTwilioCall
+	createTwilioCall = func(params *api.CreateCallParams) (*api.ApiV2010Call, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, number := range failing {
+			if *params.To == number {
+				return nil, errors.New("invalid number")
+			}
+		}
+		placed = append(placed, placedCall{To: *params.To, Twiml: *params.Twiml, StatusCallback: *params.StatusCallback})
+		sid, status := "CA"+strings.TrimPrefix(*params.To, "+"), "queued"
+		return &api.ApiV2010Call{Sid: &sid, Status: &status}, nil
+	}
+	t.Cleanup(func() { createTwilioCall = previous })
+	return func() []placedCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]placedCall(nil), placed...)
+	}
+}
+
+func TestIncidentCallTwiML(t *testing.T) {
+	response, err := incidentCallTwiML("ALERTA DE SOS", LanguageSpanish, "https://alarms.example.com/twilio/voice/gather?call=1")
+	if err != nil {
+		t.Fatalf("incidentCallTwiML failed: %v", err)
+	}
+	for _, expected := range []string{
+		`action="https://alarms.example.com/twilio/voice/gather?call=1"`,
+		`numDigits="1"`,
+		`loop="2"`,
+		`language="es-MX"`,
+		`>ALERTA DE SOS</Say></Gather>`,
+		`>No se confirmó la alerta.</Say></Response>`,
+	} {
+		if !strings.Contains(response, expected) {
+			t.Errorf("expected %q in %s", expected, response)
+		}
+	}
+}
+
+func TestBuildVoiceMessage(t *testing.T) {
+	plate := "GBA-1234"
+	device := &Device{UserName: "Flota Norte", LicenseNumber: &plate}
+	alarm := Alarm{Imei: "1", AlarmCode: "SOS"}
+	incident := Incident{Alarms: []Alarm{alarm}}
+
+	expected := "ALERTA DE SOS. Vehículo de Flota Norte, placa G B A 1 2 3 4. Ubicación desconocida. Presione 1 para confirmar la alerta."
+	if message := NewMessageBuilder(device, &alarm).BuildVoiceMessage(incident); message != expected {
+		t.Errorf("expected %q, got %q", expected, message)
+	}
+	expected = "SOS ALERT. Vehicle of Flota Norte, license plate G B A 1 2 3 4. Unknown location. Press 1 to acknowledge the alert."
+	if message := NewMessageBuilder(device, &alarm).WithLanguage(LanguageEnglish).BuildVoiceMessage(incident); message != expected {
+		t.Errorf("expected %q, got %q", expected, message)
+	}
+}
+
+func TestVoiceNotifierEscalation(t *testing.T) {
+	imei := "860419050021378"
+	server := useRoadSafetyServer(t)
+	server.SetPhoneNumbers(imei, UserPhoneNumbers{
+		{User: "owner", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000001"}, {PhoneNumber: "+593990000002"}}},
+		{User: "driver", PhoneNumbers: []PhoneNumber{{PhoneNumber: "+593990000003"}}},
+	})
+	useRecipientPreferences(t, map[string]RecipientPreferences{"driver": {Language: LanguageEnglish}})
+	archive := useTestArchive(t)
+	t.Setenv("TWILIO_VOICE_FROM", "+15005550006")
+	t.Setenv("TWILIO_VOICE_CALLBACK_URL", "https://alarms.example.com/twilio/voice/")
+	placed := useTwilioCallStub(t, "+593990000002")
+
+	c, _, notified := testCorrelator()
+	c.Add([]Alarm{{Imei: imei, Time: 1700000000, AlarmCode: "SOS"}})
+	incident := notified()[0]
+	v := NewVoiceNotifier(c)
+	v.Call(incident, &Device{UserName: "fleet"})
+
+	calls := placed()
+	if len(calls) != 1 || calls[0].To != "+593990000001" || !strings.Contains(calls[0].Twiml, "Presione 1") {
+		t.Fatalf("expected a call to the first phone, got %+v", calls)
+	}
+	callback, err := url.Parse(calls[0].StatusCallback)
+	if err != nil || callback.Path != "/twilio/voice/status" {
+		t.Fatalf("unexpected status callback %q", calls[0].StatusCallback)
+	}
+	id := callback.Query().Get("call")
+
+	// A second incident call isn't placed while the first one is escalating.
+	v.Call(incident, &Device{UserName: "fleet"})
+	if n := len(placed()); n != 1 {
+		t.Fatalf("expected a single escalation, got %d calls", n)
+	}
+
+	// An unanswered call goes to the next phone, skipping the rejected one.
+	v.Status(id, "CA593990000001", "ringing")
+	v.Status(id, "CA593990000001", "no-answer")
+	waitFor(t, "the call to the next phone", func() bool {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return v.calls[id].sid == "CA593990000003"
+	})
+	if calls = placed(); calls[1].To != "+593990000003" || !strings.Contains(calls[1].Twiml, "Press 1") {
+		t.Fatalf("expected an English call to the driver, got %+v", calls[1])
+	}
+
+	// A late key of the previous call doesn't acknowledge the incident.
+	if response, _ := v.Gather(id, "CA593990000001", "1"); strings.Contains(response, "Alerta confirmada") {
+		t.Fatalf("unexpected acknowledgement of a previous call: %s", response)
+	}
+	response, err := v.Gather(id, "CA593990000003", "1")
+	if err != nil || !strings.Contains(response, "Alert acknowledged") || !strings.Contains(response, "<Hangup") {
+		t.Fatalf("unexpected gather response %q: %v", response, err)
+	}
+	if acknowledged, _ := c.Get(incident.ID); acknowledged.Status != IncidentAcknowledged {
+		t.Fatalf("expected the incident to be acknowledged, got %s", acknowledged.Status)
+	}
+	v.Status(id, "CA593990000003", "completed")
+	waitFor(t, "the end of the escalation", func() bool {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return len(v.calls) == 0
+	})
+	if n := len(placed()); n != 2 {
+		t.Fatalf("expected no more calls after the acknowledgement, got %d", n)
+	}
+
+	attempts, _ := archive.Notifications(imei, time.Time{}, time.Time{})
+	statuses := map[string]NotificationStatus{}
+	for _, attempt := range attempts {
+		if attempt.Channel == ChannelVoice {
+			statuses[attempt.Phone] = attempt.Status
+		}
+	}
+	if statuses["+593990000002"] != NotificationFailed || statuses["+593990000003"] != NotificationRead {
+		t.Fatalf("unexpected ledger statuses %v", statuses)
+	}
+}
+
+func TestVoiceHandler(t *testing.T) {
+	callbackURL := "https://alarms.example.com/twilio/voice"
+	t.Setenv("TWILIO_VOICE_CALLBACK_URL", callbackURL)
+	t.Setenv("TWILIO_AUTH_TOKEN", "token")
+
+	post := func(form url.Values, signature string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/twilio/voice/gather?call=unknown", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Twilio-Signature", signature)
+		w := httptest.NewRecorder()
+		voiceHandler(w, r)
+		return w
+	}
+
+	form := url.Values{"CallSid": {"CA1"}, "Digits": {"1"}}
+	if w := post(form, "invalid"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for an invalid signature, got %d", w.Code)
+	}
+	w := post(form, signTwilioRequest("token", callbackURL+"/gather?call=unknown", form))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "No se confirmó la alerta.") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
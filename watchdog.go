@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_OFFLINE_THRESHOLD is the silence after which a device is
+	// reported offline, configurable with the OFFLINE_THRESHOLD environment
+	// variable. OFFLINE_THRESHOLDS overrides it per device with IMEI=DURATION
+	// pairs; a zero threshold disables the detection.
+	DEFAULT_OFFLINE_THRESHOLD = 24 * time.Hour
+	// DEFAULT_WATCHDOG_INTERVAL is the time between two checks of the silent
+	// devices, configurable with WATCHDOG_INTERVAL.
+	DEFAULT_WATCHDOG_INTERVAL = 15 * time.Minute
+	// DEFAULT_WATCHDOG_STATE_PATH is the file of the last-seen times and the
+	// offline devices, configurable with WATCHDOG_STATE_PATH, so a restart
+	// neither raises nor forgets the OFFLINE alarms.
+	DEFAULT_WATCHDOG_STATE_PATH = "watchdog.state.json"
+)
+
+// watchdogMetrics counts the OFFLINE and RECOVERED alarms raised.
+var watchdogMetrics = expvar.NewMap("watchdog")
+
+// DeviceWatchdog tracks the last time each device reported, from its alarms
+// and the last position of its vendor. It raises a synthetic OFFLINE alarm
+// when a device is silent longer than its threshold, and a RECOVERED alarm
+// when it reports again. Both go through the next handlers like any other
+// alarm, so they are saved and notified.
+type DeviceWatchdog struct {
+	next Handler
+
+	threshold  time.Duration
+	thresholds map[string]time.Duration
+
+	// lastPosition requests the last position of a device to its vendor.
+	lastPosition func(Device) (*Position, error)
+	now          func() time.Time
+
+	mu   sync.Mutex
+	path string
+	// lastSeen is the unix time of the last report of each device.
+	lastSeen map[string]int64
+	// offline is the last report of each offline device when it was raised.
+	offline map[string]int64
+}
+
+// watchdogState is the content of the state file.
+type watchdogState struct {
+	LastSeen map[string]int64 `json:"last_seen"`
+	Offline  map[string]int64 `json:"offline"`
+}
+
+var deviceWatchdogInstance *DeviceWatchdog
+var deviceWatchdogOnce sync.Once
+
+// GetDeviceWatchdog returns the watchdog configured from the environment,
+// with the state of WATCHDOG_STATE_PATH.
+func GetDeviceWatchdog() *DeviceWatchdog {
+	deviceWatchdogOnce.Do(func() {
+		deviceWatchdogInstance = NewDeviceWatchdog(
+			getEnvDuration("OFFLINE_THRESHOLD", DEFAULT_OFFLINE_THRESHOLD),
+			parseDurations(os.Getenv("OFFLINE_THRESHOLDS"), "offline threshold"),
+		)
+		path := getEnv("WATCHDOG_STATE_PATH", DEFAULT_WATCHDOG_STATE_PATH)
+		if err := deviceWatchdogInstance.Load(path); err != nil {
+			logrus.WithError(err).WithField("path", path).Warning("Starting the device watchdog without its state")
+		}
+	})
+	return deviceWatchdogInstance
+}
+
+// NewDeviceWatchdog creates a watchdog with a default threshold and the
+// thresholds of some devices, by IMEI. Its state isn't saved until Load.
+func NewDeviceWatchdog(threshold time.Duration, thresholds map[string]time.Duration) *DeviceWatchdog {
+	return &DeviceWatchdog{
+		threshold:    threshold,
+		thresholds:   thresholds,
+		lastPosition: func(device Device) (*Position, error) { return device.LastPosition() },
+		now:          time.Now,
+		lastSeen:     map[string]int64{},
+		offline:      map[string]int64{},
+	}
+}
+
+// Load reads the state file, which doesn't need to exist, and saves the
+// state there from now on.
+func (w *DeviceWatchdog) Load(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state watchdogState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid watchdog state %s: %w", path, err)
+	}
+	if state.LastSeen != nil {
+		w.lastSeen = state.LastSeen
+	}
+	if state.Offline != nil {
+		w.offline = state.Offline
+	}
+	return nil
+}
+
+// save writes the state file, if any. w.mu must be held.
+func (w *DeviceWatchdog) save() error {
+	if w.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(watchdogState{LastSeen: w.lastSeen, Offline: w.offline}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+// Threshold returns the silence after which a device is offline.
+func (w *DeviceWatchdog) Threshold(imei string) time.Duration {
+	if threshold, ok := w.thresholds[imei]; ok {
+		return threshold
+	}
+	return w.threshold
+}
+
+// LastSeen returns the time of the last report of a device, zero if unknown.
+func (w *DeviceWatchdog) LastSeen(imei string) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seen, ok := w.lastSeen[imei]; ok {
+		return time.Unix(seen, 0)
+	}
+	return time.Time{}
+}
+
+// Offline reports whether a device is offline.
+func (w *DeviceWatchdog) Offline(imei string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, offline := w.offline[imei]
+	return offline
+}
+
+// Handle records the reports of the alarms and adds a RECOVERED alarm for
+// each offline device among them.
+func (w *DeviceWatchdog) Handle(data interface{}) (interface{}, error) {
+	alarms, ok := data.([]Alarm)
+	if !ok {
+		return nil, fmt.Errorf("DeviceWatchdog.Handle: expected []Alarm, got %T", data)
+	}
+
+	var recovered []Alarm
+	for _, alarm := range alarms {
+		if alarm.AlarmCode == "OFFLINE" || alarm.AlarmCode == "RECOVERED" {
+			continue
+		}
+		if r := w.seen(alarm.Imei, alarm.Time, alarm.Lat, alarm.Lng); r != nil {
+			recovered = append(recovered, *r)
+		}
+	}
+	if len(recovered) > 0 {
+		w.mu.Lock()
+		if err := w.save(); err != nil {
+			logrus.WithError(err).Warning("Error saving the watchdog state")
+		}
+		w.mu.Unlock()
+		alarms = append(alarms, recovered...)
+	}
+
+	if w.next != nil {
+		return w.next.Handle(alarms)
+	}
+	return alarms, nil
+}
+
+func (w *DeviceWatchdog) SetNext(next Handler) {
+	w.next = next
+}
+
+// ObservePosition records a position polled from the vendor and passes the
+// RECOVERED alarm, if the device was offline, to the next handler.
+func (w *DeviceWatchdog) ObservePosition(position Position) {
+	recovered := w.seen(position.Imei, position.Time, position.Lat, position.Lng)
+	if recovered == nil {
+		return
+	}
+	w.mu.Lock()
+	if err := w.save(); err != nil {
+		logrus.WithError(err).Warning("Error saving the watchdog state")
+	}
+	w.mu.Unlock()
+	if w.next != nil {
+		if _, err := w.next.Handle([]Alarm{*recovered}); err != nil {
+			logrus.WithError(err).Error("Error handling the watchdog alarms")
+		}
+	}
+}
+
+// seen records a report of a device at a unix time. It returns the RECOVERED
+// alarm, at the given position, if the device was offline and the report is
+// newer than its last one.
+func (w *DeviceWatchdog) seen(imei string, at int64, lat, lng *string) *Alarm {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if at > w.lastSeen[imei] {
+		w.lastSeen[imei] = at
+	}
+	last, offline := w.offline[imei]
+	if !offline || at <= last {
+		return nil
+	}
+	delete(w.offline, imei)
+	watchdogMetrics.Add("recovered", 1)
+	logrus.WithField("imei", imei).Info("The device is reporting again")
+	return &Alarm{Imei: imei, Time: w.now().Unix(), AlarmCode: "RECOVERED", Lat: lat, Lng: lng}
+}
+
+// Check looks for the silent devices among the tracked ones. Before raising
+// an OFFLINE alarm, it asks the vendor for the last position of the device,
+// which is reported while it is parked; if the vendor can't be reached, the
+// device is checked again in the next round. The devices without any known
+// report get a whole threshold before they are offline. The raised alarms are
+// passed to the next handler.
+func (w *DeviceWatchdog) Check(devices []Device) {
+	now := w.now()
+	tracked := make(map[string]bool, len(devices))
+	var raised []Alarm
+	for _, device := range devices {
+		tracked[device.Imei] = true
+		threshold := w.Threshold(device.Imei)
+		if threshold <= 0 {
+			continue
+		}
+		if seen := w.LastSeen(device.Imei); !seen.IsZero() && now.Sub(seen) < threshold && !w.Offline(device.Imei) {
+			continue
+		}
+
+		position, err := w.lastPosition(device)
+		if err != nil {
+			logrus.WithError(err).WithField("imei", device.Imei).Warning("Error requesting the last position of a silent device")
+			continue
+		}
+		var lat, lng *string
+		if position != nil {
+			if recovered := w.seen(device.Imei, position.Time, position.Lat, position.Lng); recovered != nil {
+				raised = append(raised, *recovered)
+				continue
+			}
+			lat, lng = position.Lat, position.Lng
+		}
+
+		w.mu.Lock()
+		last, known := w.lastSeen[device.Imei]
+		_, offline := w.offline[device.Imei]
+		if !known {
+			w.lastSeen[device.Imei] = now.Unix()
+		} else if !offline && now.Sub(time.Unix(last, 0)) >= threshold {
+			w.offline[device.Imei] = last
+			watchdogMetrics.Add("offline", 1)
+			logrus.WithFields(logrus.Fields{"imei": device.Imei, "last_seen": time.Unix(last, 0)}).Warning("The device stopped reporting")
+			raised = append(raised, Alarm{Imei: device.Imei, Time: now.Unix(), AlarmCode: "OFFLINE", Lat: lat, Lng: lng})
+		}
+		w.mu.Unlock()
+	}
+
+	// The devices no longer tracked are forgotten.
+	w.mu.Lock()
+	for imei := range w.lastSeen {
+		if !tracked[imei] {
+			delete(w.lastSeen, imei)
+			delete(w.offline, imei)
+		}
+	}
+	if err := w.save(); err != nil {
+		logrus.WithError(err).Warning("Error saving the watchdog state")
+	}
+	w.mu.Unlock()
+
+	if len(raised) > 0 && w.next != nil {
+		if _, err := w.next.Handle(raised); err != nil {
+			logrus.WithError(err).Error("Error handling the watchdog alarms")
+		}
+	}
+}
+
+// Run checks the tracked devices every interval until the context is
+// cancelled.
+func (w *DeviceWatchdog) Run(ctx context.Context, interval time.Duration, fetchDevices func() ([]Device, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		devices, err := fetchDevices()
+		if err != nil {
+			logrus.WithError(err).Warning("Error getting the devices checked by the watchdog")
+			continue
+		}
+		w.Check(devices)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordingHandler is a Handler that records the alarms raised by the
+// service, OFFLINE, RECOVERED and OVERSPEED, it receives.
+type recordingHandler struct {
+	alarms []Alarm
+}
+
+func (h *recordingHandler) Handle(data interface{}) (interface{}, error) {
+	for _, alarm := range data.([]Alarm) {
+		if alarm.AlarmCode == "OFFLINE" || alarm.AlarmCode == "RECOVERED" || alarm.AlarmCode == "OVERSPEED" {
+			h.alarms = append(h.alarms, alarm)
+		}
+	}
+	return data, nil
+}
+
+func (h *recordingHandler) SetNext(Handler) {}
+
+// testWatchdog returns a watchdog with a threshold of an hour, two hours for
+// the device "2", and the handler that receives its alarms. The vendor
+// positions are taken from the returned map.
+func testWatchdog(t *testing.T) (*DeviceWatchdog, *time.Time, map[string]*Position, *recordingHandler) {
+	t.Helper()
+	w := NewDeviceWatchdog(time.Hour, map[string]time.Duration{"2": 2 * time.Hour, "3": 0})
+	now := time.Unix(1700000000, 0)
+	w.now = func() time.Time { return now }
+	positions := map[string]*Position{}
+	w.lastPosition = func(device Device) (*Position, error) {
+		if device.Imei == "down" {
+			return nil, errors.New("connection refused")
+		}
+		return positions[device.Imei], nil
+	}
+	next := &recordingHandler{}
+	w.SetNext(next)
+	return w, &now, positions, next
+}
+
+func TestDeviceWatchdogOffline(t *testing.T) {
+	w, now, positions, next := testWatchdog(t)
+	devices := []Device{{Imei: "1"}, {Imei: "2"}, {Imei: "3"}, {Imei: "down"}}
+
+	// The devices without reports get a whole threshold.
+	w.Check(devices)
+	*now = now.Add(50 * time.Minute)
+	w.Handle([]Alarm{{Imei: "2", Time: now.Unix(), AlarmCode: "SOS"}})
+	*now = now.Add(20 * time.Minute)
+	w.Check(devices)
+	if len(next.alarms) != 1 || next.alarms[0].Imei != "1" || next.alarms[0].AlarmCode != "OFFLINE" {
+		t.Fatalf("expected the device 1 to be offline, got %+v", next.alarms)
+	}
+	if w.Offline("2") || w.Offline("3") || w.Offline("down") {
+		t.Fatal("expected only the device 1 to be offline")
+	}
+
+	// A position reported while parked keeps the device online.
+	lat, lng := "-2.17", "-79.92"
+	positions["2"] = &Position{Imei: "2", Lat: &lat, Lng: &lng, Time: now.Unix()}
+	*now = now.Add(90 * time.Minute)
+	w.Check(devices)
+	if w.Offline("2") {
+		t.Fatal("expected the device 2 to be online with its vendor position")
+	}
+	*now = now.Add(2 * time.Hour)
+	w.Check(devices)
+	if len(next.alarms) != 2 || next.alarms[1].Imei != "2" || *next.alarms[1].Lat != lat {
+		t.Fatalf("expected the device 2 offline at its last position, got %+v", next.alarms)
+	}
+
+	// The OFFLINE alarm is raised once.
+	w.Check(devices)
+	if len(next.alarms) != 2 {
+		t.Fatalf("expected a single OFFLINE alarm per device, got %+v", next.alarms)
+	}
+}
+
+func TestDeviceWatchdogRecovered(t *testing.T) {
+	w, now, positions, next := testWatchdog(t)
+	devices := []Device{{Imei: "1"}, {Imei: "2"}}
+	w.Handle([]Alarm{{Imei: "1", Time: now.Unix(), AlarmCode: "SOS"}, {Imei: "2", Time: now.Unix(), AlarmCode: "SOS"}})
+	*now = now.Add(3 * time.Hour)
+	w.Check(devices)
+	if len(next.alarms) != 2 || !w.Offline("1") || !w.Offline("2") {
+		t.Fatalf("expected both devices offline, got %+v", next.alarms)
+	}
+
+	// An alarm of an offline device adds a RECOVERED alarm to the chain.
+	result, err := w.Handle([]Alarm{{Imei: "1", Time: now.Unix(), AlarmCode: "LOWVOT"}})
+	alarms := result.([]Alarm)
+	if err != nil || len(alarms) != 2 || alarms[1].AlarmCode != "RECOVERED" || alarms[1].Imei != "1" {
+		t.Fatalf("expected a RECOVERED alarm, got %+v: %v", alarms, err)
+	}
+	if w.Offline("1") {
+		t.Fatal("expected the device 1 to be online")
+	}
+
+	// A new vendor position recovers a device without alarms.
+	positions["2"] = &Position{Imei: "2", Time: now.Unix()}
+	next.alarms = nil
+	w.Check(devices)
+	if len(next.alarms) != 1 || next.alarms[0].Imei != "2" || next.alarms[0].AlarmCode != "RECOVERED" {
+		t.Fatalf("expected the device 2 to recover, got %+v", next.alarms)
+	}
+
+	// So does a polled position.
+	*now = now.Add(3 * time.Hour)
+	w.Check(devices)
+	next.alarms = nil
+	w.ObservePosition(Position{Imei: "1", Time: now.Unix()})
+	w.ObservePosition(Position{Imei: "1", Time: now.Unix()})
+	if len(next.alarms) != 1 || next.alarms[0].Imei != "1" || next.alarms[0].AlarmCode != "RECOVERED" {
+		t.Fatalf("expected the device 1 to recover once, got %+v", next.alarms)
+	}
+}
+
+func TestDeviceWatchdogState(t *testing.T) {
+	w, now, _, _ := testWatchdog(t)
+	path := filepath.Join(t.TempDir(), "watchdog.state.json")
+	if err := w.Load(path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	w.Handle([]Alarm{{Imei: "1", Time: now.Unix(), AlarmCode: "SOS"}, {Imei: "removed", Time: now.Unix(), AlarmCode: "SOS"}})
+	*now = now.Add(2 * time.Hour)
+	w.Check([]Device{{Imei: "1"}})
+
+	restored, restoredNow, _, next := testWatchdog(t)
+	*restoredNow = *now
+	if err := restored.Load(path); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if !restored.Offline("1") || !restored.LastSeen("1").Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("expected the offline device to be restored, got %s", restored.LastSeen("1"))
+	}
+	if !restored.LastSeen("removed").IsZero() {
+		t.Fatal("expected the devices no longer tracked to be forgotten")
+	}
+	restored.Check([]Device{{Imei: "1"}})
+	if len(next.alarms) != 0 {
+		t.Fatalf("expected no OFFLINE alarm after the restart, got %+v", next.alarms)
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_WEBHOOKS_PATH is the file of the webhook subscriptions,
+	// configurable with the WEBHOOKS_PATH environment variable. An empty path
+	// disables the webhooks.
+	DEFAULT_WEBHOOKS_PATH = "webhooks.json"
+	// WEBHOOK_MAX_ATTEMPTS is the number of times a delivery is tried.
+	WEBHOOK_MAX_ATTEMPTS = 5
+	// WEBHOOK_RETRY_DELAY is the wait before the first retry, doubled on each
+	// retry up to WEBHOOK_MAX_RETRY_DELAY.
+	WEBHOOK_RETRY_DELAY     = 2 * time.Second
+	WEBHOOK_MAX_RETRY_DELAY = time.Minute
+	// WEBHOOK_DISABLE_AFTER is the number of consecutive failed deliveries
+	// after which a subscription is disabled.
+	WEBHOOK_DISABLE_AFTER = 20
+	// WEBHOOK_QUEUE_SIZE is the number of deliveries a subscription may have
+	// waiting. The events are dropped, as failed deliveries, when it is full.
+	WEBHOOK_QUEUE_SIZE = 256
+	// WEBHOOK_DELIVERY_LOG_SIZE is the number of attempts kept per subscription.
+	WEBHOOK_DELIVERY_LOG_SIZE = 100
+	// WEBHOOK_WORKER_IDLE is how long the worker of a subscription waits for
+	// deliveries before it stops; the next delivery starts a new one.
+	WEBHOOK_WORKER_IDLE = 5 * time.Minute
+)
+
+// webhookMetrics publishes the counters of the webhook deliveries.
+var webhookMetrics = expvar.NewMap("webhooks")
+
+// ErrWebhookNotFound is returned for an unknown subscription ID.
+var ErrWebhookNotFound = errors.New("webhook subscription not found")
+
+// WebhookSubscription is a partner endpoint that receives the alarms. Empty
+// Imeis and Codes don't filter. Failures counts the consecutive failed
+// deliveries; the subscription is disabled when it reaches WEBHOOK_DISABLE_AFTER.
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Imeis     []string  `json:"imeis,omitempty"`
+	Codes     []string  `json:"codes,omitempty"`
+	Disabled  bool      `json:"disabled"`
+	Failures  int       `json:"failures"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Matches reports whether the event must be delivered to the subscription.
+func (s WebhookSubscription) Matches(event AlarmEvent) bool {
+	return NewEventFilter(s.Imeis, nil, s.Codes).Matches(event)
+}
+
+// WebhookPayload is the body sent to the subscriptions. Device is nil if the
+// device of the alarm isn't known yet.
+type WebhookPayload struct {
+	EventID uint64  `json:"event_id"`
+	Alarm   Alarm   `json:"alarm"`
+	Device  *Device `json:"device,omitempty"`
+}
+
+// WebhookDelivery is an attempt to deliver an event to a subscription.
+type WebhookDelivery struct {
+	SubscriptionID string    `json:"subscription_id"`
+	EventID        uint64    `json:"event_id"`
+	Imei           string    `json:"imei"`
+	AlarmCode      string    `json:"alarm_code"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	DurationMs     int64     `json:"duration_ms"`
+	At             time.Time `json:"at"`
+}
+
+// SignWebhook returns the signature of a payload: the hex HMAC-SHA256, with
+// the secret of the subscription, of the timestamp, a dot and the body.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks a signature made by SignWebhook.
+func VerifyWebhookSignature(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// webhookRegistry holds the subscriptions of the service, nil when the
+// webhooks are disabled.
+var webhookRegistry *WebhookRegistry
+
+// initWebhooks loads the subscriptions configured in the environment.
+func initWebhooks() {
+	path, ok := os.LookupEnv("WEBHOOKS_PATH")
+	if !ok {
+		path = DEFAULT_WEBHOOKS_PATH
+	}
+	if path == "" {
+		return
+	}
+	registry, err := LoadWebhookRegistry(path)
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Warning("Running without webhooks")
+		return
+	}
+	webhookRegistry = registry
+}
+
+// WebhookRegistry keeps the subscriptions in a JSON file, and the last
+// delivery attempts of each one in memory.
+type WebhookRegistry struct {
+	path string
+
+	mu            sync.Mutex
+	subscriptions map[string]*WebhookSubscription
+	deliveries    map[string][]WebhookDelivery
+}
+
+// LoadWebhookRegistry reads the subscriptions of the file, which doesn't need
+// to exist. An empty path keeps the subscriptions only in memory.
+func LoadWebhookRegistry(path string) (*WebhookRegistry, error) {
+	r := &WebhookRegistry{
+		path:          path,
+		subscriptions: map[string]*WebhookSubscription{},
+		deliveries:    map[string][]WebhookDelivery{},
+	}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []*WebhookSubscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("invalid webhooks file %s: %w", path, err)
+	}
+	for _, s := range subscriptions {
+		r.subscriptions[s.ID] = s
+	}
+	return r, nil
+}
+
+// Add registers a subscription. The ID, and the secret if it is empty, are
+// generated.
+func (r *WebhookRegistry) Add(s WebhookSubscription) (WebhookSubscription, error) {
+	target, err := url.Parse(s.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return WebhookSubscription{}, fmt.Errorf("invalid webhook URL %q", s.URL)
+	}
+	s.ID = randomHex(8)
+	if s.Secret == "" {
+		s.Secret = randomHex(32)
+	}
+	s.Disabled = false
+	s.Failures = 0
+	s.CreatedAt = time.Now().UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions[s.ID] = &s
+	return s, r.save()
+}
+
+// Remove deletes a subscription and its delivery log.
+func (r *WebhookRegistry) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subscriptions[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(r.subscriptions, id)
+	delete(r.deliveries, id)
+	return r.save()
+}
+
+// Enable reactivates a subscription and resets its failures.
+func (r *WebhookRegistry) Enable(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subscriptions[id]
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	s.Disabled = false
+	s.Failures = 0
+	return r.save()
+}
+
+// Get returns the subscription with the ID.
+func (r *WebhookRegistry) Get(id string) (WebhookSubscription, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subscriptions[id]
+	if !ok {
+		return WebhookSubscription{}, false
+	}
+	return *s, true
+}
+
+// List returns the subscriptions by creation time.
+func (r *WebhookRegistry) List() []WebhookSubscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]WebhookSubscription, 0, len(r.subscriptions))
+	for _, s := range r.subscriptions {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Deliveries returns the last delivery attempts of a subscription, newest last.
+func (r *WebhookRegistry) Deliveries(id string) []WebhookDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WebhookDelivery(nil), r.deliveries[id]...)
+}
+
+// recordAttempt adds an attempt to the delivery log of its subscription.
+func (r *WebhookRegistry) recordAttempt(delivery WebhookDelivery) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log := append(r.deliveries[delivery.SubscriptionID], delivery)
+	if len(log) > WEBHOOK_DELIVERY_LOG_SIZE {
+		log = log[len(log)-WEBHOOK_DELIVERY_LOG_SIZE:]
+	}
+	r.deliveries[delivery.SubscriptionID] = log
+}
+
+// recordResult updates the consecutive failures of a subscription after a
+// delivery, disabling it when they reach WEBHOOK_DISABLE_AFTER.
+func (r *WebhookRegistry) recordResult(id string, delivered bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subscriptions[id]
+	if !ok {
+		return
+	}
+	if delivered {
+		if s.Failures == 0 {
+			return
+		}
+		s.Failures = 0
+	} else {
+		s.Failures++
+		if s.Failures >= WEBHOOK_DISABLE_AFTER && !s.Disabled {
+			s.Disabled = true
+			webhookMetrics.Add("disabled", 1)
+			logrus.WithFields(logrus.Fields{"id": s.ID, "url": s.URL}).
+				Warningf("Webhook disabled after %d failed deliveries", s.Failures)
+		}
+	}
+	if err := r.save(); err != nil {
+		logrus.WithError(err).Warning("Error saving the webhooks file")
+	}
+}
+
+// matching returns the enabled subscriptions that must receive the event.
+func (r *WebhookRegistry) matching(event AlarmEvent) []WebhookSubscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matching []WebhookSubscription
+	for _, s := range r.subscriptions {
+		if !s.Disabled && s.Matches(event) {
+			matching = append(matching, *s)
+		}
+	}
+	return matching
+}
+
+// save must be called with r.mu held. The file is replaced atomically.
+func (r *WebhookRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	list := make([]*WebhookSubscription, 0, len(r.subscriptions))
+	for _, s := range r.subscriptions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// webhookJob is an event waiting to be delivered to a subscription.
+type webhookJob struct {
+	event AlarmEvent
+	body  []byte
+}
+
+// WebhookDispatcher delivers the events of the bus to the subscriptions of
+// the registry. Each subscription has its own queue and worker, so a slow
+// partner doesn't delay the others. The worker stops once its queue is empty
+// and the subscription is removed or disabled, or after WEBHOOK_WORKER_IDLE
+// without deliveries.
+type WebhookDispatcher struct {
+	registry   *WebhookRegistry
+	bus        *EventBus
+	client     *http.Client
+	retryDelay time.Duration
+	workerIdle time.Duration
+
+	mu     sync.Mutex
+	queues map[string]chan webhookJob
+}
+
+// NewWebhookDispatcher creates a dispatcher of the events of bus.
+func NewWebhookDispatcher(registry *WebhookRegistry, bus *EventBus, client *http.Client) *WebhookDispatcher {
+	if client == nil {
+		client = newHTTPClient()
+	}
+	return &WebhookDispatcher{
+		registry:   registry,
+		bus:        bus,
+		client:     client,
+		retryDelay: WEBHOOK_RETRY_DELAY,
+		workerIdle: WEBHOOK_WORKER_IDLE,
+		queues:     map[string]chan webhookJob{},
+	}
+}
+
+// Run dispatches the events until the context is cancelled. If the dispatcher
+// falls behind the bus, it subscribes again from the last event it received.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	var lastID uint64
+	for {
+		subscription := d.bus.Subscribe(EventFilter{}, lastID)
+	events:
+		for {
+			select {
+			case <-ctx.Done():
+				subscription.Unsubscribe()
+				return
+			case event, ok := <-subscription.C:
+				if !ok {
+					logrus.Warning("Webhook dispatcher fell behind, resuming from the last event")
+					break events
+				}
+				lastID = event.ID
+				d.dispatch(ctx, event)
+			}
+		}
+	}
+}
+
+// dispatch queues the event for the subscriptions that match it.
+func (d *WebhookDispatcher) dispatch(ctx context.Context, event AlarmEvent) {
+	subscriptions := d.registry.matching(event)
+	if len(subscriptions) == 0 {
+		return
+	}
+	payload := WebhookPayload{EventID: event.ID, Alarm: event.Alarm}
+	if device, ok := knownDevice(event.Imei); ok {
+		payload.Device = &device
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logrus.WithError(err).Error("Error encoding the webhook payload")
+		return
+	}
+
+	for _, s := range subscriptions {
+		if !d.enqueue(ctx, s.ID, webhookJob{event: event, body: body}) {
+			webhookMetrics.Add("dropped", 1)
+			d.registry.recordAttempt(WebhookDelivery{
+				SubscriptionID: s.ID,
+				EventID:        event.ID,
+				Imei:           event.Imei,
+				AlarmCode:      event.Alarm.AlarmCode,
+				Error:          "delivery queue full",
+				At:             time.Now().UTC(),
+			})
+			d.registry.recordResult(s.ID, false)
+		}
+	}
+}
+
+// enqueue adds a job to the queue of a subscription, starting its worker if
+// it has none. It returns false if the queue is full. The job is sent with
+// d.mu held, so a worker never stops with a job in its queue.
+func (d *WebhookDispatcher) enqueue(ctx context.Context, id string, job webhookJob) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue, ok := d.queues[id]
+	if !ok {
+		queue = make(chan webhookJob, WEBHOOK_QUEUE_SIZE)
+		d.queues[id] = queue
+		go d.work(ctx, id, queue)
+	}
+	select {
+	case queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// work delivers the jobs of a subscription in order, until the subscription
+// is removed or disabled, or it has no jobs for d.workerIdle.
+func (d *WebhookDispatcher) work(ctx context.Context, id string, queue chan webhookJob) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-queue:
+			d.deliver(ctx, id, job)
+			if s, ok := d.registry.Get(id); (!ok || s.Disabled) && d.retire(id, queue) {
+				return
+			}
+		case <-time.After(d.workerIdle):
+			if d.retire(id, queue) {
+				return
+			}
+		}
+	}
+}
+
+// retire removes the queue of a subscription if it is empty, so its worker
+// can stop.
+func (d *WebhookDispatcher) retire(id string, queue chan webhookJob) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(queue) > 0 {
+		return false
+	}
+	delete(d.queues, id)
+	return true
+}
+
+// workers returns the number of subscriptions with a running worker.
+func (d *WebhookDispatcher) workers() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queues)
+}
+
+// deliver sends a job, retrying with backoff the network errors, the 5xx,
+// 408 and 429 responses. The subscription is read on every attempt, so the
+// retries stop once it is removed or disabled.
+func (d *WebhookDispatcher) deliver(ctx context.Context, id string, job webhookJob) {
+	delay := d.retryDelay
+	for attempt := 1; attempt <= WEBHOOK_MAX_ATTEMPTS; attempt++ {
+		s, ok := d.registry.Get(id)
+		if !ok || s.Disabled {
+			return
+		}
+
+		start := time.Now()
+		status, err := d.post(ctx, s, job)
+		delivery := WebhookDelivery{
+			SubscriptionID: id,
+			EventID:        job.event.ID,
+			Imei:           job.event.Imei,
+			AlarmCode:      job.event.Alarm.AlarmCode,
+			Attempt:        attempt,
+			StatusCode:     status,
+			DurationMs:     time.Since(start).Milliseconds(),
+			At:             start.UTC(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		d.registry.recordAttempt(delivery)
+
+		if err == nil {
+			webhookMetrics.Add("delivered", 1)
+			d.registry.recordResult(id, true)
+			return
+		}
+		if status != 0 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+			break
+		}
+		if attempt == WEBHOOK_MAX_ATTEMPTS {
+			break
+		}
+
+		webhookMetrics.Add("retried", 1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, WEBHOOK_MAX_RETRY_DELAY)
+	}
+
+	webhookMetrics.Add("failed", 1)
+	logrus.WithFields(logrus.Fields{"id": id, "event": job.event.ID}).Warning("Webhook delivery failed")
+	d.registry.recordResult(id, false)
+}
+
+// post sends the signed payload. Any status other than 2xx is an error.
+func (d *WebhookDispatcher) post(ctx context.Context, s WebhookSubscription, job webhookJob) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "get_device_alarms-webhooks")
+	request.Header.Set("X-Webhook-Id", s.ID)
+	request.Header.Set("X-Webhook-Event-Id", strconv.FormatUint(job.event.ID, 10))
+	request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	request.Header.Set("X-Webhook-Signature", SignWebhook(s.Secret, timestamp, job.body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// webhooksHandler manages the subscriptions. It requires the bearer token of
+// WEBHOOKS_ADMIN_TOKEN and is disabled if it isn't set.
+//
+//	GET    /webhooks                  list the subscriptions, without secrets
+//	POST   /webhooks                  add a subscription {url, secret, imeis, codes}
+//	GET    /webhooks/{id}             get a subscription, without secret
+//	DELETE /webhooks/{id}             remove a subscription
+//	POST   /webhooks/{id}/enable      reactivate a disabled subscription
+//	GET    /webhooks/{id}/deliveries  list the last delivery attempts
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if webhookRegistry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkAdminToken(w, r, "WEBHOOKS_ADMIN_TOKEN") {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	id, action, _ := strings.Cut(path, "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		subscriptions := webhookRegistry.List()
+		for i := range subscriptions {
+			subscriptions[i].Secret = ""
+		}
+		writeJSON(w, http.StatusOK, subscriptions)
+	case id == "" && r.Method == http.MethodPost:
+		var s WebhookSubscription
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "invalid subscription: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		added, err := webhookRegistry.Add(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The secret is only returned when the subscription is created.
+		writeJSON(w, http.StatusCreated, added)
+	case id != "" && action == "" && r.Method == http.MethodGet:
+		s, ok := webhookRegistry.Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.Secret = ""
+		writeJSON(w, http.StatusOK, s)
+	case id != "" && action == "" && r.Method == http.MethodDelete:
+		writeWebhookResult(w, r, webhookRegistry.Remove(id))
+	case id != "" && action == "enable" && r.Method == http.MethodPost:
+		writeWebhookResult(w, r, webhookRegistry.Enable(id))
+	case id != "" && action == "deliveries" && r.Method == http.MethodGet:
+		if _, ok := webhookRegistry.Get(id); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, webhookRegistry.Deliveries(id))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeWebhookResult answers a change of a subscription.
+func writeWebhookResult(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrWebhookNotFound):
+		http.NotFound(w, r)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
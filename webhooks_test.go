@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor waits until condition is true.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startWebhookDispatcher runs a dispatcher of a new bus until the test ends,
+// whose workers stop after workerIdle without deliveries.
+func startWebhookDispatcher(t *testing.T, registry *WebhookRegistry, workerIdle time.Duration) (*EventBus, *WebhookDispatcher) {
+	t.Helper()
+	bus := NewEventBus(EVENT_BUFFER_SIZE)
+	dispatcher := NewWebhookDispatcher(registry, bus, nil)
+	dispatcher.retryDelay = time.Millisecond
+	dispatcher.workerIdle = workerIdle
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go dispatcher.Run(ctx)
+	waitSubscribers(t, bus, 1)
+	return bus, dispatcher
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	knownDevices.Store("2", Device{Imei: "2", UserName: "fleet"})
+	t.Cleanup(func() { knownDevices.Delete("2") })
+
+	var mu sync.Mutex
+	var received []WebhookPayload
+	calls := 0
+	partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// The first attempt fails and is retried.
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if !VerifyWebhookSignature("secret", timestamp, body, r.Header.Get("X-Webhook-Signature")) {
+			t.Errorf("invalid signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decoding the payload: %v", err)
+		}
+		received = append(received, payload)
+	}))
+	defer partner.Close()
+
+	registry, err := LoadWebhookRegistry(filepath.Join(t.TempDir(), "webhooks.json"))
+	if err != nil {
+		t.Fatalf("LoadWebhookRegistry failed: %v", err)
+	}
+	s, err := registry.Add(WebhookSubscription{URL: partner.URL, Secret: "secret", Imeis: []string{"2"}, Codes: []string{"SOS"}})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	bus, dispatcher := startWebhookDispatcher(t, registry, 50*time.Millisecond)
+	bus.Publish([]Alarm{
+		{Imei: "1", Time: 1700000000, AlarmCode: "SOS"},
+		{Imei: "2", Time: 1700000000, AlarmCode: "LOWVOT"},
+		{Imei: "2", Time: 1700000060, AlarmCode: "SOS"},
+	})
+
+	waitFor(t, "the delivery", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	})
+	payload := received[0]
+	if payload.Alarm.Imei != "2" || payload.Alarm.AlarmCode != "SOS" || payload.Device == nil || payload.Device.UserName != "fleet" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+	deliveries := registry.Deliveries(s.ID)
+	if len(deliveries) != 2 || deliveries[0].StatusCode != http.StatusServiceUnavailable || deliveries[1].Error != "" {
+		t.Fatalf("unexpected delivery log %+v", deliveries)
+	}
+
+	// The subscriptions are saved in the file.
+	loaded, err := LoadWebhookRegistry(registry.path)
+	if err != nil {
+		t.Fatalf("LoadWebhookRegistry failed: %v", err)
+	}
+	if saved, ok := loaded.Get(s.ID); !ok || saved.URL != partner.URL || saved.Secret != "secret" {
+		t.Fatalf("unexpected saved subscription %+v", saved)
+	}
+
+	// The worker of a removed subscription stops once it is idle.
+	if err := registry.Remove(s.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	waitFor(t, "the worker to stop", func() bool { return dispatcher.workers() == 0 })
+}
+
+func TestWebhookAutoDisable(t *testing.T) {
+	partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer partner.Close()
+
+	registry, _ := LoadWebhookRegistry("")
+	s, err := registry.Add(WebhookSubscription{URL: partner.URL})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	bus, dispatcher := startWebhookDispatcher(t, registry, WEBHOOK_WORKER_IDLE)
+	bus.Publish(make([]Alarm, WEBHOOK_DISABLE_AFTER+5))
+
+	waitFor(t, "the subscription to be disabled", func() bool {
+		s, _ := registry.Get(s.ID)
+		return s.Disabled
+	})
+	// A rejected delivery isn't retried and no more are tried once disabled.
+	if attempts := len(registry.Deliveries(s.ID)); attempts != WEBHOOK_DISABLE_AFTER {
+		t.Fatalf("expected %d attempts, got %d", WEBHOOK_DISABLE_AFTER, attempts)
+	}
+	// The worker of the disabled subscription stops.
+	waitFor(t, "the worker to stop", func() bool { return dispatcher.workers() == 0 })
+
+	if err := registry.Enable(s.ID); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	if s, _ := registry.Get(s.ID); s.Disabled || s.Failures != 0 {
+		t.Fatalf("expected the subscription to be enabled, got %+v", s)
+	}
+}
+
+func TestWebhooksHandler(t *testing.T) {
+	previous := webhookRegistry
+	webhookRegistry, _ = LoadWebhookRegistry("")
+	t.Cleanup(func() { webhookRegistry = previous })
+	t.Setenv("WEBHOOKS_ADMIN_TOKEN", "admin")
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		webhooksHandler(w, r)
+		return w
+	}
+
+	unauthorized := httptest.NewRecorder()
+	webhooksHandler(unauthorized, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+	if unauthorized.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without token, got %d", unauthorized.Code)
+	}
+
+	if w := request(http.MethodPost, "/webhooks", `{"url": "ftp://example.com"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid URL, got %d", w.Code)
+	}
+	w := request(http.MethodPost, "/webhooks", `{"url": "https://partner.example.com/alarms", "codes": ["SOS"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body)
+	}
+	var created WebhookSubscription
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.ID == "" || created.Secret == "" {
+		t.Fatalf("expected a generated ID and secret, got %+v", created)
+	}
+
+	var listed []WebhookSubscription
+	json.NewDecoder(request(http.MethodGet, "/webhooks", "").Body).Decode(&listed)
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Secret != "" {
+		t.Fatalf("unexpected list %+v", listed)
+	}
+
+	if w := request(http.MethodGet, "/webhooks/"+created.ID+"/deliveries", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if w := request(http.MethodDelete, "/webhooks/"+created.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/webhooks/"+created.ID+"/enable", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 after removing, got %d", w.Code)
+	}
+}
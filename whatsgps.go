@@ -39,6 +39,26 @@ type WhatsGPSAlarm struct {
 	UserName  string     `json:"userName"`
 }
 
+// WhatsGPSPositionData is the response of the last position of a car.
+type WhatsGPSPositionData struct {
+	Data *WhatsGPSPosition `json:"data"`
+	Ret  int64             `json:"ret"`
+}
+
+// WhatsGPSPosition is the last position of a car. HeartTime is the time of
+// the last heartbeat, which the devices send while parked, and AccStatus is 1
+// with the ignition on.
+type WhatsGPSPosition struct {
+	CarID     int64      `json:"carId"`
+	Dir       int64      `json:"dir"`
+	Lat       float64    `json:"lat"`
+	Lon       float64    `json:"lon"`
+	PointTime CustomTime `json:"pointTime"`
+	HeartTime CustomTime `json:"heartTime"`
+	Speed     int64      `json:"speed"`
+	AccStatus *int64     `json:"accStatus"`
+}
+
 type CustomTime struct {
 	time.Time
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DEFAULT_POLL_QUEUE_SIZE is the capacity of the queue of each provider,
+// configurable with the POLL_QUEUE_SIZE environment variable.
+const DEFAULT_POLL_QUEUE_SIZE = 500
+
+// DEFAULT_WORKERS is the number of workers polling each provider. They can be
+// changed with the IOPGPS_WORKERS and WHATSGPS_WORKERS environment variables.
+var DEFAULT_WORKERS = map[Provider]int{
+	WanWayTech: MAX_REQUESTS_IN_IOPGPS_API_PER_SECOND,
+	WhatsGPS:   MAX_REQUESTS_IN_WHATSGPS_API_PER_SECOND,
+}
+
+var workersEnv = map[Provider]string{
+	WanWayTech: "IOPGPS_WORKERS",
+	WhatsGPS:   "WHATSGPS_WORKERS",
+}
+
+// workQueueMetrics publishes the state of the queues in /debug/vars.
+var workQueueMetrics = expvar.NewMap("work_queue")
+
+// pollJob is a device waiting to be polled.
+type pollJob struct {
+	device Device
+	due    time.Time
+}
+
+// workerPool is the bounded queue and the workers of a provider, so a slow
+// provider doesn't delay the devices of the other.
+type workerPool struct {
+	provider Provider
+	jobs     chan pollJob
+	workers  int
+
+	processed *expvar.Int
+	failed    *expvar.Int
+	dropped   *expvar.Int
+	skipped   *expvar.Int
+	busy      *expvar.Int
+	lag       *expvar.Float
+}
+
+// WorkQueue receives the devices due for polling and processes them with a
+// pool of workers per provider.
+type WorkQueue struct {
+	pools     map[Provider]*workerPool
+	process   func(devices []Device) ([]Alarm, error)
+	completed func(device Device, alarms []Alarm)
+	wg        sync.WaitGroup
+}
+
+// NewWorkQueue creates the queues of the known providers. Each device is
+// processed with process and then reported to completed.
+func NewWorkQueue(process func(devices []Device) ([]Alarm, error), completed func(device Device, alarms []Alarm)) *WorkQueue {
+	wq := &WorkQueue{
+		pools:     map[Provider]*workerPool{},
+		process:   process,
+		completed: completed,
+	}
+	size := getEnvInt("POLL_QUEUE_SIZE", DEFAULT_POLL_QUEUE_SIZE)
+	for provider, workers := range DEFAULT_WORKERS {
+		wq.pools[provider] = newWorkerPool(provider, size, getEnvInt(workersEnv[provider], workers))
+	}
+	return wq
+}
+
+func newWorkerPool(provider Provider, size, workers int) *workerPool {
+	pool := &workerPool{
+		provider:  provider,
+		jobs:      make(chan pollJob, size),
+		workers:   max(workers, 1),
+		processed: new(expvar.Int),
+		failed:    new(expvar.Int),
+		dropped:   new(expvar.Int),
+		skipped:   new(expvar.Int),
+		busy:      new(expvar.Int),
+		lag:       new(expvar.Float),
+	}
+
+	metrics := new(expvar.Map).Init()
+	metrics.Set("depth", expvar.Func(func() interface{} { return len(pool.jobs) }))
+	metrics.Set("capacity", expvar.Func(func() interface{} { return cap(pool.jobs) }))
+	metrics.Set("workers", expvar.Func(func() interface{} { return pool.workers }))
+	metrics.Set("busy_workers", pool.busy)
+	metrics.Set("processed", pool.processed)
+	metrics.Set("failed", pool.failed)
+	metrics.Set("dropped", pool.dropped)
+	metrics.Set("skipped", pool.skipped)
+	metrics.Set("lag_seconds", pool.lag)
+	workQueueMetrics.Set(string(provider), metrics)
+
+	return pool
+}
+
+// Start launches the workers of every provider until the context is cancelled.
+func (wq *WorkQueue) Start(ctx context.Context) {
+	for _, pool := range wq.pools {
+		for i := 0; i < pool.workers; i++ {
+			wq.wg.Add(1)
+			go wq.work(ctx, pool)
+		}
+	}
+}
+
+// Wait blocks until the workers stop.
+func (wq *WorkQueue) Wait() {
+	wq.wg.Wait()
+}
+
+// Enqueue adds a device to the queue of its provider. It returns false if the
+// provider is unknown or its queue is full, so the caller can retry later.
+func (wq *WorkQueue) Enqueue(device Device, due time.Time) bool {
+	pool, ok := wq.pools[device.Provider]
+	if !ok {
+		logrus.WithField("imei", device.Imei).Warningf("No work queue for provider %q", device.Provider)
+		return false
+	}
+
+	select {
+	case pool.jobs <- pollJob{device: device, due: due}:
+		return true
+	default:
+		pool.dropped.Add(1)
+		logrus.WithFields(logrus.Fields{
+			"imei":     device.Imei,
+			"provider": device.Provider,
+		}).Warning("Work queue is full, delaying the device")
+		return false
+	}
+}
+
+func (wq *WorkQueue) work(ctx context.Context, pool *workerPool) {
+	defer wq.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-pool.jobs:
+			wq.processJob(pool, job)
+		}
+	}
+}
+
+func (wq *WorkQueue) processJob(pool *workerPool, job pollJob) {
+	pool.busy.Add(1)
+	defer pool.busy.Add(-1)
+	pool.lag.Set(time.Since(job.due).Seconds())
+
+	// While the vendor API is down the device isn't polled. The breaker may
+	// still reject the request of a device that passed this check, e.g. when
+	// another worker took the probe of a half-open breaker; either way its
+	// checkpoint doesn't move and the alarms are requested once it recovers.
+	if breaker := providerBreaker(job.device.Provider); breaker != nil && !breaker.Ready() {
+		pool.skipped.Add(1)
+		wq.completed(job.device, nil)
+		return
+	}
+
+	devices := []Device{job.device}
+	alarms, err := wq.process(devices)
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		pool.skipped.Add(1)
+	case err != nil:
+		pool.failed.Add(1)
+		logrus.WithError(err).WithField("imei", job.device.Imei).Warning("Error polling the device")
+	}
+	pool.processed.Add(1)
+	wq.completed(devices[0], alarms)
+}
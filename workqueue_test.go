@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkQueueIsolatesProviders(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	completed := make(chan Device, 10)
+	wq := NewWorkQueue(
+		func(devices []Device) ([]Alarm, error) {
+			if devices[0].Provider == WanWayTech {
+				started <- struct{}{}
+				<-release
+			}
+			devices[0].LastTimeTracked = 100
+			return nil, nil
+		},
+		func(device Device, alarms []Alarm) { completed <- device },
+	)
+	wq.pools[WanWayTech] = newWorkerPool(WanWayTech, 1, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wq.Start(ctx)
+	defer func() {
+		close(release)
+		cancel()
+		wq.Wait()
+	}()
+
+	if !wq.Enqueue(Device{Imei: "1", Provider: WanWayTech}, time.Now()) {
+		t.Fatal("expected the first IOPGPS device to be enqueued")
+	}
+	// Wait for the worker to take the job, leaving the queue empty.
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the IOPGPS device wasn't taken by the worker")
+	}
+	if !wq.Enqueue(Device{Imei: "2", Provider: WanWayTech}, time.Now()) {
+		t.Fatal("expected the second IOPGPS device to be enqueued")
+	}
+	if wq.Enqueue(Device{Imei: "3", Provider: WanWayTech}, time.Now()) {
+		t.Error("expected the full IOPGPS queue to reject the device")
+	}
+	if wq.Enqueue(Device{Imei: "4", Provider: "Unknown"}, time.Now()) {
+		t.Error("expected a device with an unknown provider to be rejected")
+	}
+
+	// The WhatsGPS devices are processed while the IOPGPS worker is blocked.
+	wq.Enqueue(Device{Imei: "5", Provider: WhatsGPS}, time.Now())
+	select {
+	case device := <-completed:
+		if device.Imei != "5" || device.LastTimeTracked != 100 {
+			t.Errorf("unexpected completed device %+v", device)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the WhatsGPS device wasn't processed")
+	}
+}